@@ -0,0 +1,109 @@
+// Command node-agent runs on every VPN node. It pulls the peers the panel
+// assigned to the node, applies them to the local WireGuard interface and, when
+// configured, to Xray and the certificates of OpenVPN, and reports back what it
+// applied and when each peer last shook hands.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/agent"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/config"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/logging"
+)
+
+func main() {
+	configPath := flag.String("config", os.Getenv("AGENT_CONFIG_FILE"), "path to an optional YAML or TOML config file")
+	printConfig := flag.Bool("print-config", false, "print the effective configuration with secrets redacted and exit")
+	once := flag.Bool("once", false, "reconcile once and exit")
+	flag.Parse()
+
+	cfg, err := config.LoadAgent(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *printConfig {
+		out, err := cfg.Redacted()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Stdout.Write(out)
+		return
+	}
+
+	logger, err := logging.New(os.Stdout, cfg.Log.Format, cfg.Log.Level)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err = run(ctx, cfg, *once, logger)
+	if err != nil && ctx.Err() == nil {
+		logger.Error("node agent stopped with error", "error", err)
+		os.Exit(1)
+	}
+
+	logger.Info("stopped")
+}
+
+func run(ctx context.Context, cfg config.AgentConfig, once bool, logger *slog.Logger) error {
+	client, err := agent.NewClient(cfg)
+	if err != nil {
+		return err
+	}
+
+	var backend agent.Backend
+	switch cfg.Backend {
+	case "memory":
+		logger.Warn("using the in-memory backend, no interface is configured")
+		backend = agent.NewMemoryBackend()
+	default:
+		wg, err := agent.NewWireGuardBackend(cfg.Interface)
+		if err != nil {
+			return err
+		}
+		defer wg.Close()
+
+		mux := &agent.Multiplexer{WireGuard: wg}
+		if cfg.Xray.ConfigPath != "" {
+			mux.Xray = agent.NewXrayBackend(cfg.Xray.ConfigPath, cfg.Xray.Binary, cfg.Xray.APIAddress, strings.Fields(cfg.Xray.Restart))
+		}
+		backend = mux
+	}
+
+	if strings.HasPrefix(cfg.PanelURL, "http://") {
+		logger.Warn("the panel is reached over plain http, peer keys and the agent token are sent unencrypted", "panel", cfg.PanelURL)
+	}
+
+	a := agent.New(client, backend, cfg.Interval, logger)
+	if cfg.OpenVPN.Dir != "" {
+		a.OpenVPN = agent.NewOpenVPNFiles(cfg.OpenVPN.Dir, strings.Fields(cfg.OpenVPN.Restart))
+	}
+
+	if once {
+		report, err := a.Reconcile(ctx)
+		if err != nil {
+			return err
+		}
+		logger.Info("reconciled", "peers", report.Peers)
+		return nil
+	}
+
+	logger.Info("starting node agent", "panel", cfg.PanelURL, "backend", cfg.Backend, "interface", cfg.Interface,
+		"xray_config", cfg.Xray.ConfigPath, "openvpn_dir", cfg.OpenVPN.Dir, "interval", cfg.Interval)
+	return a.Run(ctx)
+}
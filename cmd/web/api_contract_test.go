@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/handlers"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/openapi"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/tokens"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/vpn"
+	"github.com/go-chi/chi/v5"
+)
+
+const contractToken = tokens.APITokenPrefix + "contract-test-token"
+
+// contractIDs are the IDs of the seeded rows the contract test addresses
+type contractIDs struct {
+	peer    int
+	invoice int
+}
+
+// setupContractTest seeds a user with an active subscription, a peer, an invoice
+// and an all-scope API token, and returns the router and the OpenAPI document
+func setupContractTest(t *testing.T) (http.Handler, *openapi.Document, contractIDs) {
+	t.Helper()
+
+	repo, _, _ := setupTestApp(t)
+	ctx := context.Background()
+
+	userID, err := repo.AddUser(models.User{Username: "jdoe", FirstName: "John", LastName: "Doe", Email: "john@example.com"}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	planID := repo.AddPlan(models.Plan{Name: "Monthly", PriceCents: 500, Currency: "USD", DurationDays: 30})
+	subscriptionID, err := repo.InsertSubscription(ctx, models.Subscription{
+		UserID: userID, PlanID: planID, Status: "active",
+		StartsAt: time.Now().Add(-time.Hour), ExpiresAt: time.Now().Add(30 * 24 * time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	private, public, err := vpn.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids contractIDs
+	ids.peer, err = repo.InsertVpnPeer(ctx, models.VpnPeer{
+		UserID: userID, SubscriptionID: subscriptionID, Name: "laptop",
+		PublicKey: public, PrivateKey: private, Address: "10.8.0.2/32",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids.invoice, err = repo.InsertInvoice(ctx, models.Invoice{
+		UserID: userID, SubscriptionID: subscriptionID, Number: "FN-0001", AmountCents: 500,
+		Currency: "USD", Status: "paid", IssuedAt: time.Now(), PaidAt: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo.AddAPIToken(models.APIToken{
+		UserID: userID, Name: "contract", Prefix: contractToken[:12],
+		TokenHash: tokens.Hash(contractToken), Scopes: tokens.AllScopes, CreatedAt: time.Now(),
+	})
+
+	return routes(), handlers.Repo.OpenAPIDocument(), ids
+}
+
+// TestOpenAPIDocumentMatchesRouter makes sure every API route is documented and every documented operation is routed
+func TestOpenAPIDocumentMatchesRouter(t *testing.T) {
+	mux, doc, _ := setupContractTest(t)
+
+	routed := map[string]bool{}
+	err := chi.Walk(mux.(chi.Routes), func(method, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		path, ok := strings.CutPrefix(route, handlers.APIBasePath)
+		if !ok {
+			return nil
+		}
+		if len(path) > 1 {
+			path = strings.TrimSuffix(path, "/")
+		}
+		routed[method+" "+path] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	documented := map[string]bool{}
+	for path, item := range doc.Paths {
+		for method := range item {
+			documented[strings.ToUpper(method)+" "+path] = true
+		}
+	}
+
+	for route := range routed {
+		if !documented[route] {
+			t.Errorf("route %s is not described in the OpenAPI document", route)
+		}
+	}
+	for route := range documented {
+		if !routed[route] {
+			t.Errorf("OpenAPI document describes %s, which is not routed", route)
+		}
+	}
+}
+
+// TestAPIContract calls every documented operation and validates the response against the spec
+func TestAPIContract(t *testing.T) {
+	_, doc, _ := setupContractTest(t)
+
+	for path, item := range doc.Paths {
+		for method, op := range item {
+			t.Run(op.OperationID, func(t *testing.T) {
+				// every operation gets fresh data, so revoking a peer cannot affect the others
+				mux, _, ids := setupContractTest(t)
+
+				var body io.Reader
+				if op.RequestBody != nil {
+					example, err := json.Marshal(exampleValue(doc, op.RequestBody.Content["application/json"].Schema))
+					if err != nil {
+						t.Fatal(err)
+					}
+					body = bytes.NewReader(example)
+				}
+
+				id := ids.peer
+				if strings.HasPrefix(path, "/invoices") {
+					id = ids.invoice
+				}
+				url := handlers.APIBasePath + strings.ReplaceAll(path, "{id}", strconv.Itoa(id))
+				req := httptest.NewRequest(strings.ToUpper(method), url, body)
+				req.Header.Set("Authorization", "Bearer "+contractToken)
+				rr := httptest.NewRecorder()
+
+				mux.ServeHTTP(rr, req)
+
+				response, ok := op.Responses[strconv.Itoa(rr.Code)]
+				if !ok || rr.Code >= 400 {
+					t.Fatalf("status %d is not a documented success response: %s", rr.Code, rr.Body.String())
+				}
+
+				if len(response.Content) == 0 {
+					if rr.Body.Len() != 0 {
+						t.Fatalf("expected an empty body, got %q", rr.Body.String())
+					}
+					return
+				}
+
+				contentType := rr.Header().Get("Content-Type")
+				for mediaType, content := range response.Content {
+					if !strings.HasPrefix(contentType, mediaType) {
+						t.Fatalf("expected content type %s, got %s", mediaType, contentType)
+					}
+					if mediaType != "application/json" {
+						continue
+					}
+
+					var decoded any
+					if err := json.Unmarshal(rr.Body.Bytes(), &decoded); err != nil {
+						t.Fatalf("response is not JSON: %v", err)
+					}
+					if err := doc.Validate(content.Schema, decoded); err != nil {
+						t.Fatalf("response does not match the spec: %v\n%s", err, rr.Body.String())
+					}
+				}
+			})
+		}
+	}
+}
+
+// TestAPIErrorsMatchSpec checks that authentication failures use the documented error envelope
+func TestAPIErrorsMatchSpec(t *testing.T) {
+	mux, doc, _ := setupContractTest(t)
+
+	req := httptest.NewRequest(http.MethodGet, handlers.APIBasePath+"/me", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.APITokenPrefix+"unknown")
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rr.Code)
+	}
+
+	var decoded any
+	if err := json.Unmarshal(rr.Body.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	schema := doc.Paths["/me"]["get"].Responses["401"].Content["application/json"].Schema
+	if err := doc.Validate(schema, decoded); err != nil {
+		t.Fatalf("error response does not match the spec: %v", err)
+	}
+}
+
+// TestOpenAPISpecEndpoint checks the document is served
+func TestOpenAPISpecEndpoint(t *testing.T) {
+	mux, _, _ := setupContractTest(t)
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/openapi.json", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+
+	var doc openapi.Document
+	if err := json.Unmarshal(rr.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.OpenAPI != openapi.Version {
+		t.Errorf("expected openapi %s, got %s", openapi.Version, doc.OpenAPI)
+	}
+}
+
+// exampleValue builds a value satisfying schema, used as a request body
+func exampleValue(doc *openapi.Document, schema *openapi.Schema) any {
+	if schema.Ref != "" {
+		return exampleValue(doc, doc.Components.Schemas[strings.TrimPrefix(schema.Ref, "#/components/schemas/")])
+	}
+
+	typ, _ := schema.Type.(string)
+	switch typ {
+	case "object":
+		out := map[string]any{}
+		for _, name := range schema.Required {
+			out[name] = exampleValue(doc, schema.Properties[name])
+		}
+		return out
+	case "array":
+		return []any{}
+	case "integer", "number":
+		return 1
+	case "boolean":
+		return true
+	case "string":
+		if schema.Format == "date-time" {
+			return time.Now().Format(time.RFC3339)
+		}
+		return "example"
+	}
+	return nil
+}
@@ -0,0 +1,2085 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"html"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/agent"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/config"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/email"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/handlers"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/outbox"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/repository/dbrepo"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/rotation"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/telegram"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/tokens"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/vpn"
+)
+
+const (
+	testEmail    = "jane@example.com"
+	testPassword = "correct horse"
+)
+
+var (
+	csrfField        = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+	verificationCode = regexp.MustCompile(`verification code is: (\d{6})`)
+)
+
+// apiPeerResponse is the envelope of a peer returned by the API
+type apiPeerResponse struct {
+	Data struct {
+		ID      int    `json:"id"`
+		Address string `json:"address"`
+	} `json:"data"`
+}
+
+// browser is a cookie-keeping client against the real router that does not follow redirects
+type browser struct {
+	t      *testing.T
+	server *httptest.Server
+	client *http.Client
+}
+
+type handlerTest struct {
+	repo       *dbrepo.TestingRepo
+	mailer     *email.MemoryMailer
+	dispatcher *outbox.Dispatcher
+	userID     int
+	b          *browser
+}
+
+func setupHandlerTest(t *testing.T) *handlerTest {
+	t.Helper()
+
+	repo, mailer, dispatcher := setupTestApp(t)
+	userID, err := repo.AddUser(models.User{Username: "jane", FirstName: "Jane", LastName: "Roe", Email: testEmail}, testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(routes())
+	t.Cleanup(server.Close)
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return &handlerTest{
+		repo:       repo,
+		mailer:     mailer,
+		dispatcher: dispatcher,
+		userID:     userID,
+		b:          &browser{t: t, server: server, client: client},
+	}
+}
+
+// get fetches path and returns the response with its body read
+func (b *browser) get(path string) (*http.Response, string) {
+	b.t.Helper()
+
+	resp, err := b.client.Get(b.server.URL + path)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	return resp, readBody(b.t, resp)
+}
+
+// csrfToken loads a page carrying a form and returns its CSRF token
+func (b *browser) csrfToken(path string) string {
+	b.t.Helper()
+
+	_, body := b.get(path)
+	match := csrfField.FindStringSubmatch(body)
+	if match == nil {
+		b.t.Fatalf("no csrf_token field on %s", path)
+	}
+	return html.UnescapeString(match[1])
+}
+
+// post submits form to path, adding the CSRF token taken from tokenPage
+func (b *browser) post(path, tokenPage string, form url.Values) (*http.Response, string) {
+	b.t.Helper()
+
+	if form == nil {
+		form = url.Values{}
+	}
+	if tokenPage != "" {
+		form.Set("csrf_token", b.csrfToken(tokenPage))
+	}
+
+	req, err := http.NewRequest(http.MethodPost, b.server.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Origin", b.server.URL)
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	return resp, readBody(b.t, resp)
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func assertRedirect(t *testing.T, resp *http.Response, location string) {
+	t.Helper()
+
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("expected 303 to %s, got %d", location, resp.StatusCode)
+	}
+	if got := resp.Header.Get("Location"); got != location {
+		t.Fatalf("expected redirect to %s, got %s", location, got)
+	}
+}
+
+func (h *handlerTest) login(password string) *http.Response {
+	h.b.t.Helper()
+
+	resp, _ := h.b.post("/login", "/login", url.Values{"email": {testEmail}, "password": {password}})
+	return resp
+}
+
+// loginAdmin signs in as a new admin user
+func (h *handlerTest) loginAdmin() {
+	h.b.t.Helper()
+
+	_, err := h.repo.AddUser(models.User{Username: "admin", FirstName: "Ada", LastName: "Min", Email: "admin@example.com", IsAdmin: true}, testPassword)
+	if err != nil {
+		h.b.t.Fatal(err)
+	}
+	resp, _ := h.b.post("/login", "/login", url.Values{"email": {"admin@example.com"}, "password": {testPassword}})
+	assertRedirect(h.b.t, resp, "/home")
+}
+
+func (h *handlerTest) enableEmailVerification() {
+	h.b.t.Helper()
+
+	ctx := context.Background()
+	security, err := h.repo.GetUserLoginSecurity(ctx, h.userID)
+	if err != nil {
+		h.b.t.Fatal(err)
+	}
+	security.EmailVerification = true
+	if err := h.repo.UpdateUserLoginSecurity(ctx, security); err != nil {
+		h.b.t.Fatal(err)
+	}
+}
+
+// deliver runs the outbox dispatcher once, handing queued e-mail to the mailer
+func (h *handlerTest) deliver() {
+	h.b.t.Helper()
+
+	if _, err := h.dispatcher.RunOnce(context.Background()); err != nil {
+		h.b.t.Fatal(err)
+	}
+}
+
+// sentCode extracts the verification code from the plain-text part of msg
+func sentCode(t *testing.T, msg email.Message) string {
+	t.Helper()
+
+	match := verificationCode.FindStringSubmatch(msg.Text)
+	if match == nil {
+		t.Fatalf("no verification code in %q", msg.Text)
+	}
+	return match[1]
+}
+
+func TestAuthRedirects(t *testing.T) {
+	h := setupHandlerTest(t)
+
+	for _, path := range []string{"/home", "/profile", "/invoice", "/taxes", "/logout", "/verify", "/admin/outbox"} {
+		resp, _ := h.b.get(path)
+		assertRedirect(t, resp, "/login")
+	}
+
+	resp, _ := h.b.post("/update-security-setting", "/login", url.Values{"type": {"email_verification"}, "value": {"true"}})
+	assertRedirect(t, resp, "/login")
+
+	resp, _ = h.b.post("/resend-code", "/login", nil)
+	assertRedirect(t, resp, "/login")
+	h.deliver()
+	if n := len(h.mailer.Messages()); n != 0 {
+		t.Fatalf("resend without a pending login sent %d e-mails", n)
+	}
+}
+
+func TestPostRequiresCSRFToken(t *testing.T) {
+	h := setupHandlerTest(t)
+
+	resp, _ := h.b.post("/login", "", url.Values{"email": {testEmail}, "password": {testPassword}})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 without a CSRF token, got %d", resp.StatusCode)
+	}
+}
+
+func TestLoginWithoutVerification(t *testing.T) {
+	h := setupHandlerTest(t)
+
+	assertRedirect(t, h.login(testPassword), "/home")
+	h.deliver()
+
+	resp, body := h.b.get("/home")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 on /home, got %d", resp.StatusCode)
+	}
+	if !strings.Contains(body, "Jane Roe") {
+		t.Error("expected the signed-in user's name on /home")
+	}
+
+	resp, _ = h.b.get("/login")
+	assertRedirect(t, resp, "/home")
+
+	if n := len(h.mailer.Messages()); n != 0 {
+		t.Fatalf("expected no verification e-mail, got %d", n)
+	}
+}
+
+func TestLoginRejectsBadCredentials(t *testing.T) {
+	h := setupHandlerTest(t)
+	var logs bytes.Buffer
+	app.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+
+	assertRedirect(t, h.login("wrong password"), "/login")
+	if !strings.Contains(logs.String(), "login failed") || !strings.Contains(logs.String(), "j***@example.com") || strings.Contains(logs.String(), testEmail) {
+		t.Errorf("expected the failed login logged with a masked address, got %s", logs.String())
+	}
+
+	_, body := h.b.get("/login")
+	if !strings.Contains(body, "Invalid e-mail or password") {
+		t.Error("expected the error flash on /login")
+	}
+
+	resp, _ := h.b.get("/home")
+	assertRedirect(t, resp, "/login")
+}
+
+func TestLoginValidatesForm(t *testing.T) {
+	h := setupHandlerTest(t)
+
+	resp, body := h.b.post("/login", "/login", url.Values{"email": {"not-an-email"}, "password": {""}})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the form to be re-rendered, got %d: %s", resp.StatusCode, body)
+	}
+	if !strings.Contains(body, "csrf_token") {
+		t.Error("expected the login form in the response")
+	}
+
+	resp, _ = h.b.get("/home")
+	assertRedirect(t, resp, "/login")
+}
+
+func TestLoginWithEmailVerification(t *testing.T) {
+	h := setupHandlerTest(t)
+	h.enableEmailVerification()
+
+	assertRedirect(t, h.login(testPassword), "/verify")
+	if n := len(h.mailer.Messages()); n != 0 {
+		t.Fatalf("login sent %d e-mails instead of queueing them", n)
+	}
+	h.deliver()
+
+	msg, ok := h.mailer.Last(testEmail)
+	if !ok {
+		t.Fatal("no verification code was sent")
+	}
+	code := sentCode(t, msg)
+	if msg.Subject != "Fastnet VPN - Verification Code" || !strings.Contains(msg.HTML, code) {
+		t.Fatalf("unexpected verification e-mail %+v", msg)
+	}
+
+	// not logged in until the code is confirmed
+	resp, _ := h.b.get("/home")
+	assertRedirect(t, resp, "/login")
+
+	resp, _ = h.b.get("/verify")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the verify page, got %d", resp.StatusCode)
+	}
+
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+	resp, _ = h.b.post("/verify", "/verify", url.Values{"code": {wrong}})
+	assertRedirect(t, resp, "/verify")
+
+	resp, _ = h.b.post("/verify", "/verify", url.Values{"code": {code}})
+	assertRedirect(t, resp, "/home")
+
+	resp, _ = h.b.get("/home")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 on /home after verification, got %d", resp.StatusCode)
+	}
+
+	resp, _ = h.b.get("/verify")
+	assertRedirect(t, resp, "/login")
+}
+
+func TestLoginQueuesEmailWhenMailerIsDown(t *testing.T) {
+	h := setupHandlerTest(t)
+	h.enableEmailVerification()
+	h.mailer.Err = errors.New("smtp down")
+
+	assertRedirect(t, h.login(testPassword), "/verify")
+	h.deliver()
+
+	queued, err := h.repo.GetOutboxMessages(context.Background(), models.OutboxPending, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queued) != 1 || queued[0].Recipient != testEmail || queued[0].Attempts != 1 || queued[0].LastError != "smtp down" {
+		t.Fatalf("expected the code to stay queued for a retry, got %+v", queued)
+	}
+
+	resp, _ := h.b.get("/verify")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the verify page while the e-mail is retried, got %d", resp.StatusCode)
+	}
+}
+
+func TestResendCode(t *testing.T) {
+	h := setupHandlerTest(t)
+	h.enableEmailVerification()
+
+	assertRedirect(t, h.login(testPassword), "/verify")
+
+	resp, _ := h.b.post("/resend-code", "/verify", nil)
+	assertRedirect(t, resp, "/verify")
+	h.deliver()
+
+	messages := h.mailer.Messages()
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 verification e-mails, got %d", len(messages))
+	}
+
+	first, second := sentCode(t, messages[0]), sentCode(t, messages[1])
+	if first != second {
+		resp, _ = h.b.post("/verify", "/verify", url.Values{"code": {first}})
+		assertRedirect(t, resp, "/verify")
+	}
+
+	resp, _ = h.b.post("/verify", "/verify", url.Values{"code": {second}})
+	assertRedirect(t, resp, "/home")
+}
+
+func TestAdminOutboxRequiresAdmin(t *testing.T) {
+	h := setupHandlerTest(t)
+
+	assertRedirect(t, h.login(testPassword), "/home")
+
+	resp, _ := h.b.get("/admin/outbox")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for a regular user, got %d", resp.StatusCode)
+	}
+}
+
+func TestAdminOutbox(t *testing.T) {
+	h := setupHandlerTest(t)
+	ctx := context.Background()
+
+	h.loginAdmin()
+
+	id, err := h.repo.InsertOutboxMessage(ctx, models.OutboxMessage{Recipient: "lost@example.com", Subject: "Your code", Payload: []byte(`{}`), MaxAttempts: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := models.OutboxMessage{ID: id, Status: models.OutboxDead, Attempts: 1, LastError: "550 no such user"}
+	if err := h.repo.UpdateOutboxMessage(ctx, dead); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, body := h.b.get("/admin/outbox?status=dead")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the outbox page, got %d", resp.StatusCode)
+	}
+	for _, want := range []string{"lost@example.com", "Your code", "550 no such user", "/admin/outbox/" + strconv.Itoa(id) + "/retry"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q on the outbox page", want)
+		}
+	}
+
+	resp, _ = h.b.get("/admin/outbox?status=bogus")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown status, got %d", resp.StatusCode)
+	}
+
+	resp, _ = h.b.post("/admin/outbox/"+strconv.Itoa(id)+"/retry", "/admin/outbox", nil)
+	assertRedirect(t, resp, "/admin/outbox?status=dead")
+
+	pending, err := h.repo.GetOutboxMessages(ctx, models.OutboxPending, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].ID != id || pending[0].Attempts != 0 {
+		t.Fatalf("expected the dead message to be queued again, got %+v", pending)
+	}
+}
+
+func TestAdminNodes(t *testing.T) {
+	h := setupHandlerTest(t)
+	ctx := context.Background()
+
+	assertRedirect(t, h.login(testPassword), "/home")
+	if resp, _ := h.b.get("/admin/nodes"); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for a regular user, got %d", resp.StatusCode)
+	}
+	resp, _ := h.b.get("/logout")
+	assertRedirect(t, resp, "/login")
+
+	h.loginAdmin()
+
+	_, public, err := vpn.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := url.Values{
+		"name": {"de-fra-1"}, "country": {"de"}, "endpoint": {"de1.example.com:51820"},
+		"public_key": {public}, "subnet": {"10.9.0.1/24"}, "capacity": {"100"}, "state": {models.NodeEnabled},
+	}
+
+	invalid := url.Values{}
+	for k, v := range form {
+		invalid[k] = v
+	}
+	invalid.Set("endpoint", "de1.example.com")
+	invalid.Set("public_key", "not-a-key")
+	resp, body := h.b.post("/admin/nodes", "/admin/nodes/new", invalid)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "Use host:port") || !strings.Contains(body, "Not a WireGuard public key") {
+		t.Fatalf("expected the form with errors, got %d", resp.StatusCode)
+	}
+
+	resp, _ = h.b.post("/admin/nodes", "/admin/nodes/new", form)
+	assertRedirect(t, resp, "/admin/nodes")
+
+	nodes, err := h.repo.GetVpnNodes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 || nodes[0].Country != "DE" || nodes[0].Subnet != "10.9.0.0/24" || nodes[0].Capacity != 100 {
+		t.Fatalf("unexpected nodes %+v", nodes)
+	}
+	node := nodes[0]
+	path := "/admin/nodes/" + strconv.Itoa(node.ID)
+
+	resp, body = h.b.post("/admin/nodes", "/admin/nodes/new", form)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "already exist") {
+		t.Fatalf("expected a duplicate name to be rejected, got %d", resp.StatusCode)
+	}
+
+	resp, body = h.b.get("/admin/nodes")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "de-fra-1") || !strings.Contains(body, path) {
+		t.Fatalf("expected the node on the nodes page, got %d", resp.StatusCode)
+	}
+
+	form.Set("state", models.NodeDraining)
+	form.Set("capacity", "50")
+	resp, _ = h.b.post(path, path, form)
+	assertRedirect(t, resp, "/admin/nodes")
+
+	node, err = h.repo.GetVpnNodeById(ctx, node.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.State != models.NodeDraining || node.Capacity != 50 {
+		t.Fatalf("node was not updated: %+v", node)
+	}
+
+	resp, _ = h.b.post(path+"/delete", path, nil)
+	assertRedirect(t, resp, "/admin/nodes")
+	if _, err := h.repo.GetVpnNodeById(ctx, node.ID); err == nil {
+		t.Fatal("expected the node to be deleted")
+	}
+
+	if resp, _ := h.b.get(path); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for a deleted node, got %d", resp.StatusCode)
+	}
+}
+
+func TestAPIPeerPlacement(t *testing.T) {
+	h := setupHandlerTest(t)
+	ctx := context.Background()
+
+	planID := h.repo.AddPlan(models.Plan{Name: "Monthly", PriceCents: 500, Currency: "USD", DurationDays: 30})
+	_, err := h.repo.InsertSubscription(ctx, models.Subscription{
+		UserID: h.userID, PlanID: planID, Status: "active",
+		StartsAt: time.Now().Add(-time.Hour), ExpiresAt: time.Now().Add(24 * time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := tokens.APITokenPrefix + "placement-test-token"
+	h.repo.AddAPIToken(models.APIToken{
+		UserID: h.userID, Name: "placement", Prefix: token[:12],
+		TokenHash: tokens.Hash(token), Scopes: tokens.AllScopes, CreatedAt: time.Now(),
+	})
+
+	addNode := func(name, country, subnet string, capacity int) int {
+		t.Helper()
+		_, public, err := vpn.GenerateKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := h.repo.InsertVpnNode(ctx, models.VpnNode{
+			Name: name, Country: country, Endpoint: name + ".example.com:51820", PublicKey: public,
+			Subnet: subnet, Capacity: capacity, State: models.NodeEnabled,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	fra := addNode("de-fra-1", "DE", "10.9.0.0/24", 4)
+	ber := addNode("de-ber-1", "DE", "10.10.0.0/24", 2)
+	addNode("nl-ams-1", "NL", "10.11.0.0/24", 10)
+
+	createPeer := func(name, location string) (int, apiPeerResponse) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, h.b.server.URL+"/api/v1/peers",
+			strings.NewReader(`{"name":"`+name+`","location":"`+location+`"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body apiPeerResponse
+		if err := json.Unmarshal([]byte(readBody(t, resp)), &body); err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, body
+	}
+
+	// the empty nodes tie on load and go by ID; at 2/4 and 1/2 the node with fewer peers wins
+	wantNodes := []int{fra, ber, fra, ber}
+	for i, want := range wantNodes {
+		status, body := createPeer("device-"+strconv.Itoa(i), "de")
+		if status != http.StatusCreated {
+			t.Fatalf("peer %d: expected 201, got %d", i, status)
+		}
+		peer, err := h.repo.GetVpnPeerById(ctx, body.Data.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if peer.NodeID != want {
+			t.Fatalf("peer %d: expected node %d, got %d", i, want, peer.NodeID)
+		}
+	}
+
+	if status, _ := createPeer("elsewhere", "FR"); status != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 for a location without nodes, got %d", status)
+	}
+
+	// de-ber-1 is full, de-fra-1 takes two more
+	for i := range 2 {
+		createPeer("extra-"+strconv.Itoa(i), "DE")
+	}
+	if status, _ := createPeer("overflow", "DE"); status != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 with every German node full, got %d", status)
+	}
+}
+
+func TestNodeAgentSync(t *testing.T) {
+	h := setupHandlerTest(t)
+	ctx := context.Background()
+
+	_, nodeKey, err := vpn.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := models.VpnNode{
+		Name: "de-fra-1", Country: "DE", Endpoint: "de1.example.com:51820", PublicKey: nodeKey,
+		Subnet: "10.9.0.0/24", Capacity: 10, State: models.NodeEnabled,
+	}
+	node.ID, err = h.repo.InsertVpnNode(ctx, node)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	planID := h.repo.AddPlan(models.Plan{Name: "Monthly", DurationDays: 30})
+	subscribe := func(userID int, expiresAt time.Time) int {
+		t.Helper()
+		id, err := h.repo.InsertSubscription(ctx, models.Subscription{
+			UserID: userID, PlanID: planID, Status: "active", StartsAt: time.Now().AddDate(0, -1, 0), ExpiresAt: expiresAt,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	addPeer := func(userID, subscriptionID int, address string) models.VpnPeer {
+		t.Helper()
+		_, public, err := vpn.GenerateKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer := models.VpnPeer{UserID: userID, SubscriptionID: subscriptionID, NodeID: node.ID, Name: address, PublicKey: public, Address: address}
+		peer.ID, err = h.repo.InsertVpnPeer(ctx, peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return peer
+	}
+
+	active := subscribe(h.userID, time.Now().AddDate(0, 0, 10))
+	served := addPeer(h.userID, active, "10.9.0.2/32")
+	revoked := addPeer(h.userID, active, "10.9.0.3/32")
+	if err := h.repo.RevokeVpnPeer(ctx, revoked.ID); err != nil {
+		t.Fatal(err)
+	}
+	lapsed, err := h.repo.AddUser(models.User{Username: "bob", Email: "bob@example.com"}, testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addPeer(lapsed, subscribe(lapsed, time.Now().Add(-time.Hour)), "10.9.0.4/32")
+
+	h.loginAdmin()
+	path := "/admin/nodes/" + strconv.Itoa(node.ID)
+	resp, _ := h.b.post(path+"/agent-token", path, nil)
+	assertRedirect(t, resp, path)
+	_, body := h.b.get(path)
+	token := regexp.MustCompile(`fnn_[A-Za-z0-9_-]+`).FindString(body)
+	if token == "" {
+		t.Fatal("expected the new agent token on the node page")
+	}
+
+	cfg := config.AgentDefaults()
+	cfg.PanelURL = h.b.server.URL
+	cfg.Token = token
+	client, err := agent.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := agent.NewMemoryBackend()
+	a := agent.New(client, backend, time.Minute, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	if _, err := a.Reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	peers, err := backend.Peers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].PublicKey != served.PublicKey || peers[0].AllowedIPs[0] != served.Address {
+		t.Fatalf("expected only the peer with an active subscription on the interface, got %+v", peers)
+	}
+
+	handshake := time.Now().Add(-time.Minute).Truncate(time.Second)
+	backend.SetHandshake(served.PublicKey, handshake)
+	if _, err := a.Reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err := h.repo.GetVpnPeerById(ctx, served.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !peer.LastHandshakeAt.Equal(handshake) {
+		t.Fatalf("expected handshake %s to be recorded, got %s", handshake, peer.LastHandshakeAt)
+	}
+	node, err = h.repo.GetVpnNodeById(ctx, node.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.AgentSeenAt.IsZero() || node.AgentAppliedAt.IsZero() || node.AgentPeers != 1 || node.AgentError != "" {
+		t.Fatalf("expected the agent status on the node, got %+v", node)
+	}
+
+	// disabled nodes serve nobody
+	node.State = models.NodeDisabled
+	if err := h.repo.UpdateVpnNode(ctx, node); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if peers, _ := backend.Peers(ctx); len(peers) != 0 {
+		t.Fatalf("expected every peer to be removed from a disabled node, got %+v", peers)
+	}
+
+	// a replaced token stops working
+	resp, _ = h.b.post(path+"/agent-token", path, nil)
+	assertRedirect(t, resp, path)
+	var apiErr *agent.APIError
+	if _, err := a.Reconcile(ctx); !errors.As(err, &apiErr) || apiErr.Status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a replaced token, got %v", err)
+	}
+}
+
+func TestNodeAgentUsage(t *testing.T) {
+	h := setupHandlerTest(t)
+	ctx := context.Background()
+
+	_, nodeKey, err := vpn.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeID, err := h.repo.InsertVpnNode(ctx, models.VpnNode{
+		Name: "de-fra-1", Country: "DE", Endpoint: "de1.example.com:51820", PublicKey: nodeKey,
+		Subnet: "10.9.0.0/24", Capacity: 10, State: models.NodeEnabled,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	planID := h.repo.AddPlan(models.Plan{Name: "Monthly", DurationDays: 30})
+	subscriptionID, err := h.repo.InsertSubscription(ctx, models.Subscription{
+		UserID: h.userID, PlanID: planID, Status: "active", StartsAt: time.Now().AddDate(0, -1, 0), ExpiresAt: time.Now().AddDate(0, 0, 10),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, public, err := vpn.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := models.VpnPeer{UserID: h.userID, SubscriptionID: subscriptionID, NodeID: nodeID, Name: "Laptop", PublicKey: public, Address: "10.9.0.2/32"}
+	peer.ID, err = h.repo.InsertVpnPeer(ctx, peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.loginAdmin()
+	path := "/admin/nodes/" + strconv.Itoa(nodeID)
+	resp, _ := h.b.post(path+"/agent-token", path, nil)
+	assertRedirect(t, resp, path)
+	_, body := h.b.get(path)
+
+	cfg := config.AgentDefaults()
+	cfg.PanelURL = h.b.server.URL
+	cfg.Token = regexp.MustCompile(`fnn_[A-Za-z0-9_-]+`).FindString(body)
+	client, err := agent.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := agent.NewMemoryBackend()
+	a := agent.New(client, backend, time.Minute, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	reconcile := func() {
+		t.Helper()
+		if _, err := a.Reconcile(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reconcile()
+	backend.AddTraffic(peer.PublicKey, 1_000_000, 250_000_000)
+	reconcile()
+	// an unchanged counter adds nothing
+	reconcile()
+
+	// the interface was recreated: the counters start over below the last report
+	peers, _ := backend.Peers(ctx)
+	if err := backend.Configure(ctx, nil, []string{peer.PublicKey}); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Configure(ctx, peers, nil); err != nil {
+		t.Fatal(err)
+	}
+	backend.AddTraffic(peer.PublicKey, 0, 50_000_000)
+	reconcile()
+
+	points, err := h.repo.GetUsageByUserId(ctx, h.userID, models.UsageMonth, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 1 || points[0].RxBytes != 1_000_000 || points[0].TxBytes != 300_000_000 {
+		t.Fatalf("expected 1 MB up and 300 MB down this month, got %+v", points)
+	}
+
+	resp, _ = h.b.get("/logout")
+	assertRedirect(t, resp, "/login")
+	assertRedirect(t, h.login(testPassword), "/home")
+
+	resp, body = h.b.get("/home")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	for _, want := range []string{"301.0 MB", "300.0 MB", "1.0 MB", "usage-chart", `"download":[`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q on the dashboard", want)
+		}
+	}
+}
+
+func TestNodeAgentKeyRevocation(t *testing.T) {
+	h := setupHandlerTest(t)
+	ctx := context.Background()
+
+	_, nodeKey, err := vpn.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := models.VpnNode{
+		Name: "de-fra-1", Country: "DE", Endpoint: "de1.example.com:51820", PublicKey: nodeKey,
+		Subnet: "10.9.0.0/24", Capacity: 10, State: models.NodeEnabled,
+	}
+	node.ID, err = h.repo.InsertVpnNode(ctx, node)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	planID := h.repo.AddPlan(models.Plan{Name: "Monthly", DurationDays: 30})
+	subscriptionID, err := h.repo.InsertSubscription(ctx, models.Subscription{
+		UserID: h.userID, PlanID: planID, Status: "active", StartsAt: time.Now().AddDate(0, -1, 0), ExpiresAt: time.Now().AddDate(0, 0, 10),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, public, err := vpn.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := models.VpnPeer{UserID: h.userID, SubscriptionID: subscriptionID, NodeID: node.ID, Name: "Laptop", PublicKey: public, Address: "10.9.0.2/32"}
+	peer.ID, err = h.repo.InsertVpnPeer(ctx, peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.loginAdmin()
+	path := "/admin/nodes/" + strconv.Itoa(node.ID)
+	resp, _ := h.b.post(path+"/agent-token", path, nil)
+	assertRedirect(t, resp, path)
+	_, body := h.b.get(path)
+
+	cfg := config.AgentDefaults()
+	cfg.PanelURL = h.b.server.URL
+	cfg.Token = regexp.MustCompile(`fnn_[A-Za-z0-9_-]+`).FindString(body)
+	client, err := agent.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := agent.NewMemoryBackend()
+	a := agent.New(client, backend, time.Minute, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	reconcile := func() map[string]string {
+		t.Helper()
+		if _, err := a.Reconcile(ctx); err != nil {
+			t.Fatal(err)
+		}
+		peers, err := backend.Peers(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addresses := make(map[string]string, len(peers))
+		for _, p := range peers {
+			addresses[p.PublicKey] = p.AllowedIPs[0]
+		}
+		return addresses
+	}
+
+	reconcile()
+	backend.AddTraffic(peer.PublicKey, 0, 1_000_000)
+	reconcile()
+
+	// a scheduled rotation keeps the old keys on the interface for the grace window
+	peer, err = h.repo.GetVpnPeerById(ctx, peer.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, _, err := rotation.Rotate(ctx, h.repo, peer, node.Subnet, time.Hour, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	addresses := reconcile()
+	if len(addresses) != 2 || addresses[peer.PublicKey] != peer.Address || addresses[rotated.PublicKey] != rotated.Address || rotated.Address == peer.Address {
+		t.Fatalf("expected the old and the new keys on their own addresses, got %v", addresses)
+	}
+
+	// traffic on the old keys still counts
+	backend.AddTraffic(peer.PublicKey, 0, 2_000_000)
+	backend.AddTraffic(rotated.PublicKey, 0, 4_000_000)
+	reconcile()
+	points, err := h.repo.GetUsageByUserId(ctx, h.userID, models.UsageMonth, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 1 || points[0].TxBytes != 7_000_000 {
+		t.Fatalf("expected 7 MB down this month, got %+v", points)
+	}
+
+	resp, _ = h.b.get("/logout")
+	assertRedirect(t, resp, "/login")
+	assertRedirect(t, h.login(testPassword), "/home")
+
+	// a leaked config is revoked at once and confirmed gone by the agent
+	devicePath := "/devices/" + strconv.Itoa(peer.ID)
+	resp, _ = h.b.post(devicePath+"/reissue", "/devices", nil)
+	assertRedirect(t, resp, "/devices")
+	reissued, err := h.repo.GetVpnPeerById(ctx, peer.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, body = h.b.get("/devices")
+	if !strings.Contains(body, "waiting for the server to remove the old keys") {
+		t.Error("expected the reissue to wait for the node")
+	}
+
+	addresses = reconcile()
+	if _, ok := addresses[rotated.PublicKey]; ok || addresses[reissued.PublicKey] != rotated.Address || len(addresses) != 2 {
+		t.Fatalf("expected the reissued keys to replace the rotated ones, got %v", addresses)
+	}
+	_, body = h.b.get("/devices")
+	for _, want := range []string{"Keys reissued", "old keys removed from the server at", "Keys rotated", "old config works until"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q on the devices page", want)
+		}
+	}
+}
+
+func TestXrayProtocols(t *testing.T) {
+	h := setupHandlerTest(t)
+	ctx := context.Background()
+
+	h.loginAdmin()
+	_, public, err := vpn.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := url.Values{
+		"name": {"de-fra-1"}, "country": {"DE"}, "endpoint": {"de1.example.com:51820"},
+		"public_key": {public}, "subnet": {"10.9.0.0/24"}, "capacity": {"10"}, "state": {models.NodeEnabled},
+		"vless_port": {"443"}, "shadowsocks_port": {"51820"},
+	}
+	resp, body := h.b.post("/admin/nodes", "/admin/nodes/new", form)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "TLS 1.3 site") || !strings.Contains(body, "cannot share the WireGuard port") {
+		t.Fatalf("expected the server name to be required and the port clash rejected, got %d", resp.StatusCode)
+	}
+
+	form.Set("reality_server_name", "www.example.com")
+	form.Set("shadowsocks_port", "8388")
+	resp, _ = h.b.post("/admin/nodes", "/admin/nodes/new", form)
+	assertRedirect(t, resp, "/admin/nodes")
+
+	nodes, err := h.repo.GetVpnNodes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := nodes[0]
+	if node.RealityPrivateKey == "" || node.RealityPublicKey == "" || node.RealityShortID == "" || node.ShadowsocksKey == "" {
+		t.Fatalf("expected the Xray keys to be generated, got %+v", node)
+	}
+
+	// saving again keeps the keys handed out to clients
+	path := "/admin/nodes/" + strconv.Itoa(node.ID)
+	form.Set("capacity", "20")
+	resp, _ = h.b.post(path, path, form)
+	assertRedirect(t, resp, "/admin/nodes")
+	saved, err := h.repo.GetVpnNodeById(ctx, node.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.RealityPrivateKey != node.RealityPrivateKey || saved.ShadowsocksKey != node.ShadowsocksKey {
+		t.Fatal("expected the Xray keys to be kept on update")
+	}
+
+	resp, _ = h.b.post(path+"/agent-token", path, nil)
+	assertRedirect(t, resp, path)
+	_, body = h.b.get(path)
+	agentToken := regexp.MustCompile(`fnn_[A-Za-z0-9_-]+`).FindString(body)
+	resp, _ = h.b.get("/logout")
+	assertRedirect(t, resp, "/login")
+
+	planID := h.repo.AddPlan(models.Plan{
+		Name: "Stealth", DurationDays: 30, Protocols: []string{models.ProtocolVLESS, models.ProtocolWireGuard},
+	})
+	_, err = h.repo.InsertSubscription(ctx, models.Subscription{
+		UserID: h.userID, PlanID: planID, Status: "active",
+		StartsAt: time.Now().Add(-time.Hour), ExpiresAt: time.Now().Add(24 * time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertRedirect(t, h.login(testPassword), "/home")
+	_, body = h.b.get("/devices")
+	if !strings.Contains(body, `<option value="vless"`) || strings.Contains(body, `<option value="shadowsocks"`) {
+		t.Fatal("expected the protocols of the plan on the devices page")
+	}
+
+	resp, body = h.b.post("/devices", "/devices", url.Values{"name": {"Phone"}, "protocol": {models.ProtocolShadowsocks}})
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "does not include that protocol") {
+		t.Fatalf("expected a protocol outside the plan to be rejected, got %d", resp.StatusCode)
+	}
+
+	// the first protocol of the plan is the default
+	resp, _ = h.b.post("/devices", "/devices", url.Values{"name": {"Phone"}})
+	assertRedirect(t, resp, "/devices")
+	peers, err := h.repo.GetVpnPeersByUserId(ctx, h.userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].Protocol != models.ProtocolVLESS || peers[0].Address != "" || peers[0].PrivateKey != "" {
+		t.Fatalf("expected a VLESS peer without an address, got %+v", peers)
+	}
+	peer := peers[0]
+
+	resp, body = h.b.get("/devices/" + strconv.Itoa(peer.ID) + "/config")
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(body, "vless://"+peer.PublicKey+"@de1.example.com:443?") ||
+		!strings.Contains(body, "pbk="+node.RealityPublicKey) || !strings.Contains(resp.Header.Get("Content-Disposition"), ".txt") {
+		t.Fatalf("expected the share link, got %d %q", resp.StatusCode, body)
+	}
+
+	cfg := config.AgentDefaults()
+	cfg.PanelURL = h.b.server.URL
+	cfg.Token = agentToken
+	client, err := agent.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := agent.NewMemoryBackend()
+	a := agent.New(client, backend, time.Minute, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if _, err := a.Reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	inbounds := backend.Inbounds()
+	if inbounds == nil || inbounds.VLESS == nil || inbounds.VLESS.Port != 443 || inbounds.VLESS.PrivateKey != node.RealityPrivateKey ||
+		inbounds.Shadowsocks == nil || inbounds.Shadowsocks.Key != node.ShadowsocksKey || inbounds.Shadowsocks.Method != vpn.ShadowsocksMethod {
+		t.Fatalf("expected the Xray inbounds of the node, got %+v", inbounds)
+	}
+	served, err := backend.Peers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(served) != 1 || served[0].Protocol != agent.ProtocolVLESS || served[0].PublicKey != peer.PublicKey || len(served[0].AllowedIPs) != 0 {
+		t.Fatalf("expected the VLESS peer, got %+v", served)
+	}
+}
+
+func TestOpenVPN(t *testing.T) {
+	h := setupHandlerTest(t)
+	ctx := context.Background()
+
+	h.loginAdmin()
+	_, public, err := vpn.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := url.Values{
+		"name": {"de-fra-1"}, "country": {"DE"}, "endpoint": {"de1.example.com:51820"},
+		"public_key": {public}, "subnet": {"10.9.0.0/24"}, "capacity": {"10"}, "state": {models.NodeEnabled},
+		"openvpn_port": {"1194"},
+	}
+
+	key := app.PKIKey
+	app.PKIKey = nil
+	resp, body := h.b.post("/admin/nodes", "/admin/nodes/new", form)
+	app.PKIKey = key
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "Set PKI_ENCRYPTION_KEY") {
+		t.Fatalf("expected OpenVPN to need the encryption key, got %d", resp.StatusCode)
+	}
+
+	resp, _ = h.b.post("/admin/nodes", "/admin/nodes/new", form)
+	assertRedirect(t, resp, "/admin/nodes")
+	nodes, err := h.repo.GetVpnNodes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := nodes[0]
+	if node.OpenVPNPort != 1194 || !strings.Contains(node.OpenVPNCertificate, "CERTIFICATE") || node.OpenVPNPrivateKey == "" {
+		t.Fatalf("expected the server certificate to be issued, got %+v", node)
+	}
+	ca, err := h.repo.GetCertificateAuthority(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(ca.EncryptedKey, "PRIVATE KEY") {
+		t.Fatal("expected the CA key to be encrypted at rest")
+	}
+
+	path := "/admin/nodes/" + strconv.Itoa(node.ID)
+	resp, _ = h.b.post(path+"/agent-token", path, nil)
+	assertRedirect(t, resp, path)
+	_, body = h.b.get(path)
+	agentToken := regexp.MustCompile(`fnn_[A-Za-z0-9_-]+`).FindString(body)
+	resp, _ = h.b.get("/logout")
+	assertRedirect(t, resp, "/login")
+
+	planID := h.repo.AddPlan(models.Plan{Name: "Corporate", DurationDays: 30, Protocols: []string{models.ProtocolOpenVPN}})
+	_, err = h.repo.InsertSubscription(ctx, models.Subscription{
+		UserID: h.userID, PlanID: planID, Status: "active",
+		StartsAt: time.Now().Add(-time.Hour), ExpiresAt: time.Now().Add(24 * time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertRedirect(t, h.login(testPassword), "/home")
+	resp, _ = h.b.post("/devices", "/devices", url.Values{"name": {"Laptop"}})
+	assertRedirect(t, resp, "/devices")
+	peers, err := h.repo.GetVpnPeersByUserId(ctx, h.userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].Protocol != models.ProtocolOpenVPN || peers[0].Address != "" {
+		t.Fatalf("expected an OpenVPN peer without an address, got %+v", peers)
+	}
+	peer := peers[0]
+	devicePath := "/devices/" + strconv.Itoa(peer.ID)
+
+	_, body = h.b.get("/devices")
+	if strings.Contains(body, devicePath+"/qr") {
+		t.Error("expected no QR code for an OpenVPN device")
+	}
+	if resp, _ = h.b.get(devicePath + "/qr"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected no QR code for an OpenVPN device, got %d", resp.StatusCode)
+	}
+
+	resp, body = h.b.get(devicePath + "/config")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Header.Get("Content-Disposition"), ".ovpn") ||
+		!strings.Contains(body, "remote de1.example.com 1194") || !strings.Contains(body, "<ca>\n"+strings.TrimSpace(ca.Certificate)) {
+		t.Fatalf("expected the inline profile, got %d %q", resp.StatusCode, body)
+	}
+	block, _ := pem.Decode([]byte(body[strings.Index(body, "<cert>")+len("<cert>"):]))
+	if block == nil {
+		t.Fatal("expected the certificate in the profile")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.SerialNumber.Text(16) != peer.PublicKey {
+		t.Fatalf("expected the certificate serial %s, got %s", peer.PublicKey, cert.SerialNumber.Text(16))
+	}
+
+	// the certificate is issued once
+	_, again := h.b.get(devicePath + "/config")
+	if again != body {
+		t.Error("expected the same profile on the next download")
+	}
+
+	cfg := config.AgentDefaults()
+	cfg.PanelURL = h.b.server.URL
+	cfg.Token = agentToken
+	client, err := agent.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := agent.NewMemoryBackend()
+	a := agent.New(client, backend, time.Minute, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	a.OpenVPN = agent.NewOpenVPNFiles(t.TempDir(), nil)
+
+	revoked := func() []string {
+		t.Helper()
+		if _, err := a.Reconcile(ctx); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(filepath.Join(a.OpenVPN.Dir, agent.OpenVPNCRLFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			t.Fatalf("expected a PEM CRL, got %q", data)
+		}
+		crl, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var serials []string
+		for _, entry := range crl.RevokedCertificateEntries {
+			serials = append(serials, entry.SerialNumber.Text(16))
+		}
+		return serials
+	}
+
+	if serials := revoked(); len(serials) != 0 {
+		t.Fatalf("expected an empty CRL, got %v", serials)
+	}
+	served, err := backend.Peers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(served) != 0 {
+		t.Fatalf("expected no OpenVPN peers on the interface, got %+v", served)
+	}
+	if data, err := os.ReadFile(filepath.Join(a.OpenVPN.Dir, agent.OpenVPNCertFile)); err != nil || string(data) != node.OpenVPNCertificate {
+		t.Fatalf("expected the server certificate of the node, got %v", err)
+	}
+
+	resp, _ = h.b.post(devicePath+"/revoke", "/devices", nil)
+	assertRedirect(t, resp, "/devices")
+	if serials := revoked(); len(serials) != 1 || serials[0] != peer.PublicKey {
+		t.Fatalf("expected the removed device on the CRL, got %v", serials)
+	}
+}
+
+func TestSubscriptionFeed(t *testing.T) {
+	h := setupHandlerTest(t)
+	ctx := context.Background()
+
+	_, nodeKey, err := vpn.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	realityPrivate, realityPublic, err := vpn.GenerateRealityKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = h.repo.InsertVpnNode(ctx, models.VpnNode{
+		Name: "de-fra-1", Country: "DE", Endpoint: "de1.example.com:51820", PublicKey: nodeKey,
+		Subnet: "10.9.0.0/24", Capacity: 10, State: models.NodeEnabled,
+		VLESSPort: 443, RealityServerName: "www.example.com", RealityPrivateKey: realityPrivate,
+		RealityPublicKey: realityPublic, RealityShortID: "0123456789abcdef",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	planID := h.repo.AddPlan(models.Plan{
+		Name: "Stealth", DurationDays: 30, DataCapBytes: 50 << 30,
+		Protocols: []string{models.ProtocolWireGuard, models.ProtocolVLESS},
+	})
+	expiresAt := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	_, err = h.repo.InsertSubscription(ctx, models.Subscription{
+		UserID: h.userID, PlanID: planID, Status: "active", StartsAt: time.Now().Add(-time.Hour), ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertRedirect(t, h.login(testPassword), "/home")
+	for _, form := range []url.Values{
+		{"name": {"Laptop"}, "protocol": {models.ProtocolWireGuard}},
+		{"name": {"Phone"}, "protocol": {models.ProtocolVLESS}},
+	} {
+		resp, _ := h.b.post("/devices", "/devices", form)
+		assertRedirect(t, resp, "/devices")
+	}
+
+	resp, _ := h.b.post("/devices/subscription-url", "/devices", nil)
+	assertRedirect(t, resp, "/devices")
+	_, body := h.b.get("/devices")
+	subURL := regexp.MustCompile(`https?://[^\s<"]+/sub/fns_[A-Za-z0-9_-]+`).FindString(body)
+	if subURL == "" {
+		t.Fatal("expected the subscription URL on the devices page")
+	}
+	if _, body = h.b.get("/devices"); strings.Contains(body, subURL) {
+		t.Fatal("expected the subscription URL to be shown once")
+	}
+
+	fetch := func(url, userAgent string) (*http.Response, string) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("User-Agent", userAgent)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, readBody(t, resp)
+	}
+
+	resp, body = fetch(subURL, "v2rayNG/1.9.0")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	links, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(links), "vless://") || strings.Contains(string(links), "\n") {
+		t.Fatalf("expected the one VLESS link, got %q", links)
+	}
+	wantInfo := "upload=0; download=0; total=" + strconv.Itoa(50<<30) + "; expire=" + strconv.FormatInt(expiresAt.Unix(), 10)
+	if got := resp.Header.Get("Subscription-Userinfo"); got != wantInfo {
+		t.Errorf("expected userinfo %q, got %q", wantInfo, got)
+	}
+
+	resp, body = fetch(subURL, "ClashMeta/1.18")
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/yaml") ||
+		!strings.Contains(body, "type: wireguard") || !strings.Contains(body, "type: vless") || !strings.Contains(body, "MATCH,Fastnet VPN") {
+		t.Fatalf("expected a Clash profile with both devices, got %q", body)
+	}
+
+	resp, body = fetch(subURL+"?format=singbox", "v2rayNG/1.9.0")
+	var singBox struct {
+		Outbounds []struct {
+			Type string `json:"type"`
+		} `json:"outbounds"`
+		Endpoints []struct {
+			Type string `json:"type"`
+		} `json:"endpoints"`
+	}
+	if err := json.Unmarshal([]byte(body), &singBox); err != nil {
+		t.Fatalf("expected a sing-box config, got %q: %v", body, err)
+	}
+	if len(singBox.Endpoints) != 1 || singBox.Endpoints[0].Type != "wireguard" ||
+		len(singBox.Outbounds) != 3 || singBox.Outbounds[0].Type != "selector" || singBox.Outbounds[1].Type != "vless" {
+		t.Fatalf("unexpected sing-box config %s", body)
+	}
+
+	if resp, _ := fetch(subURL+"?format=nope", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown format, got %d", resp.StatusCode)
+	}
+
+	// a failure is logged without the token in the path; an OpenVPN node
+	// cannot be described before the CA exists
+	nodes, err := h.repo.GetVpnNodes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes[0].OpenVPNPort = 1194
+	if err := h.repo.UpdateVpnNode(ctx, nodes[0]); err != nil {
+		t.Fatal(err)
+	}
+	var logs bytes.Buffer
+	app.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	if resp, _ := fetch(subURL, ""); resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected 500 without a CA, got %d", resp.StatusCode)
+	}
+	token := subURL[strings.LastIndex(subURL, "/")+1:]
+	if !strings.Contains(logs.String(), "server error") || !strings.Contains(logs.String(), "/sub/[redacted]") || strings.Contains(logs.String(), token) {
+		t.Fatalf("expected the failure logged without the token, got %s", logs.String())
+	}
+
+	// a new URL replaces the old one
+	resp, _ = h.b.post("/devices/subscription-url", "/devices", nil)
+	assertRedirect(t, resp, "/devices")
+	if resp, _ := fetch(subURL, ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for a replaced URL, got %d", resp.StatusCode)
+	}
+}
+
+func TestPurchasePlan(t *testing.T) {
+	h := setupHandlerTest(t)
+	ctx := context.Background()
+
+	nodeID, err := h.repo.InsertVpnNode(ctx, models.VpnNode{
+		Name: "de-fra-1", Country: "DE", Endpoint: "de1.example.com:51820", PublicKey: "node-key",
+		Subnet: "10.9.0.0/24", Capacity: 10, State: models.NodeEnabled,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	planID := h.repo.AddPlan(models.Plan{Name: "Monthly", PriceCents: 499, Currency: "USD", DurationDays: 30})
+	plan := strconv.Itoa(planID)
+
+	// users see the plans but cannot start one without paying
+	assertRedirect(t, h.login(testPassword), "/home")
+	_, body := h.b.get("/plans")
+	for _, want := range []string{"Monthly", "4.99 USD for 30 days", "Contact support to subscribe"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected the plans page to contain %q", want)
+		}
+	}
+	if strings.Contains(body, "<form method=\"post\"") {
+		t.Error("expected no purchase form on the plans page")
+	}
+	path := "/admin/users/" + strconv.Itoa(h.userID)
+	for _, p := range []string{"/plans/" + plan + "/purchase", path + "/plans"} {
+		if resp, _ := h.b.post(p, "/devices", url.Values{"plan": {plan}}); resp.StatusCode < 400 {
+			t.Fatalf("expected a user to be refused at %s, got %d", p, resp.StatusCode)
+		}
+	}
+	if _, err := h.repo.GetActiveSubscriptionByUserId(ctx, h.userID); err != sql.ErrNoRows {
+		t.Fatalf("expected no subscription without a payment, got %v", err)
+	}
+
+	resp, _ := h.b.get("/logout")
+	assertRedirect(t, resp, "/login")
+	h.loginAdmin()
+
+	_, body = h.b.get(path + "/quota")
+	for _, want := range []string{"Record a plan purchase", `action="` + path + `/plans"`, `value="DE"`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected the user page to contain %q", want)
+		}
+	}
+
+	if resp, _ := h.b.post(path+"/plans", path+"/quota", url.Values{"plan": {"999"}}); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected an unknown plan to be a 404, got %d", resp.StatusCode)
+	}
+
+	// the first device cannot be provisioned where there is no node, which
+	// rolls back the subscription and the invoice with it
+	resp, _ = h.b.post(path+"/plans", path+"/quota", url.Values{"plan": {plan}, "location": {"NL"}})
+	assertRedirect(t, resp, path+"/quota")
+	_, body = h.b.get(path + "/quota")
+	if !strings.Contains(body, "There are no servers in that location. Nothing was recorded.") {
+		t.Fatal("expected the failed purchase to be explained")
+	}
+	if _, err := h.repo.GetActiveSubscriptionByUserId(ctx, h.userID); err != sql.ErrNoRows {
+		t.Fatalf("expected no subscription left behind, got %v", err)
+	}
+	invoices, err := h.repo.GetInvoicesByUserId(ctx, h.userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers, err := h.repo.GetVpnPeersByUserId(ctx, h.userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(invoices) != 0 || len(peers) != 0 {
+		t.Fatalf("expected no invoice or peer left behind, got %+v and %+v", invoices, peers)
+	}
+
+	resp, _ = h.b.post(path+"/plans", path+"/quota", url.Values{"plan": {plan}, "location": {"DE"}})
+	assertRedirect(t, resp, path+"/quota")
+	sub, err := h.repo.GetActiveSubscriptionByUserId(ctx, h.userID)
+	if err != nil || sub.PlanID != planID {
+		t.Fatalf("expected the subscription to Monthly, got %+v, %v", sub, err)
+	}
+	invoices, _ = h.repo.GetInvoicesByUserId(ctx, h.userID)
+	peers, _ = h.repo.GetVpnPeersByUserId(ctx, h.userID)
+	if len(invoices) != 1 || invoices[0].AmountCents != 499 || len(peers) != 1 || peers[0].NodeID != nodeID {
+		t.Fatalf("expected the invoice and the first device on de-fra-1, got %+v and %+v", invoices, peers)
+	}
+	_, body = h.b.get(path + "/quota")
+	if !strings.Contains(body, "Subscribed to Monthly until") || strings.Contains(body, "Record a plan purchase") {
+		t.Fatal("expected the user page to confirm the purchase")
+	}
+
+	resp, _ = h.b.post(path+"/plans", path+"/quota", url.Values{"plan": {plan}, "location": {"DE"}})
+	assertRedirect(t, resp, path+"/quota")
+	if invoices, _ = h.repo.GetInvoicesByUserId(ctx, h.userID); len(invoices) != 1 {
+		t.Fatal("expected a second plan not to be recorded during an active subscription")
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	h := setupHandlerTest(t)
+	ctx := context.Background()
+
+	_, nodeKey, err := vpn.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeID, err := h.repo.InsertVpnNode(ctx, models.VpnNode{
+		Name: "de-fra-1", Country: "DE", Endpoint: "de1.example.com:51820", PublicKey: nodeKey,
+		Subnet: "10.9.0.0/24", Capacity: 10, State: models.NodeEnabled,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	planID := h.repo.AddPlan(models.Plan{
+		Name: "Lite", PriceCents: 300, Currency: "USD", DurationDays: 30,
+		DataCapBytes: 100_000_000, DeviceLimit: 1,
+	})
+	_, err = h.repo.InsertSubscription(ctx, models.Subscription{
+		UserID: h.userID, PlanID: planID, Status: "active",
+		StartsAt: time.Now().Add(-time.Hour), ExpiresAt: time.Now().AddDate(0, 0, 30),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := tokens.APITokenPrefix + "quota-test-token"
+	h.repo.AddAPIToken(models.APIToken{
+		UserID: h.userID, Name: "quota", Prefix: token[:12],
+		TokenHash: tokens.Hash(token), Scopes: tokens.AllScopes, CreatedAt: time.Now(),
+	})
+	createPeer := func(name string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, h.b.server.URL+"/api/v1/peers", strings.NewReader(`{"name":"`+name+`"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, readBody(t, resp)
+	}
+
+	status, body := createPeer("Laptop")
+	if status != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", status, body)
+	}
+	var created apiPeerResponse
+	if err := json.Unmarshal([]byte(body), &created); err != nil {
+		t.Fatal(err)
+	}
+	if status, body := createPeer("Phone"); status != http.StatusConflict || !strings.Contains(body, "device_limit_reached") {
+		t.Fatalf("expected the plan's single device to be enforced, got %d: %s", status, body)
+	}
+
+	served := func() int {
+		t.Helper()
+		peers, err := h.repo.GetServedVpnPeersByNodeId(ctx, nodeID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(peers)
+	}
+	if served() != 1 {
+		t.Fatal("expected the peer to be served")
+	}
+
+	err = h.repo.AddPeerUsage(ctx, time.Now(), []models.PeerTraffic{{PeerID: created.Data.ID, RxBytes: 10_000_000, TxBytes: 90_000_000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocked, err := handlers.Repo.Quota.RunOnce(ctx, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blocked != 1 || served() != 0 {
+		t.Fatalf("expected the user to be blocked at the cap, got %d blocked and %d served", blocked, served())
+	}
+
+	packID := h.repo.AddTopUpPack(models.TopUpPack{Name: "10 GB", DataBytes: 10_000_000_000, PriceCents: 200, Currency: "USD"})
+	pack := strconv.Itoa(packID)
+	path := "/admin/users/" + strconv.Itoa(h.userID) + "/quota"
+	topUpPath := "/admin/users/" + strconv.Itoa(h.userID) + "/topups"
+
+	// users see the packs but cannot add one without paying
+	assertRedirect(t, h.login(testPassword), "/home")
+	_, body = h.b.get("/home")
+	for _, want := range []string{"devices are disconnected", "100.0 MB of 100.0 MB", "10 GB · 10.0 GB for 2.00 USD", "Contact support for a top-up pack"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected the dashboard to contain %q", want)
+		}
+	}
+	for _, p := range []string{"/topups/" + pack, topUpPath} {
+		if resp, _ := h.b.post(p, "/devices", url.Values{"pack": {pack}}); resp.StatusCode < 400 {
+			t.Fatalf("expected a user to be refused at %s, got %d", p, resp.StatusCode)
+		}
+	}
+	if served() != 0 {
+		t.Fatal("expected the user to stay blocked without a payment")
+	}
+
+	resp, _ := h.b.get("/logout")
+	assertRedirect(t, resp, "/login")
+	h.loginAdmin()
+
+	_, body = h.b.get(path)
+	if !strings.Contains(body, "Record a top-up purchase") || !strings.Contains(body, `action="`+topUpPath+`"`) {
+		t.Fatal("expected the top-up form on the user page")
+	}
+	if resp, _ := h.b.post(topUpPath, path, url.Values{"pack": {"999"}}); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected an unknown pack to be a 404, got %d", resp.StatusCode)
+	}
+	resp, _ = h.b.post(topUpPath, path, url.Values{"pack": {pack}})
+	assertRedirect(t, resp, path)
+	if served() != 1 {
+		t.Fatal("expected the top-up to lift the block")
+	}
+	invoices, err := h.repo.GetInvoicesByUserId(ctx, h.userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(invoices) != 1 || invoices[0].AmountCents != 200 {
+		t.Fatalf("expected the top-up invoiced, got %+v", invoices)
+	}
+	_, body = h.b.get(path)
+	if !strings.Contains(body, "10.0 GB of data added until") || strings.Contains(body, "blocked until") {
+		t.Fatal("expected the user page to confirm the top-up and drop the block")
+	}
+
+	_, body = h.b.get("/admin/quotas")
+	if !strings.Contains(body, testEmail) || !strings.Contains(body, "10.1 GB") {
+		t.Fatalf("expected the quotas page to list the user with the top-up in the cap")
+	}
+
+	resp, body = h.b.post(path, path, url.Values{"data_cap_gb": {"lots"}, "device_limit": {"-1"}})
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "Use a number of gigabytes") || !strings.Contains(body, "Use a number of devices") {
+		t.Fatalf("expected the invalid override to be rejected, got %d", resp.StatusCode)
+	}
+
+	resp, _ = h.b.post(path, path, url.Values{"data_cap_gb": {"0"}, "device_limit": {"2"}, "note": {"Support ticket 1234"}})
+	assertRedirect(t, resp, path)
+	q, err := h.repo.GetUserQuota(ctx, h.userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.DataCapBytes != 0 || q.DeviceLimit != 2 || q.Note != "Support ticket 1234" {
+		t.Fatalf("unexpected override %+v", q)
+	}
+	if status, body := createPeer("Phone"); status != http.StatusCreated {
+		t.Fatalf("expected the raised device limit to allow a second peer, got %d: %s", status, body)
+	}
+
+	_, body = h.b.get(path)
+	if !strings.Contains(body, "Quota saved") || !strings.Contains(body, "unlimited") || !strings.Contains(body, `value="2"`) {
+		t.Fatalf("expected the saved override on the quota page")
+	}
+}
+
+func TestDevices(t *testing.T) {
+	h := setupHandlerTest(t)
+	ctx := context.Background()
+
+	planID := h.repo.AddPlan(models.Plan{Name: "Duo", PriceCents: 400, Currency: "USD", DurationDays: 30, DeviceLimit: 2})
+	_, err := h.repo.InsertSubscription(ctx, models.Subscription{
+		UserID: h.userID, PlanID: planID, Status: "active",
+		StartsAt: time.Now().Add(-time.Hour), ExpiresAt: time.Now().AddDate(0, 0, 30),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertRedirect(t, h.login(testPassword), "/home")
+
+	resp, body := h.b.post("/devices", "/devices", url.Values{"name": {"  "}})
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "Name must be between 1 and 64 characters") {
+		t.Fatalf("expected a blank name to be rejected, got %d", resp.StatusCode)
+	}
+
+	for _, name := range []string{"Phone", "Laptop"} {
+		resp, _ = h.b.post("/devices", "/devices", url.Values{"name": {name}})
+		assertRedirect(t, resp, "/devices")
+	}
+	resp, body = h.b.post("/devices", "/devices", url.Values{"name": {"Router"}})
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "Your plan allows no more devices") {
+		t.Fatalf("expected the plan's device limit to be enforced, got %d", resp.StatusCode)
+	}
+
+	peers, err := h.repo.GetVpnPeersByUserId(ctx, h.userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 {
+		t.Fatalf("expected 2 devices, got %d", len(peers))
+	}
+	phone := peers[0]
+	path := "/devices/" + strconv.Itoa(phone.ID)
+
+	err = h.repo.AddPeerUsage(ctx, time.Now(), []models.PeerTraffic{{PeerID: phone.ID, RxBytes: 1_000_000, TxBytes: 500_000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, body = h.b.get("/devices")
+	for _, want := range []string{"2 of 2 devices", "Phone", "Laptop", "1.5 MB", "never"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected the devices page to contain %q", want)
+		}
+	}
+
+	resp, body = h.b.get(path + "/config")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "PrivateKey = "+phone.PrivateKey) {
+		t.Fatalf("expected the config download, got %d", resp.StatusCode)
+	}
+	if !strings.Contains(resp.Header.Get("Content-Disposition"), "attachment") {
+		t.Fatalf("expected the config as an attachment")
+	}
+
+	resp, body = h.b.get(path + "/qr")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/png" || !strings.HasPrefix(body, "\x89PNG") {
+		t.Fatalf("expected a PNG QR code, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	resp, _ = h.b.post(path+"/rename", "/devices", url.Values{"name": {"Work phone"}})
+	assertRedirect(t, resp, "/devices")
+	resp, _ = h.b.post(path+"/reissue", "/devices", nil)
+	assertRedirect(t, resp, "/devices")
+	rotated, err := h.repo.GetVpnPeerById(ctx, phone.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.Name != "Work phone" || rotated.PublicKey == phone.PublicKey || rotated.PrivateKey == phone.PrivateKey {
+		t.Fatalf("expected the device renamed with new keys, got %+v", rotated)
+	}
+
+	resp, _ = h.b.post(path+"/revoke", "/devices", nil)
+	assertRedirect(t, resp, "/devices")
+	if resp, _ = h.b.get(path + "/config"); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected a revoked device to be gone, got %d", resp.StatusCode)
+	}
+	resp, _ = h.b.post("/devices", "/devices", url.Values{"name": {"Router"}})
+	assertRedirect(t, resp, "/devices")
+
+	otherID, err := h.repo.AddUser(models.User{Username: "john", FirstName: "John", LastName: "Doe", Email: "john@example.com"}, testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := h.repo.InsertVpnPeer(ctx, models.VpnPeer{UserID: otherID, Name: "Tablet", Address: "10.8.0.200/32", PublicKey: "other-key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/config", "/qr"} {
+		if resp, _ := h.b.get("/devices/" + strconv.Itoa(other) + p); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected another user's device to be hidden from %s, got %d", p, resp.StatusCode)
+		}
+	}
+	if resp, _ := h.b.post("/devices/"+strconv.Itoa(other)+"/revoke", "/devices", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected another user's device not to be revocable, got %d", resp.StatusCode)
+	}
+}
+
+func TestMoveDevice(t *testing.T) {
+	h := setupHandlerTest(t)
+	ctx := context.Background()
+
+	var nodes []models.VpnNode
+	for i, name := range []string{"de-1", "de-2"} {
+		node := models.VpnNode{
+			Name: name, Country: "DE", Endpoint: name + ".example.com:51820", PublicKey: "node-key",
+			Subnet: "10." + strconv.Itoa(9+i) + ".0.0/24", Capacity: 10, State: models.NodeEnabled,
+		}
+		id, err := h.repo.InsertVpnNode(ctx, node)
+		if err != nil {
+			t.Fatal(err)
+		}
+		node.ID = id
+		nodes = append(nodes, node)
+	}
+
+	planID := h.repo.AddPlan(models.Plan{Name: "Monthly", PriceCents: 400, Currency: "USD", DurationDays: 30})
+	subID, err := h.repo.InsertSubscription(ctx, models.Subscription{
+		UserID: h.userID, PlanID: planID, Status: "active",
+		StartsAt: time.Now().Add(-time.Hour), ExpiresAt: time.Now().AddDate(0, 0, 30),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerID, err := h.repo.InsertVpnPeer(ctx, models.VpnPeer{
+		UserID: h.userID, SubscriptionID: subID, NodeID: nodes[0].ID, Name: "Laptop", Protocol: models.ProtocolWireGuard,
+		PublicKey: "laptop-key", PrivateKey: "laptop-private", Address: "10.9.0.2/32",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/devices/" + strconv.Itoa(peerID)
+
+	assertRedirect(t, h.login(testPassword), "/home")
+
+	resp, _ := h.b.post(path+"/move", "/devices", nil)
+	assertRedirect(t, resp, "/devices")
+	_, body := h.b.get("/devices")
+	if !strings.Contains(body, "is up again") {
+		t.Fatal("expected a device on a healthy node not to be moved")
+	}
+
+	down := func(node models.VpnNode) {
+		t.Helper()
+		err := h.repo.UpdateVpnNodeHealth(ctx, models.VpnNodeHealth{NodeID: node.ID, Health: models.NodeDown, Reason: "unreachable", Failures: 3, CheckedAt: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	down(nodes[0])
+	_, body = h.b.get("/devices")
+	if !strings.Contains(body, "server down") || !strings.Contains(body, path+"/move") {
+		t.Fatal("expected the devices page to offer moving the device off the down node")
+	}
+
+	resp, _ = h.b.post(path+"/move", "/devices", nil)
+	assertRedirect(t, resp, "/devices")
+	moved, err := h.repo.GetVpnPeerById(ctx, peerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.NodeID != nodes[1].ID || !strings.HasPrefix(moved.Address, "10.10.0.") || moved.PublicKey != "laptop-key" {
+		t.Fatalf("expected the device moved to de-2 with its keys, got %+v", moved)
+	}
+	resp, body = h.b.get(path + "/config")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "Endpoint = de-2.example.com:51820") {
+		t.Fatalf("expected the config to point at de-2, got %d", resp.StatusCode)
+	}
+
+	down(nodes[1])
+	resp, _ = h.b.post(path+"/move", "/devices", nil)
+	assertRedirect(t, resp, "/devices")
+	_, body = h.b.get("/devices")
+	if !strings.Contains(body, "No other DE server has room for Laptop") {
+		t.Fatal("expected the move to fail without another node")
+	}
+}
+
+// fakeBot records what the bot sends
+type fakeBot struct {
+	messages []string
+	files    []string
+}
+
+func (b *fakeBot) SendMessage(ctx context.Context, chatID, text string) error {
+	b.messages = append(b.messages, text)
+	return nil
+}
+
+func (b *fakeBot) SendDocument(ctx context.Context, chatID, filename string, data []byte, caption string) error {
+	b.files = append(b.files, filename)
+	return nil
+}
+
+func (b *fakeBot) SendPhoto(ctx context.Context, chatID, filename string, data []byte, caption string) error {
+	b.files = append(b.files, filename)
+	return nil
+}
+
+// last returns the last message sent
+func (b *fakeBot) last() string {
+	if len(b.messages) == 0 {
+		return ""
+	}
+	return b.messages[len(b.messages)-1]
+}
+
+func TestBotCommands(t *testing.T) {
+	h := setupHandlerTest(t)
+	ctx := context.Background()
+
+	bot := &fakeBot{}
+	handlers.Repo.Bot = bot
+	app.TelegramBot = "fastnet_test_bot"
+	t.Cleanup(func() { app.TelegramBot = "" })
+
+	planID := h.repo.AddPlan(models.Plan{Name: "Monthly", PriceCents: 500, Currency: "USD", DurationDays: 30})
+	_, err := h.repo.InsertSubscription(ctx, models.Subscription{
+		UserID: h.userID, PlanID: planID, Status: "active",
+		StartsAt: time.Now().Add(-time.Hour), ExpiresAt: time.Now().AddDate(0, 0, 30),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(text string) string {
+		t.Helper()
+		handlers.Repo.HandleBotMessage(ctx, telegram.Message{Chat: telegram.Chat{ID: 4242, Type: "private"}, Text: text})
+		return bot.last()
+	}
+
+	if got := send("/devices"); !strings.Contains(got, "not linked") {
+		t.Fatalf("expected an unlinked chat to be told so, got %q", got)
+	}
+	handlers.Repo.HandleBotMessage(ctx, telegram.Message{Chat: telegram.Chat{ID: 4242, Type: "group"}, Text: "/devices"})
+	if len(bot.messages) != 1 {
+		t.Fatal("expected group chats to be ignored")
+	}
+
+	assertRedirect(t, h.login(testPassword), "/home")
+	resp, _ := h.b.post("/devices/telegram-link", "/devices", nil)
+	assertRedirect(t, resp, "/devices")
+	_, body := h.b.get("/devices")
+	match := regexp.MustCompile(`\?start=(` + tokens.TelegramLinkPrefix + `[^"]+)"`).FindStringSubmatch(body)
+	if match == nil {
+		t.Fatal("expected the link to the bot on the devices page")
+	}
+	code := html.UnescapeString(match[1])
+
+	if got := send("/start " + code); !strings.Contains(got, "now linked") {
+		t.Fatalf("expected the chat to be linked, got %q", got)
+	}
+	if got := send("/start " + code); !strings.Contains(got, "expired or was already used") {
+		t.Fatalf("expected the code to be single use, got %q", got)
+	}
+	prefs, err := h.repo.GetNotificationPreferences(ctx, h.userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefs.TelegramChatID != "4242" {
+		t.Fatalf("expected notifications to go to the linked chat, got %q", prefs.TelegramChatID)
+	}
+
+	if got := send("/devices"); !strings.Contains(got, "no devices yet") {
+		t.Fatalf("unexpected answer %q", got)
+	}
+	if got := send("/add"); !strings.Contains(got, "Give the device a name") {
+		t.Fatalf("expected /add without a name to be rejected, got %q", got)
+	}
+	send("/add Home router")
+	if len(bot.files) != 2 {
+		t.Fatalf("expected the config and QR code of the new device, got %v", bot.files)
+	}
+	peers, err := h.repo.GetVpnPeersByUserId(ctx, h.userID)
+	if err != nil || len(peers) != 1 {
+		t.Fatalf("expected one device, got %d: %v", len(peers), err)
+	}
+	id := strconv.Itoa(peers[0].ID)
+
+	if got := send("/devices@fastnet_test_bot"); !strings.Contains(got, "#"+id+" Home router") {
+		t.Fatalf("expected the device in the list, got %q", got)
+	}
+	send("/config #" + id)
+	if len(bot.files) != 4 {
+		t.Fatalf("expected /config to send the config again, got %v", bot.files)
+	}
+	if got := send("/rename " + id + " Router"); !strings.Contains(got, "renamed to Router") {
+		t.Fatalf("unexpected answer %q", got)
+	}
+	send("/reissue " + id)
+	rotated, err := h.repo.GetVpnPeerById(ctx, peers[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.Name != "Router" || rotated.PublicKey == peers[0].PublicKey || len(bot.files) != 6 {
+		t.Fatalf("expected the renamed device with new keys and a new config, got %+v", rotated)
+	}
+	if got := send("/revoke " + id); !strings.Contains(got, "Router revoked") {
+		t.Fatalf("unexpected answer %q", got)
+	}
+	if got := send("/config " + id); !strings.Contains(got, "You have no device #"+id) {
+		t.Fatalf("expected a revoked device to be gone, got %q", got)
+	}
+	if got := send("/help"); !strings.Contains(got, "/devices - list your devices") {
+		t.Fatalf("expected the help, got %q", got)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	h := setupHandlerTest(t)
+
+	assertRedirect(t, h.login(testPassword), "/home")
+
+	resp, _ := h.b.get("/logout")
+	assertRedirect(t, resp, "/login")
+
+	resp, _ = h.b.get("/home")
+	assertRedirect(t, resp, "/login")
+}
+
+func TestUpdateSecuritySetting(t *testing.T) {
+	h := setupHandlerTest(t)
+
+	assertRedirect(t, h.login(testPassword), "/home")
+
+	resp, body := h.b.post("/update-security-setting", "/profile", url.Values{"type": {"email_verification"}, "value": {"true"}})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	var result struct {
+		Success bool   `json:"success"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal([]byte(body), &result); err != nil {
+		t.Fatal(err)
+	}
+	if !result.Success || result.Message != "Successfully enabled" {
+		t.Fatalf("unexpected response %+v", result)
+	}
+
+	security, err := h.repo.GetUserLoginSecurity(context.Background(), h.userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !security.EmailVerification {
+		t.Fatal("email verification was not enabled")
+	}
+
+	resp, _ = h.b.post("/update-security-setting", "/profile", url.Values{"type": {"bogus"}, "value": {"true"}})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown setting, got %d", resp.StatusCode)
+	}
+
+	// the next login now goes through verification
+	resp, _ = h.b.get("/logout")
+	assertRedirect(t, resp, "/login")
+	assertRedirect(t, h.login(testPassword), "/verify")
+}
+
+func TestNotificationFeed(t *testing.T) {
+	h := setupHandlerTest(t)
+	ctx := context.Background()
+
+	for _, title := range []string{"Payment received", "New device added"} {
+		_, err := h.repo.InsertNotification(ctx, models.Notification{UserID: h.userID, Event: "payment_succeeded", Title: title, Body: "Details", InApp: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := h.repo.InsertNotification(ctx, models.Notification{UserID: h.userID, Event: "payment_failed", Title: "Muted notification", InApp: false})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertRedirect(t, h.login(testPassword), "/home")
+
+	_, body := h.b.get("/home")
+	for _, want := range []string{"Payment received", "New device added", "2 new", `href="/notifications"`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in the notification bell", want)
+		}
+	}
+	if strings.Contains(body, "Muted notification") || strings.Contains(body, "pages-notifications.html") {
+		t.Error("unexpected notification in the bell")
+	}
+
+	resp, body := h.b.get("/notifications")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "2 unread") {
+		t.Fatalf("expected the notifications page with 2 unread, got %d", resp.StatusCode)
+	}
+
+	resp, _ = h.b.post("/notifications/read", "/notifications", nil)
+	assertRedirect(t, resp, "/notifications")
+
+	unread, err := h.repo.CountUnreadNotifications(ctx, h.userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unread != 0 {
+		t.Fatalf("expected every notification to be read, %d unread", unread)
+	}
+}
+
+func TestNotificationPreferences(t *testing.T) {
+	h := setupHandlerTest(t)
+	ctx := context.Background()
+
+	assertRedirect(t, h.login(testPassword), "/home")
+
+	resp, _ := h.b.post("/profile/notifications", "/profile", url.Values{"email": {"on"}, "telegram": {"on"}})
+	assertRedirect(t, resp, "/profile")
+	if prefs, _ := h.repo.GetNotificationPreferences(ctx, h.userID); prefs.Telegram {
+		t.Fatal("expected Telegram without a chat ID to be rejected")
+	}
+
+	resp, _ = h.b.post("/profile/notifications", "/profile", url.Values{"telegram": {"on"}, "telegram_chat_id": {" 123456 "}})
+	assertRedirect(t, resp, "/profile")
+
+	prefs, err := h.repo.GetNotificationPreferences(ctx, h.userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefs.Email || prefs.InApp || !prefs.Telegram || prefs.TelegramChatID != "123456" {
+		t.Fatalf("unexpected preferences %+v", prefs)
+	}
+
+	if _, body := h.b.get("/profile"); !strings.Contains(body, `value="123456"`) {
+		t.Fatal("expected the saved chat ID on the profile page")
+	}
+}
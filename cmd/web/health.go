@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/driver"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/health"
+)
+
+// newHealthChecker registers the readiness checks. The database and the template
+// cache are critical; SMTP, the VPN backend and the workers only degrade readiness.
+func newHealthChecker(db *driver.DB) *health.Checker {
+	checker := health.NewChecker(cfg.Health.CheckTimeout)
+
+	checker.Add("database", true, health.Database(db.SQL))
+	checker.Add("templates", true, health.Templates(&app))
+	checker.Add("vpn", false, health.WireGuard(&app))
+	checker.Add("workers", false, health.Workers(app.Workers))
+
+	if cfg.Mail.Sender == "smtp" && cfg.SMTP.Host != "" {
+		smtpAddr := net.JoinHostPort(cfg.SMTP.Host, cfg.SMTP.Port)
+		checker.AddPeriodic(app.Workers, "smtp", false, cfg.Health.SMTPInterval, health.TCP(smtpAddr))
+	}
+
+	return checker
+}
@@ -1,67 +1,118 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/alexedwards/scs/v2"
 	"github.com/bayramovrahman/fastnet_vpn_bot/internal/config"
 	"github.com/bayramovrahman/fastnet_vpn_bot/internal/driver"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/email"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/failover"
 	"github.com/bayramovrahman/fastnet_vpn_bot/internal/handlers"
 	"github.com/bayramovrahman/fastnet_vpn_bot/internal/helpers"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/logging"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/metrics"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/notify"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/outbox"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/pki"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/quota"
 	"github.com/bayramovrahman/fastnet_vpn_bot/internal/render"
-	"github.com/joho/godotenv"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/rotation"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/telegram"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/usage"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/vpn"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/worker"
 )
 
 var app config.AppConfig
 var session *scs.SessionManager
-var infoLog *log.Logger
-var errorLog *log.Logger
+var cfg config.Config
 
 func main() {
-	err := godotenv.Load()
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to an optional YAML or TOML config file")
+	printConfig := flag.Bool("print-config", false, "print the effective configuration with secrets redacted and exit")
+	flag.Parse()
+
+	if flag.Arg(0) == "migrate" {
+		os.Exit(migrateCommand(*configPath, flag.Args()[1:], os.Stdout, os.Stderr))
+	}
+
+	var err error
+	cfg, err = config.Load(*configPath)
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *printConfig {
+		out, err := cfg.Redacted()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Stdout.Write(out)
+		return
 	}
-	
-	db, err := run()
+
+	logger, err := logging.New(os.Stdout, cfg.Log.Format, cfg.Log.Level)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-	defer db.SQL.Close()
+	slog.SetDefault(logger)
+	app.Logger = logger
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	portNumber := os.Getenv("APP_PORT")
-	if portNumber == "" {
-		portNumber = "8080"
+	app.Workers = worker.NewGroup(ctx)
+
+	db, err := run(ctx)
+	if err != nil {
+		logger.Error("startup failed", "error", err)
+		os.Exit(1)
 	}
 
-	fmt.Printf("Starting serve on port :%s\n", portNumber)
+	servers := []*http.Server{newServer(cfg.HTTP, ":"+cfg.Port, routes())}
 
-	srv := &http.Server{
-		Addr:    ":" + portNumber,
-		Handler: routes(),
+	logger.Info("starting server", "port", cfg.Port, "in_production", cfg.InProduction)
+
+	switch {
+	case cfg.Metrics.Addr != "":
+		servers = append(servers, newAdminServer(cfg.HTTP, cfg.Metrics.Addr))
+		logger.Info("serving metrics on admin listener", "addr", cfg.Metrics.Addr)
+	case cfg.Metrics.Token != "":
+		logger.Info("serving metrics on main listener behind METRICS_TOKEN")
+	default:
+		logger.Warn("metrics are disabled, set METRICS_ADDR or METRICS_TOKEN to expose them")
 	}
 
-	err = srv.ListenAndServe()
+	err = serve(ctx, cfg.HTTP.ShutdownTimeout, servers...)
 	if err != nil {
-		log.Fatal(err)
+		logger.Error("server stopped with error", "error", err)
 	}
-}
 
-func run() (*driver.DB, error) {
-	// Get IN_PRODUCTION from environment
-	inProduction := os.Getenv("IN_PRODUCTION")
-	app.InProduction = inProduction == "true"
+	logger.Info("closing database connections")
+	err = db.Close()
+	if err != nil {
+		logger.Error("error closing database", "error", err)
+	}
 
-	app.InProduction = false
-	infoLog = log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
-	app.InfoLog = infoLog
+	logger.Info("stopped")
+}
 
-	errorLog = log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
-	app.ErrorLog = errorLog
+func run(ctx context.Context) (*driver.DB, error) {
+	app.InProduction = cfg.InProduction
+	app.PublicURL = strings.TrimSuffix(cfg.PublicURL, "/")
 
 	// set up the session
 	session = scs.New()
@@ -72,36 +123,94 @@ func run() (*driver.DB, error) {
 
 	app.Session = session
 
-	// Build database connection string from environment variables
-	dbHost := os.Getenv("DB_HOST")
-	dbPort := os.Getenv("DB_PORT")
-	dbName := os.Getenv("DB_NAME")
-	dbUser := os.Getenv("DB_USER")
-	dbPassword := os.Getenv("DB_PASSWORD")
+	// WireGuard server peers are provisioned against
+	app.WireGuard = vpn.ServerConfig{
+		Endpoint:   cfg.WireGuard.Endpoint,
+		PublicKey:  cfg.WireGuard.ServerPublicKey,
+		Subnet:     cfg.WireGuard.Subnet,
+		DNS:        cfg.WireGuard.DNS,
+		AllowedIPs: cfg.WireGuard.AllowedIPs,
+	}
 
-	dsn := fmt.Sprintf("host=%s port=%s dbname=%s user=%s password=%s", dbHost, dbPort, dbName, dbUser, dbPassword)
+	// the key of the OpenVPN CA, validated with the rest of the configuration
+	if cfg.PKI.EncryptionKey != "" {
+		key, err := pki.ParseEncryptionKey(cfg.PKI.EncryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		app.PKIKey = key
+	}
 
 	// connect to database
-	log.Println("Connecting to database...")
-	db, err := driver.ConnectSQL(dsn)
+	app.Logger.Info("connecting to database", "host", cfg.Database.Host, "port", cfg.Database.Port, "dbname", cfg.Database.Name)
+	db, err := driver.ConnectSQL(ctx, cfg.Database, app.Logger)
 	if err != nil {
-		log.Fatal("Cannot connect to database! Dying...")
+		return nil, fmt.Errorf("cannot connect to database: %w", err)
 	}
-	log.Println("Connected to database!")
+	app.Logger.Info("connected to database")
+
+	warnPendingMigrations(ctx, db)
 
 	templateCache, err := render.CreateTemplateCache()
 	if err != nil {
-		log.Fatal("Cannot create template cache")
-		return nil, err
+		return nil, fmt.Errorf("cannot create template cache: %w", err)
 	}
 
 	app.TemplateCache = templateCache
-	app.UseCache = false
+	app.UseCache = cfg.UseTemplateCache
+
+	mailer, err := email.NewMailer(cfg.Mail, cfg.SMTP)
+	if err != nil {
+		return nil, err
+	}
+	mailTemplates, err := email.ParseTemplates(cfg.Mail.TemplateDir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse e-mail templates: %w", err)
+	}
+
+	repo := handlers.NewRepo(&app, db, nil)
+
+	// handlers only queue e-mail; the outbox workers hand it to the real mailer
+	queue := outbox.NewQueue(repo.DB, cfg.Outbox, app.Logger)
+	repo.EmailService = email.NewService(queue, mailTemplates, email.FromAddress(cfg.Mail.FromName, cfg.SMTP.From), app.Logger)
+	dispatcher := outbox.NewDispatcher(repo.DB, mailer, cfg.Outbox, app.Logger)
+	var bot *telegram.Client
+	if cfg.Telegram.BotToken != "" {
+		bot = telegram.NewClient(cfg.Telegram)
+		dispatcher.Telegram = bot
+	}
+	for i := 1; i <= cfg.Outbox.Workers; i++ {
+		app.Workers.Go(fmt.Sprintf("outbox-%d", i), dispatcher.Run)
+	}
+
+	notifyTemplates, err := notify.ParseTemplates(cfg.Notify.TemplateDir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse notification templates: %w", err)
+	}
+	repo.Notifier = notify.NewNotifier(repo.DB, notifyTemplates, repo.EmailService, app.Logger)
+	if cfg.Telegram.BotToken != "" {
+		repo.Notifier.Telegram = queue
+	}
+	app.Workers.Go("notify-scheduler", notify.NewScheduler(repo.Notifier, cfg.Notify, app.Logger).Run)
+	app.Workers.Go("usage-pruner", usage.NewPruner(repo.DB, cfg.Usage, app.Logger).Run)
+	repo.Quota = quota.NewEnforcer(repo.DB, repo.Notifier, cfg.Quota, app.Logger)
+	app.Workers.Go("quota-enforcer", repo.Quota.Run)
+	app.Workers.Go("key-rotation", rotation.NewRotator(repo.DB, repo.Notifier, cfg.Rotation, cfg.WireGuard.Subnet, app.Logger).Run)
+	app.Workers.Go("node-failover", failover.NewMonitor(repo.DB, repo.Notifier, cfg.Failover, app.Logger).Run)
+	if bot != nil && cfg.Telegram.Commands {
+		repo.Bot = bot
+		app.TelegramBot = cfg.Telegram.Username
+		app.Workers.Go("telegram-bot", telegram.NewPoller(bot, repo.HandleBotMessage, cfg.Telegram.PollTimeout, app.Logger).Run)
+	}
 
-	repo := handlers.NewRepo(&app, db)
 	handlers.NewHandlers(repo)
-	render.NewTemplates(&app)
+	metrics.RegisterDatabase(db.SQL, repo.DB, app.Logger)
+	if db.Pool != nil {
+		metrics.RegisterPool(db.Pool)
+	}
+	repo.Health = newHealthChecker(db)
+	render.NewTemplates(&app, repo.DB)
 	helpers.NewHelpers(&app)
-	
+
 	return db, nil
 }
@@ -1,21 +1,117 @@
 package main
 
 import (
+	"crypto/subtle"
+	"database/sql"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/handlers"
 	"github.com/bayramovrahman/fastnet_vpn_bot/internal/helpers"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/logging"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/metrics"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/tokens"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/justinas/nosurf"
 )
 
-func WriteToConsole(next http.Handler) http.Handler {
+// RequestID assigns every request an ID, reusing a sane incoming X-Request-ID,
+// and exposes it through the request context and the response header
+func RequestID(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Println("Hit the page")
-		next.ServeHTTP(w, r)
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = logging.NewRequestID()
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(logging.WithRequestID(r.Context(), id)))
+	})
+}
+
+// RequestLogger logs every request once it has been served
+func RequestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		next.ServeHTTP(ww, r)
+
+		app.Logger.LogAttrs(r.Context(), slog.LevelInfo, "request",
+			slog.String("method", r.Method),
+			slog.String("path", logPath(r.URL.Path)),
+			slog.Int("status", ww.Status()),
+			slog.Int("bytes", ww.BytesWritten()),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("remote_addr", r.RemoteAddr),
+		)
+	})
+}
+
+// logPath returns path as it is logged: the token of a subscription URL is
+// left out, since anyone holding it can fetch the configs of its user
+func logPath(path string) string {
+	if strings.HasPrefix(path, handlers.SubscriptionPath) {
+		return handlers.SubscriptionPath + "[redacted]"
+	}
+	return path
+}
+
+// Metrics records request counts and latencies by chi route pattern
+func Metrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		metrics.HTTPRequests.WithLabelValues(r.Method, route, strconv.Itoa(status)).Inc()
+		metrics.HTTPRequestDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
 	})
 }
 
+// MetricsAuth guards the metrics endpoint on the public listener with a static bearer token
+func MetricsAuth(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			given, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
 func NoSurf(next http.Handler) http.Handler {
 	csrfHandler := nosurf.New(next)
 
@@ -26,6 +122,12 @@ func NoSurf(next http.Handler) http.Handler {
 		SameSite: http.SameSiteLaxMode,
 	})
 
+	// nosurf assumes HTTPS when checking Origin/Referer; outside production
+	// the app is served over plain HTTP
+	csrfHandler.SetIsTLSFunc(func(r *http.Request) bool {
+		return app.InProduction
+	})
+
 	return csrfHandler
 }
 
@@ -43,6 +145,22 @@ func Auth(next http.Handler) http.Handler {
 	})
 }
 
+// Admin lets only administrators through; it must run after Auth
+func Admin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := handlers.Repo.DB.GetUserById(r.Context(), session.GetInt(r.Context(), "user_id"))
+		if err != nil && err != sql.ErrNoRows {
+			helpers.ServerError(w, r, err)
+			return
+		}
+		if err != nil || !user.IsAdmin {
+			helpers.ClientError(w, r, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func ExtendedSessionCheck(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if session.Exists(r.Context(), "remember_me") {
@@ -68,3 +186,75 @@ func ExtendedSessionCheck(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// APIAuth authenticates API requests with a personal bearer token
+func APIAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		plain, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok || !strings.HasPrefix(plain, tokens.APITokenPrefix) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			helpers.ErrorJSON(w, http.StatusUnauthorized, "unauthorized", "Missing or malformed bearer token")
+			return
+		}
+
+		token, err := handlers.Repo.DB.GetAPITokenByHash(r.Context(), tokens.Hash(plain))
+		if err == sql.ErrNoRows || (err == nil && !token.IsUsable(time.Now())) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api", error="invalid_token"`)
+			helpers.ErrorJSON(w, http.StatusUnauthorized, "invalid_token", "Token is invalid, expired or revoked")
+			return
+		}
+		if err != nil {
+			helpers.ServerErrorJSON(w, r, err)
+			return
+		}
+
+		err = handlers.Repo.DB.TouchAPIToken(r.Context(), token.ID)
+		if err != nil {
+			app.Logger.WarnContext(r.Context(), "unable to record API token usage", "token_id", token.ID, "error", err)
+		}
+
+		next.ServeHTTP(w, r.WithContext(helpers.WithAPIToken(r.Context(), token)))
+	})
+}
+
+// AgentAuth authenticates node agents by the agent token of their VPN node.
+// Like the API it sits outside the session and CSRF middleware.
+func AgentAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		plain, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok || !strings.HasPrefix(plain, tokens.AgentTokenPrefix) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="agent"`)
+			helpers.ErrorJSON(w, http.StatusUnauthorized, "unauthorized", "Missing or malformed bearer token")
+			return
+		}
+
+		node, err := handlers.Repo.DB.GetVpnNodeByAgentToken(r.Context(), tokens.Hash(plain))
+		if err == sql.ErrNoRows {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="agent", error="invalid_token"`)
+			helpers.ErrorJSON(w, http.StatusUnauthorized, "invalid_token", "Token is invalid or was replaced")
+			return
+		}
+		if err != nil {
+			helpers.ServerErrorJSON(w, r, err)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(helpers.WithVpnNode(r.Context(), node)))
+	})
+}
+
+// RequireScope rejects API requests whose token was not granted scope
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, ok := helpers.APIToken(r)
+			if !ok || !token.HasScope(scope) {
+				helpers.ErrorJSON(w, http.StatusForbidden, "insufficient_scope", fmt.Sprintf("Token requires the %s scope", scope))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/config"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/driver"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/logging"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/migrate"
+	"github.com/bayramovrahman/fastnet_vpn_bot/migrations"
+)
+
+const migrateUsage = `usage: web [--config file] migrate <command>
+
+commands:
+  up               apply all pending migrations
+  down [n]         roll back the last n migrations (default 1)
+  status           list migrations and when they were applied
+  create <name>    write an empty up/down pair into --dir
+`
+
+// migrateCommand runs the migrate subcommand and returns the process exit code
+func migrateCommand(configPath string, args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, migrateUsage)
+		return 2
+	}
+
+	if args[0] == "create" {
+		fs := flag.NewFlagSet("migrate create", flag.ContinueOnError)
+		fs.SetOutput(stderr)
+		dir := fs.String("dir", "migrations", "directory the new files are written to")
+		if err := fs.Parse(args[1:]); err != nil {
+			return 2
+		}
+		if fs.NArg() != 1 {
+			fmt.Fprint(stderr, migrateUsage)
+			return 2
+		}
+
+		paths, err := migrate.Create(*dir, fs.Arg(0), time.Now())
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		for _, p := range paths {
+			fmt.Fprintln(stdout, "created", p)
+		}
+		return 0
+	}
+
+	c, err := config.Load(configPath)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	logger, err := logging.New(stderr, c.Log.Format, c.Log.Level)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	ctx := context.Background()
+
+	db, err := driver.ConnectSQL(ctx, c.Database, logger)
+	if err != nil {
+		logger.Error("cannot connect to database", "error", err)
+		return 1
+	}
+	defer db.Close()
+
+	m, err := migrate.New(db.SQL, migrations.FS, logger)
+	if err != nil {
+		logger.Error("cannot load migrations", "error", err)
+		return 1
+	}
+
+	switch args[0] {
+	case "up":
+		n, err := m.Up(ctx)
+		if err != nil {
+			logger.Error("migrate up failed", "error", err)
+			return 1
+		}
+		fmt.Fprintf(stdout, "applied %d migration(s)\n", n)
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				fmt.Fprintf(stderr, "invalid step count %q\n", args[1])
+				return 2
+			}
+		}
+
+		n, err := m.Down(ctx, steps)
+		if errors.Is(err, migrate.ErrNoChange) {
+			fmt.Fprintln(stdout, err)
+			return 0
+		}
+		if err != nil {
+			logger.Error("migrate down failed", "error", err)
+			return 1
+		}
+		fmt.Fprintf(stdout, "rolled back %d migration(s)\n", n)
+
+	case "status":
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			logger.Error("migrate status failed", "error", err)
+			return 1
+		}
+
+		tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED AT")
+		for _, s := range statuses {
+			applied := "pending"
+			if s.Applied() {
+				applied = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\n", s.Version, s.Name, applied)
+		}
+		tw.Flush()
+
+	default:
+		fmt.Fprint(stderr, migrateUsage)
+		return 2
+	}
+
+	return 0
+}
+
+// warnPendingMigrations logs when the database schema is behind the binary
+func warnPendingMigrations(ctx context.Context, db *driver.DB) {
+	m, err := migrate.New(db.SQL, migrations.FS, app.Logger)
+	if err != nil {
+		app.Logger.Error("cannot load migrations", "error", err)
+		return
+	}
+
+	pending, err := m.Pending(ctx)
+	if err != nil {
+		app.Logger.Error("cannot check migration status", "error", err)
+		return
+	}
+	if pending > 0 {
+		app.Logger.Warn("database has pending migrations, run `migrate up`", "pending", pending)
+	}
+}
@@ -3,37 +3,112 @@ package main
 import (
 	"net/http"
 
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/agent"
 	"github.com/bayramovrahman/fastnet_vpn_bot/internal/handlers"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/helpers"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/metrics"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 )
 
 func routes() http.Handler {
 	mux := chi.NewRouter()
+	mux.Use(RequestID)
+	mux.Use(RequestLogger)
+	mux.Use(Metrics)
 	mux.Use(middleware.Recoverer)
-	mux.Use(NoSurf)
-	mux.Use(SessionLoad)
-	mux.Use(ExtendedSessionCheck)
-
-	mux.Get("/", handlers.Repo.Login)
-	mux.Get("/login", handlers.Repo.Login)
-	mux.Post("/login", handlers.Repo.PostLogin)
-	mux.Get("/verify", handlers.Repo.Verify)
-	mux.Post("/verify", handlers.Repo.PostVerify)
-	mux.Post("/resend-code", handlers.Repo.ResendCode)
-	
+
+	if cfg.Metrics.Addr == "" && cfg.Metrics.Token != "" {
+		mux.With(MetricsAuth(cfg.Metrics.Token)).Handle("/metrics", metrics.Handler())
+	}
+
+	mux.Get("/healthz", handlers.Repo.Healthz)
+	mux.Get("/readyz", handlers.Repo.Readyz)
+
+	mux.Get("/api/openapi.json", handlers.Repo.OpenAPISpec)
+	mux.Route(handlers.APIBasePath, apiRoutes)
+	mux.Get(handlers.SubscriptionPath+"{token}", handlers.Repo.SubscriptionFeed)
+
 	mux.Group(func(r chi.Router) {
-		r.Use(Auth)
-		r.Get("/home", handlers.Repo.Home)
-		r.Get("/taxes", handlers.Repo.Taxes)
-		r.Get("/logout", handlers.Repo.Logout)
-		r.Get("/profile", handlers.Repo.Profile)
-		r.Get("/invoice", handlers.Repo.Invoice)
-		r.Post("/update-security-setting", handlers.Repo.UpdateSecuritySetting)
+		r.Use(AgentAuth)
+		r.Get(agent.PeersPath, handlers.Repo.AgentPeers)
+		r.Post(agent.ReportPath, handlers.Repo.PostAgentReport)
+	})
+
+	mux.Group(func(mux chi.Router) {
+		mux.Use(NoSurf)
+		mux.Use(SessionLoad)
+		mux.Use(ExtendedSessionCheck)
+
+		mux.Get("/", handlers.Repo.Login)
+		mux.Get("/login", handlers.Repo.Login)
+		mux.Post("/login", handlers.Repo.PostLogin)
+		mux.Get("/verify", handlers.Repo.Verify)
+		mux.Post("/verify", handlers.Repo.PostVerify)
+		mux.Post("/resend-code", handlers.Repo.ResendCode)
+
+		mux.Group(func(r chi.Router) {
+			r.Use(Auth)
+			r.Get("/home", handlers.Repo.Home)
+			r.Get("/devices", handlers.Repo.Devices)
+			r.Post("/devices", handlers.Repo.PostDevice)
+			r.Post("/devices/telegram-link", handlers.Repo.PostTelegramLink)
+			r.Post("/devices/subscription-url", handlers.Repo.PostSubscriptionURL)
+			r.Get("/devices/{id}/config", handlers.Repo.DeviceConfig)
+			r.Get("/devices/{id}/qr", handlers.Repo.DeviceQRCode)
+			r.Post("/devices/{id}/rename", handlers.Repo.PostRenameDevice)
+			r.Post("/devices/{id}/reissue", handlers.Repo.PostReissueDevice)
+			r.Post("/devices/{id}/move", handlers.Repo.PostMoveDevice)
+			r.Post("/devices/{id}/revoke", handlers.Repo.PostRevokeDevice)
+			r.Get("/plans", handlers.Repo.Plans)
+			r.Get("/taxes", handlers.Repo.Taxes)
+			r.Get("/logout", handlers.Repo.Logout)
+			r.Get("/profile", handlers.Repo.Profile)
+			r.Get("/invoice", handlers.Repo.Invoice)
+			r.Post("/update-security-setting", handlers.Repo.UpdateSecuritySetting)
+			r.Post("/profile/api-tokens", handlers.Repo.PostCreateAPIToken)
+			r.Post("/profile/api-tokens/{id}/revoke", handlers.Repo.PostRevokeAPIToken)
+			r.Post("/profile/notifications", handlers.Repo.PostNotificationPreferences)
+			r.Get("/notifications", handlers.Repo.Notifications)
+			r.Post("/notifications/read", handlers.Repo.PostMarkNotificationsRead)
+
+			r.Route("/admin", func(r chi.Router) {
+				r.Use(Admin)
+				r.Get("/outbox", handlers.Repo.AdminOutbox)
+				r.Post("/outbox/{id}/retry", handlers.Repo.PostRetryOutboxMessage)
+				r.Get("/nodes", handlers.Repo.AdminNodes)
+				r.Get("/nodes/new", handlers.Repo.AdminNewNode)
+				r.Post("/nodes", handlers.Repo.PostAdminNode)
+				r.Get("/nodes/{id}", handlers.Repo.AdminEditNode)
+				r.Post("/nodes/{id}", handlers.Repo.PostAdminUpdateNode)
+				r.Post("/nodes/{id}/delete", handlers.Repo.PostAdminDeleteNode)
+				r.Post("/nodes/{id}/agent-token", handlers.Repo.PostAdminNodeAgentToken)
+				r.Get("/quotas", handlers.Repo.AdminQuotas)
+				r.Get("/users/{id}/quota", handlers.Repo.AdminUserQuota)
+				r.Post("/users/{id}/quota", handlers.Repo.PostAdminUserQuota)
+				r.Post("/users/{id}/plans", handlers.Repo.PostAdminPurchasePlan)
+				r.Post("/users/{id}/topups", handlers.Repo.PostAdminTopUp)
+			})
+		})
 	})
 
 	fileServer := http.FileServer(http.Dir("./static/"))
 	mux.Handle("/static/*", http.StripPrefix("/static", fileServer))
 
 	return mux
-}
\ No newline at end of file
+}
+
+// apiRoutes registers the versioned JSON API from handlers.APIOperations. It is
+// authenticated with personal bearer tokens, so it sits outside the session and
+// CSRF middleware.
+func apiRoutes(r chi.Router) {
+	r.Use(APIAuth)
+
+	for _, op := range handlers.Repo.APIOperations() {
+		r.With(RequireScope(op.Scope)).Method(op.Method, op.Pattern, op.Handler)
+	}
+
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		helpers.ErrorJSON(w, http.StatusNotFound, "not_found", "Endpoint not found")
+	})
+}
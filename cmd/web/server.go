@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/config"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/metrics"
+)
+
+// newServer builds the HTTP server for handler listening on addr
+func newServer(cfg config.HTTPConfig, addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+		ErrorLog:          slog.NewLogLogger(app.Logger.Handler(), slog.LevelError),
+	}
+}
+
+// newAdminServer builds the listener serving operational endpoints such as /metrics
+func newAdminServer(cfg config.HTTPConfig, addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+
+	return newServer(cfg, addr, mux)
+}
+
+// serve runs servers until ctx is done or one of them fails, then drains in-flight
+// requests and stops the background workers, giving both shutdownTimeout to finish
+func serve(ctx context.Context, shutdownTimeout time.Duration, servers ...*http.Server) error {
+	serverErr := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			serverErr <- srv.ListenAndServe()
+		}(srv)
+	}
+
+	var result error
+	select {
+	case err := <-serverErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			result = err
+		}
+	case <-ctx.Done():
+	}
+
+	app.Logger.Info("shutting down, draining connections", "timeout", shutdownTimeout)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	for _, srv := range servers {
+		err := srv.Shutdown(shutdownCtx)
+		if err != nil {
+			app.Logger.Error("HTTP server did not shut down cleanly", "addr", srv.Addr, "error", err)
+			_ = srv.Close()
+		}
+	}
+
+	err := app.Workers.Stop(shutdownCtx)
+	if err != nil {
+		app.Logger.Error("background workers did not stop in time", "error", err)
+	}
+
+	return result
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/config"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/email"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/handlers"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/helpers"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/notify"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/outbox"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/pki"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/quota"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/render"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/repository/dbrepo"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/vpn"
+)
+
+func TestMain(m *testing.M) {
+	// templates and static files are resolved relative to the repository root
+	if err := os.Chdir("../.."); err != nil {
+		panic(err)
+	}
+
+	os.Exit(m.Run())
+}
+
+// setupTestApp wires the package globals the way run does, but with an
+// in-memory repository and e-mail that is kept in memory. Handlers queue
+// e-mail; it reaches the mailer once the returned dispatcher runs.
+func setupTestApp(t *testing.T) (*dbrepo.TestingRepo, *email.MemoryMailer, *outbox.Dispatcher) {
+	t.Helper()
+
+	app.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	app.InProduction = false
+	app.WireGuard = vpn.ServerConfig{Endpoint: "vpn.example.com:51820", PublicKey: "server-key", Subnet: "10.8.0.0/24"}
+	app.PKIKey = bytes.Repeat([]byte{7}, pki.KeySize)
+
+	session = scs.New()
+	app.Session = session
+
+	templateCache, err := render.CreateTemplateCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.TemplateCache = templateCache
+	app.UseCache = true
+
+	repo := dbrepo.NewTestingRepo(&app)
+	mailer := email.NewMemoryMailer()
+	mailTemplates, err := email.ParseTemplates("./templates/email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	outboxCfg := config.Defaults().Outbox
+	queue := outbox.NewQueue(repo, outboxCfg, app.Logger)
+	emailService := email.NewService(queue, mailTemplates, "Fastnet VPN <no-reply@example.com>", app.Logger)
+	dispatcher := outbox.NewDispatcher(repo, mailer, outboxCfg, app.Logger)
+
+	notifyTemplates, err := notify.ParseTemplates("./templates/notifications")
+	if err != nil {
+		t.Fatal(err)
+	}
+	notifier := notify.NewNotifier(repo, notifyTemplates, emailService, app.Logger)
+	notifier.Telegram = queue
+
+	enforcer := quota.NewEnforcer(repo, notifier, config.Defaults().Quota, app.Logger)
+
+	handlers.NewHandlers(&handlers.Repository{App: &app, DB: repo, EmailService: emailService, Notifier: notifier, Quota: enforcer})
+	render.NewTemplates(&app, repo)
+	helpers.NewHelpers(&app)
+
+	return repo, mailer, dispatcher
+}
@@ -0,0 +1,191 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/worker"
+)
+
+// Panel is the side of the panel the agent talks to, see Client
+type Panel interface {
+	DesiredState(ctx context.Context) (DesiredState, error)
+	Report(ctx context.Context, report Report) error
+}
+
+// Agent reconciles the interface behind Backend with the peers Panel assigns
+// to the node
+type Agent struct {
+	Panel    Panel
+	Backend  Backend
+	Interval time.Duration
+	Logger   *slog.Logger
+	// OpenVPN is nil on nodes that do not serve OpenVPN
+	OpenVPN *OpenVPNFiles
+}
+
+// New returns an Agent reconciling every interval
+func New(panel Panel, backend Backend, interval time.Duration, logger *slog.Logger) *Agent {
+	return &Agent{
+		Panel:    panel,
+		Backend:  backend,
+		Interval: interval,
+		Logger:   logger,
+	}
+}
+
+// Run reconciles every Interval until ctx is done
+func (a *Agent) Run(ctx context.Context) error {
+	return worker.Every(ctx, a.Interval, func(ctx context.Context) {
+		report, err := a.Reconcile(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				a.Logger.ErrorContext(ctx, "reconcile failed", "error", err)
+			}
+			return
+		}
+		a.Logger.DebugContext(ctx, "reconciled", "peers", report.Peers)
+	})
+}
+
+// Reconcile fetches the desired peers, applies the difference to the interface
+// and reports the result to the panel. When the panel cannot be reached the
+// interface is left as it is, so the node keeps serving its current peers.
+func (a *Agent) Reconcile(ctx context.Context) (Report, error) {
+	desired, err := a.Panel.DesiredState(ctx)
+	if err != nil {
+		return Report{}, fmt.Errorf("fetch desired state: %w", err)
+	}
+
+	report, applyErr := a.apply(ctx, desired)
+	if applyErr != nil {
+		report.Error = applyErr.Error()
+	}
+
+	err = a.Panel.Report(ctx, report)
+	if applyErr != nil {
+		return report, applyErr
+	}
+	if err != nil {
+		return report, fmt.Errorf("report: %w", err)
+	}
+
+	return report, nil
+}
+
+// apply configures the interface, the inbounds and the OpenVPN certificates
+// with desired and reads back their state
+func (a *Agent) apply(ctx context.Context, desired DesiredState) (Report, error) {
+	if b, ok := a.Backend.(InboundBackend); ok {
+		err := b.ConfigureInbounds(ctx, desired.Xray)
+		if err != nil {
+			return Report{}, err
+		}
+	}
+
+	switch {
+	case a.OpenVPN != nil:
+		err := a.OpenVPN.Configure(ctx, desired.OpenVPN)
+		if err != nil {
+			return Report{}, err
+		}
+	case desired.OpenVPN != nil:
+		return Report{}, errors.New("the node serves OpenVPN, configure AGENT_OPENVPN_DIR on the node")
+	}
+
+	current, err := a.Backend.Peers(ctx)
+	if err != nil {
+		return Report{}, err
+	}
+
+	upsert, remove := diff(desired.Peers, current)
+	if len(upsert) > 0 || len(remove) > 0 {
+		err = a.Backend.Configure(ctx, upsert, remove)
+		if err != nil {
+			return Report{Peers: len(current), Handshakes: handshakes(current), Counters: counters(current, nil)}, err
+		}
+		a.Logger.InfoContext(ctx, "interface updated", "added_or_changed", len(upsert), "removed", len(remove))
+
+		before := current
+		current, err = a.Backend.Peers(ctx)
+		if err != nil {
+			return Report{}, err
+		}
+
+		// the counters of removed peers are gone from the interface; report
+		// them as last read so their final traffic is still accounted
+		return Report{Applied: true, Peers: len(current), Handshakes: handshakes(current), Counters: counters(current, before), Removed: remove}, nil
+	}
+
+	return Report{Applied: true, Peers: len(current), Handshakes: handshakes(current), Counters: counters(current, nil)}, nil
+}
+
+// diff returns the peers of desired that are missing from current or differ,
+// and the public keys of the peers in current that are not desired
+func diff(desired, current []Peer) (upsert []Peer, remove []string) {
+	have := make(map[string]Peer, len(current))
+	for _, p := range current {
+		have[p.PublicKey] = p
+	}
+
+	want := make(map[string]bool, len(desired))
+	for _, p := range desired {
+		want[p.PublicKey] = true
+
+		c, ok := have[p.PublicKey]
+		if !ok || c.Protocol != p.Protocol || c.PresharedKey != p.PresharedKey || !sameIPs(c.AllowedIPs, p.AllowedIPs) {
+			upsert = append(upsert, p)
+		}
+	}
+
+	for _, p := range current {
+		if !want[p.PublicKey] {
+			remove = append(remove, p.PublicKey)
+		}
+	}
+
+	return upsert, remove
+}
+
+// sameIPs reports whether a and b hold the same prefixes in any order
+func sameIPs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
+
+// handshakes returns the handshakes of the peers that connected at least once
+func handshakes(peers []Peer) []Handshake {
+	out := []Handshake{}
+	for _, p := range peers {
+		if !p.LastHandshake.IsZero() {
+			out = append(out, Handshake{PublicKey: p.PublicKey, At: p.LastHandshake})
+		}
+	}
+	return out
+}
+
+// counters returns the byte counters of peers, followed by those of the peers
+// in removed that are no longer among peers
+func counters(peers, removed []Peer) []Counter {
+	out := make([]Counter, 0, len(peers))
+	have := make(map[string]bool, len(peers))
+	for _, p := range peers {
+		have[p.PublicKey] = true
+		out = append(out, Counter{PublicKey: p.PublicKey, RxBytes: p.ReceiveBytes, TxBytes: p.TransmitBytes})
+	}
+	for _, p := range removed {
+		if !have[p.PublicKey] {
+			out = append(out, Counter{PublicKey: p.PublicKey, RxBytes: p.ReceiveBytes, TxBytes: p.TransmitBytes})
+		}
+	}
+	return out
+}
@@ -0,0 +1,245 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/config"
+)
+
+// fakePanel serves a fixed desired state and records the reports
+type fakePanel struct {
+	state   DesiredState
+	err     error
+	reports []Report
+}
+
+func (p *fakePanel) DesiredState(ctx context.Context) (DesiredState, error) {
+	return p.state, p.err
+}
+
+func (p *fakePanel) Report(ctx context.Context, report Report) error {
+	p.reports = append(p.reports, report)
+	return nil
+}
+
+func newTestAgent(panel Panel, backend Backend) *Agent {
+	return New(panel, backend, time.Minute, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func TestDiff(t *testing.T) {
+	current := []Peer{
+		{PublicKey: "kept", AllowedIPs: []string{"10.9.0.2/32", "fd00::2/128"}},
+		{PublicKey: "moved", AllowedIPs: []string{"10.9.0.3/32"}},
+		{PublicKey: "rekeyed", PresharedKey: "old", AllowedIPs: []string{"10.9.0.4/32"}},
+		{PublicKey: "gone", AllowedIPs: []string{"10.9.0.5/32"}},
+	}
+	desired := []Peer{
+		{PublicKey: "kept", AllowedIPs: []string{"fd00::2/128", "10.9.0.2/32"}},
+		{PublicKey: "moved", AllowedIPs: []string{"10.9.0.6/32"}},
+		{PublicKey: "rekeyed", PresharedKey: "new", AllowedIPs: []string{"10.9.0.4/32"}},
+		{PublicKey: "new", AllowedIPs: []string{"10.9.0.7/32"}},
+	}
+
+	upsert, remove := diff(desired, current)
+
+	var upserted []string
+	for _, p := range upsert {
+		upserted = append(upserted, p.PublicKey)
+	}
+	if len(upserted) != 3 || upserted[0] != "moved" || upserted[1] != "rekeyed" || upserted[2] != "new" {
+		t.Errorf("expected moved, rekeyed and new to be configured, got %v", upserted)
+	}
+	if len(remove) != 1 || remove[0] != "gone" {
+		t.Errorf("expected gone to be removed, got %v", remove)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemoryBackend()
+	if err := backend.Configure(ctx, []Peer{{PublicKey: "stale", AllowedIPs: []string{"10.9.0.9/32"}}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	panel := &fakePanel{state: DesiredState{NodeID: 1, Peers: []Peer{
+		{PublicKey: "laptop", PresharedKey: "psk", AllowedIPs: []string{"10.9.0.2/32"}},
+		{PublicKey: "phone", AllowedIPs: []string{"10.9.0.3/32"}},
+	}}}
+	a := newTestAgent(panel, backend)
+
+	report, err := a.Reconcile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Applied || report.Peers != 2 || len(report.Handshakes) != 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	peers, err := backend.Peers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 || peers[0].PublicKey != "laptop" || peers[0].PresharedKey != "psk" || peers[1].PublicKey != "phone" {
+		t.Fatalf("unexpected peers on the interface %+v", peers)
+	}
+
+	handshake := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	backend.SetHandshake("phone", handshake)
+
+	report, err = a.Reconcile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Handshakes) != 1 || report.Handshakes[0].PublicKey != "phone" || !report.Handshakes[0].At.Equal(handshake) {
+		t.Fatalf("expected the phone's handshake to be reported, got %+v", report.Handshakes)
+	}
+	if len(panel.reports) != 2 {
+		t.Fatalf("expected a report per reconcile, got %d", len(panel.reports))
+	}
+}
+
+func TestReconcileReportsCounters(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemoryBackend()
+	panel := &fakePanel{state: DesiredState{Peers: []Peer{
+		{PublicKey: "laptop", AllowedIPs: []string{"10.9.0.2/32"}},
+		{PublicKey: "phone", AllowedIPs: []string{"10.9.0.3/32"}},
+	}}}
+	a := newTestAgent(panel, backend)
+
+	if _, err := a.Reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	backend.AddTraffic("laptop", 100, 2000)
+	backend.AddTraffic("phone", 10, 300)
+
+	// the phone is removed, its last counters are still reported
+	panel.state.Peers = panel.state.Peers[:1]
+	report, err := a.Reconcile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Counter{
+		{PublicKey: "laptop", RxBytes: 100, TxBytes: 2000},
+		{PublicKey: "phone", RxBytes: 10, TxBytes: 300},
+	}
+	if len(report.Counters) != len(want) {
+		t.Fatalf("expected counters %+v, got %+v", want, report.Counters)
+	}
+	for i := range want {
+		if report.Counters[i] != want[i] {
+			t.Errorf("expected counters %+v, got %+v", want, report.Counters)
+		}
+	}
+	if len(report.Removed) != 1 || report.Removed[0] != "phone" {
+		t.Errorf("expected the phone reported removed, got %v", report.Removed)
+	}
+
+	report, err = a.Reconcile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Counters) != 1 || len(report.Removed) != 0 {
+		t.Errorf("expected only the laptop on the next report, got %+v", report)
+	}
+}
+
+func TestReconcileReportsBackendErrors(t *testing.T) {
+	backend := NewMemoryBackend()
+	backend.SetError(errors.New("no such device"))
+
+	panel := &fakePanel{state: DesiredState{Peers: []Peer{{PublicKey: "laptop", AllowedIPs: []string{"10.9.0.2/32"}}}}}
+
+	_, err := newTestAgent(panel, backend).Reconcile(context.Background())
+	if err == nil {
+		t.Fatal("expected the backend error")
+	}
+	if len(panel.reports) != 1 || panel.reports[0].Applied || panel.reports[0].Error != "no such device" {
+		t.Fatalf("expected a failed report, got %+v", panel.reports)
+	}
+}
+
+func TestReconcileKeepsPeersWhenPanelIsDown(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemoryBackend()
+	if err := backend.Configure(ctx, []Peer{{PublicKey: "laptop", AllowedIPs: []string{"10.9.0.2/32"}}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	panel := &fakePanel{err: errors.New("connection refused")}
+	if _, err := newTestAgent(panel, backend).Reconcile(ctx); err == nil {
+		t.Fatal("expected the panel error")
+	}
+
+	peers, err := backend.Peers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 {
+		t.Fatalf("expected the interface to be left alone, got %+v", peers)
+	}
+}
+
+func TestClient(t *testing.T) {
+	var report Report
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer fnn_secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":{"code":"invalid_token","message":"Token is invalid or was replaced"}}`))
+			return
+		}
+
+		switch r.Method + " " + r.URL.Path {
+		case "GET " + PeersPath:
+			w.Write([]byte(`{"data":{"node_id":7,"peers":[{"public_key":"laptop","allowed_ips":["10.9.0.2/32"]}]}}`))
+		case "POST " + ReportPath:
+			if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+				t.Error(err)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	cfg := config.AgentDefaults()
+	cfg.PanelURL = server.URL + "/"
+	cfg.Token = "fnn_secret"
+	client, err := NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := client.DesiredState(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.NodeID != 7 || len(state.Peers) != 1 || state.Peers[0].AllowedIPs[0] != "10.9.0.2/32" {
+		t.Fatalf("unexpected desired state %+v", state)
+	}
+
+	err = client.Report(context.Background(), Report{Applied: true, Peers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Applied || report.Peers != 1 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	client.Token = "fnn_wrong"
+	_, err = client.DesiredState(context.Background())
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusUnauthorized || apiErr.Code != "invalid_token" {
+		t.Fatalf("expected an invalid_token error, got %v", err)
+	}
+}
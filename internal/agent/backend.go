@@ -0,0 +1,136 @@
+package agent
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backend reads and configures the peers the node serves: those of its
+// WireGuard interface, of its Xray inbounds, or of both
+type Backend interface {
+	// Peers returns the peers configured on the interface
+	Peers(ctx context.Context) ([]Peer, error)
+	// Configure adds or updates the peers in upsert and removes the peers whose
+	// public keys are in remove, leaving every other peer untouched
+	Configure(ctx context.Context, upsert []Peer, remove []string) error
+}
+
+// InboundBackend is a Backend that also runs the server side of the Xray
+// protocols, which the panel sends along with the peers
+type InboundBackend interface {
+	Backend
+	// ConfigureInbounds sets the inbounds to serve, nil for none. It is
+	// called before every Configure and should only restart the server when
+	// the inbounds changed.
+	ConfigureInbounds(ctx context.Context, inbounds *Xray) error
+}
+
+// MemoryBackend is a Backend keeping its peers in memory, for tests and for
+// trying the agent against a panel without touching a real interface
+type MemoryBackend struct {
+	mu       sync.Mutex
+	peers    map[string]Peer
+	inbounds *Xray
+	err      error
+}
+
+// NewMemoryBackend returns a MemoryBackend without peers
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{peers: map[string]Peer{}}
+}
+
+// Peers returns the peers in public key order
+func (b *MemoryBackend) Peers(ctx context.Context) ([]Peer, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	peers := slices.Collect(maps.Values(b.peers))
+	slices.SortFunc(peers, func(a, b Peer) int {
+		return strings.Compare(a.PublicKey, b.PublicKey)
+	})
+	return peers, nil
+}
+
+// Configure applies the changes like a real interface would, keeping the
+// handshake and counters of updated peers
+func (b *MemoryBackend) Configure(ctx context.Context, upsert []Peer, remove []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.err != nil {
+		return b.err
+	}
+
+	for _, key := range remove {
+		delete(b.peers, key)
+	}
+	for _, p := range upsert {
+		p.AllowedIPs = slices.Clone(p.AllowedIPs)
+		old := b.peers[p.PublicKey]
+		p.LastHandshake = old.LastHandshake
+		p.ReceiveBytes, p.TransmitBytes = old.ReceiveBytes, old.TransmitBytes
+		b.peers[p.PublicKey] = p
+	}
+
+	return nil
+}
+
+// ConfigureInbounds keeps inbounds, see Inbounds
+func (b *MemoryBackend) ConfigureInbounds(ctx context.Context, inbounds *Xray) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.err != nil {
+		return b.err
+	}
+
+	b.inbounds = inbounds
+	return nil
+}
+
+// Inbounds returns the inbounds last configured
+func (b *MemoryBackend) Inbounds() *Xray {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.inbounds
+}
+
+// SetHandshake records a handshake of the peer, as if it had connected
+func (b *MemoryBackend) SetHandshake(publicKey string, at time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if p, ok := b.peers[publicKey]; ok {
+		p.LastHandshake = at
+		b.peers[publicKey] = p
+	}
+}
+
+// AddTraffic counts rx bytes received from and tx bytes sent to the peer
+func (b *MemoryBackend) AddTraffic(publicKey string, rx, tx int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if p, ok := b.peers[publicKey]; ok {
+		p.ReceiveBytes += rx
+		p.TransmitBytes += tx
+		b.peers[publicKey] = p
+	}
+}
+
+// SetError makes every following call fail with err, or succeed again when err is nil
+func (b *MemoryBackend) SetError(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.err = err
+}
@@ -0,0 +1,132 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/config"
+)
+
+// Client talks to the agent API of the panel, authenticating with the node's
+// agent token and, when configured, a client certificate
+type Client struct {
+	BaseURL    string
+	Token      string
+	HTTPClient *http.Client
+}
+
+// NewClient returns a Client for the panel and credentials configured in cfg
+func NewClient(cfg config.AgentConfig) (*Client, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA file: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+	}
+
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &Client{
+		BaseURL:    strings.TrimSuffix(cfg.PanelURL, "/"),
+		Token:      cfg.Token,
+		HTTPClient: &http.Client{Timeout: cfg.Timeout, Transport: transport},
+	}, nil
+}
+
+// APIError is an error answered by the panel
+type APIError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("panel: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// DesiredState fetches the peers the node should serve
+func (c *Client) DesiredState(ctx context.Context) (DesiredState, error) {
+	var state DesiredState
+	err := c.do(ctx, http.MethodGet, PeersPath, nil, &state)
+	return state, err
+}
+
+// Report posts the outcome of a reconcile
+func (c *Client) Report(ctx context.Context, report Report) error {
+	return c.do(ctx, http.MethodPost, ReportPath, report, nil)
+}
+
+// do sends in as JSON, if not nil, and decodes the response into out, if not nil
+func (c *Client) do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var envelope struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		_ = json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&envelope)
+		return &APIError{Status: resp.StatusCode, Code: envelope.Error.Code, Message: envelope.Error.Message}
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	var envelope struct {
+		Data json.RawMessage `json:"data"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&envelope)
+	if err != nil {
+		return fmt.Errorf("decoding %s response: %w", path, err)
+	}
+	return json.Unmarshal(envelope.Data, out)
+}
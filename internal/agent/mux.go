@@ -0,0 +1,97 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Multiplexer is the Backend of a node serving WireGuard and, when Xray is set,
+// the Xray protocols: it hands each peer to the backend of its protocol
+type Multiplexer struct {
+	WireGuard Backend
+	// Xray is nil on nodes serving WireGuard only
+	Xray InboundBackend
+}
+
+// Peers returns the WireGuard peers followed by the Xray peers
+func (m *Multiplexer) Peers(ctx context.Context) ([]Peer, error) {
+	peers, err := m.WireGuard.Peers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range peers {
+		peers[i].Protocol = ""
+	}
+
+	if m.Xray == nil {
+		return peers, nil
+	}
+	xray, err := m.Xray.Peers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("xray: %w", err)
+	}
+
+	return append(peers, xray...), nil
+}
+
+// Configure configures each backend with its share of the changes. Peers of a
+// protocol without a backend are left out and reported in the error, after
+// the others are applied.
+func (m *Multiplexer) Configure(ctx context.Context, upsert []Peer, remove []string) error {
+	var wgUpsert, xrayUpsert []Peer
+	var errs []error
+	for _, p := range upsert {
+		switch {
+		case p.Protocol == "":
+			wgUpsert = append(wgUpsert, p)
+		case m.Xray != nil:
+			xrayUpsert = append(xrayUpsert, p)
+		default:
+			errs = append(errs, fmt.Errorf("peer %s: no backend serves %s, configure Xray on the node", p.PublicKey, p.Protocol))
+		}
+	}
+
+	xrayKeys := map[string]bool{}
+	if m.Xray != nil {
+		peers, err := m.Xray.Peers(ctx)
+		if err != nil {
+			return fmt.Errorf("xray: %w", err)
+		}
+		for _, p := range peers {
+			xrayKeys[p.PublicKey] = true
+		}
+	}
+	var wgRemove, xrayRemove []string
+	for _, key := range remove {
+		if xrayKeys[key] {
+			xrayRemove = append(xrayRemove, key)
+		} else {
+			wgRemove = append(wgRemove, key)
+		}
+	}
+
+	if len(wgUpsert) > 0 || len(wgRemove) > 0 {
+		err := m.WireGuard.Configure(ctx, wgUpsert, wgRemove)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(xrayUpsert) > 0 || len(xrayRemove) > 0 {
+		err := m.Xray.Configure(ctx, xrayUpsert, xrayRemove)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("xray: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// ConfigureInbounds hands inbounds to the Xray backend. Without one they are
+// ignored; the peers needing them fail in Configure.
+func (m *Multiplexer) ConfigureInbounds(ctx context.Context, inbounds *Xray) error {
+	if m.Xray == nil {
+		return nil
+	}
+	return m.Xray.ConfigureInbounds(ctx, inbounds)
+}
@@ -0,0 +1,122 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Files the OpenVPN server of the node is configured with, in OpenVPNFiles.Dir:
+//
+//	ca ca.crt
+//	cert server.crt
+//	key server.key
+//	crl-verify crl.pem
+const (
+	OpenVPNCAFile   = "ca.crt"
+	OpenVPNCertFile = "server.crt"
+	OpenVPNKeyFile  = "server.key"
+	OpenVPNCRLFile  = "crl.pem"
+)
+
+// OpenVPNFiles keeps the certificates the OpenVPN server of the node reads in
+// line with the panel. The server accepts every certificate of the panel's
+// authority, so there are no peers to configure: devices are taken away by
+// the revocation list, which OpenVPN reads again on every connection and
+// renegotiation. The server is restarted only when its own certificate, its
+// key or the authority changed.
+type OpenVPNFiles struct {
+	Dir string
+	// Restart is the command restarting OpenVPN, e.g. systemctl restart openvpn-server@server
+	Restart []string
+
+	// run runs a command and returns its standard output
+	run func(ctx context.Context, name string, args ...string) ([]byte, error)
+}
+
+// NewOpenVPNFiles returns an OpenVPNFiles writing into dir
+func NewOpenVPNFiles(dir string, restart []string) *OpenVPNFiles {
+	return &OpenVPNFiles{
+		Dir:     dir,
+		Restart: restart,
+		run:     runCommand,
+	}
+}
+
+// Configure writes the files of server that changed. A nil server leaves the
+// files as they are; stop OpenVPN on nodes that no longer serve it.
+func (f *OpenVPNFiles) Configure(ctx context.Context, server *OpenVPN) error {
+	if server == nil {
+		return nil
+	}
+	if server.CA == "" || server.Certificate == "" || server.PrivateKey == "" || server.CRL == "" {
+		return errors.New("openvpn: the panel sent an incomplete server")
+	}
+
+	var restart bool
+	for _, file := range []struct {
+		name string
+		data string
+		perm fs.FileMode
+	}{
+		{OpenVPNCAFile, server.CA, 0o644},
+		{OpenVPNCertFile, server.Certificate, 0o644},
+		{OpenVPNKeyFile, server.PrivateKey, 0o600},
+	} {
+		changed, err := replaceFile(filepath.Join(f.Dir, file.name), []byte(file.data), file.perm)
+		if err != nil {
+			return fmt.Errorf("openvpn: %w", err)
+		}
+		restart = restart || changed
+	}
+
+	// OpenVPN reads the CRL after dropping its privileges
+	_, err := replaceFile(filepath.Join(f.Dir, OpenVPNCRLFile), []byte(server.CRL), 0o644)
+	if err != nil {
+		return fmt.Errorf("openvpn: %w", err)
+	}
+
+	if !restart || len(f.Restart) == 0 {
+		return nil
+	}
+	_, err = f.run(ctx, f.Restart[0], f.Restart[1:]...)
+	if err != nil {
+		return fmt.Errorf("restart openvpn: %w", err)
+	}
+	return nil
+}
+
+// replaceFile atomically replaces the file at path with data unless it holds
+// data already, and reports whether it did
+func replaceFile(path string, data []byte, perm fs.FileMode) (bool, error) {
+	current, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	if err == nil && bytes.Equal(current, data) {
+		return false, nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, os.Rename(tmp.Name(), path)
+}
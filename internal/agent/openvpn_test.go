@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOpenVPNFiles(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeXray{}
+	f := NewOpenVPNFiles(t.TempDir(), []string{"systemctl", "restart", "openvpn-server@server"})
+	f.run = fake.run
+
+	if err := f.Configure(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(f.Dir); len(entries) != 0 || len(fake.commands) != 0 {
+		t.Fatalf("expected nothing done without a server, got %v and %v", entries, fake.commands)
+	}
+
+	server := &OpenVPN{Port: 1194, CA: "ca", Certificate: "cert", PrivateKey: "key", CRL: "crl 1"}
+	if err := f.Configure(ctx, server); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		OpenVPNCAFile:   "ca",
+		OpenVPNCertFile: "cert",
+		OpenVPNKeyFile:  "key",
+		OpenVPNCRLFile:  "crl 1",
+	} {
+		data, err := os.ReadFile(filepath.Join(f.Dir, name))
+		if err != nil || string(data) != want {
+			t.Errorf("expected %s to hold %q, got %q, %v", name, want, data, err)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(f.Dir, OpenVPNKeyFile)); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("expected the key readable by its owner only, got %v", info.Mode())
+	}
+	if len(fake.commands) != 1 || fake.commands[0] != "systemctl restart openvpn-server@server" {
+		t.Fatalf("expected one restart, got %v", fake.commands)
+	}
+
+	// OpenVPN reads a new CRL without a restart
+	server.CRL = "crl 2"
+	if err := f.Configure(ctx, server); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(f.Dir, OpenVPNCRLFile)); string(data) != "crl 2" {
+		t.Errorf("expected the new CRL, got %q", data)
+	}
+	if len(fake.commands) != 1 {
+		t.Errorf("expected no restart for a new CRL, got %v", fake.commands)
+	}
+
+	server.Certificate = "renewed"
+	if err := f.Configure(ctx, server); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.commands) != 2 {
+		t.Errorf("expected a restart for a new certificate, got %v", fake.commands)
+	}
+
+	if err := f.Configure(ctx, &OpenVPN{Port: 1194, CA: "ca"}); err == nil {
+		t.Error("expected an incomplete server to be refused")
+	}
+}
+
+func TestReconcileNeedsOpenVPNFiles(t *testing.T) {
+	panel := &fakePanel{state: DesiredState{OpenVPN: &OpenVPN{Port: 1194, CA: "ca", Certificate: "cert", PrivateKey: "key", CRL: "crl"}}}
+
+	_, err := newTestAgent(panel, NewMemoryBackend()).Reconcile(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "AGENT_OPENVPN_DIR") {
+		t.Fatalf("expected the agent to ask for AGENT_OPENVPN_DIR, got %v", err)
+	}
+	if len(panel.reports) != 1 || panel.reports[0].Applied {
+		t.Fatalf("expected a failed report, got %+v", panel.reports)
+	}
+}
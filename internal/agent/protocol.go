@@ -0,0 +1,114 @@
+// Package agent keeps the WireGuard interface, the Xray inbounds and the
+// OpenVPN certificates of a VPN node in line with the peers the panel assigned
+// to the node, and reports back what it applied
+package agent
+
+import "time"
+
+// Paths of the agent API on the panel, relative to its base URL
+const (
+	PeersPath  = "/agent/v1/peers"
+	ReportPath = "/agent/v1/report"
+)
+
+// Protocols of the peers served through Xray. WireGuard peers leave
+// Peer.Protocol empty.
+const (
+	ProtocolVLESS       = "vless"
+	ProtocolShadowsocks = "shadowsocks"
+)
+
+// Peer is a peer as the panel assigns it and a Backend configures it. For
+// VLESS and Shadowsocks peers PublicKey is the user ID or key and AllowedIPs
+// is empty.
+type Peer struct {
+	Protocol     string   `json:"protocol,omitempty"`
+	PublicKey    string   `json:"public_key"`
+	PresharedKey string   `json:"preshared_key,omitempty"`
+	AllowedIPs   []string `json:"allowed_ips"`
+	// LastHandshake is read from the interface; zero until the peer connects
+	// and for protocols without handshakes
+	LastHandshake time.Time `json:"-"`
+	// ReceiveBytes and TransmitBytes are the byte counters of the interface
+	// for the peer. They start over when the peer is re-added or the
+	// interface is recreated.
+	ReceiveBytes  int64 `json:"-"`
+	TransmitBytes int64 `json:"-"`
+}
+
+// DesiredState is the panel's answer to GET PeersPath: every peer the node
+// should serve. Peers missing from it are removed from the interface.
+type DesiredState struct {
+	NodeID int    `json:"node_id"`
+	Peers  []Peer `json:"peers"`
+	// Xray holds the inbounds the node serves VLESS and Shadowsocks peers
+	// on; nil when it serves WireGuard only
+	Xray *Xray `json:"xray,omitempty"`
+	// OpenVPN is the OpenVPN server of the node, nil when it serves none.
+	// OpenVPN peers are not among Peers; see OpenVPNFiles.
+	OpenVPN *OpenVPN `json:"openvpn,omitempty"`
+}
+
+// Xray is the server side of the protocols served through Xray. A nil
+// inbound is not served.
+type Xray struct {
+	VLESS       *VLESSInbound       `json:"vless,omitempty"`
+	Shadowsocks *ShadowsocksInbound `json:"shadowsocks,omitempty"`
+}
+
+// VLESSInbound serves VLESS over Reality, passing for TLS to ServerName
+type VLESSInbound struct {
+	Port       int    `json:"port"`
+	ServerName string `json:"server_name"`
+	PrivateKey string `json:"private_key"`
+	ShortID    string `json:"short_id"`
+}
+
+// ShadowsocksInbound serves Shadowsocks-2022 with Method. Key is the server
+// key; each peer brings its own user key.
+type ShadowsocksInbound struct {
+	Port   int    `json:"port"`
+	Method string `json:"method"`
+	Key    string `json:"key"`
+}
+
+// OpenVPN is the server side of OpenVPN: the authority, the certificate and
+// key the server presents, and the revocation list of the authority, all PEM
+// encoded
+type OpenVPN struct {
+	Port        int    `json:"port"`
+	CA          string `json:"ca"`
+	Certificate string `json:"certificate"`
+	PrivateKey  string `json:"private_key"`
+	CRL         string `json:"crl"`
+}
+
+// Report is posted to ReportPath after every reconcile
+type Report struct {
+	// Applied is false when the interface could not be read or configured
+	Applied bool `json:"applied"`
+	// Peers is the number of peers on the interface
+	Peers      int         `json:"peers"`
+	Error      string      `json:"error,omitempty"`
+	Handshakes []Handshake `json:"handshakes"`
+	// Counters holds the byte counters of every peer on the interface, and of
+	// the peers removed since they were last read
+	Counters []Counter `json:"counters"`
+	// Removed holds the public keys taken off the interface by this
+	// reconcile. The panel confirms revoked keys gone by them.
+	Removed []string `json:"removed,omitempty"`
+}
+
+// Handshake is the latest handshake of a peer
+type Handshake struct {
+	PublicKey string    `json:"public_key"`
+	At        time.Time `json:"at"`
+}
+
+// Counter is the byte counters of a peer, as the node sees them: RxBytes were
+// received from the peer, TxBytes sent to it
+type Counter struct {
+	PublicKey string `json:"public_key"`
+	RxBytes   int64  `json:"rx_bytes"`
+	TxBytes   int64  `json:"tx_bytes"`
+}
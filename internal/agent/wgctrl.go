@@ -0,0 +1,125 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// WireGuardBackend configures a WireGuard interface through wgctrl, which talks
+// to the kernel module over netlink or to a userspace implementation over its
+// UAPI socket. The interface itself, its private key and listen port are set up
+// outside the agent, e.g. with wg-quick.
+type WireGuardBackend struct {
+	Interface string
+	client    *wgctrl.Client
+}
+
+// NewWireGuardBackend returns a WireGuardBackend for the interface named iface
+func NewWireGuardBackend(iface string) (*WireGuardBackend, error) {
+	client, err := wgctrl.New()
+	if err != nil {
+		return nil, fmt.Errorf("open wireguard control: %w", err)
+	}
+
+	return &WireGuardBackend{Interface: iface, client: client}, nil
+}
+
+// Close releases the wgctrl client
+func (b *WireGuardBackend) Close() error {
+	return b.client.Close()
+}
+
+// Peers returns the peers of the interface
+func (b *WireGuardBackend) Peers(ctx context.Context) ([]Peer, error) {
+	device, err := b.client.Device(b.Interface)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", b.Interface, err)
+	}
+
+	peers := make([]Peer, 0, len(device.Peers))
+	for _, p := range device.Peers {
+		peer := Peer{
+			PublicKey:     p.PublicKey.String(),
+			LastHandshake: p.LastHandshakeTime,
+			ReceiveBytes:  p.ReceiveBytes,
+			TransmitBytes: p.TransmitBytes,
+		}
+		if p.PresharedKey != (wgtypes.Key{}) {
+			peer.PresharedKey = p.PresharedKey.String()
+		}
+		for _, ip := range p.AllowedIPs {
+			peer.AllowedIPs = append(peer.AllowedIPs, ip.String())
+		}
+		peers = append(peers, peer)
+	}
+
+	return peers, nil
+}
+
+// Configure applies the changes in a single wgctrl call
+func (b *WireGuardBackend) Configure(ctx context.Context, upsert []Peer, remove []string) error {
+	var cfg wgtypes.Config
+
+	for _, key := range remove {
+		publicKey, err := wgtypes.ParseKey(key)
+		if err != nil {
+			return fmt.Errorf("peer %s: %w", key, err)
+		}
+		cfg.Peers = append(cfg.Peers, wgtypes.PeerConfig{PublicKey: publicKey, Remove: true})
+	}
+
+	for _, p := range upsert {
+		pc, err := peerConfig(p)
+		if err != nil {
+			return fmt.Errorf("peer %s: %w", p.PublicKey, err)
+		}
+		cfg.Peers = append(cfg.Peers, pc)
+	}
+
+	if len(cfg.Peers) == 0 {
+		return nil
+	}
+
+	err := b.client.ConfigureDevice(b.Interface, cfg)
+	if err != nil {
+		return fmt.Errorf("configure %s: %w", b.Interface, err)
+	}
+	return nil
+}
+
+// peerConfig converts p into a wgctrl peer configuration replacing its allowed IPs
+func peerConfig(p Peer) (wgtypes.PeerConfig, error) {
+	publicKey, err := wgtypes.ParseKey(p.PublicKey)
+	if err != nil {
+		return wgtypes.PeerConfig{}, err
+	}
+
+	// the zero key removes a preshared key the peer no longer has
+	var presharedKey wgtypes.Key
+	if p.PresharedKey != "" {
+		presharedKey, err = wgtypes.ParseKey(p.PresharedKey)
+		if err != nil {
+			return wgtypes.PeerConfig{}, fmt.Errorf("preshared key: %w", err)
+		}
+	}
+
+	allowedIPs := make([]net.IPNet, 0, len(p.AllowedIPs))
+	for _, cidr := range p.AllowedIPs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return wgtypes.PeerConfig{}, err
+		}
+		allowedIPs = append(allowedIPs, *ipNet)
+	}
+
+	return wgtypes.PeerConfig{
+		PublicKey:         publicKey,
+		PresharedKey:      &presharedKey,
+		ReplaceAllowedIPs: true,
+		AllowedIPs:        allowedIPs,
+	}, nil
+}
@@ -0,0 +1,459 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// xrayAPITag tags the inbound of the stats API. The inbounds serving peers are
+// tagged with their protocol.
+const xrayAPITag = "api"
+
+// The stats query is tried xrayStatsAttempts times, xrayStatsRetryDelay apart
+const (
+	xrayStatsAttempts   = 5
+	xrayStatsRetryDelay = 200 * time.Millisecond
+)
+
+// xrayFlow is the XTLS flow of VLESS clients over Reality
+const xrayFlow = "xtls-rprx-vision"
+
+// XrayBackend serves VLESS and Shadowsocks peers through Xray. It owns the
+// Xray config file: every change rewrites it and restarts Xray, which drops
+// the open connections and starts the traffic counters over. The counters are
+// read from the Xray stats API, which the config exposes on APIAddress.
+type XrayBackend struct {
+	ConfigPath string
+	APIAddress string
+	// Binary is the xray executable, used to query the stats API
+	Binary string
+	// Restart is the command restarting Xray, e.g. systemctl restart xray
+	Restart []string
+
+	// run runs a command and returns its standard output
+	run func(ctx context.Context, name string, args ...string) ([]byte, error)
+
+	mu       sync.Mutex
+	inbounds *Xray
+}
+
+// NewXrayBackend returns an XrayBackend writing configPath
+func NewXrayBackend(configPath, binary, apiAddress string, restart []string) *XrayBackend {
+	return &XrayBackend{
+		ConfigPath: configPath,
+		APIAddress: apiAddress,
+		Binary:     binary,
+		Restart:    restart,
+		run:        runCommand,
+	}
+}
+
+// runCommand runs name and returns its output, with its standard error in
+// the error when it fails
+func runCommand(ctx context.Context, name string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// Peers returns the clients of the config file with their counters
+func (b *XrayBackend) Peers(ctx context.Context) ([]Peer, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	peers, err := b.load()
+	if err != nil || len(peers) == 0 {
+		return peers, err
+	}
+
+	stats, err := b.stats(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i, p := range peers {
+		s := stats[p.PublicKey]
+		peers[i].ReceiveBytes, peers[i].TransmitBytes = s.uplink, s.downlink
+	}
+
+	return peers, nil
+}
+
+// Configure rewrites the config with the changes and restarts Xray
+func (b *XrayBackend) Configure(ctx context.Context, upsert []Peer, remove []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	peers, err := b.load()
+	if err != nil {
+		return err
+	}
+
+	byKey := make(map[string]Peer, len(peers))
+	for _, p := range peers {
+		byKey[p.PublicKey] = p
+	}
+	for _, key := range remove {
+		delete(byKey, key)
+	}
+	for _, p := range upsert {
+		if p.Protocol != ProtocolVLESS && p.Protocol != ProtocolShadowsocks {
+			return fmt.Errorf("peer %s: xray does not serve %q peers", p.PublicKey, p.Protocol)
+		}
+		byKey[p.PublicKey] = Peer{Protocol: p.Protocol, PublicKey: p.PublicKey}
+	}
+
+	return b.write(ctx, slices.Collect(maps.Values(byKey)))
+}
+
+// ConfigureInbounds sets the inbounds and rewrites the config when they changed
+func (b *XrayBackend) ConfigureInbounds(ctx context.Context, inbounds *Xray) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.inbounds = inbounds
+
+	peers, err := b.load()
+	if err != nil {
+		return err
+	}
+	return b.write(ctx, peers)
+}
+
+// load reads the peers from the clients of the config file; a missing file
+// has none
+func (b *XrayBackend) load() ([]Peer, error) {
+	data, err := os.ReadFile(b.ConfigPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []Peer{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg xrayConfig
+	err = json.Unmarshal(data, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", b.ConfigPath, err)
+	}
+
+	peers := []Peer{}
+	for _, in := range cfg.Inbounds {
+		for _, c := range in.Settings.Clients {
+			switch in.Tag {
+			case ProtocolVLESS:
+				peers = append(peers, Peer{Protocol: ProtocolVLESS, PublicKey: c.ID})
+			case ProtocolShadowsocks:
+				peers = append(peers, Peer{Protocol: ProtocolShadowsocks, PublicKey: c.Password})
+			}
+		}
+	}
+	slices.SortFunc(peers, func(a, b Peer) int {
+		return strings.Compare(a.PublicKey, b.PublicKey)
+	})
+
+	return peers, nil
+}
+
+// write renders the config for peers and, when it differs from the file,
+// replaces the file and restarts Xray
+func (b *XrayBackend) write(ctx context.Context, peers []Peer) error {
+	data, err := b.render(peers)
+	if err != nil {
+		return err
+	}
+
+	current, err := os.ReadFile(b.ConfigPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if bytes.Equal(current, data) {
+		return nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(b.ConfigPath), ".xray-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0o600)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), b.ConfigPath)
+	if err != nil {
+		return err
+	}
+
+	if len(b.Restart) == 0 {
+		return nil
+	}
+	_, err = b.run(ctx, b.Restart[0], b.Restart[1:]...)
+	if err != nil {
+		return fmt.Errorf("restart xray: %w", err)
+	}
+	return nil
+}
+
+// render returns the Xray config serving peers on the inbounds. An inbound
+// without peers is left out: a Shadowsocks-2022 inbound without clients would
+// let in anyone holding the server key.
+func (b *XrayBackend) render(peers []Peer) ([]byte, error) {
+	host, port, err := net.SplitHostPort(b.APIAddress)
+	if err != nil {
+		return nil, fmt.Errorf("api address %q: %w", b.APIAddress, err)
+	}
+	apiPort, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("api address %q: %w", b.APIAddress, err)
+	}
+
+	var vless, ss []xrayClient
+	for _, p := range peers {
+		switch p.Protocol {
+		case ProtocolVLESS:
+			vless = append(vless, xrayClient{ID: p.PublicKey, Email: p.PublicKey, Flow: xrayFlow})
+		case ProtocolShadowsocks:
+			ss = append(ss, xrayClient{Password: p.PublicKey, Email: p.PublicKey})
+		}
+	}
+	sortClients := func(a, b xrayClient) int { return strings.Compare(a.Email, b.Email) }
+	slices.SortFunc(vless, sortClients)
+	slices.SortFunc(ss, sortClients)
+
+	cfg := xrayConfig{
+		Log:   xrayLog{LogLevel: "warning"},
+		API:   xrayAPI{Tag: xrayAPITag, Services: []string{"StatsService"}},
+		Stats: struct{}{},
+		Policy: xrayPolicy{Levels: map[string]xrayLevel{
+			"0": {StatsUserUplink: true, StatsUserDownlink: true},
+		}},
+		Inbounds: []xrayInbound{{
+			Tag: xrayAPITag, Listen: host, Port: apiPort, Protocol: "dokodemo-door",
+			Settings: xraySettings{Address: host},
+		}},
+		Outbounds: []xrayOutbound{{Tag: "direct", Protocol: "freedom"}, {Tag: "block", Protocol: "blackhole"}},
+		Routing: xrayRouting{Rules: []xrayRule{
+			{Type: "field", InboundTag: []string{xrayAPITag}, OutboundTag: xrayAPITag},
+		}},
+	}
+
+	var in Xray
+	if b.inbounds != nil {
+		in = *b.inbounds
+	}
+
+	if len(vless) > 0 {
+		if in.VLESS == nil {
+			return nil, errors.New("the panel sent VLESS peers but no VLESS inbound")
+		}
+		cfg.Inbounds = append(cfg.Inbounds, xrayInbound{
+			Tag: ProtocolVLESS, Port: in.VLESS.Port, Protocol: "vless",
+			Settings: xraySettings{Clients: vless, Decryption: "none"},
+			StreamSettings: &xrayStream{
+				Network:  "tcp",
+				Security: "reality",
+				RealitySettings: xrayReality{
+					Dest:        net.JoinHostPort(in.VLESS.ServerName, "443"),
+					ServerNames: []string{in.VLESS.ServerName},
+					PrivateKey:  in.VLESS.PrivateKey,
+					ShortIDs:    []string{in.VLESS.ShortID},
+				},
+			},
+		})
+	}
+	if len(ss) > 0 {
+		if in.Shadowsocks == nil {
+			return nil, errors.New("the panel sent Shadowsocks peers but no Shadowsocks inbound")
+		}
+		cfg.Inbounds = append(cfg.Inbounds, xrayInbound{
+			Tag: ProtocolShadowsocks, Port: in.Shadowsocks.Port, Protocol: "shadowsocks",
+			Settings: xraySettings{
+				Clients: ss, Method: in.Shadowsocks.Method, Password: in.Shadowsocks.Key, Network: "tcp,udp",
+			},
+		})
+	}
+
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// xrayTraffic is the traffic Xray counted for a user: uplink from the client,
+// downlink to it
+type xrayTraffic struct {
+	uplink, downlink int64
+}
+
+// stats queries the per-user traffic counters of the stats API, by user. Xray
+// takes a moment to bring the API up after a restart, so a failed query is
+// retried a few times.
+func (b *XrayBackend) stats(ctx context.Context) (map[string]xrayTraffic, error) {
+	var out []byte
+	var err error
+	for attempt := 0; attempt < xrayStatsAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(xrayStatsRetryDelay):
+			}
+		}
+		out, err = b.run(ctx, b.Binary, "api", "statsquery", "--server="+b.APIAddress, "-pattern", "user>>>")
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query xray stats: %w", err)
+	}
+
+	var resp struct {
+		Stat []struct {
+			Name string `json:"name"`
+			// Value is an int64, which the API encodes as a string
+			Value json.RawMessage `json:"value"`
+		} `json:"stat"`
+	}
+	err = json.Unmarshal(out, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("parse xray stats: %w", err)
+	}
+
+	stats := map[string]xrayTraffic{}
+	for _, s := range resp.Stat {
+		// user>>>EMAIL>>>traffic>>>uplink
+		parts := strings.Split(s.Name, ">>>")
+		if len(parts) != 4 || parts[0] != "user" || parts[2] != "traffic" {
+			continue
+		}
+		value, err := strconv.ParseInt(strings.Trim(string(s.Value), `"`), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		t := stats[parts[1]]
+		switch parts[3] {
+		case "uplink":
+			t.uplink = value
+		case "downlink":
+			t.downlink = value
+		}
+		stats[parts[1]] = t
+	}
+
+	return stats, nil
+}
+
+// The parts of the Xray config file the backend writes and reads back
+
+type xrayConfig struct {
+	Log       xrayLog        `json:"log"`
+	API       xrayAPI        `json:"api"`
+	Stats     struct{}       `json:"stats"`
+	Policy    xrayPolicy     `json:"policy"`
+	Inbounds  []xrayInbound  `json:"inbounds"`
+	Outbounds []xrayOutbound `json:"outbounds"`
+	Routing   xrayRouting    `json:"routing"`
+}
+
+type xrayLog struct {
+	LogLevel string `json:"loglevel"`
+}
+
+type xrayAPI struct {
+	Tag      string   `json:"tag"`
+	Services []string `json:"services"`
+}
+
+type xrayPolicy struct {
+	Levels map[string]xrayLevel `json:"levels"`
+}
+
+type xrayLevel struct {
+	StatsUserUplink   bool `json:"statsUserUplink"`
+	StatsUserDownlink bool `json:"statsUserDownlink"`
+}
+
+type xrayInbound struct {
+	Tag            string       `json:"tag"`
+	Listen         string       `json:"listen,omitempty"`
+	Port           int          `json:"port"`
+	Protocol       string       `json:"protocol"`
+	Settings       xraySettings `json:"settings"`
+	StreamSettings *xrayStream  `json:"streamSettings,omitempty"`
+}
+
+type xraySettings struct {
+	Address    string       `json:"address,omitempty"`
+	Clients    []xrayClient `json:"clients,omitempty"`
+	Decryption string       `json:"decryption,omitempty"`
+	Method     string       `json:"method,omitempty"`
+	Password   string       `json:"password,omitempty"`
+	Network    string       `json:"network,omitempty"`
+}
+
+// xrayClient is a VLESS client, known by ID, or a Shadowsocks one, known by
+// Password. Email names the client in the stats.
+type xrayClient struct {
+	ID       string `json:"id,omitempty"`
+	Password string `json:"password,omitempty"`
+	Email    string `json:"email"`
+	Flow     string `json:"flow,omitempty"`
+}
+
+type xrayStream struct {
+	Network         string      `json:"network"`
+	Security        string      `json:"security"`
+	RealitySettings xrayReality `json:"realitySettings"`
+}
+
+type xrayReality struct {
+	Dest        string   `json:"dest"`
+	ServerNames []string `json:"serverNames"`
+	PrivateKey  string   `json:"privateKey"`
+	ShortIDs    []string `json:"shortIds"`
+}
+
+type xrayOutbound struct {
+	Tag      string `json:"tag"`
+	Protocol string `json:"protocol"`
+}
+
+type xrayRouting struct {
+	Rules []xrayRule `json:"rules"`
+}
+
+type xrayRule struct {
+	Type        string   `json:"type"`
+	InboundTag  []string `json:"inboundTag"`
+	OutboundTag string   `json:"outboundTag"`
+}
@@ -0,0 +1,180 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeXray answers the stats query with stats and records the commands run
+type fakeXray struct {
+	stats    string
+	commands []string
+}
+
+func (x *fakeXray) run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	x.commands = append(x.commands, strings.Join(append([]string{name}, args...), " "))
+	if len(args) > 1 && args[1] == "statsquery" {
+		return []byte(x.stats), nil
+	}
+	return nil, nil
+}
+
+func newTestXray(t *testing.T) (*XrayBackend, *fakeXray) {
+	t.Helper()
+	fake := &fakeXray{stats: `{}`}
+	b := NewXrayBackend(filepath.Join(t.TempDir(), "config.json"), "xray", "127.0.0.1:10085", []string{"systemctl", "restart", "xray"})
+	b.run = fake.run
+	return b, fake
+}
+
+func TestXrayBackend(t *testing.T) {
+	ctx := context.Background()
+	b, fake := newTestXray(t)
+
+	inbounds := &Xray{
+		VLESS:       &VLESSInbound{Port: 443, ServerName: "www.example.com", PrivateKey: "reality-private", ShortID: "0123456789abcdef"},
+		Shadowsocks: &ShadowsocksInbound{Port: 8388, Method: "2022-blake3-aes-256-gcm", Key: "server-key"},
+	}
+	if err := b.ConfigureInbounds(ctx, inbounds); err != nil {
+		t.Fatal(err)
+	}
+	fake.commands = nil
+
+	err := b.Configure(ctx, []Peer{
+		{Protocol: ProtocolVLESS, PublicKey: "vless-user"},
+		{Protocol: ProtocolShadowsocks, PublicKey: "ss-user"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(b.ConfigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfg xrayConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Inbounds) != 3 || cfg.Inbounds[0].Listen != "127.0.0.1" || cfg.Inbounds[0].Port != 10085 {
+		t.Fatalf("expected the API, VLESS and Shadowsocks inbounds, got %+v", cfg.Inbounds)
+	}
+	vless := cfg.Inbounds[1]
+	if vless.Port != 443 || vless.StreamSettings == nil || vless.StreamSettings.RealitySettings.PrivateKey != "reality-private" ||
+		vless.StreamSettings.RealitySettings.Dest != "www.example.com:443" || vless.Settings.Clients[0].ID != "vless-user" {
+		t.Errorf("unexpected VLESS inbound %+v", vless)
+	}
+	ss := cfg.Inbounds[2]
+	if ss.Port != 8388 || ss.Settings.Password != "server-key" || ss.Settings.Clients[0].Password != "ss-user" {
+		t.Errorf("unexpected Shadowsocks inbound %+v", ss)
+	}
+	if len(fake.commands) != 1 || fake.commands[0] != "systemctl restart xray" {
+		t.Errorf("expected one restart, got %v", fake.commands)
+	}
+
+	fake.stats = `{"stat":[
+		{"name":"user>>>vless-user>>>traffic>>>uplink","value":"100"},
+		{"name":"user>>>vless-user>>>traffic>>>downlink","value":2000},
+		{"name":"inbound>>>vless>>>traffic>>>uplink","value":"100"}
+	]}`
+	peers, err := b.Peers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 || peers[0].PublicKey != "ss-user" || peers[1].PublicKey != "vless-user" {
+		t.Fatalf("expected both peers read back, got %+v", peers)
+	}
+	if peers[1].ReceiveBytes != 100 || peers[1].TransmitBytes != 2000 || peers[0].ReceiveBytes != 0 {
+		t.Errorf("expected the counters of the VLESS user, got %+v", peers)
+	}
+
+	// an unchanged config does not restart Xray
+	fake.commands = nil
+	if err := b.ConfigureInbounds(ctx, inbounds); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.commands) != 0 {
+		t.Errorf("expected no restart, got %v", fake.commands)
+	}
+
+	// an inbound without clients is left out
+	if err := b.Configure(ctx, nil, []string{"ss-user"}); err != nil {
+		t.Fatal(err)
+	}
+	data, err = os.ReadFile(b.ConfigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "server-key") {
+		t.Error("expected the Shadowsocks inbound to be removed with its last client")
+	}
+
+	if err := b.Configure(ctx, []Peer{{PublicKey: "wg-key", AllowedIPs: []string{"10.9.0.2/32"}}}, nil); err == nil {
+		t.Error("expected WireGuard peers to be refused")
+	}
+}
+
+func TestXrayBackendRequiresInbound(t *testing.T) {
+	b, _ := newTestXray(t)
+
+	err := b.Configure(context.Background(), []Peer{{Protocol: ProtocolVLESS, PublicKey: "vless-user"}}, nil)
+	if err == nil {
+		t.Fatal("expected VLESS peers without a VLESS inbound to fail")
+	}
+}
+
+func TestMultiplexer(t *testing.T) {
+	ctx := context.Background()
+	wg := NewMemoryBackend()
+	xray := NewMemoryBackend()
+	m := &Multiplexer{WireGuard: wg, Xray: xray}
+
+	inbounds := &Xray{VLESS: &VLESSInbound{Port: 443}}
+	if err := m.ConfigureInbounds(ctx, inbounds); err != nil {
+		t.Fatal(err)
+	}
+	if xray.Inbounds() != inbounds {
+		t.Error("expected the inbounds to reach the Xray backend")
+	}
+
+	err := m.Configure(ctx, []Peer{
+		{PublicKey: "laptop", AllowedIPs: []string{"10.9.0.2/32"}},
+		{Protocol: ProtocolVLESS, PublicKey: "phone"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peers, _ := wg.Peers(ctx); len(peers) != 1 || peers[0].PublicKey != "laptop" {
+		t.Errorf("expected the laptop on WireGuard, got %+v", peers)
+	}
+	if peers, _ := xray.Peers(ctx); len(peers) != 1 || peers[0].PublicKey != "phone" {
+		t.Errorf("expected the phone on Xray, got %+v", peers)
+	}
+
+	if err := m.Configure(ctx, nil, []string{"phone"}); err != nil {
+		t.Fatal(err)
+	}
+	if peers, _ := xray.Peers(ctx); len(peers) != 0 {
+		t.Errorf("expected the phone removed from Xray, got %+v", peers)
+	}
+	if peers, _ := m.Peers(ctx); len(peers) != 1 {
+		t.Errorf("expected only the laptop left, got %+v", peers)
+	}
+
+	// without Xray the other peers are refused and WireGuard is still applied
+	m = &Multiplexer{WireGuard: NewMemoryBackend()}
+	err = m.Configure(ctx, []Peer{
+		{PublicKey: "laptop", AllowedIPs: []string{"10.9.0.2/32"}},
+		{Protocol: ProtocolShadowsocks, PublicKey: "tablet"},
+	}, nil)
+	if err == nil {
+		t.Fatal("expected the Shadowsocks peer to be refused")
+	}
+	if peers, _ := m.Peers(ctx); len(peers) != 1 || peers[0].PublicKey != "laptop" {
+		t.Errorf("expected the laptop applied, got %+v", peers)
+	}
+}
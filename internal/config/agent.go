@@ -0,0 +1,183 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// AgentConfig is the configuration of the node agent running on each VPN node.
+// It is layered like Config: defaults, the optional config file, .env and the
+// environment.
+type AgentConfig struct {
+	// PanelURL is the base URL of the panel, e.g. https://panel.example.com
+	PanelURL string `yaml:"panel_url" toml:"panel_url" env:"AGENT_PANEL_URL"`
+	// InsecurePanelURL allows an http:// PanelURL, for development only: the
+	// desired state carries peer private keys and every request the token
+	InsecurePanelURL bool `yaml:"insecure_panel_url" toml:"insecure_panel_url" env:"AGENT_INSECURE_PANEL_URL"`
+	// Token is the node's agent token, generated on the node's admin page
+	Token string `yaml:"token" toml:"token" env:"AGENT_TOKEN" secret:"true"`
+	// Backend is wgctrl, which configures the kernel or userspace WireGuard
+	// interface, or memory, which only pretends to and is meant for testing
+	Backend   string        `yaml:"backend" toml:"backend" env:"AGENT_BACKEND"`
+	Interface string        `yaml:"interface" toml:"interface" env:"AGENT_INTERFACE"`
+	Interval  time.Duration `yaml:"interval" toml:"interval" env:"AGENT_INTERVAL"`
+	Timeout   time.Duration `yaml:"timeout" toml:"timeout" env:"AGENT_TIMEOUT"`
+
+	// CAFile verifies the panel with a private CA instead of the system roots.
+	// CertFile and KeyFile present a client certificate, for panels behind a
+	// proxy that requires mutual TLS.
+	CAFile   string `yaml:"ca_file" toml:"ca_file" env:"AGENT_CA_FILE"`
+	CertFile string `yaml:"cert_file" toml:"cert_file" env:"AGENT_CERT_FILE"`
+	KeyFile  string `yaml:"key_file" toml:"key_file" env:"AGENT_KEY_FILE"`
+
+	Xray    XrayConfig    `yaml:"xray" toml:"xray"`
+	OpenVPN OpenVPNConfig `yaml:"openvpn" toml:"openvpn"`
+	Log     LogConfig     `yaml:"log" toml:"log"`
+}
+
+// XrayConfig is the Xray install the node agent serves VLESS and Shadowsocks
+// peers through. The agent owns ConfigPath and rewrites it on every change;
+// leaving it empty serves WireGuard only.
+type XrayConfig struct {
+	ConfigPath string `yaml:"config_path" toml:"config_path" env:"AGENT_XRAY_CONFIG"`
+	Binary     string `yaml:"binary" toml:"binary" env:"AGENT_XRAY_BINARY"`
+	// APIAddress is where the Xray stats API listens, on the loopback
+	APIAddress string `yaml:"api_address" toml:"api_address" env:"AGENT_XRAY_API_ADDRESS"`
+	// Restart is the command restarting Xray after its config changed
+	Restart string `yaml:"restart" toml:"restart" env:"AGENT_XRAY_RESTART"`
+}
+
+// OpenVPNConfig is the OpenVPN server the node agent keeps the certificates
+// and the revocation list of. The agent owns ca.crt, server.crt, server.key and
+// crl.pem in Dir; leaving it empty serves no OpenVPN.
+type OpenVPNConfig struct {
+	Dir string `yaml:"dir" toml:"dir" env:"AGENT_OPENVPN_DIR"`
+	// Restart is the command restarting OpenVPN after its certificate changed
+	Restart string `yaml:"restart" toml:"restart" env:"AGENT_OPENVPN_RESTART"`
+}
+
+// AgentDefaults returns the node agent configuration used when nothing else is set
+func AgentDefaults() AgentConfig {
+	return AgentConfig{
+		Backend:   "wgctrl",
+		Interface: "wg0",
+		Interval:  30 * time.Second,
+		Timeout:   10 * time.Second,
+		Xray: XrayConfig{
+			Binary:     "xray",
+			APIAddress: "127.0.0.1:10085",
+			Restart:    "systemctl restart xray",
+		},
+		OpenVPN: OpenVPNConfig{
+			Restart: "systemctl restart openvpn-server@server",
+		},
+		Log: LogConfig{
+			Format: "text",
+			Level:  "info",
+		},
+	}
+}
+
+// LoadAgent builds the node agent configuration like Load does and validates it
+func LoadAgent(path string) (AgentConfig, error) {
+	cfg := AgentDefaults()
+
+	if path != "" {
+		err := loadFile(path, &cfg)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
+	err := godotenv.Load()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return cfg, fmt.Errorf("loading .env: %w", err)
+	}
+
+	err = applyEnv(reflect.ValueOf(&cfg).Elem(), os.LookupEnv)
+	if err != nil {
+		return cfg, err
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// Validate checks the node agent configuration and reports every problem at once
+func (c AgentConfig) Validate() error {
+	var errs []error
+	add := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	u, err := url.Parse(c.PanelURL)
+	if c.PanelURL == "" {
+		add("AGENT_PANEL_URL: is required")
+	} else if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		add("AGENT_PANEL_URL: %q must be an https URL", c.PanelURL)
+	} else if u.Scheme == "http" && !c.InsecurePanelURL {
+		add("AGENT_PANEL_URL: %q must use https, or set AGENT_INSECURE_PANEL_URL for development", c.PanelURL)
+	}
+	if c.Token == "" {
+		add("AGENT_TOKEN: is required")
+	}
+
+	switch c.Backend {
+	case "wgctrl", "memory":
+	default:
+		add("AGENT_BACKEND: must be wgctrl or memory, got %q", c.Backend)
+	}
+	if c.Interface == "" {
+		add("AGENT_INTERFACE: is required")
+	}
+	for _, s := range []durationSetting{
+		{"AGENT_INTERVAL", c.Interval},
+		{"AGENT_TIMEOUT", c.Timeout},
+	} {
+		if s.value <= 0 {
+			add("%s: must be positive, got %s", s.name, s.value)
+		}
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		add("AGENT_CERT_FILE and AGENT_KEY_FILE: must be set together")
+	}
+	if c.Xray.ConfigPath != "" {
+		if c.Xray.Binary == "" {
+			add("AGENT_XRAY_BINARY: is required with AGENT_XRAY_CONFIG")
+		}
+		host, _, err := net.SplitHostPort(c.Xray.APIAddress)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			add("AGENT_XRAY_API_ADDRESS: %q must be a loopback host:port, e.g. 127.0.0.1:10085", c.Xray.APIAddress)
+		}
+	}
+
+	switch c.Log.Format {
+	case "text", "json":
+	default:
+		add("LOG_FORMAT: must be text or json, got %q", c.Log.Format)
+	}
+	switch strings.ToLower(c.Log.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		add("LOG_LEVEL: must be debug, info, warn or error, got %q", c.Log.Level)
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return &ValidationError{Errors: errs}
+}
+
+// Redacted renders the node agent configuration as YAML with secrets masked
+func (c AgentConfig) Redacted() ([]byte, error) {
+	return yaml.Marshal(redact(reflect.ValueOf(c)))
+}
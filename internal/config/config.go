@@ -2,16 +2,27 @@ package config
 
 import (
 	"html/template"
-	"log"
+	"log/slog"
 
 	"github.com/alexedwards/scs/v2"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/vpn"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/worker"
 )
 
 type AppConfig struct {
 	UseCache      bool
 	TemplateCache map[string]*template.Template
-	InfoLog       *log.Logger
-	ErrorLog      *log.Logger
+	Logger        *slog.Logger
 	InProduction  bool
 	Session       *scs.SessionManager
+	WireGuard     vpn.ServerConfig
+	Workers       *worker.Group
+	// TelegramBot is the username of the bot that answers device commands,
+	// empty when users cannot link a chat
+	TelegramBot string
+	// PublicURL is the URL users reach the panel at, without a trailing slash;
+	// empty to use the host of each request
+	PublicURL string
+	// PKIKey encrypts the key of the OpenVPN CA; nil when OpenVPN is unavailable
+	PKIKey []byte
 }
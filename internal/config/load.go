@@ -0,0 +1,720 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/pki"
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the typed application configuration. Values are layered, later
+// layers winning: defaults, the optional config file (YAML or TOML), .env and
+// finally the process environment. Every field can be set from the file using
+// its yaml/toml key and from the environment using its env name.
+type Config struct {
+	InProduction     bool   `yaml:"in_production" toml:"in_production" env:"IN_PRODUCTION"`
+	UseTemplateCache bool   `yaml:"use_template_cache" toml:"use_template_cache" env:"USE_TEMPLATE_CACHE"`
+	Port             string `yaml:"port" toml:"port" env:"APP_PORT"`
+	// PublicURL is the URL users reach the panel at, used in the subscription
+	// URLs client apps import; the host of the request is used when empty
+	PublicURL string `yaml:"public_url" toml:"public_url" env:"APP_PUBLIC_URL"`
+
+	HTTP      HTTPConfig      `yaml:"http" toml:"http"`
+	Log       LogConfig       `yaml:"log" toml:"log"`
+	Database  DatabaseConfig  `yaml:"database" toml:"database"`
+	SMTP      SMTPConfig      `yaml:"smtp" toml:"smtp"`
+	Mail      MailConfig      `yaml:"mail" toml:"mail"`
+	Outbox    OutboxConfig    `yaml:"outbox" toml:"outbox"`
+	Telegram  TelegramConfig  `yaml:"telegram" toml:"telegram"`
+	Notify    NotifyConfig    `yaml:"notify" toml:"notify"`
+	Usage     UsageConfig     `yaml:"usage" toml:"usage"`
+	Quota     QuotaConfig     `yaml:"quota" toml:"quota"`
+	Rotation  RotationConfig  `yaml:"rotation" toml:"rotation"`
+	Failover  FailoverConfig  `yaml:"failover" toml:"failover"`
+	WireGuard WireGuardConfig `yaml:"wireguard" toml:"wireguard"`
+	PKI       PKIConfig       `yaml:"pki" toml:"pki"`
+	Metrics   MetricsConfig   `yaml:"metrics" toml:"metrics"`
+	Health    HealthConfig    `yaml:"health" toml:"health"`
+}
+
+type HTTPConfig struct {
+	ReadTimeout       time.Duration `yaml:"read_timeout" toml:"read_timeout" env:"HTTP_READ_TIMEOUT"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" toml:"read_header_timeout" env:"HTTP_READ_HEADER_TIMEOUT"`
+	WriteTimeout      time.Duration `yaml:"write_timeout" toml:"write_timeout" env:"HTTP_WRITE_TIMEOUT"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout" toml:"idle_timeout" env:"HTTP_IDLE_TIMEOUT"`
+	MaxHeaderBytes    int           `yaml:"max_header_bytes" toml:"max_header_bytes" env:"HTTP_MAX_HEADER_BYTES"`
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout" env:"HTTP_SHUTDOWN_TIMEOUT"`
+}
+
+type LogConfig struct {
+	Format string `yaml:"format" toml:"format" env:"LOG_FORMAT"`
+	Level  string `yaml:"level" toml:"level" env:"LOG_LEVEL"`
+}
+
+type DatabaseConfig struct {
+	Host     string `yaml:"host" toml:"host" env:"DB_HOST"`
+	Port     string `yaml:"port" toml:"port" env:"DB_PORT"`
+	Name     string `yaml:"name" toml:"name" env:"DB_NAME"`
+	User     string `yaml:"user" toml:"user" env:"DB_USER"`
+	Password string `yaml:"password" toml:"password" env:"DB_PASSWORD" secret:"true"`
+	SSLMode  string `yaml:"sslmode" toml:"sslmode" env:"DB_SSLMODE"`
+
+	MaxOpenConns     int           `yaml:"max_open_conns" toml:"max_open_conns" env:"DB_MAX_OPEN_CONNS"`
+	MaxIdleConns     int           `yaml:"max_idle_conns" toml:"max_idle_conns" env:"DB_MAX_IDLE_CONNS"`
+	ConnMaxLifetime  time.Duration `yaml:"conn_max_lifetime" toml:"conn_max_lifetime" env:"DB_CONN_MAX_LIFETIME"`
+	ConnMaxIdleTime  time.Duration `yaml:"conn_max_idle_time" toml:"conn_max_idle_time" env:"DB_CONN_MAX_IDLE_TIME"`
+	StatementTimeout time.Duration `yaml:"statement_timeout" toml:"statement_timeout" env:"DB_STATEMENT_TIMEOUT"`
+	ApplicationName  string        `yaml:"application_name" toml:"application_name" env:"DB_APPLICATION_NAME"`
+	ConnectTimeout   time.Duration `yaml:"connect_timeout" toml:"connect_timeout" env:"DB_CONNECT_TIMEOUT"`
+	UsePgxPool       bool          `yaml:"use_pgxpool" toml:"use_pgxpool" env:"DB_USE_PGXPOOL"`
+	// MinConns is how many connections the native pgxpool keeps open; the
+	// database/sql pool has no such setting
+	MinConns int `yaml:"min_conns" toml:"min_conns" env:"DB_MIN_CONNS"`
+}
+
+// DSN returns the connection string for the database
+func (d DatabaseConfig) DSN() string {
+	parts := []string{
+		"host=" + dsnQuote(d.Host),
+		"port=" + dsnQuote(d.Port),
+		"dbname=" + dsnQuote(d.Name),
+		"user=" + dsnQuote(d.User),
+		"password=" + dsnQuote(d.Password),
+	}
+	if d.SSLMode != "" {
+		parts = append(parts, "sslmode="+dsnQuote(d.SSLMode))
+	}
+	return strings.Join(parts, " ")
+}
+
+// dsnQuote quotes a keyword/value connection string value
+func dsnQuote(v string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
+
+type SMTPConfig struct {
+	Host     string `yaml:"host" toml:"host" env:"SMTP_HOST"`
+	Port     string `yaml:"port" toml:"port" env:"SMTP_PORT"`
+	From     string `yaml:"from" toml:"from" env:"SMTP_FROM"`
+	Username string `yaml:"username" toml:"username" env:"SMTP_USERNAME"`
+	Password string `yaml:"password" toml:"password" env:"SMTP_PASSWORD" secret:"true"`
+	// TLS is starttls (upgrade a plain connection, usually port 587), tls
+	// (implicit TLS, usually port 465) or none
+	TLS     string        `yaml:"tls" toml:"tls" env:"SMTP_TLS"`
+	Timeout time.Duration `yaml:"timeout" toml:"timeout" env:"SMTP_TIMEOUT"`
+}
+
+type MailConfig struct {
+	// Sender is smtp or file; file writes every message as an .eml file into DropDir
+	Sender      string `yaml:"sender" toml:"sender" env:"MAIL_SENDER"`
+	DropDir     string `yaml:"drop_dir" toml:"drop_dir" env:"MAIL_DROP_DIR"`
+	FromName    string `yaml:"from_name" toml:"from_name" env:"MAIL_FROM_NAME"`
+	TemplateDir string `yaml:"template_dir" toml:"template_dir" env:"MAIL_TEMPLATE_DIR"`
+}
+
+type OutboxConfig struct {
+	Workers      int           `yaml:"workers" toml:"workers" env:"OUTBOX_WORKERS"`
+	BatchSize    int           `yaml:"batch_size" toml:"batch_size" env:"OUTBOX_BATCH_SIZE"`
+	PollInterval time.Duration `yaml:"poll_interval" toml:"poll_interval" env:"OUTBOX_POLL_INTERVAL"`
+	// Lease is how long a claimed message stays locked to its worker; it must
+	// outlast a send, after which a crashed worker's messages are picked up again
+	Lease        time.Duration `yaml:"lease" toml:"lease" env:"OUTBOX_LEASE"`
+	MaxAttempts  int           `yaml:"max_attempts" toml:"max_attempts" env:"OUTBOX_MAX_ATTEMPTS"`
+	RetryBackoff time.Duration `yaml:"retry_backoff" toml:"retry_backoff" env:"OUTBOX_RETRY_BACKOFF"`
+	MaxBackoff   time.Duration `yaml:"max_backoff" toml:"max_backoff" env:"OUTBOX_MAX_BACKOFF"`
+	// RecipientLimit caps the messages delivered to one address per
+	// RecipientWindow; 0 disables the limit
+	RecipientLimit  int           `yaml:"recipient_limit" toml:"recipient_limit" env:"OUTBOX_RECIPIENT_LIMIT"`
+	RecipientWindow time.Duration `yaml:"recipient_window" toml:"recipient_window" env:"OUTBOX_RECIPIENT_WINDOW"`
+}
+
+type TelegramConfig struct {
+	// BotToken enables the Telegram notification channel when set
+	BotToken string        `yaml:"bot_token" toml:"bot_token" env:"TELEGRAM_BOT_TOKEN" secret:"true"`
+	APIURL   string        `yaml:"api_url" toml:"api_url" env:"TELEGRAM_API_URL"`
+	Timeout  time.Duration `yaml:"timeout" toml:"timeout" env:"TELEGRAM_TIMEOUT"`
+	// Username is the bot's @username without the @, used to link to the bot
+	Username string `yaml:"username" toml:"username" env:"TELEGRAM_BOT_USERNAME"`
+	// Commands answers the commands users send the bot by long-polling its
+	// updates; turn it off when another process reads them
+	Commands    bool          `yaml:"commands" toml:"commands" env:"TELEGRAM_COMMANDS"`
+	PollTimeout time.Duration `yaml:"poll_timeout" toml:"poll_timeout" env:"TELEGRAM_POLL_TIMEOUT"`
+}
+
+type NotifyConfig struct {
+	// ExpiryNotice is how long before a subscription expires its owner is warned
+	ExpiryNotice time.Duration `yaml:"expiry_notice" toml:"expiry_notice" env:"NOTIFY_EXPIRY_NOTICE"`
+	Interval     time.Duration `yaml:"interval" toml:"interval" env:"NOTIFY_INTERVAL"`
+	TemplateDir  string        `yaml:"template_dir" toml:"template_dir" env:"NOTIFY_TEMPLATE_DIR"`
+}
+
+type UsageConfig struct {
+	// HourlyRetention and DailyRetention are how long hourly and daily traffic
+	// buckets are kept; monthly buckets are kept for good
+	HourlyRetention time.Duration `yaml:"hourly_retention" toml:"hourly_retention" env:"USAGE_HOURLY_RETENTION"`
+	DailyRetention  time.Duration `yaml:"daily_retention" toml:"daily_retention" env:"USAGE_DAILY_RETENTION"`
+	PruneInterval   time.Duration `yaml:"prune_interval" toml:"prune_interval" env:"USAGE_PRUNE_INTERVAL"`
+}
+
+type QuotaConfig struct {
+	// Interval is how often data caps are checked against the usage
+	Interval time.Duration `yaml:"interval" toml:"interval" env:"QUOTA_INTERVAL"`
+}
+
+type RotationConfig struct {
+	// Interval is how often peers are checked for keys their plan wants rotated
+	Interval time.Duration `yaml:"interval" toml:"interval" env:"ROTATION_INTERVAL"`
+}
+
+type FailoverConfig struct {
+	// Interval is how often the VPN nodes are checked
+	Interval time.Duration `yaml:"interval" toml:"interval" env:"FAILOVER_INTERVAL"`
+	// HeartbeatTimeout is how long a node agent may go without reporting
+	HeartbeatTimeout time.Duration `yaml:"heartbeat_timeout" toml:"heartbeat_timeout" env:"FAILOVER_HEARTBEAT_TIMEOUT"`
+	// HandshakeTimeout is how long a node with peers may go without any of
+	// them shaking hands before it counts as degraded
+	HandshakeTimeout time.Duration `yaml:"handshake_timeout" toml:"handshake_timeout" env:"FAILOVER_HANDSHAKE_TIMEOUT"`
+	// ProbeTimeout bounds each TCP and UDP probe of a node's ports
+	ProbeTimeout time.Duration `yaml:"probe_timeout" toml:"probe_timeout" env:"FAILOVER_PROBE_TIMEOUT"`
+	// DownAfter is how many checks in a row must fail before a node is down
+	DownAfter int `yaml:"down_after" toml:"down_after" env:"FAILOVER_DOWN_AFTER"`
+	// MoveAfter is how long a node is down before its peers are moved to
+	// another node in its country; 0 only offers customers the move
+	MoveAfter time.Duration `yaml:"move_after" toml:"move_after" env:"FAILOVER_MOVE_AFTER"`
+}
+
+type WireGuardConfig struct {
+	Endpoint        string `yaml:"endpoint" toml:"endpoint" env:"WG_ENDPOINT"`
+	ServerPublicKey string `yaml:"server_public_key" toml:"server_public_key" env:"WG_SERVER_PUBLIC_KEY"`
+	Subnet          string `yaml:"subnet" toml:"subnet" env:"WG_SUBNET"`
+	DNS             string `yaml:"dns" toml:"dns" env:"WG_DNS"`
+	AllowedIPs      string `yaml:"allowed_ips" toml:"allowed_ips" env:"WG_ALLOWED_IPS"`
+}
+
+type PKIConfig struct {
+	// EncryptionKey is 32 base64 encoded bytes the key of the OpenVPN CA is
+	// encrypted with in the database. OpenVPN is unavailable without it.
+	EncryptionKey string `yaml:"encryption_key" toml:"encryption_key" env:"PKI_ENCRYPTION_KEY" secret:"true"`
+}
+
+type MetricsConfig struct {
+	Addr  string `yaml:"addr" toml:"addr" env:"METRICS_ADDR"`
+	Token string `yaml:"token" toml:"token" env:"METRICS_TOKEN" secret:"true"`
+}
+
+type HealthConfig struct {
+	CheckTimeout time.Duration `yaml:"check_timeout" toml:"check_timeout" env:"HEALTH_CHECK_TIMEOUT"`
+	SMTPInterval time.Duration `yaml:"smtp_interval" toml:"smtp_interval" env:"HEALTH_SMTP_INTERVAL"`
+}
+
+// Defaults returns the configuration used when nothing else is set
+func Defaults() Config {
+	return Config{
+		Port: "8080",
+		HTTP: HTTPConfig{
+			ReadTimeout:       15 * time.Second,
+			ReadHeaderTimeout: 5 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       120 * time.Second,
+			MaxHeaderBytes:    1 << 20,
+			ShutdownTimeout:   20 * time.Second,
+		},
+		Log: LogConfig{
+			Format: "text",
+			Level:  "info",
+		},
+		Database: DatabaseConfig{
+			Host:             "localhost",
+			Port:             "5432",
+			MaxOpenConns:     10,
+			MaxIdleConns:     5,
+			ConnMaxLifetime:  5 * time.Minute,
+			StatementTimeout: 30 * time.Second,
+			ApplicationName:  "fastnet_vpn_bot",
+			ConnectTimeout:   30 * time.Second,
+		},
+		SMTP: SMTPConfig{
+			Port:    "587",
+			TLS:     "starttls",
+			Timeout: 30 * time.Second,
+		},
+		Mail: MailConfig{
+			Sender:      "smtp",
+			DropDir:     "./tmp/mail",
+			FromName:    "Fastnet VPN",
+			TemplateDir: "./templates/email",
+		},
+		Outbox: OutboxConfig{
+			Workers:         2,
+			BatchSize:       10,
+			PollInterval:    2 * time.Second,
+			Lease:           2 * time.Minute,
+			MaxAttempts:     8,
+			RetryBackoff:    30 * time.Second,
+			MaxBackoff:      time.Hour,
+			RecipientLimit:  10,
+			RecipientWindow: time.Hour,
+		},
+		Telegram: TelegramConfig{
+			APIURL:      "https://api.telegram.org",
+			Timeout:     10 * time.Second,
+			Commands:    true,
+			PollTimeout: 30 * time.Second,
+		},
+		Notify: NotifyConfig{
+			ExpiryNotice: 72 * time.Hour,
+			Interval:     time.Hour,
+			TemplateDir:  "./templates/notifications",
+		},
+		Usage: UsageConfig{
+			HourlyRetention: 14 * 24 * time.Hour,
+			DailyRetention:  400 * 24 * time.Hour,
+			PruneInterval:   time.Hour,
+		},
+		Quota: QuotaConfig{
+			Interval: 5 * time.Minute,
+		},
+		Rotation: RotationConfig{
+			Interval: time.Hour,
+		},
+		Failover: FailoverConfig{
+			Interval:         time.Minute,
+			HeartbeatTimeout: 3 * time.Minute,
+			HandshakeTimeout: time.Hour,
+			ProbeTimeout:     3 * time.Second,
+			DownAfter:        3,
+			MoveAfter:        15 * time.Minute,
+		},
+		WireGuard: WireGuardConfig{
+			Subnet: "10.8.0.0/24",
+		},
+		Health: HealthConfig{
+			CheckTimeout: 2 * time.Second,
+			SMTPInterval: time.Minute,
+		},
+	}
+}
+
+// Load builds the configuration from defaults, the optional file at path, the
+// optional .env file in the working directory and the environment, then validates it
+func Load(path string) (Config, error) {
+	cfg := Defaults()
+
+	if path != "" {
+		err := loadFile(path, &cfg)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
+	// .env is optional, but a malformed one is an error
+	err := godotenv.Load()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return cfg, fmt.Errorf("loading .env: %w", err)
+	}
+
+	err = applyEnv(reflect.ValueOf(&cfg).Elem(), os.LookupEnv)
+	if err != nil {
+		return cfg, err
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// loadFile decodes the YAML or TOML file at path into cfg, a pointer to a config struct
+func loadFile(path string, cfg any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(cfg)
+		// an empty file decodes to io.EOF and leaves the defaults untouched
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("parsing %s: %w", path, err)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(data), cfg)
+		if err != nil {
+			return fmt.Errorf("parsing %s: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("parsing %s: unknown keys %v", path, undecoded)
+		}
+	default:
+		return fmt.Errorf("config file %s must be .yaml, .yml or .toml", path)
+	}
+
+	return nil
+}
+
+// applyEnv overrides every field carrying an env tag that is set in the environment
+func applyEnv(v reflect.Value, lookup func(string) (string, bool)) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		sf := t.Field(i)
+
+		if sf.Type.Kind() == reflect.Struct {
+			err := applyEnv(field, lookup)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		key := sf.Tag.Get("env")
+		if key == "" {
+			continue
+		}
+		raw, ok := lookup(key)
+		if !ok || raw == "" {
+			continue
+		}
+
+		err := setField(field, raw)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+func setField(field reflect.Value, raw string) error {
+	switch {
+	case field.Type() == reflect.TypeOf(time.Duration(0)):
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration such as 30s or 5m", raw)
+		}
+		field.SetInt(int64(d))
+	case field.Kind() == reflect.String:
+		field.SetString(raw)
+	case field.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", raw)
+		}
+		field.SetBool(b)
+	case field.Kind() == reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", raw)
+		}
+		field.SetInt(int64(n))
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+	return nil
+}
+
+// Validate checks the configuration and reports every problem at once
+func (c Config) Validate() error {
+	var errs []error
+	add := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if !validPort(c.Port) {
+		add("APP_PORT: %q is not a valid port", c.Port)
+	}
+	if c.PublicURL != "" {
+		u, err := url.Parse(c.PublicURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add("APP_PUBLIC_URL: %q is not an http(s) URL", c.PublicURL)
+		}
+	}
+
+	for _, s := range []durationSetting{
+		{"HTTP_READ_TIMEOUT", c.HTTP.ReadTimeout},
+		{"HTTP_READ_HEADER_TIMEOUT", c.HTTP.ReadHeaderTimeout},
+		{"HTTP_WRITE_TIMEOUT", c.HTTP.WriteTimeout},
+		{"HTTP_IDLE_TIMEOUT", c.HTTP.IdleTimeout},
+		{"HTTP_SHUTDOWN_TIMEOUT", c.HTTP.ShutdownTimeout},
+		{"HEALTH_CHECK_TIMEOUT", c.Health.CheckTimeout},
+		{"HEALTH_SMTP_INTERVAL", c.Health.SMTPInterval},
+	} {
+		if s.value <= 0 {
+			add("%s: must be positive, got %s", s.name, s.value)
+		}
+	}
+	if c.HTTP.MaxHeaderBytes < 4096 {
+		add("HTTP_MAX_HEADER_BYTES: must be at least 4096, got %d", c.HTTP.MaxHeaderBytes)
+	}
+
+	switch c.Log.Format {
+	case "text", "json":
+	default:
+		add("LOG_FORMAT: must be text or json, got %q", c.Log.Format)
+	}
+	switch strings.ToLower(c.Log.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		add("LOG_LEVEL: must be debug, info, warn or error, got %q", c.Log.Level)
+	}
+
+	if c.Database.Host == "" {
+		add("DB_HOST: is required")
+	}
+	if !validPort(c.Database.Port) {
+		add("DB_PORT: %q is not a valid port", c.Database.Port)
+	}
+	if c.Database.Name == "" {
+		add("DB_NAME: is required")
+	}
+	if c.Database.User == "" {
+		add("DB_USER: is required")
+	}
+	switch c.Database.SSLMode {
+	case "", "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+	default:
+		add("DB_SSLMODE: %q is not a valid sslmode", c.Database.SSLMode)
+	}
+	if c.Database.MaxOpenConns < 1 {
+		add("DB_MAX_OPEN_CONNS: must be at least 1, got %d", c.Database.MaxOpenConns)
+	}
+	if c.Database.MaxIdleConns < 0 || c.Database.MaxIdleConns > c.Database.MaxOpenConns {
+		add("DB_MAX_IDLE_CONNS: must be between 0 and DB_MAX_OPEN_CONNS, got %d", c.Database.MaxIdleConns)
+	}
+	if c.Database.MinConns < 0 || c.Database.MinConns > c.Database.MaxOpenConns {
+		add("DB_MIN_CONNS: must be between 0 and DB_MAX_OPEN_CONNS, got %d", c.Database.MinConns)
+	}
+	for _, s := range []durationSetting{
+		{"DB_CONN_MAX_LIFETIME", c.Database.ConnMaxLifetime},
+		{"DB_CONN_MAX_IDLE_TIME", c.Database.ConnMaxIdleTime},
+		{"DB_STATEMENT_TIMEOUT", c.Database.StatementTimeout},
+	} {
+		if s.value < 0 {
+			add("%s: must not be negative, got %s", s.name, s.value)
+		}
+	}
+	if c.Database.ConnectTimeout <= 0 {
+		add("DB_CONNECT_TIMEOUT: must be positive, got %s", c.Database.ConnectTimeout)
+	}
+
+	if c.SMTP.Host != "" {
+		if !validPort(c.SMTP.Port) {
+			add("SMTP_PORT: %q is not a valid port", c.SMTP.Port)
+		}
+	} else if c.InProduction && c.Mail.Sender == "smtp" {
+		add("SMTP_HOST: is required in production")
+	}
+	if c.SMTP.From == "" && (c.SMTP.Host != "" || c.Mail.Sender == "file") {
+		add("SMTP_FROM: is required when e-mail is sent")
+	}
+	switch c.SMTP.TLS {
+	case "starttls", "tls", "none":
+	default:
+		add("SMTP_TLS: must be starttls, tls or none, got %q", c.SMTP.TLS)
+	}
+	if c.SMTP.Timeout <= 0 {
+		add("SMTP_TIMEOUT: must be positive, got %s", c.SMTP.Timeout)
+	}
+	switch c.Mail.Sender {
+	case "smtp":
+	case "file":
+		if c.Mail.DropDir == "" {
+			add("MAIL_DROP_DIR: is required when MAIL_SENDER is file")
+		}
+	default:
+		add("MAIL_SENDER: must be smtp or file, got %q", c.Mail.Sender)
+	}
+	if c.Mail.TemplateDir == "" {
+		add("MAIL_TEMPLATE_DIR: is required")
+	}
+
+	for _, s := range []intSetting{
+		{"OUTBOX_WORKERS", c.Outbox.Workers},
+		{"OUTBOX_BATCH_SIZE", c.Outbox.BatchSize},
+		{"OUTBOX_MAX_ATTEMPTS", c.Outbox.MaxAttempts},
+	} {
+		if s.value < 1 {
+			add("%s: must be at least 1, got %d", s.name, s.value)
+		}
+	}
+	for _, s := range []durationSetting{
+		{"OUTBOX_POLL_INTERVAL", c.Outbox.PollInterval},
+		{"OUTBOX_RETRY_BACKOFF", c.Outbox.RetryBackoff},
+		{"OUTBOX_MAX_BACKOFF", c.Outbox.MaxBackoff},
+	} {
+		if s.value <= 0 {
+			add("%s: must be positive, got %s", s.name, s.value)
+		}
+	}
+	if c.Outbox.Lease <= c.SMTP.Timeout {
+		add("OUTBOX_LEASE: must be longer than SMTP_TIMEOUT (%s), got %s", c.SMTP.Timeout, c.Outbox.Lease)
+	}
+	if c.Outbox.Lease <= c.Telegram.Timeout {
+		add("OUTBOX_LEASE: must be longer than TELEGRAM_TIMEOUT (%s), got %s", c.Telegram.Timeout, c.Outbox.Lease)
+	}
+	if c.Outbox.RecipientLimit < 0 {
+		add("OUTBOX_RECIPIENT_LIMIT: must not be negative, got %d", c.Outbox.RecipientLimit)
+	}
+	if c.Outbox.RecipientLimit > 0 && c.Outbox.RecipientWindow <= 0 {
+		add("OUTBOX_RECIPIENT_WINDOW: must be positive when OUTBOX_RECIPIENT_LIMIT is set, got %s", c.Outbox.RecipientWindow)
+	}
+
+	if c.Notify.TemplateDir == "" {
+		add("NOTIFY_TEMPLATE_DIR: is required")
+	}
+	if c.Telegram.BotToken != "" && c.Telegram.APIURL == "" {
+		add("TELEGRAM_API_URL: is required when TELEGRAM_BOT_TOKEN is set")
+	}
+	if c.Telegram.BotToken != "" && c.Telegram.Commands && c.Telegram.PollTimeout < time.Second {
+		add("TELEGRAM_POLL_TIMEOUT: must be at least 1s when TELEGRAM_COMMANDS is on, got %s", c.Telegram.PollTimeout)
+	}
+	for _, s := range []durationSetting{
+		{"TELEGRAM_TIMEOUT", c.Telegram.Timeout},
+		{"NOTIFY_EXPIRY_NOTICE", c.Notify.ExpiryNotice},
+		{"NOTIFY_INTERVAL", c.Notify.Interval},
+	} {
+		if s.value <= 0 {
+			add("%s: must be positive, got %s", s.name, s.value)
+		}
+	}
+
+	if c.Usage.PruneInterval <= 0 {
+		add("USAGE_PRUNE_INTERVAL: must be positive, got %s", c.Usage.PruneInterval)
+	}
+	if c.Quota.Interval <= 0 {
+		add("QUOTA_INTERVAL: must be positive, got %s", c.Quota.Interval)
+	}
+	if c.Rotation.Interval <= 0 {
+		add("ROTATION_INTERVAL: must be positive, got %s", c.Rotation.Interval)
+	}
+	for _, s := range []durationSetting{
+		{"FAILOVER_INTERVAL", c.Failover.Interval},
+		{"FAILOVER_HEARTBEAT_TIMEOUT", c.Failover.HeartbeatTimeout},
+		{"FAILOVER_HANDSHAKE_TIMEOUT", c.Failover.HandshakeTimeout},
+		{"FAILOVER_PROBE_TIMEOUT", c.Failover.ProbeTimeout},
+	} {
+		if s.value <= 0 {
+			add("%s: must be positive, got %s", s.name, s.value)
+		}
+	}
+	if c.Failover.DownAfter < 1 {
+		add("FAILOVER_DOWN_AFTER: must be at least 1, got %d", c.Failover.DownAfter)
+	}
+	if c.Failover.MoveAfter < 0 {
+		add("FAILOVER_MOVE_AFTER: must not be negative, got %s", c.Failover.MoveAfter)
+	}
+	// the dashboard charts the last 24 hours and 30 days
+	if c.Usage.HourlyRetention < 24*time.Hour {
+		add("USAGE_HOURLY_RETENTION: must be at least 24h, got %s", c.Usage.HourlyRetention)
+	}
+	if c.Usage.DailyRetention < 31*24*time.Hour {
+		add("USAGE_DAILY_RETENTION: must be at least 744h (31 days), got %s", c.Usage.DailyRetention)
+	}
+
+	if _, err := netip.ParsePrefix(c.WireGuard.Subnet); err != nil {
+		add("WG_SUBNET: %q is not a CIDR prefix", c.WireGuard.Subnet)
+	}
+	if c.PKI.EncryptionKey != "" {
+		if _, err := pki.ParseEncryptionKey(c.PKI.EncryptionKey); err != nil {
+			add("PKI_ENCRYPTION_KEY: %s, e.g. from openssl rand -base64 32", err)
+		}
+	}
+	if c.WireGuard.Endpoint != "" {
+		if _, _, err := net.SplitHostPort(c.WireGuard.Endpoint); err != nil {
+			add("WG_ENDPOINT: %q must be host:port", c.WireGuard.Endpoint)
+		}
+	}
+
+	if c.Metrics.Addr != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics.Addr); err != nil {
+			add("METRICS_ADDR: %q must be host:port or :port", c.Metrics.Addr)
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return &ValidationError{Errors: errs}
+}
+
+// ValidationError lists every invalid setting
+type ValidationError struct {
+	Errors []error
+}
+
+func (e *ValidationError) Error() string {
+	lines := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		lines = append(lines, "  - "+err.Error())
+	}
+	return "invalid configuration:\n" + strings.Join(lines, "\n")
+}
+
+// durationSetting and intSetting pair a setting with its env name, listed in
+// slices so Validate reports problems in a stable order
+type durationSetting struct {
+	name  string
+	value time.Duration
+}
+
+type intSetting struct {
+	name  string
+	value int
+}
+
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n < 65536
+}
+
+// Redacted renders the configuration as YAML with secrets masked
+func (c Config) Redacted() ([]byte, error) {
+	return yaml.Marshal(redact(reflect.ValueOf(c)))
+}
+
+func redact(v reflect.Value) any {
+	t := v.Type()
+	out := yaml.Node{Kind: yaml.MappingNode}
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		field := v.Field(i)
+		key := sf.Tag.Get("yaml")
+
+		var value any
+		switch {
+		case sf.Type.Kind() == reflect.Struct:
+			value = redact(field)
+		case sf.Tag.Get("secret") == "true" && !field.IsZero():
+			value = "[REDACTED]"
+		case sf.Type == reflect.TypeOf(time.Duration(0)):
+			value = time.Duration(field.Int()).String()
+		default:
+			value = field.Interface()
+		}
+
+		var keyNode, valueNode yaml.Node
+		keyNode.SetString(key)
+		if err := valueNode.Encode(value); err != nil {
+			continue
+		}
+		out.Content = append(out.Content, &keyNode, &valueNode)
+	}
+
+	return &out
+}
@@ -0,0 +1,208 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// valid returns defaults that pass Validate
+func valid() Config {
+	cfg := Defaults()
+	cfg.Database.Name, cfg.Database.User = "fastnet", "fastnet"
+	return cfg
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	path := filepath.Join(dir, "config.yaml")
+	err := os.WriteFile(path, []byte(`port: "9000"
+log:
+  level: debug
+database:
+  name: file_db
+  user: file_user
+  password: file_password
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, ".env"), []byte("DB_USER=dotenv_user\nDB_PASSWORD=dotenv_password\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// godotenv only sets unset variables, in the process environment; t.Setenv
+	// restores them afterwards
+	t.Setenv("DB_USER", "")
+	os.Unsetenv("DB_USER")
+	t.Setenv("DB_PASSWORD", "env_password")
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name, got, want string
+	}{
+		{"default", cfg.Database.Host, "localhost"},
+		{"file", cfg.Port, "9000"},
+		{"file", cfg.Log.Level, "debug"},
+		{"file", cfg.Database.Name, "file_db"},
+		{".env over file", cfg.Database.User, "dotenv_user"},
+		{"environment over .env", cfg.Database.Password, "env_password"},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, tt.got)
+		}
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	t.Setenv("HTTP_READ_TIMEOUT", "5 minutes")
+	if _, err := Load(""); err == nil || !strings.Contains(err.Error(), "HTTP_READ_TIMEOUT") {
+		t.Fatalf("expected an unparsable duration rejected, got %v", err)
+	}
+
+	t.Setenv("HTTP_READ_TIMEOUT", "")
+	t.Setenv("DB_NAME", "fastnet")
+	t.Setenv("DB_USER", "fastnet")
+	t.Setenv("DB_PORT", "70000")
+	var invalid *ValidationError
+	if _, err := Load(""); !errors.As(err, &invalid) || !strings.Contains(err.Error(), "DB_PORT") {
+		t.Fatalf("expected an out of range port rejected, got %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := valid().Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		change func(*Config)
+		want   string
+	}{
+		{"app port", func(c *Config) { c.Port = "http" }, `APP_PORT: "http" is not a valid port`},
+		{"zero port", func(c *Config) { c.Port = "0" }, `APP_PORT: "0" is not a valid port`},
+		{"database port", func(c *Config) { c.Database.Port = "65536" }, `DB_PORT: "65536" is not a valid port`},
+		{"smtp port", func(c *Config) { c.SMTP.Host, c.SMTP.From, c.SMTP.Port = "mail", "a@example.com", "-1" }, `SMTP_PORT: "-1" is not a valid port`},
+		{"zero timeout", func(c *Config) { c.HTTP.ReadTimeout = 0 }, "HTTP_READ_TIMEOUT: must be positive, got 0s"},
+		{"negative lifetime", func(c *Config) { c.Database.ConnMaxLifetime = -time.Second }, "DB_CONN_MAX_LIFETIME: must not be negative, got -1s"},
+		{"zero interval", func(c *Config) { c.Failover.ProbeTimeout = 0 }, "FAILOVER_PROBE_TIMEOUT: must be positive, got 0s"},
+		{"min conns", func(c *Config) { c.Database.MinConns = 11 }, "DB_MIN_CONNS: must be between 0 and DB_MAX_OPEN_CONNS, got 11"},
+		{"zero workers", func(c *Config) { c.Outbox.Workers = 0 }, "OUTBOX_WORKERS: must be at least 1, got 0"},
+	} {
+		cfg := valid()
+		tt.change(&cfg)
+		var invalid *ValidationError
+		err := cfg.Validate()
+		if !errors.As(err, &invalid) || len(invalid.Errors) != 1 || invalid.Errors[0].Error() != tt.want {
+			t.Errorf("%s: expected %q, got %v", tt.name, tt.want, err)
+		}
+	}
+
+	// problems are reported in the order the settings are checked
+	cfg := valid()
+	cfg.HTTP.ReadTimeout, cfg.HTTP.IdleTimeout, cfg.Health.SMTPInterval = 0, 0, 0
+	cfg.Outbox.MaxBackoff, cfg.Outbox.PollInterval = 0, 0
+	want := []string{"HTTP_READ_TIMEOUT", "HTTP_IDLE_TIMEOUT", "HEALTH_SMTP_INTERVAL", "OUTBOX_POLL_INTERVAL", "OUTBOX_MAX_BACKOFF"}
+	for range 10 {
+		var invalid *ValidationError
+		if !errors.As(cfg.Validate(), &invalid) || len(invalid.Errors) != len(want) {
+			t.Fatalf("expected %d problems, got %v", len(want), invalid)
+		}
+		for i, err := range invalid.Errors {
+			if !strings.HasPrefix(err.Error(), want[i]+":") {
+				t.Fatalf("expected %s reported #%d, got %v", want[i], i+1, invalid)
+			}
+		}
+	}
+}
+
+func TestValidateAgent(t *testing.T) {
+	cfg := AgentDefaults()
+	cfg.PanelURL, cfg.Token = "https://panel.example.com", "fnn_secret"
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the desired state carries private keys, plain http is for development only
+	cfg.PanelURL = "http://panel.example.com"
+	var invalid *ValidationError
+	if err := cfg.Validate(); !errors.As(err, &invalid) || !strings.Contains(err.Error(), "AGENT_PANEL_URL") {
+		t.Fatalf("expected an http panel URL rejected, got %v", err)
+	}
+	cfg.InsecurePanelURL = true
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected an http panel URL allowed when insecure, got %v", err)
+	}
+
+	cfg.PanelURL = "ftp://panel.example.com"
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected a non-http panel URL rejected")
+	}
+}
+
+// setSecrets sets every string field tagged secret:"true" in v to value and
+// returns how many it set
+func setSecrets(v reflect.Value, value string) int {
+	n := 0
+	for i := 0; i < v.NumField(); i++ {
+		field, sf := v.Field(i), v.Type().Field(i)
+		switch {
+		case sf.Type.Kind() == reflect.Struct:
+			n += setSecrets(field, value)
+		case sf.Tag.Get("secret") == "true":
+			field.SetString(value)
+			n++
+		}
+	}
+	return n
+}
+
+func TestRedacted(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		cfg  any
+	}{
+		{"app", &Config{}},
+		{"agent", &AgentConfig{}},
+	} {
+		secrets := setSecrets(reflect.ValueOf(tt.cfg).Elem(), "hunter2")
+		if secrets == 0 {
+			t.Fatalf("%s: expected secret fields", tt.name)
+		}
+
+		var out []byte
+		var err error
+		switch cfg := tt.cfg.(type) {
+		case *Config:
+			cfg.Port = "8080"
+			out, err = cfg.Redacted()
+		case *AgentConfig:
+			out, err = cfg.Redacted()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(out), "hunter2") {
+			t.Errorf("%s: expected every secret masked, got\n%s", tt.name, out)
+		}
+		if got := strings.Count(string(out), "[REDACTED]"); got != secrets {
+			t.Errorf("%s: expected %d secrets masked, got %d in\n%s", tt.name, secrets, got, out)
+		}
+		if tt.name == "app" && !strings.Contains(string(out), `port: "8080"`) {
+			t.Errorf("%s: expected other settings kept, got\n%s", tt.name, out)
+		}
+	}
+}
@@ -1,51 +1,127 @@
 package driver
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
+	"log/slog"
+	"strconv"
 	"time"
 
-	_ "github.com/jackc/pgconn"
-	_ "github.com/jackc/pgx/v4"
-	_ "github.com/jackc/pgx/v4/stdlib"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/config"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
 )
 
-// DB holds the database connection pool
+// DB holds the database connection pool. Pool is only set when the native
+// pgxpool is enabled; SQL is always usable and shares the same connections,
+// whose statistics are read from Pool then.
 type DB struct {
-	SQL *sql.DB
+	SQL  *sql.DB
+	Pool *pgxpool.Pool
 }
 
-var dbConnection = &DB{}
-
-const maxOpenDbConnection = 10        // Maximum number of connections that can be open simultaneously: 10
-const maxIdleDbConnection = 5         // Maximum number of idle (unused) connections allowed: 5
-const maxDbLifetime = 5 * time.Minute // Maximum lifetime of a connection: 5 minutes
+const (
+	initialConnectBackoff = 500 * time.Millisecond
+	maxConnectBackoff     = 10 * time.Second
+)
 
-// ConnectSQL creates database pool for Postgres
-func ConnectSQL(dsn string) (*DB, error) {
-	db, err := NewDatabase(dsn)
+// ConnectSQL opens the database pool described by cfg and waits until the
+// database answers, retrying with exponential backoff for up to cfg.ConnectTimeout
+func ConnectSQL(ctx context.Context, cfg config.DatabaseConfig, logger *slog.Logger) (*DB, error) {
+	db, err := NewDatabase(cfg)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	db.SetMaxOpenConns(maxOpenDbConnection)
-	db.SetMaxIdleConns(maxIdleDbConnection)
-	db.SetConnMaxLifetime(maxDbLifetime)
-	dbConnection.SQL = db
+	ctx, cancel := context.WithTimeout(ctx, cfg.ConnectTimeout)
+	defer cancel()
+
+	backoff := initialConnectBackoff
+	for attempt := 1; ; attempt++ {
+		err = db.SQL.PingContext(ctx)
+		if err == nil {
+			return db, nil
+		}
+
+		logger.Warn("database is not reachable yet", "attempt", attempt, "retry_in", backoff, "error", err)
+
+		select {
+		case <-ctx.Done():
+			db.Close()
+			return nil, fmt.Errorf("database not reachable after %d attempts: %w", attempt, err)
+		case <-time.After(backoff):
+		}
 
-	return dbConnection, nil
+		backoff = min(backoff*2, maxConnectBackoff)
+	}
 }
 
-// NewDatabase creates a new database for the application
-func NewDatabase(dsn string) (*sql.DB, error) {
-	db, err := sql.Open("pgx", dsn)
+// NewDatabase creates the pool for cfg without checking that the database is up
+func NewDatabase(cfg config.DatabaseConfig) (*DB, error) {
+	if cfg.UsePgxPool {
+		poolConfig, err := pgxpool.ParseConfig(cfg.DSN())
+		if err != nil {
+			return nil, err
+		}
+		setRuntimeParams(poolConfig.ConnConfig, cfg)
+		poolConfig.MaxConns = int32(cfg.MaxOpenConns)
+		poolConfig.MinConns = int32(cfg.MinConns)
+		poolConfig.MaxConnLifetime = cfg.ConnMaxLifetime
+		if cfg.ConnMaxIdleTime > 0 {
+			poolConfig.MaxConnIdleTime = cfg.ConnMaxIdleTime
+		}
+
+		pool, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		return &DB{SQL: stdlib.OpenDBFromPool(pool), Pool: pool}, nil
+	}
+
+	connConfig, err := ConnConfig(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	err = db.Ping()
+	db := stdlib.OpenDB(*connConfig)
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(cfg.ConnMaxIdleTime)
+
+	return &DB{SQL: db}, nil
+}
+
+// ConnConfig parses cfg into a pgx connection config with the per-connection
+// session settings applied
+func ConnConfig(cfg config.DatabaseConfig) (*pgx.ConnConfig, error) {
+	connConfig, err := pgx.ParseConfig(cfg.DSN())
 	if err != nil {
 		return nil, err
 	}
+	setRuntimeParams(connConfig, cfg)
+
+	return connConfig, nil
+}
+
+// setRuntimeParams sets the parameters sent in every connection's startup message
+func setRuntimeParams(connConfig *pgx.ConnConfig, cfg config.DatabaseConfig) {
+	if cfg.ApplicationName != "" {
+		connConfig.RuntimeParams["application_name"] = cfg.ApplicationName
+	}
+	if cfg.StatementTimeout > 0 {
+		connConfig.RuntimeParams["statement_timeout"] = strconv.FormatInt(cfg.StatementTimeout.Milliseconds(), 10)
+	}
+}
 
-	return db, nil
+// Close closes the database/sql handle and, when enabled, the native pool
+func (d *DB) Close() error {
+	err := d.SQL.Close()
+	if d.Pool != nil {
+		d.Pool.Close()
+	}
+	return err
 }
@@ -0,0 +1,74 @@
+package driver
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/config"
+)
+
+func testConfig() config.DatabaseConfig {
+	cfg := config.Defaults().Database
+	cfg.Name = "fastnet"
+	cfg.User = "fastnet"
+	cfg.Password = `it's a \secret`
+	return cfg
+}
+
+func TestConnConfigSetsSessionParameters(t *testing.T) {
+	cfg := testConfig()
+	cfg.StatementTimeout = 1500 * time.Millisecond
+
+	connConfig, err := ConnConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := connConfig.RuntimeParams["application_name"]; got != "fastnet_vpn_bot" {
+		t.Errorf("application_name = %q", got)
+	}
+	if got := connConfig.RuntimeParams["statement_timeout"]; got != "1500" {
+		t.Errorf("statement_timeout = %q", got)
+	}
+	if connConfig.Password != cfg.Password {
+		t.Errorf("password was not quoted correctly, got %q", connConfig.Password)
+	}
+}
+
+func TestNewDatabaseSizesPgxPool(t *testing.T) {
+	cfg := testConfig()
+	cfg.Host = "127.0.0.1"
+	cfg.Port = "1"
+	cfg.UsePgxPool = true
+	cfg.MinConns = 2
+
+	db, err := NewDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	poolConfig := db.Pool.Config()
+	if poolConfig.MaxConns != int32(cfg.MaxOpenConns) || poolConfig.MinConns != 2 {
+		t.Errorf("expected %d to 2 connections, got %d to %d", cfg.MaxOpenConns, poolConfig.MaxConns, poolConfig.MinConns)
+	}
+}
+
+func TestConnectSQLGivesUpAfterTimeout(t *testing.T) {
+	cfg := testConfig()
+	cfg.Host = "127.0.0.1"
+	cfg.Port = "1"
+	cfg.ConnectTimeout = 800 * time.Millisecond
+
+	start := time.Now()
+	_, err := ConnectSQL(context.Background(), cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("gave up after %s, want about %s", elapsed, cfg.ConnectTimeout)
+	}
+}
@@ -1,27 +1,96 @@
 package email
 
 import (
+	"context"
 	"crypto/rand"
 	"fmt"
+	"log/slog"
 	"math/big"
-	"net/smtp"
-	"os"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/config"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/metrics"
 )
 
-type EmailService struct {
-	SMTPHost string
-	SMTPPort string
-	From     string
-	Password string
+// Mailer delivers a fully composed message
+type Mailer interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// NewMailer returns the Mailer selected by MAIL_SENDER
+func NewMailer(mailCfg config.MailConfig, smtpCfg config.SMTPConfig) (Mailer, error) {
+	switch mailCfg.Sender {
+	case "smtp":
+		return NewSMTPMailer(smtpCfg), nil
+	case "file":
+		return NewFileMailer(mailCfg.DropDir), nil
+	default:
+		return nil, fmt.Errorf("unknown mail sender %q", mailCfg.Sender)
+	}
+}
+
+// Service composes the application's e-mails from templates and hands them to a Mailer
+type Service struct {
+	Mailer    Mailer
+	Templates *Templates
+	From      string
+	Logger    *slog.Logger
+}
+
+// NewService returns a Service sending from the address from, e.g. "Fastnet VPN <no-reply@example.com>"
+func NewService(mailer Mailer, templates *Templates, from string, logger *slog.Logger) *Service {
+	return &Service{
+		Mailer:    mailer,
+		Templates: templates,
+		From:      from,
+		Logger:    logger,
+	}
+}
+
+// FromAddress formats the sender address from the configured name and address
+func FromAddress(name, address string) string {
+	return (&mail.Address{Name: name, Address: address}).String()
+}
+
+// Send renders the e-mail template name with data and sends it to to
+func (s *Service) Send(ctx context.Context, to, name string, data any, attachments ...Attachment) error {
+	msg, err := s.Templates.Render(name, data)
+	if err != nil {
+		return err
+	}
+
+	msg.From = s.From
+	msg.To = []string{to}
+	msg.Attachments = attachments
+
+	err = s.Mailer.Send(ctx, msg)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "email failed", "template", name, "to", MaskAddress(to), "error", err)
+		return err
+	}
+
+	s.Logger.InfoContext(ctx, "email submitted", "template", name, "to", MaskAddress(to), "message_id", msg.MessageID)
+	return nil
 }
 
-func NewEmailService() *EmailService {
-	return &EmailService{
-		SMTPHost: os.Getenv("SMTP_HOST"),
-		SMTPPort: os.Getenv("SMTP_PORT"),
-		From:     os.Getenv("SMTP_FROM"),
-		Password: os.Getenv("SMTP_PASSWORD"),
+// MaskAddress keeps the first letter and the domain of address, enough to
+// tell messages and failed logins apart in the logs without recording whose
+// they are
+func MaskAddress(address string) string {
+	local, domain, ok := strings.Cut(address, "@")
+	if !ok || local == "" {
+		return "***"
 	}
+	_, size := utf8.DecodeRuneInString(local)
+	return local[:size] + "***@" + domain
+}
+
+// VerificationCode is the data for the verification_code e-mail
+type VerificationCode struct {
+	Code             string
+	ExpiresInMinutes int
 }
 
 // GenerateVerificationCode generates a random 6-digit code
@@ -35,35 +104,13 @@ func GenerateVerificationCode() (string, error) {
 }
 
 // SendVerificationCode sends a verification code to the specified email
-func (e *EmailService) SendVerificationCode(to, code string) error {
-	auth := smtp.PlainAuth("", e.From, e.Password, e.SMTPHost)
-
-	subject := "Subject: Fastnet VPN - Verification Code\r\n"
-	mime := "MIME-version: 1.0;\r\nContent-Type: text/html; charset=\"UTF-8\";\r\n\r\n"
-	
-	body := fmt.Sprintf(`
-		<html>
-		<body style="font-family: Arial, sans-serif;">
-			<div style="max-width: 600px; margin: 0 auto; padding: 20px;">
-				<h2 style="color: #333;">Fastnet VPN Verification</h2>
-				<p>Your verification code is:</p>
-				<div style="background-color: #f4f4f4; padding: 15px; text-align: center; font-size: 32px; font-weight: bold; letter-spacing: 5px; margin: 20px 0;">
-					%s
-				</div>
-				<p>This code will expire in 10 minutes.</p>
-				<p>If you didn't request this code, please ignore this email.</p>
-			</div>
-		</body>
-		</html>
-	`, code)
-
-	message := []byte(subject + mime + body)
-
-	addr := fmt.Sprintf("%s:%s", e.SMTPHost, e.SMTPPort)
-	err := smtp.SendMail(addr, auth, e.From, []string{to}, message)
+func (s *Service) SendVerificationCode(ctx context.Context, to, code string) error {
+	err := s.Send(ctx, to, "verification_code", VerificationCode{Code: code, ExpiresInMinutes: 10})
 	if err != nil {
+		metrics.VerificationEmails.WithLabelValues("failed").Inc()
 		return err
 	}
 
+	metrics.VerificationEmails.WithLabelValues("sent").Inc()
 	return nil
-}
\ No newline at end of file
+}
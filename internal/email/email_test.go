@@ -0,0 +1,350 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// part is a decoded leaf of a MIME tree
+type part struct {
+	contentType string
+	disposition string
+	body        string
+}
+
+// parseMessage parses raw and flattens its MIME tree, decoding transfer encodings
+func parseMessage(t *testing.T, raw []byte) (*mail.Message, []part) {
+	t.Helper()
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var parts []part
+	var walk func(contentType string, header func(string) string, body io.Reader)
+	walk = func(contentType string, header func(string) string, body io.Reader) {
+		mediaType, params, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.HasPrefix(mediaType, "multipart/") {
+			r := multipart.NewReader(body, params["boundary"])
+			for {
+				p, err := r.NextPart()
+				if err == io.EOF {
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				walk(p.Header.Get("Content-Type"), p.Header.Get, p)
+			}
+		}
+
+		// multipart.Reader already decodes quoted-printable
+		data, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header("Content-Transfer-Encoding") == "base64" {
+			data = decodeBase64(t, data)
+		}
+		if strings.HasPrefix(mediaType, "text/") {
+			// text bodies travel with CRLF line endings
+			data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+		}
+		parts = append(parts, part{contentType: mediaType, disposition: header("Content-Disposition"), body: string(data)})
+	}
+
+	walk(msg.Header.Get("Content-Type"), msg.Header.Get, msg.Body)
+	return msg, parts
+}
+
+func decodeBase64(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\r\n")) {
+		if len(line) > 76 {
+			t.Fatalf("base64 line longer than 76 characters: %d", len(line))
+		}
+	}
+
+	out := make([]byte, len(data))
+	n, err := base64.StdEncoding.Decode(out, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out[:n]
+}
+
+func testMessage() *Message {
+	return &Message{
+		From:    "Fastnet VPN <no-reply@example.com>",
+		To:      []string{"Jane Roe <jane@example.com>"},
+		Subject: "Grüße\r\nBcc: evil@example.com",
+		Text:    "Hello Jane,\nyour code is 123456.",
+		HTML:    "<p>Hello Jane, your code is <b>123456</b>.</p>",
+	}
+}
+
+func TestMessageAlternative(t *testing.T) {
+	m := testMessage()
+	raw, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, parts := parseMessage(t, raw)
+
+	for _, key := range []string{"From", "To", "Date", "Message-Id", "Mime-Version"} {
+		if msg.Header.Get(key) == "" {
+			t.Errorf("missing %s header", key)
+		}
+	}
+	if msg.Header.Get("Bcc") != "" {
+		t.Fatal("a newline in the subject injected a header")
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "Grüße Bcc: evil@example.com" {
+		t.Fatalf("unexpected subject %q", subject)
+	}
+	if msg.Header.Get("Message-Id") != m.MessageID || !strings.HasSuffix(m.MessageID, "@example.com>") {
+		t.Fatalf("unexpected Message-ID %q", m.MessageID)
+	}
+	if _, err := msg.Header.Date(); err != nil {
+		t.Fatalf("invalid Date header: %v", err)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("expected multipart/alternative, got %s", mediaType)
+	}
+	if len(parts) != 2 || parts[0].contentType != "text/plain" || parts[1].contentType != "text/html" {
+		t.Fatalf("unexpected parts %+v", parts)
+	}
+	if parts[0].body != m.Text || parts[1].body != m.HTML {
+		t.Fatalf("bodies do not round-trip: %+v", parts)
+	}
+}
+
+func TestMessageWithAttachments(t *testing.T) {
+	m := testMessage()
+	pdf := bytes.Repeat([]byte("%PDF-1.7 binary \x00\xff"), 20)
+	m.Attachments = []Attachment{
+		{Filename: "invoice FN-1.pdf", Data: pdf},
+		{Filename: "../../wg0.conf", ContentType: "text/plain", Data: []byte("[Interface]\n")},
+	}
+
+	raw, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, parts := parseMessage(t, raw)
+
+	mediaType, _, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if mediaType != "multipart/mixed" {
+		t.Fatalf("expected multipart/mixed, got %s", mediaType)
+	}
+	if len(parts) != 4 {
+		t.Fatalf("expected text, html and 2 attachments, got %+v", parts)
+	}
+
+	if parts[2].contentType != "application/pdf" || parts[2].body != string(pdf) {
+		t.Fatalf("pdf attachment did not round-trip: %s", parts[2].contentType)
+	}
+	_, params, err := mime.ParseMediaType(parts[2].disposition)
+	if err != nil || params["filename"] != "invoice FN-1.pdf" {
+		t.Fatalf("unexpected disposition %q", parts[2].disposition)
+	}
+
+	_, params, _ = mime.ParseMediaType(parts[3].disposition)
+	if params["filename"] != "wg0.conf" || parts[3].body != "[Interface]\n" {
+		t.Fatalf("unexpected attachment %q %q", parts[3].disposition, parts[3].body)
+	}
+}
+
+func TestMessageSingleBody(t *testing.T) {
+	m := testMessage()
+	m.HTML = ""
+
+	raw, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, parts := parseMessage(t, raw)
+
+	mediaType, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if mediaType != "text/plain" || params["charset"] != "UTF-8" || len(parts) != 1 || parts[0].body != m.Text {
+		t.Fatalf("unexpected plain-text message %s %+v", mediaType, parts)
+	}
+}
+
+func TestMessageValidation(t *testing.T) {
+	tests := map[string]func(m *Message){
+		"no body":       func(m *Message) { m.Text, m.HTML = "", "" },
+		"no recipients": func(m *Message) { m.To = nil },
+		"bad from":      func(m *Message) { m.From = "not an address" },
+		"bad to":        func(m *Message) { m.To = []string{"jane@example.com\r\nBcc: x@example.com"} },
+		"no filename":   func(m *Message) { m.Attachments = []Attachment{{Filename: "/"}} },
+	}
+
+	for name, mutate := range tests {
+		t.Run(name, func(t *testing.T) {
+			m := testMessage()
+			mutate(m)
+			if _, err := m.Bytes(); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	templates, err := ParseTemplates("../../templates/email")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := templates.Render("verification_code", VerificationCode{Code: "<042317>", ExpiresInMinutes: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.Subject != "Fastnet VPN - Verification Code" {
+		t.Fatalf("unexpected subject %q", msg.Subject)
+	}
+	if !strings.Contains(msg.Text, "Your verification code is: <042317>") || !strings.Contains(msg.Text, "10 minutes") {
+		t.Fatalf("unexpected text body %q", msg.Text)
+	}
+	if !strings.Contains(msg.HTML, "&lt;042317&gt;") || !strings.Contains(msg.HTML, "<!DOCTYPE html>") {
+		t.Fatalf("html body is not escaped or not using the layout: %q", msg.HTML)
+	}
+
+	if _, err := templates.Render("missing", nil); err == nil {
+		t.Fatal("expected an error for an unknown template")
+	}
+	if _, err := templates.Render("verification_code", map[string]string{}); err == nil {
+		t.Fatal("expected an error for missing template data")
+	}
+}
+
+func TestParseTemplatesRequiresSubjectAndText(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("welcome.txt.tmpl", "Welcome")
+	if _, err := ParseTemplates(dir); err == nil {
+		t.Fatal("expected an error for a template without a subject")
+	}
+
+	write("welcome.txt.tmpl", `{{define "subject"}}Welcome{{end}}Hello`)
+	write("receipt.html.tmpl", "<p>Receipt</p>")
+	if _, err := ParseTemplates(dir); err == nil {
+		t.Fatal("expected an error for an HTML template without a text version")
+	}
+
+	if _, err := ParseTemplates(t.TempDir()); err == nil {
+		t.Fatal("expected an error for an empty directory")
+	}
+}
+
+func TestServiceSend(t *testing.T) {
+	templates, err := ParseTemplates("../../templates/email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailer := NewMemoryMailer()
+	var logs bytes.Buffer
+	service := NewService(mailer, templates, FromAddress("Fastnet VPN", "no-reply@example.com"), slog.New(slog.NewTextHandler(&logs, nil)))
+
+	err = service.SendVerificationCode(context.Background(), "jane@example.com", "123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, ok := mailer.Last("jane@example.com")
+	if !ok {
+		t.Fatal("nothing was sent")
+	}
+	if msg.From != `"Fastnet VPN" <no-reply@example.com>` || msg.MessageID == "" || msg.Date.IsZero() {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+	if !strings.Contains(msg.Text, "123456") || !strings.Contains(msg.HTML, "123456") {
+		t.Fatal("the code is missing from the message")
+	}
+
+	mailer.Err = errors.New("smtp down")
+	if err := service.SendVerificationCode(context.Background(), "jane@example.com", "654321"); err == nil {
+		t.Fatal("expected the mailer error")
+	}
+	if n := len(mailer.Messages()); n != 1 {
+		t.Fatalf("expected only the first message, got %d", n)
+	}
+	if strings.Contains(logs.String(), "jane@example.com") || strings.Count(logs.String(), "to=j***@example.com") != 2 {
+		t.Fatalf("expected the recipient masked in the logs, got\n%s", logs.String())
+	}
+}
+
+func TestMaskAddress(t *testing.T) {
+	for address, want := range map[string]string{
+		"jane@example.com": "j***@example.com",
+		"élan@example.com": "é***@example.com",
+		"@example.com":     "***",
+		"not an address":   "***",
+	} {
+		if got := MaskAddress(address); got != want {
+			t.Errorf("%q: expected %q, got %q", address, want, got)
+		}
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	mailer := NewFileMailer(dir)
+
+	m := testMessage()
+	m.Date = time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	if err := mailer.Send(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || !strings.HasPrefix(entries[0].Name(), "20261019T120000") || filepath.Ext(entries[0].Name()) != ".eml" {
+		t.Fatalf("unexpected files %v", entries)
+	}
+
+	raw, err := os.ReadFile(filepath.Join(dir, entries[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, _ := parseMessage(t, raw)
+	if msg.Header.Get("Message-Id") != m.MessageID {
+		t.Fatal("written message does not match")
+	}
+}
@@ -0,0 +1,59 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileMailer is a Mailer that writes every message as an .eml file into Dir,
+// for development and for inspecting what would have been sent
+type FileMailer struct {
+	Dir string
+}
+
+// NewFileMailer returns a FileMailer writing into dir, which is created on first use
+func NewFileMailer(dir string) *FileMailer {
+	return &FileMailer{Dir: dir}
+}
+
+// Send writes msg to a new file named after its date and Message-ID
+func (f *FileMailer) Send(ctx context.Context, msg *Message) error {
+	data, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(f.Dir, 0o755)
+	if err != nil {
+		return fmt.Errorf("creating mail drop directory: %w", err)
+	}
+
+	id := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		}
+		return -1
+	}, msg.MessageID)
+	name := fmt.Sprintf("%s-%s.eml", msg.Date.UTC().Format("20060102T150405.000000000"), id)
+
+	// write under a temporary name first so readers never see partial files
+	tmp, err := os.CreateTemp(f.Dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(f.Dir, name))
+}
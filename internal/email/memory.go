@@ -0,0 +1,66 @@
+package email
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryMailer is a Mailer that keeps messages in memory instead of sending
+// them, for tests. Setting Err makes every send fail with it.
+type MemoryMailer struct {
+	mu       sync.Mutex
+	messages []Message
+	Err      error
+}
+
+// NewMemoryMailer returns an empty MemoryMailer
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+// Send records msg after checking that it renders
+func (m *MemoryMailer) Send(ctx context.Context, msg *Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.Err != nil {
+		return m.Err
+	}
+	if _, err := msg.Bytes(); err != nil {
+		return err
+	}
+
+	m.messages = append(m.messages, *msg)
+	return nil
+}
+
+// Messages returns a copy of everything sent so far
+func (m *MemoryMailer) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]Message(nil), m.messages...)
+}
+
+// Last returns the most recent message sent to the address to
+func (m *MemoryMailer) Last(to string) (Message, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := len(m.messages) - 1; i >= 0; i-- {
+		for _, addr := range m.messages[i].To {
+			if addr == to {
+				return m.messages[i], true
+			}
+		}
+	}
+	return Message{}, false
+}
+
+// Reset forgets every recorded message
+func (m *MemoryMailer) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.messages = nil
+}
@@ -0,0 +1,263 @@
+package email
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Message is an e-mail with a plain-text and/or HTML body and optional attachments
+type Message struct {
+	From        string
+	To          []string
+	ReplyTo     string
+	Subject     string
+	Text        string
+	HTML        string
+	Attachments []Attachment
+
+	// Date and MessageID are filled in by Bytes when left empty
+	Date      time.Time
+	MessageID string
+}
+
+// Attachment is a file attached to a Message. ContentType is derived from
+// the file name when empty.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// Envelope returns the bare sender and recipient addresses used by the transport
+func (m *Message) Envelope() (string, []string, error) {
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid From %q: %w", m.From, err)
+	}
+	if len(m.To) == 0 {
+		return "", nil, errors.New("message has no recipients")
+	}
+
+	to := make([]string, 0, len(m.To))
+	for _, addr := range m.To {
+		a, err := mail.ParseAddress(addr)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid To %q: %w", addr, err)
+		}
+		to = append(to, a.Address)
+	}
+
+	return from.Address, to, nil
+}
+
+// Bytes renders the message as RFC 5322 text. A message with both bodies is
+// sent as multipart/alternative, wrapped in multipart/mixed when it has attachments.
+func (m *Message) Bytes() ([]byte, error) {
+	if m.Text == "" && m.HTML == "" {
+		return nil, errors.New("message has no body")
+	}
+
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid From %q: %w", m.From, err)
+	}
+	if len(m.To) == 0 {
+		return nil, errors.New("message has no recipients")
+	}
+	to := make([]string, 0, len(m.To))
+	for _, addr := range m.To {
+		a, err := mail.ParseAddress(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid To %q: %w", addr, err)
+		}
+		to = append(to, a.String())
+	}
+
+	if m.Date.IsZero() {
+		m.Date = time.Now()
+	}
+	if m.MessageID == "" {
+		m.MessageID, err = newMessageID(from.Address)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var buf bytes.Buffer
+	header := func(key, value string) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", key, value)
+	}
+
+	header("From", from.String())
+	header("To", strings.Join(to, ", "))
+	if m.ReplyTo != "" {
+		replyTo, err := mail.ParseAddress(m.ReplyTo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Reply-To %q: %w", m.ReplyTo, err)
+		}
+		header("Reply-To", replyTo.String())
+	}
+	header("Subject", mime.QEncoding.Encode("utf-8", oneLine(m.Subject)))
+	header("Date", m.Date.Format(time.RFC1123Z))
+	header("Message-ID", m.MessageID)
+	header("MIME-Version", "1.0")
+
+	bodyHeader, body, err := renderBody(m.Text, m.HTML)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(m.Attachments) == 0 {
+		for _, key := range []string{"Content-Type", "Content-Transfer-Encoding"} {
+			if v := bodyHeader.Get(key); v != "" {
+				header(key, v)
+			}
+		}
+		buf.WriteString("\r\n")
+		buf.Write(body)
+		return buf.Bytes(), nil
+	}
+
+	mixed := multipart.NewWriter(&buf)
+	header("Content-Type", mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": mixed.Boundary()}))
+	buf.WriteString("\r\n")
+
+	part, err := mixed.CreatePart(bodyHeader)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := part.Write(body); err != nil {
+		return nil, err
+	}
+
+	for _, a := range m.Attachments {
+		if err := writeAttachment(mixed, a); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mixed.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// renderBody returns the headers and content of the body: a single text part
+// when only one of text and html is set, multipart/alternative otherwise
+func renderBody(text, html string) (textproto.MIMEHeader, []byte, error) {
+	switch {
+	case html == "":
+		return textPart("text/plain", text)
+	case text == "":
+		return textPart("text/html", html)
+	}
+
+	var buf bytes.Buffer
+	alt := multipart.NewWriter(&buf)
+
+	for _, p := range []struct{ contentType, body string }{{"text/plain", text}, {"text/html", html}} {
+		header, body, err := textPart(p.contentType, p.body)
+		if err != nil {
+			return nil, nil, err
+		}
+		part, err := alt.CreatePart(header)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err := part.Write(body); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := alt.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	header := textproto.MIMEHeader{
+		"Content-Type": {mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": alt.Boundary()})},
+	}
+	return header, buf.Bytes(), nil
+}
+
+func textPart(contentType, body string) (textproto.MIMEHeader, []byte, error) {
+	var buf bytes.Buffer
+	qp := quotedprintable.NewWriter(&buf)
+	if _, err := qp.Write([]byte(strings.ReplaceAll(body, "\r\n", "\n"))); err != nil {
+		return nil, nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	header := textproto.MIMEHeader{
+		"Content-Type":              {contentType + "; charset=UTF-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	}
+	return header, buf.Bytes(), nil
+}
+
+func writeAttachment(w *multipart.Writer, a Attachment) error {
+	name := filepath.Base(oneLine(a.Filename))
+	if name == "." || name == "/" {
+		return fmt.Errorf("attachment %q has no file name", a.Filename)
+	}
+
+	contentType := a.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(name))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {mime.FormatMediaType(contentType, map[string]string{"name": name})},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": name})},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return err
+	}
+
+	// base64 bodies are wrapped at 76 characters
+	encoded := base64.StdEncoding.EncodeToString(a.Data)
+	for len(encoded) > 76 {
+		if _, err := io.WriteString(part, encoded[:76]+"\r\n"); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err = io.WriteString(part, encoded+"\r\n")
+	return err
+}
+
+// oneLine keeps header values from smuggling in extra header lines
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(strings.NewReplacer("\r", " ", "\n", " ").Replace(s)), " ")
+}
+
+func newMessageID(from string) (string, error) {
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at >= 0 {
+		domain = from[at+1:]
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("<%s.%s@%s>", time.Now().UTC().Format("20060102150405"), hex.EncodeToString(b), domain), nil
+}
@@ -0,0 +1,153 @@
+package email
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/config"
+)
+
+// TLS modes for SMTPMailer
+const (
+	TLSStartTLS = "starttls"
+	TLSImplicit = "tls"
+	TLSNone     = "none"
+)
+
+// SMTPMailer is a Mailer that delivers through an SMTP server
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	TLS      string
+	Timeout  time.Duration
+
+	// TLSConfig overrides the TLS settings, e.g. to trust a private CA
+	TLSConfig *tls.Config
+}
+
+// NewSMTPMailer returns an SMTPMailer for the given server settings. The
+// username defaults to the sender address.
+func NewSMTPMailer(cfg config.SMTPConfig) *SMTPMailer {
+	username := cfg.Username
+	if username == "" {
+		username = cfg.From
+	}
+
+	return &SMTPMailer{
+		Host:     cfg.Host,
+		Port:     cfg.Port,
+		Username: username,
+		Password: cfg.Password,
+		TLS:      cfg.TLS,
+		Timeout:  cfg.Timeout,
+	}
+}
+
+// Send delivers msg in a single SMTP session
+func (s *SMTPMailer) Send(ctx context.Context, msg *Message) error {
+	data, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	from, to, err := msg.Envelope()
+	if err != nil {
+		return err
+	}
+
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	conn, err := s.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// the deadline covers the whole conversation, not just the dial
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+
+	client, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		return fmt.Errorf("smtp greeting: %w", err)
+	}
+	defer client.Close()
+
+	if s.TLS == TLSStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("smtp server %s does not support STARTTLS", s.Host)
+		}
+		if err := client.StartTLS(s.tlsConfig()); err != nil {
+			return fmt.Errorf("smtp starttls: %w", err)
+		}
+	}
+
+	if s.Password != "" {
+		if ok, _ := client.Extension("AUTH"); ok {
+			if err := client.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host)); err != nil {
+				return fmt.Errorf("smtp auth: %w", err)
+			}
+		}
+	}
+
+	if err := client.Mail(from); err != nil {
+		return fmt.Errorf("smtp MAIL FROM: %w", err)
+	}
+	for _, rcpt := range to {
+		if err := client.Rcpt(rcpt); err != nil {
+			return fmt.Errorf("smtp RCPT TO %s: %w", rcpt, err)
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("smtp DATA: %w", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("smtp DATA: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("smtp DATA: %w", err)
+	}
+
+	return client.Quit()
+}
+
+func (s *SMTPMailer) dial(ctx context.Context) (net.Conn, error) {
+	addr := net.JoinHostPort(s.Host, s.Port)
+
+	if s.TLS == TLSImplicit {
+		dialer := &tls.Dialer{Config: s.tlsConfig()}
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("smtp dial %s: %w", addr, err)
+		}
+		return conn, nil
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("smtp dial %s: %w", addr, err)
+	}
+	return conn, nil
+}
+
+func (s *SMTPMailer) tlsConfig() *tls.Config {
+	if s.TLSConfig != nil {
+		return s.TLSConfig.Clone()
+	}
+	return &tls.Config{ServerName: s.Host, MinVersion: tls.VersionTLS12}
+}
@@ -0,0 +1,240 @@
+package email
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// smtpServer is a minimal SMTP server recording what a client sent
+type smtpServer struct {
+	listener net.Listener
+	tls      *tls.Config
+	startTLS bool
+
+	mu       sync.Mutex
+	auth     string
+	mailFrom string
+	rcptTo   []string
+	data     string
+	usedTLS  bool
+}
+
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// startSMTPServer listens on a random port. implicit wraps the listener in
+// TLS; otherwise STARTTLS is offered when startTLS is set.
+func startSMTPServer(t *testing.T, implicit, startTLS bool) (*smtpServer, *x509.CertPool) {
+	t.Helper()
+
+	cert, pool := newTestCertificate(t)
+	s := &smtpServer{tls: &tls.Config{Certificates: []tls.Certificate{cert}}, startTLS: startTLS}
+
+	var err error
+	if implicit {
+		s.listener, err = tls.Listen("tcp", "127.0.0.1:0", s.tls)
+	} else {
+		s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.listener.Close() })
+
+	go func() {
+		for {
+			conn, err := s.listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, implicit)
+		}
+	}()
+
+	return s, pool
+}
+
+func (s *smtpServer) serve(conn net.Conn, secure bool) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 test ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb, arg, _ := strings.Cut(line, " ")
+
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			reply("250-test")
+			if s.startTLS && !secure {
+				reply("250-STARTTLS")
+			}
+			reply("250 AUTH PLAIN")
+		case "STARTTLS":
+			reply("220 go ahead")
+			tlsConn := tls.Server(conn, s.tls)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, r, secure = tlsConn, bufio.NewReader(tlsConn), true
+			reply = func(line string) { conn.Write([]byte(line + "\r\n")) }
+		case "AUTH":
+			_, initial, _ := strings.Cut(arg, " ")
+			decoded, _ := base64.StdEncoding.DecodeString(initial)
+			s.mu.Lock()
+			s.auth = string(decoded)
+			s.mu.Unlock()
+			reply("235 ok")
+		case "MAIL":
+			s.mu.Lock()
+			s.mailFrom = arg
+			s.usedTLS = secure
+			s.mu.Unlock()
+			reply("250 ok")
+		case "RCPT":
+			s.mu.Lock()
+			s.rcptTo = append(s.rcptTo, arg)
+			s.mu.Unlock()
+			reply("250 ok")
+		case "DATA":
+			reply("354 send it")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			s.mu.Lock()
+			s.data = data.String()
+			s.mu.Unlock()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func (s *smtpServer) mailer(mode string, pool *x509.CertPool) *SMTPMailer {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	return &SMTPMailer{
+		Host:      host,
+		Port:      port,
+		Username:  "no-reply@example.com",
+		Password:  "secret",
+		TLS:       mode,
+		Timeout:   5 * time.Second,
+		TLSConfig: &tls.Config{RootCAs: pool, ServerName: host},
+	}
+}
+
+func TestSMTPMailerStartTLS(t *testing.T) {
+	server, pool := startSMTPServer(t, false, true)
+
+	m := testMessage()
+	m.To = append(m.To, "ops@example.com")
+	if err := server.mailer(TLSStartTLS, pool).Send(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if !server.usedTLS {
+		t.Fatal("message was sent before upgrading to TLS")
+	}
+	if server.auth != "\x00no-reply@example.com\x00secret" {
+		t.Fatalf("unexpected AUTH PLAIN credentials %q", server.auth)
+	}
+	if server.mailFrom != "FROM:<no-reply@example.com>" {
+		t.Fatalf("unexpected MAIL FROM %q", server.mailFrom)
+	}
+	if len(server.rcptTo) != 2 || server.rcptTo[0] != "TO:<jane@example.com>" || server.rcptTo[1] != "TO:<ops@example.com>" {
+		t.Fatalf("unexpected RCPT TO %v", server.rcptTo)
+	}
+	if !strings.Contains(server.data, "Message-ID: "+m.MessageID) {
+		t.Fatalf("the rendered message was not sent: %q", server.data)
+	}
+}
+
+func TestSMTPMailerImplicitTLS(t *testing.T) {
+	server, pool := startSMTPServer(t, true, false)
+
+	if err := server.mailer(TLSImplicit, pool).Send(context.Background(), testMessage()); err != nil {
+		t.Fatal(err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if !server.usedTLS || server.data == "" {
+		t.Fatal("message was not delivered over TLS")
+	}
+}
+
+func TestSMTPMailerRequiresStartTLS(t *testing.T) {
+	server, pool := startSMTPServer(t, false, false)
+
+	err := server.mailer(TLSStartTLS, pool).Send(context.Background(), testMessage())
+	if err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Fatalf("expected a STARTTLS error, got %v", err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.auth != "" || server.data != "" {
+		t.Fatal("credentials or data were sent over a plain connection")
+	}
+}
@@ -0,0 +1,101 @@
+package email
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Templates renders e-mails from a directory holding, for every e-mail name,
+// name.txt.tmpl (the plain-text body, defining a "subject" template) and
+// name.html.tmpl (the HTML body, which may use the *.layout.tmpl files)
+type Templates struct {
+	text map[string]*texttemplate.Template
+	html map[string]*htmltemplate.Template
+}
+
+// ParseTemplates parses every e-mail template in dir
+func ParseTemplates(dir string) (*Templates, error) {
+	t := &Templates{
+		text: map[string]*texttemplate.Template{},
+		html: map[string]*htmltemplate.Template{},
+	}
+
+	texts, err := filepath.Glob(filepath.Join(dir, "*.txt.tmpl"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range texts {
+		name := strings.TrimSuffix(filepath.Base(path), ".txt.tmpl")
+		tmpl, err := texttemplate.New(filepath.Base(path)).Option("missingkey=error").ParseFiles(path)
+		if err != nil {
+			return nil, err
+		}
+		if tmpl.Lookup("subject") == nil {
+			return nil, fmt.Errorf("e-mail template %s does not define a subject", path)
+		}
+		t.text[name] = tmpl
+	}
+
+	layouts, err := filepath.Glob(filepath.Join(dir, "*.layout.tmpl"))
+	if err != nil {
+		return nil, err
+	}
+	pages, err := filepath.Glob(filepath.Join(dir, "*.html.tmpl"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range pages {
+		name := strings.TrimSuffix(filepath.Base(path), ".html.tmpl")
+		if _, ok := t.text[name]; !ok {
+			return nil, fmt.Errorf("e-mail template %s has no plain-text version %s.txt.tmpl", path, name)
+		}
+
+		tmpl, err := htmltemplate.New(filepath.Base(path)).Option("missingkey=error").ParseFiles(append([]string{path}, layouts...)...)
+		if err != nil {
+			return nil, err
+		}
+		t.html[name] = tmpl
+	}
+
+	if len(t.text) == 0 {
+		return nil, fmt.Errorf("no e-mail templates found in %s", dir)
+	}
+
+	return t, nil
+}
+
+// Render builds the subject and bodies of the e-mail name. The HTML body is
+// left empty for e-mails that only have a plain-text template.
+func (t *Templates) Render(name string, data any) (*Message, error) {
+	text, ok := t.text[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown e-mail template %q", name)
+	}
+
+	var subject, body bytes.Buffer
+	if err := text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, fmt.Errorf("rendering %s subject: %w", name, err)
+	}
+	if err := text.Execute(&body, data); err != nil {
+		return nil, fmt.Errorf("rendering %s text: %w", name, err)
+	}
+
+	msg := &Message{
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    body.String(),
+	}
+
+	if html, ok := t.html[name]; ok {
+		var buf bytes.Buffer
+		if err := html.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("rendering %s html: %w", name, err)
+		}
+		msg.HTML = buf.String()
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,72 @@
+// Package failover checks the health of the VPN nodes and moves the peers of
+// nodes that are down to another node in the same country: when their users
+// ask for it, or on their own once the node has been down for a while.
+package failover
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/repository"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/vpn"
+)
+
+// ErrNoNode is returned when no other node in the country of a peer's node
+// serves its protocol with room to spare
+var ErrNoNode = errors.New("no other node can take the peer")
+
+// MoveOff moves peer off node, its current node, to the least loaded node in
+// the same country serving its protocol, and returns the peer and the node it
+// is on now
+func MoveOff(ctx context.Context, repo repository.DatabaseRepo, peer models.VpnPeer, node models.VpnNode) (models.VpnPeer, models.VpnNode, error) {
+	target, err := repo.SelectVpnNode(ctx, node.Country, peer.Protocol, node.ID)
+	if err == sql.ErrNoRows {
+		return models.VpnPeer{}, models.VpnNode{}, ErrNoNode
+	}
+	if err != nil {
+		return models.VpnPeer{}, models.VpnNode{}, err
+	}
+
+	peer, err = Move(ctx, repo, peer, target)
+	if err != nil {
+		return models.VpnPeer{}, models.VpnNode{}, err
+	}
+	return peer, target, nil
+}
+
+// Move places peer on node. The peer keeps its keys and, for tunneled
+// protocols, gets an address in the subnet of node; the configs downloaded
+// before point at the old node and have to be downloaded again.
+func Move(ctx context.Context, repo repository.DatabaseRepo, peer models.VpnPeer, node models.VpnNode) (models.VpnPeer, error) {
+	protocol, err := vpn.Lookup(peer.Protocol)
+	if err != nil {
+		return models.VpnPeer{}, err
+	}
+
+	// the address stays locked until the peer holding it is stored
+	err = repo.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		var address string
+		if protocol.Tunneled() {
+			err := repo.LockVpnPeerAddresses(ctx, node.ID)
+			if err != nil {
+				return err
+			}
+			used, err := repo.GetVpnPeerAddresses(ctx, node.ID)
+			if err != nil {
+				return err
+			}
+			address, err = vpn.NextAddress(node.Subnet, used)
+			if err != nil {
+				return err
+			}
+		}
+		return repo.MoveVpnPeer(ctx, peer.ID, node.ID, address)
+	})
+	if err != nil {
+		return models.VpnPeer{}, err
+	}
+
+	return repo.GetVpnPeerById(ctx, peer.ID)
+}
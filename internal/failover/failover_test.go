@@ -0,0 +1,262 @@
+package failover
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/config"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/email"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/notify"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/outbox"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/repository/dbrepo"
+)
+
+// addNode stores a node whose agent has just reported
+func addNode(t *testing.T, repo *dbrepo.TestingRepo, node models.VpnNode) models.VpnNode {
+	t.Helper()
+
+	node.State, node.Capacity = models.NodeEnabled, 10
+	id, err := repo.InsertVpnNode(context.Background(), node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.UpdateVpnNodeAgentStatus(context.Background(), models.VpnNodeAgentStatus{NodeID: id, Applied: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node, err = repo.GetVpnNodeById(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+// events returns the events a user was notified about, oldest first
+func events(t *testing.T, repo *dbrepo.TestingRepo, userID int) []string {
+	t.Helper()
+
+	feed, err := repo.GetNotificationsByUserId(context.Background(), userID, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, len(feed))
+	for i, n := range feed {
+		names[len(feed)-1-i] = n.Event
+	}
+	return names
+}
+
+func TestAssess(t *testing.T) {
+	now := time.Now()
+	node := models.VpnNode{ID: 1, Health: models.NodeDegraded, HealthFailures: 2}
+
+	for _, tt := range []struct {
+		name               string
+		failures, warnings []string
+		health             string
+		count              int
+	}{
+		{"clean", nil, nil, models.NodeHealthy, 0},
+		{"warning", nil, []string{"stale handshakes"}, models.NodeDegraded, 0},
+		{"third failure", []string{"unreachable"}, nil, models.NodeDown, 3},
+	} {
+		health := assess(node, tt.failures, tt.warnings, 3, now)
+		if health.Health != tt.health || health.Failures != tt.count || !health.CheckedAt.Equal(now) {
+			t.Errorf("%s: expected %s after %d failures, got %+v", tt.name, tt.health, tt.count, health)
+		}
+	}
+}
+
+func TestMoveOff(t *testing.T) {
+	ctx := context.Background()
+	repo := dbrepo.NewTestingRepo(&config.AppConfig{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+
+	// de-1 is degraded but still the least loaded node in DE
+	de1 := addNode(t, repo, models.VpnNode{Name: "de-1", Country: "DE", Endpoint: "de1.example.com:51820", Subnet: "10.9.0.0/24"})
+	de2 := addNode(t, repo, models.VpnNode{Name: "de-2", Country: "DE", Endpoint: "de2.example.com:51820", Subnet: "10.10.0.0/24"})
+	err := repo.UpdateVpnNodeHealth(ctx, models.VpnNodeHealth{NodeID: de1.ID, Health: models.NodeDegraded, Reason: "stale handshakes", CheckedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var peers []models.VpnPeer
+	for i, node := range []models.VpnNode{de1, de2, de2} {
+		id, err := repo.InsertVpnPeer(ctx, models.VpnPeer{
+			UserID: 1, SubscriptionID: 1, NodeID: node.ID, Name: "Laptop", Protocol: models.ProtocolWireGuard,
+			PublicKey: "key" + strconv.Itoa(i), PrivateKey: "private", Address: "10.9.0." + strconv.Itoa(i+2) + "/32",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer, err := repo.GetVpnPeerById(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peers = append(peers, peer)
+	}
+
+	peer, target, err := MoveOff(ctx, repo, peers[0], de1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target.ID != de2.ID || peer.NodeID != de2.ID {
+		t.Fatalf("expected the peer moved to de-2, got %+v on %+v", peer, target)
+	}
+
+	err = repo.UpdateVpnNodeHealth(ctx, models.VpnNodeHealth{NodeID: de1.ID, Health: models.NodeDown, Reason: "unreachable", CheckedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := MoveOff(ctx, repo, peer, de2); err != ErrNoNode {
+		t.Fatalf("expected ErrNoNode with de-1 down, got %v", err)
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	repo := dbrepo.NewTestingRepo(&config.AppConfig{Logger: logger})
+	mailTemplates, err := email.ParseTemplates("../../templates/email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	templates, err := notify.ParseTemplates("../../templates/notifications")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := outbox.NewQueue(repo, config.Defaults().Outbox, logger)
+	notifier := notify.NewNotifier(repo, templates, email.NewService(queue, mailTemplates, "Fastnet VPN <no-reply@example.com>", logger), logger)
+
+	cfg := config.Defaults().Failover
+	cfg.HeartbeatTimeout = time.Hour
+	monitor := NewMonitor(repo, notifier, cfg, logger)
+	var unreachable atomic.Bool
+	monitor.probe = func(ctx context.Context, network, address string) error {
+		if unreachable.Load() && strings.HasPrefix(address, "de1.") {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+
+	de1 := addNode(t, repo, models.VpnNode{Name: "de-1", Country: "DE", Endpoint: "de1.example.com:51820", Subnet: "10.9.0.0/24", VLESSPort: 443})
+	de2 := addNode(t, repo, models.VpnNode{Name: "de-2", Country: "DE", Endpoint: "de2.example.com:51820", Subnet: "10.10.0.0/24"})
+	addNode(t, repo, models.VpnNode{Name: "fr-1", Country: "FR", Endpoint: "fr1.example.com:51820", Subnet: "10.11.0.0/24", VLESSPort: 443})
+
+	adminID, err := repo.AddUser(models.User{Username: "admin", Email: "admin@example.com", IsAdmin: true}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, err := repo.AddUser(models.User{Username: "jane", Email: "jane@example.com"}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	subID, err := repo.InsertSubscription(ctx, models.Subscription{
+		UserID: userID, PlanID: repo.AddPlan(models.Plan{Name: "Monthly", DurationDays: 30}), Status: "active",
+		StartsAt: now.Add(-time.Hour), ExpiresAt: now.AddDate(0, 1, 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	laptopID, err := repo.InsertVpnPeer(ctx, models.VpnPeer{
+		UserID: userID, SubscriptionID: subID, NodeID: de1.ID, Name: "Laptop", Protocol: models.ProtocolWireGuard,
+		PublicKey: "laptop", PrivateKey: "private", Address: "10.9.0.2/32",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	phoneID, err := repo.InsertVpnPeer(ctx, models.VpnPeer{
+		UserID: userID, SubscriptionID: subID, NodeID: de1.ID, Name: "Phone", Protocol: models.ProtocolVLESS, PublicKey: "phone",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(at time.Time) models.VpnNode {
+		t.Helper()
+		if err := monitor.RunOnce(ctx, at); err != nil {
+			t.Fatal(err)
+		}
+		node, err := repo.GetVpnNodeById(ctx, de1.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return node
+	}
+
+	ran, err := repo.WithLock(ctx, lockKey, func() error {
+		node := run(now)
+		if !node.HealthCheckedAt.IsZero() {
+			t.Fatalf("expected no check while another replica holds the lock, got %+v", node)
+		}
+		return nil
+	})
+	if err != nil || !ran {
+		t.Fatalf("expected the lock taken, got %v, %v", ran, err)
+	}
+
+	if node := run(now); node.Health != models.NodeHealthy || node.HealthCheckedAt.IsZero() {
+		t.Fatalf("expected a reachable node healthy, got %+v", node)
+	}
+
+	unreachable.Store(true)
+	node := run(now.Add(time.Minute))
+	if node.Health != models.NodeDegraded || node.HealthFailures != 1 || !strings.Contains(node.HealthReason, "wireguard udp/51820 unreachable") {
+		t.Fatalf("expected the first failure to degrade the node, got %+v", node)
+	}
+	run(now.Add(2 * time.Minute))
+	if node := run(now.Add(3 * time.Minute)); node.Health != models.NodeDown || node.HealthFailures != 3 {
+		t.Fatalf("expected the node down after 3 failures, got %+v", node)
+	}
+	if got := events(t, repo, adminID); strings.Join(got, ",") != "node_health,node_health" {
+		t.Fatalf("expected the admin alerted when the node degraded and went down, got %v", got)
+	}
+	if got := events(t, repo, userID); strings.Join(got, ",") != "node_down,node_down" {
+		t.Fatalf("expected the user offered the move of both devices, got %v", got)
+	}
+	if _, err := repo.SelectVpnNode(ctx, "DE", models.ProtocolVLESS, 0); err == nil {
+		t.Fatal("expected a down node to take no new peers")
+	}
+
+	run(now.Add(10 * time.Minute))
+	if laptop, _ := repo.GetVpnPeerById(ctx, laptopID); laptop.NodeID != de1.ID {
+		t.Fatal("expected the peers to stay until the node is down for MoveAfter")
+	}
+
+	run(now.Add(3*time.Minute + cfg.MoveAfter))
+	laptop, err := repo.GetVpnPeerById(ctx, laptopID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address, err := netip.ParsePrefix(laptop.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if laptop.NodeID != de2.ID || !netip.MustParsePrefix(de2.Subnet).Contains(address.Addr()) || laptop.PublicKey != "laptop" {
+		t.Fatalf("expected the laptop moved to de-2 with its keys, got %+v", laptop)
+	}
+	if phone, _ := repo.GetVpnPeerById(ctx, phoneID); phone.NodeID != de1.ID {
+		t.Fatal("expected the VLESS peer to stay, no other DE node serves VLESS")
+	}
+	if got := events(t, repo, userID); strings.Join(got, ",") != "node_down,node_down,device_moved" {
+		t.Fatalf("expected the user told about the moved device, got %v", got)
+	}
+
+	unreachable.Store(false)
+	if node := run(now.Add(20 * time.Minute)); node.Health != models.NodeHealthy || node.HealthFailures != 0 || node.HealthReason != "" {
+		t.Fatalf("expected the node healthy again, got %+v", node)
+	}
+	if got := events(t, repo, adminID); len(got) != 3 {
+		t.Fatalf("expected the admin told about the recovery, got %v", got)
+	}
+}
@@ -0,0 +1,361 @@
+package failover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/config"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/notify"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/repository"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/worker"
+)
+
+// lockKey is the advisory lock held while checking, so of several replicas
+// only one counts a failed check and moves the peers of a down node
+const lockKey int64 = 0x66617374_6661696c // "fastfail"
+
+// udpWait is how long a UDP probe waits for the host to refuse the packet
+const udpWait = time.Second
+
+// Monitor checks every node that is not disabled: whether its agent reports,
+// whether its ports are reachable and whether its peers shake hands. Nodes
+// failing DownAfter checks in a row are down; the admins are told whenever
+// the health of a node changes, the users on a down node are offered the move
+// to another node and, after MoveAfter, moved.
+type Monitor struct {
+	Repo repository.DatabaseRepo
+	// Notifier is nil when neither admins nor users are to be notified
+	Notifier *notify.Notifier
+	Config   config.FailoverConfig
+	Logger   *slog.Logger
+
+	// probe checks that address answers on network, "tcp" or "udp"
+	probe func(ctx context.Context, network, address string) error
+}
+
+// NewMonitor returns a Monitor notifying through notifier
+func NewMonitor(repo repository.DatabaseRepo, notifier *notify.Notifier, cfg config.FailoverConfig, logger *slog.Logger) *Monitor {
+	return &Monitor{
+		Repo:     repo,
+		Notifier: notifier,
+		Config:   cfg,
+		Logger:   logger,
+		probe:    probe,
+	}
+}
+
+// Run checks the nodes every Interval until ctx is done. It is meant to be
+// started on a worker.Group.
+func (m *Monitor) Run(ctx context.Context) error {
+	return worker.Every(ctx, m.Config.Interval, func(ctx context.Context) {
+		err := m.RunOnce(ctx, time.Now())
+		if err != nil && ctx.Err() == nil {
+			m.Logger.ErrorContext(ctx, "node health check failed", "error", err)
+		}
+	})
+}
+
+// RunOnce checks the nodes at now, unless another replica is checking them.
+// The probes of all nodes run at once; a node whose result cannot be stored is
+// logged and checked again on the next run.
+func (m *Monitor) RunOnce(ctx context.Context, now time.Time) error {
+	ran, err := m.Repo.WithLock(ctx, lockKey, func() error {
+		return m.checkAll(ctx, now)
+	})
+	if err == nil && !ran {
+		m.Logger.DebugContext(ctx, "node health check skipped, another replica is running it")
+	}
+	return err
+}
+
+// checkAll checks every node that is not disabled at now
+func (m *Monitor) checkAll(ctx context.Context, now time.Time) error {
+	nodes, err := m.Repo.GetVpnNodes(ctx)
+	if err != nil {
+		return fmt.Errorf("load nodes: %w", err)
+	}
+
+	results := make([]models.VpnNodeHealth, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		if node.State == models.NodeDisabled {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = m.check(ctx, node, now)
+		}()
+	}
+	wg.Wait()
+
+	for i, node := range nodes {
+		if node.State == models.NodeDisabled {
+			continue
+		}
+		err := m.update(ctx, node, results[i])
+		if err != nil {
+			m.Logger.ErrorContext(ctx, "unable to update node health", "node_id", node.ID, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// check finds the health of node at now. Missing agent reports and
+// unreachable ports are failures, which take the node down once DownAfter
+// checks in a row found them; agent errors and stale handshakes only make it
+// degraded.
+func (m *Monitor) check(ctx context.Context, node models.VpnNode, now time.Time) models.VpnNodeHealth {
+	var failures, warnings []string
+
+	switch {
+	case node.AgentSeenAt.IsZero():
+		failures = append(failures, "the node agent never reported")
+	case now.Sub(node.AgentSeenAt) > m.Config.HeartbeatTimeout:
+		failures = append(failures, fmt.Sprintf("no report from the node agent for %s", now.Sub(node.AgentSeenAt).Round(time.Second)))
+	case node.AgentError != "":
+		warnings = append(warnings, "the node agent failed: "+node.AgentError)
+	}
+
+	host, _, err := net.SplitHostPort(node.Endpoint)
+	if err != nil {
+		failures = append(failures, fmt.Sprintf("invalid endpoint %q", node.Endpoint))
+	} else {
+		for _, port := range ports(node) {
+			ctx, cancel := context.WithTimeout(ctx, m.Config.ProbeTimeout)
+			err := m.probe(ctx, port.network, net.JoinHostPort(host, port.port))
+			cancel()
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("%s %s/%s unreachable: %v", port.protocol, port.network, port.port, err))
+			}
+		}
+	}
+
+	if node.ActivePeers > 0 && !node.LastHandshakeAt.IsZero() && now.Sub(node.LastHandshakeAt) > m.Config.HandshakeTimeout {
+		warnings = append(warnings, fmt.Sprintf("no handshake from any peer for %s", now.Sub(node.LastHandshakeAt).Round(time.Minute)))
+	}
+
+	return assess(node, failures, warnings, m.Config.DownAfter, now)
+}
+
+// assess turns what a check of node found into its health. Failures count
+// towards downAfter; a check without any resets the count.
+func assess(node models.VpnNode, failures, warnings []string, downAfter int, now time.Time) models.VpnNodeHealth {
+	health := models.VpnNodeHealth{
+		NodeID:    node.ID,
+		Health:    models.NodeHealthy,
+		Reason:    strings.Join(append(failures, warnings...), "; "),
+		CheckedAt: now,
+	}
+	if len(failures) > 0 {
+		health.Failures = node.HealthFailures + 1
+	}
+
+	switch {
+	case len(failures) > 0 && health.Failures >= downAfter:
+		health.Health = models.NodeDown
+	case len(failures) > 0 || len(warnings) > 0:
+		health.Health = models.NodeDegraded
+	}
+	return health
+}
+
+// update stores the health of node, tells the admins and the users on it when
+// it changed and moves the peers off the node once it is down for MoveAfter
+func (m *Monitor) update(ctx context.Context, node models.VpnNode, health models.VpnNodeHealth) error {
+	err := m.Repo.UpdateVpnNodeHealth(ctx, health)
+	if err != nil {
+		return err
+	}
+
+	downSince := node.HealthChangedAt
+	if health.Health != node.Health {
+		downSince = health.CheckedAt
+		m.Logger.InfoContext(ctx, "VPN node health changed", "node_id", node.ID, "from", node.Health, "to", health.Health, "reason", health.Reason)
+		m.alertAdmins(ctx, node, health)
+		if health.Health == models.NodeDown {
+			m.offerMove(ctx, node, downSince)
+		}
+	}
+
+	if health.Health != models.NodeDown || m.Config.MoveAfter <= 0 || health.CheckedAt.Before(downSince.Add(m.Config.MoveAfter)) {
+		return nil
+	}
+	return m.moveAll(ctx, node, downSince)
+}
+
+// alertAdmins tells every admin that the health of node changed
+func (m *Monitor) alertAdmins(ctx context.Context, node models.VpnNode, health models.VpnNodeHealth) {
+	if m.Notifier == nil {
+		return
+	}
+
+	admins, err := m.Repo.GetAdminUserIds(ctx)
+	if err != nil {
+		m.Logger.ErrorContext(ctx, "unable to load admins to alert", "node_id", node.ID, "error", err)
+		return
+	}
+
+	for _, id := range admins {
+		err := m.Notifier.Notify(ctx, notify.Event{
+			UserID: id,
+			Name:   notify.EventNodeHealth,
+			Data: notify.NodeHealth{
+				Node:    node.Name,
+				Country: node.Country,
+				Health:  health.Health,
+				Reason:  health.Reason,
+				Peers:   node.ActivePeers,
+			},
+			Link:      fmt.Sprintf("/admin/nodes/%d", node.ID),
+			DedupeKey: fmt.Sprintf("%s:%d:%s:%d", notify.EventNodeHealth, node.ID, health.Health, health.CheckedAt.Unix()),
+		})
+		if err != nil {
+			m.Logger.ErrorContext(ctx, "unable to alert admin about node health", "user_id", id, "node_id", node.ID, "error", err)
+		}
+	}
+}
+
+// offerMove tells the users served by node, down since downSince, that they
+// can move their devices to another node
+func (m *Monitor) offerMove(ctx context.Context, node models.VpnNode, downSince time.Time) {
+	if m.Notifier == nil {
+		return
+	}
+
+	peers, err := m.Repo.GetServedVpnPeersByNodeId(ctx, node.ID)
+	if err != nil {
+		m.Logger.ErrorContext(ctx, "unable to load peers on down node", "node_id", node.ID, "error", err)
+		return
+	}
+
+	var movesAt time.Time
+	if m.Config.MoveAfter > 0 {
+		movesAt = downSince.Add(m.Config.MoveAfter)
+	}
+	for _, peer := range peers {
+		err := m.Notifier.Notify(ctx, notify.Event{
+			UserID:    peer.UserID,
+			Name:      notify.EventNodeDown,
+			Data:      notify.NodeDown{Name: peer.Name, Country: node.Country, MovesAt: movesAt},
+			Link:      "/devices",
+			DedupeKey: fmt.Sprintf("%s:%d:%d", notify.EventNodeDown, peer.ID, downSince.Unix()),
+		})
+		if err != nil {
+			m.Logger.ErrorContext(ctx, "unable to notify user about down node", "user_id", peer.UserID, "peer_id", peer.ID, "error", err)
+		}
+	}
+}
+
+// moveAll moves the peers on node, down since downSince, to other nodes in its
+// country. Peers no node has room for stay and are tried again on the next run.
+func (m *Monitor) moveAll(ctx context.Context, node models.VpnNode, downSince time.Time) error {
+	peers, err := m.Repo.GetActiveVpnPeersByNodeId(ctx, node.ID)
+	if err != nil {
+		return fmt.Errorf("load peers to move: %w", err)
+	}
+
+	var stranded int
+	for _, peer := range peers {
+		moved, target, err := MoveOff(ctx, m.Repo, peer, node)
+		if errors.Is(err, ErrNoNode) {
+			stranded++
+			continue
+		}
+		if err != nil {
+			m.Logger.ErrorContext(ctx, "unable to move peer off down node", "node_id", node.ID, "peer_id", peer.ID, "error", err)
+			continue
+		}
+		m.Logger.InfoContext(ctx, "VPN peer moved off down node", "user_id", peer.UserID, "peer_id", peer.ID, "from", node.ID, "to", target.ID)
+
+		if m.Notifier == nil {
+			continue
+		}
+		err = m.Notifier.Notify(ctx, notify.Event{
+			UserID:    moved.UserID,
+			Name:      notify.EventDeviceMoved,
+			Data:      notify.DeviceMoved{Name: moved.Name, Country: target.Country},
+			Link:      "/devices",
+			DedupeKey: fmt.Sprintf("%s:%d:%d", notify.EventDeviceMoved, peer.ID, downSince.Unix()),
+		})
+		if err != nil {
+			// the peer is moved; the devices page shows the new config all the same
+			m.Logger.ErrorContext(ctx, "unable to notify user about moved device", "user_id", moved.UserID, "peer_id", moved.ID, "error", err)
+		}
+	}
+
+	if stranded > 0 {
+		m.Logger.WarnContext(ctx, "no node in the country has room for the peers of a down node", "node_id", node.ID, "country", node.Country, "peers", stranded)
+	}
+	return nil
+}
+
+// port is a port of a node the monitor probes
+type port struct {
+	protocol string
+	network  string
+	port     string
+}
+
+// ports returns the ports node serves its protocols on
+func ports(node models.VpnNode) []port {
+	var ports []port
+	if _, p, err := net.SplitHostPort(node.Endpoint); err == nil {
+		ports = append(ports, port{models.ProtocolWireGuard, "udp", p})
+	}
+	if node.VLESSPort != 0 {
+		ports = append(ports, port{models.ProtocolVLESS, "tcp", strconv.Itoa(node.VLESSPort)})
+	}
+	if node.ShadowsocksPort != 0 {
+		ports = append(ports, port{models.ProtocolShadowsocks, "tcp", strconv.Itoa(node.ShadowsocksPort)})
+	}
+	if node.OpenVPNPort != 0 {
+		ports = append(ports, port{models.ProtocolOpenVPN, "udp", strconv.Itoa(node.OpenVPNPort)})
+	}
+	return ports
+}
+
+// probe dials address on network. A TCP port must accept the connection. UDP
+// has no handshake, and WireGuard and OpenVPN do not answer strangers, so a
+// UDP port counts as reachable unless the host refuses a probe packet with an
+// ICMP port unreachable.
+func probe(ctx context.Context, network, address string) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if network != "udp" {
+		return nil
+	}
+
+	deadline := time.Now().Add(udpWait)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	err = conn.SetDeadline(deadline)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write([]byte{0})
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Read(make([]byte, 1))
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return nil
+	}
+	return err
+}
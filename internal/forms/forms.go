@@ -45,6 +45,15 @@ func (f *Form) MinLength(field string, length int) bool {
 	return true
 }
 
+func (f *Form) MaxLength(field string, length int) bool {
+	x := f.Get(field)
+	if len(x) > length {
+		f.Errors.Add(field, fmt.Sprintf("This field must be at most %d characters long", length))
+		return false
+	}
+	return true
+}
+
 func (f *Form) IsEmail(field string) {
 	if !govalidator.IsEmail(f.Get(field)) {
 		f.Errors.Add(field, "Invalid e-mail address")
@@ -0,0 +1,620 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/forms"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/helpers"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/quota"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/render"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/tokens"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/vpn"
+	"github.com/go-chi/chi/v5"
+)
+
+// outboxPageSize is how many messages the outbox page lists
+const outboxPageSize = 100
+
+// countryCodeRe matches an ISO 3166-1 alpha-2 country code
+var countryCodeRe = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// hostnameRe matches a DNS host name with at least two labels
+var hostnameRe = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,63}$`)
+
+// outboxStatuses are the statuses the outbox page can filter by, in queue order
+var outboxStatuses = []string{models.OutboxPending, models.OutboxSending, models.OutboxSent, models.OutboxDead}
+
+// AdminOutbox shows the outbound message queue, optionally filtered by ?status=
+func (m *Repository) AdminOutbox(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status != "" && !slices.Contains(outboxStatuses, status) {
+		helpers.ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	counts, err := m.DB.CountOutboxMessagesByStatus(r.Context())
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	messages, err := m.DB.GetOutboxMessages(r.Context(), status, outboxPageSize)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	intMap := make(map[string]int64)
+	for _, s := range outboxStatuses {
+		intMap[s] = int64(counts[s])
+	}
+
+	data := make(map[string]interface{})
+	data["messages"] = messages
+	data["statuses"] = outboxStatuses
+
+	render.Template(w, r, "admin-outbox.page.tmpl", &models.TemplateData{
+		StringMap: map[string]string{"status": status},
+		IntMap:    intMap,
+		Data:      data,
+	})
+}
+
+// PostRetryOutboxMessage puts a dead-lettered message back in the queue
+func (m *Repository) PostRetryOutboxMessage(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	err = m.DB.RetryOutboxMessage(r.Context(), id)
+	if err != nil {
+		m.App.Logger.ErrorContext(r.Context(), "error retrying outbox message", "outbox_id", id, "error", err)
+		m.App.Session.Put(r.Context(), "error", "Only dead messages can be retried")
+		http.Redirect(w, r, "/admin/outbox", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Logger.InfoContext(r.Context(), "outbox message requeued", "outbox_id", id,
+		"admin_id", m.App.Session.GetInt(r.Context(), "user_id"))
+	m.App.Session.Put(r.Context(), "flash", "Message queued for another delivery")
+	http.Redirect(w, r, "/admin/outbox?status="+models.OutboxDead, http.StatusSeeOther)
+}
+
+// AdminNodes lists the VPN nodes with their load
+func (m *Repository) AdminNodes(w http.ResponseWriter, r *http.Request) {
+	nodes, err := m.DB.GetVpnNodes(r.Context())
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["nodes"] = nodes
+
+	render.Template(w, r, "admin-nodes.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminNewNode shows the form registering a VPN node
+func (m *Repository) AdminNewNode(w http.ResponseWriter, r *http.Request) {
+	form := forms.New(url.Values{
+		"capacity": {"250"},
+		"state":    {models.NodeEnabled},
+	})
+
+	m.renderNodeForm(w, r, form, models.VpnNode{})
+}
+
+// PostAdminNode registers a VPN node
+func (m *Repository) PostAdminNode(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	node := nodeFromForm(form)
+	if !form.Valid() {
+		m.renderNodeForm(w, r, form, models.VpnNode{})
+		return
+	}
+
+	node, err = nodeSecrets(node, models.VpnNode{})
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	err = m.nodeCertificate(r.Context(), &node)
+	if errors.Is(err, errPKIUnavailable) {
+		form.Errors.Add("openvpn_port", "Set PKI_ENCRYPTION_KEY on the panel to serve OpenVPN")
+		m.renderNodeForm(w, r, form, models.VpnNode{})
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	node.ID, err = m.DB.InsertVpnNode(r.Context(), node)
+	if err != nil {
+		m.App.Logger.ErrorContext(r.Context(), "error inserting VPN node", "name", node.Name, "error", err)
+		form.Errors.Add("name", "A node with this name may already exist")
+		m.renderNodeForm(w, r, form, models.VpnNode{})
+		return
+	}
+
+	m.App.Logger.InfoContext(r.Context(), "VPN node registered", "node_id", node.ID, "name", node.Name,
+		"admin_id", m.App.Session.GetInt(r.Context(), "user_id"))
+	m.App.Session.Put(r.Context(), "flash", "Node registered")
+	http.Redirect(w, r, "/admin/nodes", http.StatusSeeOther)
+}
+
+// AdminEditNode shows the form editing a VPN node
+func (m *Repository) AdminEditNode(w http.ResponseWriter, r *http.Request) {
+	node, ok := m.adminLoadNode(w, r)
+	if !ok {
+		return
+	}
+
+	form := forms.New(url.Values{
+		"name":       {node.Name},
+		"country":    {node.Country},
+		"endpoint":   {node.Endpoint},
+		"public_key": {node.PublicKey},
+		"subnet":     {node.Subnet},
+		"capacity":   {strconv.Itoa(node.Capacity)},
+		"state":      {node.State},
+
+		"vless_port":          {optionalPort(node.VLESSPort)},
+		"reality_server_name": {node.RealityServerName},
+		"shadowsocks_port":    {optionalPort(node.ShadowsocksPort)},
+		"openvpn_port":        {optionalPort(node.OpenVPNPort)},
+	})
+
+	m.renderNodeForm(w, r, form, node)
+}
+
+// PostAdminUpdateNode updates a VPN node
+func (m *Repository) PostAdminUpdateNode(w http.ResponseWriter, r *http.Request) {
+	existing, ok := m.adminLoadNode(w, r)
+	if !ok {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	node := nodeFromForm(form)
+	node.ID = existing.ID
+
+	// peers already hold addresses in the old subnet
+	if existing.ActivePeers > 0 && node.Subnet != existing.Subnet {
+		form.Errors.Add("subnet", "The subnet cannot change while the node has active peers")
+	}
+
+	if !form.Valid() {
+		m.renderNodeForm(w, r, form, existing)
+		return
+	}
+
+	node, err = nodeSecrets(node, existing)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	err = m.nodeCertificate(r.Context(), &node)
+	if errors.Is(err, errPKIUnavailable) {
+		form.Errors.Add("openvpn_port", "Set PKI_ENCRYPTION_KEY on the panel to serve OpenVPN")
+		m.renderNodeForm(w, r, form, existing)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	err = m.DB.UpdateVpnNode(r.Context(), node)
+	if err != nil {
+		m.App.Logger.ErrorContext(r.Context(), "error updating VPN node", "node_id", node.ID, "error", err)
+		form.Errors.Add("name", "A node with this name may already exist")
+		m.renderNodeForm(w, r, form, existing)
+		return
+	}
+
+	m.App.Logger.InfoContext(r.Context(), "VPN node updated", "node_id", node.ID, "state", node.State,
+		"admin_id", m.App.Session.GetInt(r.Context(), "user_id"))
+	m.App.Session.Put(r.Context(), "flash", "Node saved")
+	http.Redirect(w, r, "/admin/nodes", http.StatusSeeOther)
+}
+
+// PostAdminDeleteNode deletes a VPN node no peer was ever provisioned on
+func (m *Repository) PostAdminDeleteNode(w http.ResponseWriter, r *http.Request) {
+	node, ok := m.adminLoadNode(w, r)
+	if !ok {
+		return
+	}
+
+	err := m.DB.DeleteVpnNode(r.Context(), node.ID)
+	if err == sql.ErrNoRows {
+		m.App.Session.Put(r.Context(), "error", "Nodes that have had peers cannot be deleted; disable the node instead")
+		http.Redirect(w, r, fmt.Sprintf("/admin/nodes/%d", node.ID), http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	m.App.Logger.InfoContext(r.Context(), "VPN node deleted", "node_id", node.ID, "name", node.Name,
+		"admin_id", m.App.Session.GetInt(r.Context(), "user_id"))
+	m.App.Session.Put(r.Context(), "flash", "Node deleted")
+	http.Redirect(w, r, "/admin/nodes", http.StatusSeeOther)
+}
+
+// adminLoadNode loads the node named by the id URL parameter. It writes the
+// error response itself and reports whether the handler should continue.
+func (m *Repository) adminLoadNode(w http.ResponseWriter, r *http.Request) (models.VpnNode, bool) {
+	id, ok := urlParamID(r, "id")
+	if !ok {
+		helpers.ClientError(w, r, http.StatusNotFound)
+		return models.VpnNode{}, false
+	}
+
+	node, err := m.DB.GetVpnNodeById(r.Context(), id)
+	if err == sql.ErrNoRows {
+		helpers.ClientError(w, r, http.StatusNotFound)
+		return models.VpnNode{}, false
+	}
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return models.VpnNode{}, false
+	}
+
+	return node, true
+}
+
+// renderNodeForm shows the node form; node is the node being edited, if any
+func (m *Repository) renderNodeForm(w http.ResponseWriter, r *http.Request, form *forms.Form, node models.VpnNode) {
+	stringMap := make(map[string]string)
+	stringMap["new_agent_token"] = m.App.Session.PopString(r.Context(), "new_agent_token")
+
+	data := make(map[string]interface{})
+	data["node"] = node
+	data["states"] = models.NodeStates
+
+	render.Template(w, r, "admin-node.page.tmpl", &models.TemplateData{
+		StringMap: stringMap,
+		Form:      form,
+		Data:      data,
+	})
+}
+
+// nodeFromForm validates the node form and returns the node it describes
+func nodeFromForm(form *forms.Form) models.VpnNode {
+	form.Required("name", "country", "endpoint", "public_key", "subnet", "capacity", "state")
+	form.MaxLength("name", 64)
+
+	node := models.VpnNode{
+		Name:      strings.TrimSpace(form.Get("name")),
+		Country:   strings.ToUpper(strings.TrimSpace(form.Get("country"))),
+		Endpoint:  strings.TrimSpace(form.Get("endpoint")),
+		PublicKey: strings.TrimSpace(form.Get("public_key")),
+		State:     form.Get("state"),
+	}
+
+	if form.Has("country") && !countryCodeRe.MatchString(node.Country) {
+		form.Errors.Add("country", "Use a two-letter country code, e.g. DE")
+	}
+	if form.Has("endpoint") {
+		host, port, err := net.SplitHostPort(node.Endpoint)
+		if n, perr := strconv.Atoi(port); err != nil || host == "" || perr != nil || n < 1 || n > 65535 {
+			form.Errors.Add("endpoint", "Use host:port, e.g. de1.example.com:51820")
+		}
+	}
+	if form.Has("public_key") && !vpn.ValidKey(node.PublicKey) {
+		form.Errors.Add("public_key", "Not a WireGuard public key")
+	}
+	if form.Has("subnet") {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(form.Get("subnet")))
+		if err != nil {
+			form.Errors.Add("subnet", "Use a CIDR prefix, e.g. 10.9.0.0/24")
+		} else {
+			node.Subnet = prefix.Masked().String()
+		}
+	}
+	if form.Has("capacity") {
+		capacity, err := strconv.Atoi(form.Get("capacity"))
+		if err != nil || capacity < 1 {
+			form.Errors.Add("capacity", "Capacity must be a positive number")
+		}
+		node.Capacity = capacity
+	}
+	if form.Has("state") && !slices.Contains(models.NodeStates, node.State) {
+		form.Errors.Add("state", "Unknown state")
+	}
+
+	node.VLESSPort = formPort(form, "vless_port")
+	node.ShadowsocksPort = formPort(form, "shadowsocks_port")
+	if node.VLESSPort > 0 {
+		node.RealityServerName = strings.ToLower(strings.TrimSpace(form.Get("reality_server_name")))
+		if !hostnameRe.MatchString(node.RealityServerName) {
+			form.Errors.Add("reality_server_name", "Use the host name of a TLS 1.3 site to borrow, e.g. www.microsoft.com")
+		}
+	}
+	if node.ShadowsocksPort > 0 && node.ShadowsocksPort == node.VLESSPort {
+		form.Errors.Add("shadowsocks_port", "Shadowsocks and VLESS need different ports")
+	}
+	if _, port, err := net.SplitHostPort(node.Endpoint); err == nil && node.ShadowsocksPort > 0 && port == strconv.Itoa(node.ShadowsocksPort) {
+		form.Errors.Add("shadowsocks_port", "Shadowsocks listens on UDP too and cannot share the WireGuard port")
+	}
+
+	// OpenVPN listens on UDP; it may share its port number with VLESS, which is TCP only
+	node.OpenVPNPort = formPort(form, "openvpn_port")
+	if node.OpenVPNPort > 0 && node.OpenVPNPort == node.ShadowsocksPort {
+		form.Errors.Add("openvpn_port", "OpenVPN and Shadowsocks need different ports")
+	}
+	if _, port, err := net.SplitHostPort(node.Endpoint); err == nil && node.OpenVPNPort > 0 && port == strconv.Itoa(node.OpenVPNPort) {
+		form.Errors.Add("openvpn_port", "OpenVPN cannot share the WireGuard port")
+	}
+
+	return node
+}
+
+// formPort returns the optional port in the field of form, 0 when empty. An
+// invalid port is recorded as an error of the field.
+func formPort(form *forms.Form, field string) int {
+	value := strings.TrimSpace(form.Get(field))
+	if value == "" {
+		return 0
+	}
+
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		form.Errors.Add(field, "Use a port between 1 and 65535, or leave it empty to turn the protocol off")
+		return 0
+	}
+	return port
+}
+
+// optionalPort formats port for the node form, empty when off
+func optionalPort(port int) string {
+	if port == 0 {
+		return ""
+	}
+	return strconv.Itoa(port)
+}
+
+// nodeSecrets returns node with the Reality and Shadowsocks keys and the
+// OpenVPN certificate of existing, generating the keys of protocols node
+// serves that existing has none for; the certificate is issued by
+// nodeCertificate. Keys are kept when a protocol is turned off so that
+// turning it back on does not break the configs already handed out.
+func nodeSecrets(node, existing models.VpnNode) (models.VpnNode, error) {
+	node.RealityPrivateKey = existing.RealityPrivateKey
+	node.RealityPublicKey = existing.RealityPublicKey
+	node.RealityShortID = existing.RealityShortID
+	node.ShadowsocksKey = existing.ShadowsocksKey
+	node.OpenVPNCertificate = existing.OpenVPNCertificate
+	node.OpenVPNPrivateKey = existing.OpenVPNPrivateKey
+	if node.VLESSPort == 0 {
+		node.RealityServerName = existing.RealityServerName
+	}
+
+	var err error
+	if node.VLESSPort > 0 && node.RealityPrivateKey == "" {
+		node.RealityPrivateKey, node.RealityPublicKey, err = vpn.GenerateRealityKeyPair()
+		if err != nil {
+			return models.VpnNode{}, err
+		}
+		node.RealityShortID, err = vpn.GenerateShortID()
+		if err != nil {
+			return models.VpnNode{}, err
+		}
+	}
+	if node.ShadowsocksPort > 0 && node.ShadowsocksKey == "" {
+		node.ShadowsocksKey, err = vpn.GenerateShadowsocksKey()
+		if err != nil {
+			return models.VpnNode{}, err
+		}
+	}
+
+	return node, nil
+}
+
+// PostAdminNodeAgentToken generates a new agent token for a VPN node and shows
+// it once. The previous token stops working.
+func (m *Repository) PostAdminNodeAgentToken(w http.ResponseWriter, r *http.Request) {
+	node, ok := m.adminLoadNode(w, r)
+	if !ok {
+		return
+	}
+
+	plain, _, hash, err := tokens.Generate(tokens.AgentTokenPrefix)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	err = m.DB.SetVpnNodeAgentToken(r.Context(), node.ID, hash)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	m.App.Logger.InfoContext(r.Context(), "VPN node agent token generated", "node_id", node.ID,
+		"admin_id", m.App.Session.GetInt(r.Context(), "user_id"))
+	m.App.Session.Put(r.Context(), "new_agent_token", plain)
+	http.Redirect(w, r, fmt.Sprintf("/admin/nodes/%d", node.ID), http.StatusSeeOther)
+}
+
+// AdminQuotas lists the users with an active subscription and where they
+// stand against their data cap
+func (m *Repository) AdminQuotas(w http.ResponseWriter, r *http.Request) {
+	subscriptions, err := m.DB.GetActiveSubscriptions(r.Context())
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	now := time.Now()
+	rows := make([]quotaRow, 0, len(subscriptions))
+	for _, sub := range subscriptions {
+		user, err := m.DB.GetUserById(r.Context(), sub.UserID)
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+		status, err := quota.Load(r.Context(), m.DB, sub, now)
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+		rows = append(rows, newQuotaRow(user, status))
+	}
+
+	data := make(map[string]interface{})
+	data["rows"] = rows
+
+	render.Template(w, r, "admin-quotas.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminUserQuota shows where a user stands against their quota and the form
+// overriding it
+func (m *Repository) AdminUserQuota(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.adminLoadUser(w, r)
+	if !ok {
+		return
+	}
+
+	q, err := m.DB.GetUserQuota(r.Context(), user.ID)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	m.renderUserQuota(w, r, forms.New(quotaFormValues(q)), user)
+}
+
+// PostAdminUserQuota saves the quota override of a user and applies it right away
+func (m *Repository) PostAdminUserQuota(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.adminLoadUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	q := quotaFromForm(form, user.ID)
+	if !form.Valid() {
+		m.renderUserQuota(w, r, form, user)
+		return
+	}
+
+	err = m.DB.UpdateUserQuotaOverride(r.Context(), q)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	m.checkQuota(r.Context(), user.ID)
+
+	m.App.Logger.InfoContext(r.Context(), "quota override saved", "user_id", user.ID,
+		"data_cap_bytes", q.DataCapBytes, "device_limit", q.DeviceLimit,
+		"admin_id", m.App.Session.GetInt(r.Context(), "user_id"))
+	m.App.Session.Put(r.Context(), "flash", "Quota saved")
+	http.Redirect(w, r, fmt.Sprintf("/admin/users/%d/quota", user.ID), http.StatusSeeOther)
+}
+
+// adminLoadUser loads the user named by the id URL parameter. It writes the
+// error response itself and reports whether the handler should continue.
+func (m *Repository) adminLoadUser(w http.ResponseWriter, r *http.Request) (models.User, bool) {
+	id, ok := urlParamID(r, "id")
+	if !ok {
+		helpers.ClientError(w, r, http.StatusNotFound)
+		return models.User{}, false
+	}
+
+	user, err := m.DB.GetUserById(r.Context(), id)
+	if err == sql.ErrNoRows {
+		helpers.ClientError(w, r, http.StatusNotFound)
+		return models.User{}, false
+	}
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return models.User{}, false
+	}
+
+	return user, true
+}
+
+// renderUserQuota shows the quota page of user with the override form and the
+// forms recording a top-up or, without an active subscription, a plan purchase
+func (m *Repository) renderUserQuota(w http.ResponseWriter, r *http.Request, form *forms.Form, user models.User) {
+	data := make(map[string]interface{})
+	data["user"] = user
+
+	sub, err := m.DB.GetActiveSubscriptionByUserId(r.Context(), user.ID)
+	if err != nil && err != sql.ErrNoRows {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	if err == nil {
+		status, err := quota.Load(r.Context(), m.DB, sub, time.Now())
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+		data["quota"] = newQuotaRow(user, status)
+
+		offers, err := m.topUpOffers(r.Context())
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+		data["topups"] = offers
+	} else {
+		offers, err := m.planOffers(r.Context())
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+		locations, err := m.locations(r.Context())
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+		data["plans"] = offers
+		data["locations"] = locations
+	}
+
+	render.Template(w, r, "admin-user-quota.page.tmpl", &models.TemplateData{
+		Form: form,
+		Data: data,
+	})
+}
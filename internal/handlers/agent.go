@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/agent"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/helpers"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/repository"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/usage"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/vpn"
+)
+
+// maxAgentErrorLength caps the reconcile error an agent may store on its node
+const maxAgentErrorLength = 1000
+
+// AgentPeers answers the node agent with every peer its node should serve,
+// including the old keys of peers in the grace window of a rotation, the Xray
+// inbounds and the OpenVPN server of the node. OpenVPN peers are not among
+// the peers: the node accepts every certificate of the panel's authority and
+// refuses those on the revocation list sent along. A disabled node serves
+// none, so its agent removes every peer.
+func (m *Repository) AgentPeers(w http.ResponseWriter, r *http.Request) {
+	node, _ := helpers.VpnNode(r)
+
+	state := agent.DesiredState{NodeID: node.ID, Peers: []agent.Peer{}}
+
+	if node.State != models.NodeDisabled {
+		peers, err := m.DB.GetServedVpnPeersByNodeId(r.Context(), node.ID)
+		if err != nil {
+			helpers.ServerErrorJSON(w, r, err)
+			return
+		}
+
+		for _, p := range peers {
+			if p.Protocol == models.ProtocolOpenVPN {
+				continue
+			}
+			state.Peers = append(state.Peers, agentPeer(p.Protocol, p.PublicKey, p.PresharedKey, p.Address))
+		}
+
+		revocations, err := m.DB.GetServedKeyRevocationsByNodeId(r.Context(), node.ID)
+		if err != nil {
+			helpers.ServerErrorJSON(w, r, err)
+			return
+		}
+
+		for _, k := range revocations {
+			if k.Protocol == models.ProtocolOpenVPN {
+				continue
+			}
+			state.Peers = append(state.Peers, agentPeer(k.Protocol, k.PublicKey, k.PresharedKey, k.Address))
+		}
+
+		state.Xray = nodeInbounds(node)
+
+		state.OpenVPN, err = m.nodeOpenVPN(r.Context(), node)
+		if err != nil {
+			helpers.ServerErrorJSON(w, r, err)
+			return
+		}
+	}
+
+	helpers.WriteJSON(w, http.StatusOK, apiEnvelope{Data: state})
+}
+
+// agentPeer returns the peer the agent configures for the keys of a peer using
+// protocol. WireGuard peers carry no protocol so that older agents keep
+// applying them.
+func agentPeer(protocol, publicKey, presharedKey, address string) agent.Peer {
+	if protocol == "" || protocol == models.ProtocolWireGuard {
+		return agent.Peer{
+			PublicKey:    publicKey,
+			PresharedKey: presharedKey,
+			AllowedIPs:   []string{address},
+		}
+	}
+	return agent.Peer{Protocol: protocol, PublicKey: publicKey}
+}
+
+// nodeInbounds returns the Xray inbounds node serves, nil when it serves
+// WireGuard only
+func nodeInbounds(node models.VpnNode) *agent.Xray {
+	if !node.Serves(models.ProtocolVLESS) && !node.Serves(models.ProtocolShadowsocks) {
+		return nil
+	}
+
+	inbounds := &agent.Xray{}
+	if node.Serves(models.ProtocolVLESS) {
+		inbounds.VLESS = &agent.VLESSInbound{
+			Port:       node.VLESSPort,
+			ServerName: node.RealityServerName,
+			PrivateKey: node.RealityPrivateKey,
+			ShortID:    node.RealityShortID,
+		}
+	}
+	if node.Serves(models.ProtocolShadowsocks) {
+		inbounds.Shadowsocks = &agent.ShadowsocksInbound{
+			Port:   node.ShadowsocksPort,
+			Method: vpn.ShadowsocksMethod,
+			Key:    node.ShadowsocksKey,
+		}
+	}
+	return inbounds
+}
+
+// nodeOpenVPN returns the OpenVPN server node serves with the current
+// revocation list, nil when it serves none
+func (m *Repository) nodeOpenVPN(ctx context.Context, node models.VpnNode) (*agent.OpenVPN, error) {
+	if !node.Serves(models.ProtocolOpenVPN) {
+		return nil, nil
+	}
+
+	crl, err := m.currentCRL(ctx, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	row, err := m.DB.GetCertificateAuthority(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &agent.OpenVPN{
+		Port:        node.OpenVPNPort,
+		CA:          row.Certificate,
+		Certificate: node.OpenVPNCertificate,
+		PrivateKey:  node.OpenVPNPrivateKey,
+		CRL:         crl,
+	}, nil
+}
+
+// PostAgentReport records what the node agent applied and the handshake times
+// it read from the interface, and accounts the traffic its byte counters grew
+// by since the last report. Revoked keys past their grace window that are no
+// longer on an applied interface are confirmed gone.
+func (m *Repository) PostAgentReport(w http.ResponseWriter, r *http.Request) {
+	node, _ := helpers.VpnNode(r)
+
+	var report agent.Report
+
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<20))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&report)
+	if err != nil || report.Peers < 0 {
+		helpers.ErrorJSON(w, http.StatusBadRequest, "invalid_body", "Request body must be a report")
+		return
+	}
+
+	if len(report.Error) > maxAgentErrorLength {
+		report.Error = report.Error[:maxAgentErrorLength]
+	}
+
+	handshakes := make(map[string]time.Time, len(report.Handshakes))
+	for _, h := range report.Handshakes {
+		if !h.At.IsZero() {
+			handshakes[h.PublicKey] = h.At
+		}
+	}
+
+	var confirmed int
+	err = m.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		err := repo.UpdateVpnNodeAgentStatus(r.Context(), models.VpnNodeAgentStatus{
+			NodeID:  node.ID,
+			Applied: report.Applied,
+			Peers:   report.Peers,
+			Error:   report.Error,
+		})
+		if err != nil {
+			return err
+		}
+		err = repo.UpdateVpnPeerHandshakes(r.Context(), node.ID, handshakes)
+		if err != nil {
+			return err
+		}
+
+		revocations, err := repo.GetPendingKeyRevocationsByNodeId(r.Context(), node.ID)
+		if err != nil {
+			return err
+		}
+
+		if len(report.Counters) > 0 {
+			peers, err := repo.GetActiveVpnPeersByNodeId(r.Context(), node.ID)
+			if err != nil {
+				return err
+			}
+			counters, traffic := usage.Account(peers, report.Counters)
+			err = repo.UpdateVpnPeerCounters(r.Context(), counters)
+			if err != nil {
+				return err
+			}
+
+			// the old keys of a rotated peer carry its traffic until the grace window ends
+			revokedCounters, revokedTraffic := usage.AccountRevoked(revocations, report.Counters)
+			err = repo.UpdateKeyRevocationCounters(r.Context(), revokedCounters)
+			if err != nil {
+				return err
+			}
+
+			err = repo.AddPeerUsage(r.Context(), time.Now(), usage.Merge(append(traffic, revokedTraffic...)))
+			if err != nil {
+				return err
+			}
+		}
+
+		if !report.Applied || len(revocations) == 0 {
+			return nil
+		}
+		confirmed, err = repo.ConfirmKeyRevocations(r.Context(), node.ID, interfaceKeys(report), time.Now())
+		return err
+	})
+	if err != nil {
+		helpers.ServerErrorJSON(w, r, err)
+		return
+	}
+
+	if confirmed > 0 {
+		m.App.Logger.InfoContext(r.Context(), "revoked keys confirmed gone", "node_id", node.ID, "node", node.Name, "keys", confirmed)
+	}
+	if report.Error != "" {
+		m.App.Logger.WarnContext(r.Context(), "node agent failed to reconcile", "node_id", node.ID, "node", node.Name, "error", report.Error)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// interfaceKeys returns the public keys on the interface after the reconcile
+// of report: those it reported counters for, less the ones it removed
+func interfaceKeys(report agent.Report) []string {
+	removed := make(map[string]bool, len(report.Removed))
+	for _, key := range report.Removed {
+		removed[key] = true
+	}
+
+	keys := make([]string, 0, len(report.Counters))
+	for _, c := range report.Counters {
+		if !removed[c.PublicKey] {
+			keys = append(keys, c.PublicKey)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,611 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/helpers"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/notify"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/repository"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/vpn"
+	"github.com/go-chi/chi/v5"
+)
+
+var (
+	// errNoActiveSubscription is returned when a user without an active subscription asks for a peer
+	errNoActiveSubscription = errors.New("no active subscription")
+	// errUnknownLocation is returned for a location no VPN node is registered in
+	errUnknownLocation = errors.New("unknown location")
+	// errNoCapacity is returned when every node in the chosen location is full, draining or disabled
+	errNoCapacity = errors.New("no VPN node with free capacity")
+	// errDeviceLimit is returned when the subscription has as many peers as its plan allows
+	errDeviceLimit = errors.New("device limit reached")
+	// errProtocolNotInPlan is returned for a protocol the plan of the subscription does not include
+	errProtocolNotInPlan = errors.New("protocol not included in the plan")
+	// errProtocolUnavailable is returned when no node in the chosen location serves the protocol
+	errProtocolUnavailable = errors.New("no VPN node serves the protocol")
+)
+
+// apiEnvelope wraps every successful API response
+type apiEnvelope struct {
+	Data interface{} `json:"data"`
+}
+
+type apiUser struct {
+	ID         int       `json:"id"`
+	Username   string    `json:"username"`
+	FirstName  string    `json:"first_name"`
+	LastName   string    `json:"last_name"`
+	Email      string    `json:"email"`
+	IsVerified bool      `json:"is_verified"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type apiPlan struct {
+	ID           int    `json:"id"`
+	Name         string `json:"name"`
+	PriceCents   int    `json:"price_cents"`
+	Currency     string `json:"currency"`
+	DurationDays int    `json:"duration_days"`
+	// DataCapBytes and DeviceLimit are 0 when unlimited
+	DataCapBytes int64    `json:"data_cap_bytes"`
+	DeviceLimit  int      `json:"device_limit"`
+	Protocols    []string `json:"protocols"`
+}
+
+type apiSubscription struct {
+	ID        int       `json:"id"`
+	Plan      apiPlan   `json:"plan"`
+	Status    string    `json:"status"`
+	Active    bool      `json:"active"`
+	StartsAt  time.Time `json:"starts_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type apiPeer struct {
+	ID             int        `json:"id"`
+	SubscriptionID int        `json:"subscription_id"`
+	Name           string     `json:"name"`
+	Protocol       string     `json:"protocol"`
+	PublicKey      string     `json:"public_key"`
+	Address        string     `json:"address"`
+	Revoked        bool       `json:"revoked"`
+	RevokedAt      *time.Time `json:"revoked_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+type apiInvoice struct {
+	ID             int        `json:"id"`
+	SubscriptionID *int       `json:"subscription_id"`
+	Number         string     `json:"number"`
+	AmountCents    int        `json:"amount_cents"`
+	Currency       string     `json:"currency"`
+	Status         string     `json:"status"`
+	IssuedAt       time.Time  `json:"issued_at"`
+	PaidAt         *time.Time `json:"paid_at"`
+}
+
+type apiCreatePeerRequest struct {
+	Name string `json:"name"`
+	// Location is the country code of the node to provision on, any node when empty
+	Location string `json:"location,omitempty"`
+	// Protocol is one of the protocols of the plan, the first one when empty
+	Protocol string `json:"protocol,omitempty"`
+}
+
+type apiLocation struct {
+	Country   string `json:"country"`
+	Available bool   `json:"available"`
+}
+
+func toAPIUser(u models.User) apiUser {
+	return apiUser{
+		ID:         u.ID,
+		Username:   u.Username,
+		FirstName:  u.FirstName,
+		LastName:   u.LastName,
+		Email:      u.Email,
+		IsVerified: u.IsVerified,
+		CreatedAt:  u.CreatedAt,
+	}
+}
+
+func toAPISubscription(s models.Subscription) apiSubscription {
+	return apiSubscription{
+		ID: s.ID,
+		Plan: apiPlan{
+			ID:           s.Plan.ID,
+			Name:         s.Plan.Name,
+			PriceCents:   s.Plan.PriceCents,
+			Currency:     s.Plan.Currency,
+			DurationDays: s.Plan.DurationDays,
+			DataCapBytes: s.Plan.DataCapBytes,
+			DeviceLimit:  s.Plan.DeviceLimit,
+			Protocols:    s.Plan.AllowedProtocols(),
+		},
+		Status:    s.Status,
+		Active:    s.IsActive(time.Now()),
+		StartsAt:  s.StartsAt,
+		ExpiresAt: s.ExpiresAt,
+	}
+}
+
+func toAPIPeer(p models.VpnPeer) apiPeer {
+	return apiPeer{
+		ID:             p.ID,
+		SubscriptionID: p.SubscriptionID,
+		Name:           p.Name,
+		Protocol:       p.Protocol,
+		PublicKey:      p.PublicKey,
+		Address:        p.Address,
+		Revoked:        p.IsRevoked(),
+		RevokedAt:      optionalTime(p.RevokedAt),
+		CreatedAt:      p.CreatedAt,
+	}
+}
+
+func toAPIInvoice(i models.Invoice) apiInvoice {
+	invoice := apiInvoice{
+		ID:          i.ID,
+		Number:      i.Number,
+		AmountCents: i.AmountCents,
+		Currency:    i.Currency,
+		Status:      i.Status,
+		IssuedAt:    i.IssuedAt,
+		PaidAt:      optionalTime(i.PaidAt),
+	}
+	if i.SubscriptionID != 0 {
+		invoice.SubscriptionID = &i.SubscriptionID
+	}
+	return invoice
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// apiUserID returns the ID of the user owning the token the request was authenticated with
+func apiUserID(r *http.Request) int {
+	token, _ := helpers.APIToken(r)
+	return token.UserID
+}
+
+// urlParamID parses a numeric chi URL parameter
+func urlParamID(r *http.Request, name string) (int, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, name))
+	if err != nil || id <= 0 {
+		return 0, false
+	}
+	return id, true
+}
+
+// APIMe returns the user owning the API token
+func (m *Repository) APIMe(w http.ResponseWriter, r *http.Request) {
+	user, err := m.DB.GetUserById(r.Context(), apiUserID(r))
+	if err != nil {
+		helpers.ServerErrorJSON(w, r, err)
+		return
+	}
+
+	helpers.WriteJSON(w, http.StatusOK, apiEnvelope{Data: toAPIUser(user)})
+}
+
+// APISubscriptions lists the subscriptions of the user
+func (m *Repository) APISubscriptions(w http.ResponseWriter, r *http.Request) {
+	subscriptions, err := m.DB.GetSubscriptionsByUserId(r.Context(), apiUserID(r))
+	if err != nil {
+		helpers.ServerErrorJSON(w, r, err)
+		return
+	}
+
+	out := make([]apiSubscription, 0, len(subscriptions))
+	for _, s := range subscriptions {
+		out = append(out, toAPISubscription(s))
+	}
+
+	helpers.WriteJSON(w, http.StatusOK, apiEnvelope{Data: out})
+}
+
+// APIPeers lists the VPN peers of the user
+func (m *Repository) APIPeers(w http.ResponseWriter, r *http.Request) {
+	peers, err := m.DB.GetVpnPeersByUserId(r.Context(), apiUserID(r))
+	if err != nil {
+		helpers.ServerErrorJSON(w, r, err)
+		return
+	}
+
+	out := make([]apiPeer, 0, len(peers))
+	for _, p := range peers {
+		out = append(out, toAPIPeer(p))
+	}
+
+	helpers.WriteJSON(w, http.StatusOK, apiEnvelope{Data: out})
+}
+
+// APIPeer returns a single VPN peer of the user
+func (m *Repository) APIPeer(w http.ResponseWriter, r *http.Request) {
+	peer, ok := m.apiLoadPeer(w, r)
+	if !ok {
+		return
+	}
+
+	helpers.WriteJSON(w, http.StatusOK, apiEnvelope{Data: toAPIPeer(peer)})
+}
+
+// APICreatePeer provisions a new VPN peer on the active subscription of the user
+func (m *Repository) APICreatePeer(w http.ResponseWriter, r *http.Request) {
+	var req apiCreatePeerRequest
+
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&req)
+	if err != nil {
+		helpers.ErrorJSON(w, http.StatusBadRequest, "invalid_body", "Request body must be a JSON object")
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 64 {
+		helpers.ErrorJSON(w, http.StatusUnprocessableEntity, "invalid_name", "Name must be between 1 and 64 characters")
+		return
+	}
+
+	peer, err := m.provisionPeer(r.Context(), apiUserID(r), req.Name, strings.ToUpper(strings.TrimSpace(req.Location)), strings.ToLower(strings.TrimSpace(req.Protocol)))
+	if errors.Is(err, errNoActiveSubscription) {
+		helpers.ErrorJSON(w, http.StatusConflict, "no_active_subscription", "An active subscription is required to add a peer")
+		return
+	}
+	if errors.Is(err, errDeviceLimit) {
+		helpers.ErrorJSON(w, http.StatusConflict, "device_limit_reached", "The plan allows no more devices; revoke a peer to add another")
+		return
+	}
+	if errors.Is(err, errUnknownLocation) {
+		helpers.ErrorJSON(w, http.StatusUnprocessableEntity, "invalid_location", "Location must be one of the listed locations")
+		return
+	}
+	if errors.Is(err, errProtocolNotInPlan) {
+		helpers.ErrorJSON(w, http.StatusUnprocessableEntity, "invalid_protocol", "Protocol must be one of the protocols of the plan")
+		return
+	}
+	if errors.Is(err, errProtocolUnavailable) {
+		helpers.ErrorJSON(w, http.StatusServiceUnavailable, "protocol_unavailable", "No server in that location offers the protocol yet")
+		return
+	}
+	if errors.Is(err, vpn.ErrSubnetExhausted) || errors.Is(err, errNoCapacity) {
+		helpers.ErrorJSON(w, http.StatusServiceUnavailable, "no_capacity", "No free VPN addresses are available")
+		return
+	}
+	if err != nil {
+		helpers.ServerErrorJSON(w, r, err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/peers/%d", peer.ID))
+	helpers.WriteJSON(w, http.StatusCreated, apiEnvelope{Data: toAPIPeer(peer)})
+}
+
+// APIPeerConfig downloads the wg-quick configuration or the share link of a VPN peer
+func (m *Repository) APIPeerConfig(w http.ResponseWriter, r *http.Request) {
+	peer, ok := m.apiLoadPeer(w, r)
+	if !ok {
+		return
+	}
+
+	if peer.IsRevoked() {
+		helpers.ErrorJSON(w, http.StatusGone, "peer_revoked", "Peer has been revoked")
+		return
+	}
+
+	conf, err := m.deviceConfig(r.Context(), peer)
+	if err != nil {
+		helpers.ServerErrorJSON(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, configFilename(peer)))
+	_, _ = w.Write(conf)
+}
+
+// APIRevokePeer revokes a VPN peer of the user
+func (m *Repository) APIRevokePeer(w http.ResponseWriter, r *http.Request) {
+	peer, ok := m.apiLoadPeer(w, r)
+	if !ok {
+		return
+	}
+
+	if !peer.IsRevoked() {
+		err := m.DB.RevokeVpnPeer(r.Context(), peer.ID)
+		if err != nil {
+			helpers.ServerErrorJSON(w, r, err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// APILocations lists the countries peers can be provisioned in
+func (m *Repository) APILocations(w http.ResponseWriter, r *http.Request) {
+	locations, err := m.locations(r.Context())
+	if err != nil {
+		helpers.ServerErrorJSON(w, r, err)
+		return
+	}
+
+	helpers.WriteJSON(w, http.StatusOK, apiEnvelope{Data: locations})
+}
+
+// locations returns the countries peers can be provisioned in, with whether a
+// node in them has room for another peer
+func (m *Repository) locations(ctx context.Context) ([]apiLocation, error) {
+	nodes, err := m.DB.GetVpnNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]apiLocation, 0)
+	for _, n := range nodes {
+		if n.State == models.NodeDisabled {
+			continue
+		}
+		// nodes are ordered by country
+		if len(out) == 0 || out[len(out)-1].Country != n.Country {
+			out = append(out, apiLocation{Country: n.Country})
+		}
+		if n.AcceptsPeers() {
+			out[len(out)-1].Available = true
+		}
+	}
+
+	return out, nil
+}
+
+// APIInvoices lists the invoices of the user
+func (m *Repository) APIInvoices(w http.ResponseWriter, r *http.Request) {
+	invoices, err := m.DB.GetInvoicesByUserId(r.Context(), apiUserID(r))
+	if err != nil {
+		helpers.ServerErrorJSON(w, r, err)
+		return
+	}
+
+	out := make([]apiInvoice, 0, len(invoices))
+	for _, i := range invoices {
+		out = append(out, toAPIInvoice(i))
+	}
+
+	helpers.WriteJSON(w, http.StatusOK, apiEnvelope{Data: out})
+}
+
+// APIInvoice returns a single invoice of the user
+func (m *Repository) APIInvoice(w http.ResponseWriter, r *http.Request) {
+	id, ok := urlParamID(r, "id")
+	if !ok {
+		helpers.ErrorJSON(w, http.StatusNotFound, "not_found", "Invoice not found")
+		return
+	}
+
+	invoice, err := m.DB.GetInvoiceById(r.Context(), id)
+	if err == sql.ErrNoRows || (err == nil && invoice.UserID != apiUserID(r)) {
+		helpers.ErrorJSON(w, http.StatusNotFound, "not_found", "Invoice not found")
+		return
+	}
+	if err != nil {
+		helpers.ServerErrorJSON(w, r, err)
+		return
+	}
+
+	helpers.WriteJSON(w, http.StatusOK, apiEnvelope{Data: toAPIInvoice(invoice)})
+}
+
+// apiLoadPeer loads the peer named by the id URL parameter and makes sure it belongs to the user.
+// It writes the error response itself and reports whether the handler should continue.
+func (m *Repository) apiLoadPeer(w http.ResponseWriter, r *http.Request) (models.VpnPeer, bool) {
+	id, ok := urlParamID(r, "id")
+	if !ok {
+		helpers.ErrorJSON(w, http.StatusNotFound, "not_found", "Peer not found")
+		return models.VpnPeer{}, false
+	}
+
+	peer, err := m.DB.GetVpnPeerById(r.Context(), id)
+	if err == sql.ErrNoRows || (err == nil && peer.UserID != apiUserID(r)) {
+		helpers.ErrorJSON(w, http.StatusNotFound, "not_found", "Peer not found")
+		return models.VpnPeer{}, false
+	}
+	if err != nil {
+		helpers.ServerErrorJSON(w, r, err)
+		return models.VpnPeer{}, false
+	}
+
+	return peer, true
+}
+
+// provisionPeer generates credentials for a new peer using protocol on the
+// active subscription of a user, within the device limit, and tells the user a
+// device was added. An empty protocol is the first one of the plan.
+func (m *Repository) provisionPeer(ctx context.Context, userID int, name, location, protocol string) (models.VpnPeer, error) {
+	subscription, err := m.DB.GetActiveSubscriptionByUserId(ctx, userID)
+	if err == sql.ErrNoRows {
+		return models.VpnPeer{}, errNoActiveSubscription
+	}
+	if err != nil {
+		return models.VpnPeer{}, err
+	}
+
+	if protocol == "" {
+		protocol = subscription.Plan.AllowedProtocols()[0]
+	}
+
+	// the subscription stays locked until the peer is stored, so concurrent
+	// requests cannot all pass the device limit
+	var peer models.VpnPeer
+	err = m.DB.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		err := repo.LockSubscription(ctx, subscription.ID)
+		if err != nil {
+			return err
+		}
+		err = m.checkDeviceLimit(ctx, repo, subscription)
+		if err != nil {
+			return err
+		}
+
+		peer, err = m.createPeer(ctx, repo, subscription, name, location, protocol)
+		return err
+	})
+	if err != nil {
+		return models.VpnPeer{}, err
+	}
+
+	m.notify(ctx, notify.Event{
+		UserID: userID,
+		Name:   notify.EventDeviceAdded,
+		Data:   notify.DeviceAdded{Name: peer.Name, Address: peer.Address},
+	})
+
+	return peer, nil
+}
+
+// createPeer generates credentials and, for tunneled protocols, an address for
+// a new peer using protocol on subscription, placed on the least-loaded node
+// in location serving protocol, and stores it through repo, which may be
+// bound to a transaction
+func (m *Repository) createPeer(ctx context.Context, repo repository.DatabaseRepo, subscription models.Subscription, name, location, protocol string) (models.VpnPeer, error) {
+	proto, err := vpn.Lookup(protocol)
+	if err != nil || !subscription.Plan.Includes(protocol) {
+		return models.VpnPeer{}, errProtocolNotInPlan
+	}
+
+	node, err := m.selectNode(ctx, repo, location, protocol)
+	if err != nil {
+		return models.VpnPeer{}, err
+	}
+
+	credentials, err := proto.NewCredentials()
+	if err != nil {
+		return models.VpnPeer{}, err
+	}
+
+	peer := models.VpnPeer{
+		UserID:         subscription.UserID,
+		SubscriptionID: subscription.ID,
+		NodeID:         node.ID,
+		Name:           name,
+		Protocol:       protocol,
+		PublicKey:      credentials.PublicKey,
+		PrivateKey:     credentials.PrivateKey,
+		PresharedKey:   credentials.PresharedKey,
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
+	}
+
+	// the address stays locked until the peer holding it is stored
+	err = repo.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		if proto.Tunneled() {
+			err := repo.LockVpnPeerAddresses(ctx, node.ID)
+			if err != nil {
+				return err
+			}
+			used, err := repo.GetVpnPeerAddresses(ctx, node.ID)
+			if err != nil {
+				return err
+			}
+
+			subnet := m.App.WireGuard.Subnet
+			if node.ID != 0 {
+				subnet = node.Subnet
+			}
+			peer.Address, err = vpn.NextAddress(subnet, used)
+			if err != nil {
+				return err
+			}
+		}
+
+		var err error
+		peer.ID, err = repo.InsertVpnPeer(ctx, peer)
+		return err
+	})
+	if err != nil {
+		return models.VpnPeer{}, err
+	}
+
+	return peer, nil
+}
+
+// selectNode picks the node a new peer using protocol in location is placed
+// on. Until the first node is registered every WireGuard peer goes to the
+// default server of WG_ENDPOINT, which is returned as node 0; the default
+// server serves no other protocol.
+func (m *Repository) selectNode(ctx context.Context, repo repository.DatabaseRepo, location, protocol string) (models.VpnNode, error) {
+	node, err := repo.SelectVpnNode(ctx, location, protocol, 0)
+	if err != sql.ErrNoRows {
+		return node, err
+	}
+
+	nodes, err := repo.GetVpnNodes(ctx)
+	if err != nil {
+		return models.VpnNode{}, err
+	}
+	if len(nodes) == 0 && location == "" {
+		if protocol == models.ProtocolWireGuard {
+			return models.VpnNode{}, nil
+		}
+		return models.VpnNode{}, errProtocolUnavailable
+	}
+
+	var inLocation bool
+	for _, n := range nodes {
+		if location != "" && n.Country != location {
+			continue
+		}
+		if n.Serves(protocol) {
+			return models.VpnNode{}, errNoCapacity
+		}
+		inLocation = true
+	}
+	if inLocation {
+		return models.VpnNode{}, errProtocolUnavailable
+	}
+
+	return models.VpnNode{}, errUnknownLocation
+}
+
+// serverConfig returns the server peer connects to: its node, or the default
+// server for peers without one. DNS and allowed IPs are shared by all.
+func (m *Repository) serverConfig(ctx context.Context, peer models.VpnPeer) (vpn.ServerConfig, error) {
+	server := m.App.WireGuard
+	if peer.NodeID == 0 {
+		return server, nil
+	}
+
+	node, err := m.DB.GetVpnNodeById(ctx, peer.NodeID)
+	if err != nil {
+		return vpn.ServerConfig{}, err
+	}
+
+	server.Endpoint = node.Endpoint
+	server.PublicKey = node.PublicKey
+	server.Subnet = node.Subnet
+	server.VLESS = vpn.VLESSServer{
+		Port:       node.VLESSPort,
+		ServerName: node.RealityServerName,
+		PublicKey:  node.RealityPublicKey,
+		ShortID:    node.RealityShortID,
+	}
+	server.Shadowsocks = vpn.ShadowsocksServer{Port: node.ShadowsocksPort, Key: node.ShadowsocksKey}
+	server.OpenVPN, err = m.openVPNServer(ctx, node)
+	if err != nil {
+		return vpn.ServerConfig{}, err
+	}
+	return server, nil
+}
@@ -0,0 +1,222 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/helpers"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/openapi"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/tokens"
+)
+
+// APIBasePath is where the versioned API is mounted
+const APIBasePath = "/api/v1"
+
+// APIOperation describes a single API endpoint. The router is built from these,
+// so the OpenAPI document always lists exactly the routes that are served.
+type APIOperation struct {
+	Method      string
+	Pattern     string
+	ID          string
+	Summary     string
+	Tag         string
+	Scope       string
+	Request     any
+	Response    any
+	Status      int
+	ContentType string
+	Errors      []int
+	Handler     http.HandlerFunc
+}
+
+var pathParamRe = regexp.MustCompile(`\{([^}]+)\}`)
+
+// APIOperations returns every endpoint of the versioned API
+func (m *Repository) APIOperations() []APIOperation {
+	return []APIOperation{
+		{
+			Method: http.MethodGet, Pattern: "/me", ID: "getMe", Tag: "user",
+			Summary: "Get the user owning the token", Scope: tokens.ScopeUserRead,
+			Response: apiUser{}, Handler: m.APIMe,
+		},
+		{
+			Method: http.MethodGet, Pattern: "/subscriptions", ID: "listSubscriptions", Tag: "subscriptions",
+			Summary: "List subscriptions", Scope: tokens.ScopeSubscriptionsRead,
+			Response: []apiSubscription{}, Handler: m.APISubscriptions,
+		},
+		{
+			Method: http.MethodGet, Pattern: "/peers", ID: "listPeers", Tag: "peers",
+			Summary: "List VPN peers", Scope: tokens.ScopePeersRead,
+			Response: []apiPeer{}, Handler: m.APIPeers,
+		},
+		{
+			Method: http.MethodPost, Pattern: "/peers", ID: "createPeer", Tag: "peers",
+			Summary: "Provision a VPN peer on the active subscription", Scope: tokens.ScopePeersWrite,
+			Request: apiCreatePeerRequest{}, Response: apiPeer{}, Status: http.StatusCreated,
+			Errors:  []int{http.StatusBadRequest, http.StatusConflict, http.StatusUnprocessableEntity, http.StatusServiceUnavailable},
+			Handler: m.APICreatePeer,
+		},
+		{
+			Method: http.MethodGet, Pattern: "/locations", ID: "listLocations", Tag: "peers",
+			Summary: "List the locations peers can be provisioned in", Scope: tokens.ScopePeersRead,
+			Response: []apiLocation{}, Handler: m.APILocations,
+		},
+		{
+			Method: http.MethodGet, Pattern: "/peers/{id}", ID: "getPeer", Tag: "peers",
+			Summary: "Get a VPN peer", Scope: tokens.ScopePeersRead,
+			Response: apiPeer{}, Errors: []int{http.StatusNotFound}, Handler: m.APIPeer,
+		},
+		{
+			Method: http.MethodGet, Pattern: "/peers/{id}/config", ID: "downloadPeerConfig", Tag: "peers",
+			Summary: "Download the wg-quick configuration or the share link of a VPN peer", Scope: tokens.ScopePeersRead,
+			ContentType: "text/plain", Errors: []int{http.StatusNotFound, http.StatusGone}, Handler: m.APIPeerConfig,
+		},
+		{
+			Method: http.MethodDelete, Pattern: "/peers/{id}", ID: "revokePeer", Tag: "peers",
+			Summary: "Revoke a VPN peer", Scope: tokens.ScopePeersWrite,
+			Status: http.StatusNoContent, Errors: []int{http.StatusNotFound}, Handler: m.APIRevokePeer,
+		},
+		{
+			Method: http.MethodGet, Pattern: "/invoices", ID: "listInvoices", Tag: "invoices",
+			Summary: "List invoices", Scope: tokens.ScopeInvoicesRead,
+			Response: []apiInvoice{}, Handler: m.APIInvoices,
+		},
+		{
+			Method: http.MethodGet, Pattern: "/invoices/{id}", ID: "getInvoice", Tag: "invoices",
+			Summary: "Get an invoice", Scope: tokens.ScopeInvoicesRead,
+			Response: apiInvoice{}, Errors: []int{http.StatusNotFound}, Handler: m.APIInvoice,
+		},
+	}
+}
+
+// OpenAPIDocument builds the OpenAPI document describing APIOperations
+func (m *Repository) OpenAPIDocument() *openapi.Document {
+	reflector := openapi.NewReflector()
+	errorSchema := reflector.Schema(helpers.JSONError{})
+
+	doc := &openapi.Document{
+		OpenAPI: openapi.Version,
+		Info: openapi.Info{
+			Title:       "Fastnet VPN API",
+			Version:     "1.0.0",
+			Description: "Manage your Fastnet VPN account, subscriptions, peers and invoices.",
+		},
+		Servers: []openapi.Server{{URL: APIBasePath}},
+		Paths:   map[string]openapi.PathItem{},
+		Security: []map[string][]string{
+			{"bearerAuth": {}},
+		},
+		Tags: []openapi.Tag{
+			{Name: "user"},
+			{Name: "subscriptions"},
+			{Name: "peers"},
+			{Name: "invoices"},
+		},
+	}
+
+	for _, op := range m.APIOperations() {
+		operation := &openapi.Operation{
+			OperationID: op.ID,
+			Summary:     op.Summary,
+			Tags:        []string{op.Tag},
+			Responses:   map[string]*openapi.Response{},
+			Security:    []map[string][]string{{"bearerAuth": {op.Scope}}},
+		}
+
+		for _, param := range pathParamRe.FindAllStringSubmatch(op.Pattern, -1) {
+			operation.Parameters = append(operation.Parameters, openapi.Parameter{
+				Name:     param[1],
+				In:       "path",
+				Required: true,
+				Schema:   &openapi.Schema{Type: "integer"},
+			})
+		}
+
+		if op.Request != nil {
+			operation.RequestBody = &openapi.RequestBody{
+				Required: true,
+				Content: map[string]openapi.MediaType{
+					"application/json": {Schema: reflector.Schema(op.Request)},
+				},
+			}
+		}
+
+		status := op.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		success := &openapi.Response{Description: http.StatusText(status)}
+		switch {
+		case op.ContentType != "":
+			success.Content = map[string]openapi.MediaType{
+				op.ContentType: {Schema: &openapi.Schema{Type: "string"}},
+			}
+		case op.Response != nil:
+			closed := false
+			success.Content = map[string]openapi.MediaType{
+				"application/json": {Schema: &openapi.Schema{
+					Type:                 "object",
+					Properties:           map[string]*openapi.Schema{"data": reflector.Schema(op.Response)},
+					Required:             []string{"data"},
+					AdditionalProperties: &closed,
+				}},
+			}
+		}
+		operation.Responses[strconv.Itoa(status)] = success
+
+		for _, code := range append([]int{http.StatusUnauthorized, http.StatusForbidden}, op.Errors...) {
+			operation.Responses[strconv.Itoa(code)] = &openapi.Response{
+				Description: http.StatusText(code),
+				Content: map[string]openapi.MediaType{
+					"application/json": {Schema: errorSchema},
+				},
+			}
+		}
+
+		path := op.Pattern
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = openapi.PathItem{}
+		}
+		doc.Paths[path][strings.ToLower(op.Method)] = operation
+	}
+
+	doc.Components = openapi.Components{
+		Schemas: reflector.Schemas,
+		SecuritySchemes: map[string]openapi.SecurityScheme{
+			"bearerAuth": {
+				Type:         "http",
+				Scheme:       "bearer",
+				BearerFormat: "Personal API token",
+				Description:  "Create tokens on the profile page. Each operation lists the scope it requires.",
+			},
+		},
+	}
+
+	return doc
+}
+
+var (
+	openAPIOnce sync.Once
+	openAPIJSON []byte
+	openAPIErr  error
+)
+
+// OpenAPISpec serves the OpenAPI document of the versioned API
+func (m *Repository) OpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	openAPIOnce.Do(func() {
+		openAPIJSON, openAPIErr = json.MarshalIndent(m.OpenAPIDocument(), "", "  ")
+	})
+	if openAPIErr != nil {
+		helpers.ServerErrorJSON(w, r, openAPIErr)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	_, _ = w.Write(openAPIJSON)
+}
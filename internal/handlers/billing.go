@@ -0,0 +1,381 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/helpers"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/metrics"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/notify"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/quota"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/render"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/repository"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/usage"
+)
+
+// Purchase is everything created when a user buys a plan
+type Purchase struct {
+	Subscription models.Subscription
+	Invoice      models.Invoice
+	Peer         models.VpnPeer
+}
+
+// PurchasePlan starts a subscription to a plan for a user, records the paid
+// invoice and provisions the first VPN peer in location, or anywhere when it is
+// empty. Either all three are stored or none is. The invoice is stored as paid,
+// so it must only be called once the payment was received.
+func (m *Repository) PurchasePlan(ctx context.Context, userID, planID int, location string) (Purchase, error) {
+	var purchase Purchase
+
+	err := m.DB.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		plan, err := repo.GetPlanById(ctx, planID)
+		if err != nil {
+			return fmt.Errorf("load plan %d: %w", planID, err)
+		}
+
+		now := time.Now()
+		subscription := models.Subscription{
+			UserID:    userID,
+			PlanID:    plan.ID,
+			Status:    "active",
+			StartsAt:  now,
+			ExpiresAt: now.AddDate(0, 0, plan.DurationDays),
+			Plan:      plan,
+		}
+		subscription.ID, err = repo.InsertSubscription(ctx, subscription)
+		if err != nil {
+			return fmt.Errorf("insert subscription: %w", err)
+		}
+
+		invoice := models.Invoice{
+			UserID:         userID,
+			SubscriptionID: subscription.ID,
+			Number:         invoiceNumber(now, subscription.ID),
+			AmountCents:    plan.PriceCents,
+			Currency:       plan.Currency,
+			Status:         "paid",
+			IssuedAt:       now,
+			PaidAt:         now,
+		}
+		invoice.ID, err = repo.InsertInvoice(ctx, invoice)
+		if err != nil {
+			return fmt.Errorf("insert invoice: %w", err)
+		}
+
+		peer, err := m.createPeer(ctx, repo, subscription, "Default", location, plan.AllowedProtocols()[0])
+		if err != nil {
+			return fmt.Errorf("provision peer: %w", err)
+		}
+
+		purchase = Purchase{Subscription: subscription, Invoice: invoice, Peer: peer}
+		return nil
+	})
+	if err != nil {
+		metrics.PaymentEvents.WithLabelValues("failed").Inc()
+		m.App.Logger.ErrorContext(ctx, "purchase failed", "user_id", userID, "plan_id", planID, "error", err)
+
+		// a plan that cannot be loaded was never offered, so there is no payment to report
+		if plan, planErr := m.DB.GetPlanById(ctx, planID); planErr == nil {
+			m.notify(ctx, notify.Event{
+				UserID: userID,
+				Name:   notify.EventPaymentFailed,
+				Data:   notify.PaymentFailed{PlanName: plan.Name},
+			})
+		}
+		return Purchase{}, err
+	}
+
+	metrics.PaymentEvents.WithLabelValues("succeeded").Inc()
+	m.App.Logger.InfoContext(ctx, "plan purchased", "user_id", userID, "plan_id", planID,
+		"subscription_id", purchase.Subscription.ID, "invoice", purchase.Invoice.Number)
+
+	// a new plan starts a new billing cycle
+	m.checkQuota(ctx, userID)
+
+	m.notify(ctx, notify.Event{
+		UserID: userID,
+		Name:   notify.EventPaymentSucceeded,
+		Data: notify.PaymentSucceeded{
+			PlanName:      purchase.Subscription.Plan.Name,
+			InvoiceNumber: purchase.Invoice.Number,
+			Amount:        formatAmount(purchase.Invoice.AmountCents, purchase.Invoice.Currency),
+			ExpiresAt:     purchase.Subscription.ExpiresAt,
+		},
+		Link: "/invoice",
+	})
+
+	return purchase, nil
+}
+
+// planOffer is a plan as the plans page offers it
+type planOffer struct {
+	Plan  models.Plan
+	Price string
+	// Data is the data cap of a billing cycle, empty when unlimited
+	Data string
+}
+
+// planOffers returns the plans on sale
+func (m *Repository) planOffers(ctx context.Context) ([]planOffer, error) {
+	plans, err := m.DB.GetPlans(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	offers := make([]planOffer, 0, len(plans))
+	for _, p := range plans {
+		offer := planOffer{Plan: p, Price: formatAmount(p.PriceCents, p.Currency)}
+		if p.DataCapBytes > 0 {
+			offer.Data = usage.FormatBytes(p.DataCapBytes)
+		}
+		offers = append(offers, offer)
+	}
+	return offers, nil
+}
+
+// Plans shows the plans on sale. There is no payment provider yet, so users
+// pay outside the panel and an admin records the purchase.
+func (m *Repository) Plans(w http.ResponseWriter, r *http.Request) {
+	userID := m.App.Session.GetInt(r.Context(), "user_id")
+
+	offers, err := m.planOffers(r.Context())
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	data := map[string]any{"plans": offers}
+	sub, err := m.DB.GetActiveSubscriptionByUserId(r.Context(), userID)
+	if err != nil && err != sql.ErrNoRows {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	if err == nil {
+		data["subscription"] = sub
+	}
+
+	render.Template(w, r, "plans.page.tmpl", &models.TemplateData{Data: data})
+}
+
+// PostAdminPurchasePlan records that the user named by the id URL parameter
+// paid for the plan posted, starting the subscription with the first device in
+// the location posted. Only admins may record it, once the payment was received.
+func (m *Repository) PostAdminPurchasePlan(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.adminLoadUser(w, r)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		helpers.ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+	planID, err := strconv.Atoi(r.PostForm.Get("plan"))
+	if err != nil {
+		helpers.ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+	path := fmt.Sprintf("/admin/users/%d/quota", user.ID)
+
+	_, err = m.DB.GetActiveSubscriptionByUserId(r.Context(), user.ID)
+	if err == nil {
+		m.App.Session.Put(r.Context(), "error", "The user already has an active subscription")
+		http.Redirect(w, r, path, http.StatusSeeOther)
+		return
+	}
+	if err != sql.ErrNoRows {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	purchase, err := m.PurchasePlan(r.Context(), user.ID, planID, r.PostForm.Get("location"))
+	if errors.Is(err, sql.ErrNoRows) {
+		helpers.ClientError(w, r, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		msg, ok := provisionErrorMessage(err)
+		if !ok {
+			helpers.ServerError(w, r, err)
+			return
+		}
+		m.App.Session.Put(r.Context(), "error", msg+". Nothing was recorded.")
+		http.Redirect(w, r, path, http.StatusSeeOther)
+		return
+	}
+
+	m.App.Logger.InfoContext(r.Context(), "plan purchase recorded", "user_id", user.ID,
+		"invoice", purchase.Invoice.Number, "admin_id", m.App.Session.GetInt(r.Context(), "user_id"))
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("Subscribed to %s until %s, invoice %s",
+		purchase.Subscription.Plan.Name, purchase.Subscription.ExpiresAt.Format("January 2, 2006"), purchase.Invoice.Number))
+	http.Redirect(w, r, path, http.StatusSeeOther)
+}
+
+// TopUpPurchase is everything created when a user buys a top-up pack
+type TopUpPurchase struct {
+	TopUp   models.TopUp
+	Invoice models.Invoice
+}
+
+// PurchaseTopUp sells a top-up pack to a user with an active subscription and
+// records the paid invoice. The data raises the cap until the current billing
+// cycle ends, and a block over the cap is lifted right away. The invoice is
+// stored as paid, so it must only be called once the payment was received.
+func (m *Repository) PurchaseTopUp(ctx context.Context, userID, packID int) (TopUpPurchase, error) {
+	var purchase TopUpPurchase
+	var pack models.TopUpPack
+
+	err := m.DB.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		var err error
+		pack, err = repo.GetTopUpPackById(ctx, packID)
+		if err != nil {
+			return fmt.Errorf("load top-up pack %d: %w", packID, err)
+		}
+
+		subscription, err := repo.GetActiveSubscriptionByUserId(ctx, userID)
+		if err == sql.ErrNoRows {
+			return errNoActiveSubscription
+		}
+		if err != nil {
+			return fmt.Errorf("load active subscription: %w", err)
+		}
+
+		now := time.Now()
+		_, cycleEnd := quota.Cycle(subscription, now)
+		topUp := models.TopUp{
+			UserID:         userID,
+			SubscriptionID: subscription.ID,
+			PackID:         pack.ID,
+			DataBytes:      pack.DataBytes,
+			StartsAt:       now,
+			ExpiresAt:      cycleEnd,
+		}
+		topUp.ID, err = repo.InsertTopUp(ctx, topUp)
+		if err != nil {
+			return fmt.Errorf("insert top-up: %w", err)
+		}
+
+		invoice := models.Invoice{
+			UserID:         userID,
+			SubscriptionID: subscription.ID,
+			Number:         topUpInvoiceNumber(now, topUp.ID),
+			AmountCents:    pack.PriceCents,
+			Currency:       pack.Currency,
+			Status:         "paid",
+			IssuedAt:       now,
+			PaidAt:         now,
+		}
+		invoice.ID, err = repo.InsertInvoice(ctx, invoice)
+		if err != nil {
+			return fmt.Errorf("insert invoice: %w", err)
+		}
+
+		purchase = TopUpPurchase{TopUp: topUp, Invoice: invoice}
+		return nil
+	})
+	if err != nil {
+		metrics.PaymentEvents.WithLabelValues("failed").Inc()
+		m.App.Logger.ErrorContext(ctx, "top-up purchase failed", "user_id", userID, "pack_id", packID, "error", err)
+		return TopUpPurchase{}, err
+	}
+
+	metrics.PaymentEvents.WithLabelValues("succeeded").Inc()
+	m.App.Logger.InfoContext(ctx, "top-up purchased", "user_id", userID, "pack_id", packID,
+		"topup_id", purchase.TopUp.ID, "invoice", purchase.Invoice.Number)
+
+	m.notify(ctx, notify.Event{
+		UserID: userID,
+		Name:   notify.EventTopUpPurchased,
+		Data: notify.TopUpPurchased{
+			PackName:      pack.Name,
+			Data:          usage.FormatBytes(pack.DataBytes),
+			InvoiceNumber: purchase.Invoice.Number,
+			Amount:        formatAmount(purchase.Invoice.AmountCents, purchase.Invoice.Currency),
+			ExpiresAt:     purchase.TopUp.ExpiresAt,
+		},
+		Link: "/invoice",
+	})
+
+	m.checkQuota(ctx, userID)
+
+	return purchase, nil
+}
+
+// topUpOffer is a top-up pack as the dashboard offers it
+type topUpOffer struct {
+	Pack  models.TopUpPack
+	Data  string
+	Price string
+}
+
+// topUpOffers returns the top-up packs on sale
+func (m *Repository) topUpOffers(ctx context.Context) ([]topUpOffer, error) {
+	packs, err := m.DB.GetTopUpPacks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	offers := make([]topUpOffer, 0, len(packs))
+	for _, p := range packs {
+		offers = append(offers, topUpOffer{Pack: p, Data: usage.FormatBytes(p.DataBytes), Price: formatAmount(p.PriceCents, p.Currency)})
+	}
+	return offers, nil
+}
+
+// PostAdminTopUp records that the user named by the id URL parameter paid for
+// the top-up pack posted. Only admins may record it, once the payment was
+// received; every call adds another pack.
+func (m *Repository) PostAdminTopUp(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.adminLoadUser(w, r)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		helpers.ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+	packID, err := strconv.Atoi(r.PostForm.Get("pack"))
+	if err != nil {
+		helpers.ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	purchase, err := m.PurchaseTopUp(r.Context(), user.ID, packID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		helpers.ClientError(w, r, http.StatusNotFound)
+		return
+	case errors.Is(err, errNoActiveSubscription):
+		m.App.Session.Put(r.Context(), "error", "An active subscription is required for a top-up pack")
+	case err != nil:
+		helpers.ServerError(w, r, err)
+		return
+	default:
+		m.App.Logger.InfoContext(r.Context(), "top-up purchase recorded", "user_id", user.ID,
+			"invoice", purchase.Invoice.Number, "admin_id", m.App.Session.GetInt(r.Context(), "user_id"))
+		m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("%s of data added until %s, invoice %s",
+			usage.FormatBytes(purchase.TopUp.DataBytes), purchase.TopUp.ExpiresAt.Format("January 2"), purchase.Invoice.Number))
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/admin/users/%d/quota", user.ID), http.StatusSeeOther)
+}
+
+// formatAmount formats an amount in cents for people, e.g. 4.99 USD
+func formatAmount(cents int, currency string) string {
+	return fmt.Sprintf("%d.%02d %s", cents/100, cents%100, currency)
+}
+
+// topUpInvoiceNumber builds the invoice number of a top-up, e.g. FN-20261019-T000042
+func topUpInvoiceNumber(issuedAt time.Time, topUpID int) string {
+	return fmt.Sprintf("FN-%s-T%06d", issuedAt.Format("20060102"), topUpID)
+}
+
+// invoiceNumber builds the human readable invoice number, e.g. FN-20261019-000042
+func invoiceNumber(issuedAt time.Time, subscriptionID int) string {
+	return fmt.Sprintf("FN-%s-%06d", issuedAt.Format("20060102"), subscriptionID)
+}
@@ -0,0 +1,281 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/telegram"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/tokens"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/vpn"
+)
+
+// BotSender is the part of the Telegram client the bot answers through
+type BotSender interface {
+	SendMessage(ctx context.Context, chatID, text string) error
+	SendDocument(ctx context.Context, chatID, filename string, data []byte, caption string) error
+	SendPhoto(ctx context.Context, chatID, filename string, data []byte, caption string) error
+}
+
+const (
+	botHelp = `Manage your VPN devices:
+/devices - list your devices
+/add [protocol] <name> - add a device, e.g. /add vless Phone
+/config <id> - get the config and QR code of a device
+/rename <id> <name> - rename a device
+/reissue <id> - revoke the keys of a device and issue new ones
+/revoke <id> - revoke a device`
+
+	botNotLinked = "This chat is not linked to an account yet. Open My devices in the panel, choose Link Telegram and follow the link."
+	botFailed    = "Something went wrong, please try again later."
+)
+
+// HandleBotMessage answers a message sent to the Telegram bot. Chats are linked
+// to a user with the /start code from the devices page; only private chats are
+// answered since configs carry private keys.
+func (m *Repository) HandleBotMessage(ctx context.Context, msg telegram.Message) {
+	if msg.Chat.Type != "private" {
+		return
+	}
+
+	chatID := msg.Chat.ChatID()
+	command, args := parseBotCommand(msg.Text)
+	if command == "/start" && len(args) > 0 {
+		m.botLink(ctx, msg.Chat, args[0])
+		return
+	}
+
+	userID, err := m.DB.GetUserIdByTelegramChat(ctx, msg.Chat.ID)
+	if err == sql.ErrNoRows {
+		m.botReply(ctx, chatID, botNotLinked)
+		return
+	}
+	if err != nil {
+		m.App.Logger.ErrorContext(ctx, "unable to look up Telegram chat", "error", err)
+		m.botReply(ctx, chatID, botFailed)
+		return
+	}
+
+	switch command {
+	case "/devices":
+		err = m.botDevices(ctx, chatID, userID)
+	case "/add":
+		err = m.botAdd(ctx, chatID, userID, args)
+	case "/config", "/rename", "/reissue", "/revoke":
+		err = m.botDevice(ctx, chatID, userID, command, args)
+	default:
+		m.botReply(ctx, chatID, botHelp)
+	}
+	if err != nil {
+		m.App.Logger.ErrorContext(ctx, "unable to answer bot command", "user_id", userID, "command", command, "error", err)
+		m.botReply(ctx, chatID, botFailed)
+	}
+}
+
+// parseBotCommand splits a message into the lower-cased command, without the
+// @botname suffix Telegram adds in some clients, and its arguments
+func parseBotCommand(text string) (string, []string) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "/") {
+		return "", nil
+	}
+
+	command, _, _ := strings.Cut(fields[0], "@")
+	return strings.ToLower(command), fields[1:]
+}
+
+// botLink links chat to the user whose link code code is and sends the chat
+// their notifications from then on
+func (m *Repository) botLink(ctx context.Context, chat telegram.Chat, code string) {
+	chatID := chat.ChatID()
+
+	userID, err := m.DB.LinkTelegramChat(ctx, tokens.Hash(code), chat.ID)
+	if err == sql.ErrNoRows {
+		m.botReply(ctx, chatID, "This link has expired or was already used. Choose Link Telegram on the devices page again.")
+		return
+	}
+	if err == nil {
+		var prefs models.NotificationPreferences
+		prefs, err = m.DB.GetNotificationPreferences(ctx, userID)
+		if err == nil {
+			prefs.TelegramChatID = chatID
+			err = m.DB.UpdateNotificationPreferences(ctx, prefs)
+		}
+	}
+	if err != nil {
+		m.App.Logger.ErrorContext(ctx, "unable to link Telegram chat", "error", err)
+		m.botReply(ctx, chatID, botFailed)
+		return
+	}
+
+	m.App.Logger.InfoContext(ctx, "Telegram chat linked", "user_id", userID)
+	m.botReply(ctx, chatID, "This chat is now linked to your account.\n\n"+botHelp)
+}
+
+// botDevices lists the devices of the user and the key changes still under way
+func (m *Repository) botDevices(ctx context.Context, chatID string, userID int) error {
+	now := time.Now()
+	devices, err := m.userDevices(ctx, userID, now)
+	if err != nil {
+		return err
+	}
+	changes, err := m.userKeyChanges(ctx, userID, now)
+	if err != nil {
+		return err
+	}
+	limit, err := m.userDeviceLimit(ctx, userID, devices)
+	if err != nil {
+		return err
+	}
+
+	if len(devices) == 0 {
+		m.botReply(ctx, chatID, "You have no devices yet. Add one with /add <name>.")
+		return nil
+	}
+
+	var b strings.Builder
+	if limit.Limit > 0 {
+		fmt.Fprintf(&b, "Your devices (%d of %d):\n", limit.Used, limit.Limit)
+	} else {
+		b.WriteString("Your devices:\n")
+	}
+	for _, d := range devices {
+		fmt.Fprintf(&b, "\n#%d %s, %s", d.Peer.ID, d.Peer.Name, d.Protocol)
+		if d.Location != "" {
+			fmt.Fprintf(&b, " (%s)", d.Location)
+		}
+		switch {
+		case d.Online:
+			b.WriteString("\nonline")
+		case d.Peer.LastHandshakeAt.IsZero():
+			b.WriteString("\nnever connected")
+		default:
+			fmt.Fprintf(&b, "\nlast seen %s UTC", d.Peer.LastHandshakeAt.UTC().Format("2006-01-02 15:04"))
+		}
+		fmt.Fprintf(&b, ", %s this month\n", d.Traffic)
+	}
+	for _, c := range changes {
+		if c.Done && now.Sub(c.Revocation.CreatedAt) > time.Hour {
+			continue
+		}
+		fmt.Fprintf(&b, "\n%s on %s: %s", c.Action, c.Revocation.PeerName, c.Status)
+	}
+	m.botReply(ctx, chatID, b.String())
+
+	return nil
+}
+
+// botAdd adds a device named by args and sends its config. The first of args
+// may name the protocol; the first protocol of the plan is used otherwise.
+func (m *Repository) botAdd(ctx context.Context, chatID string, userID int, args []string) error {
+	var protocol string
+	if len(args) > 1 && slices.Contains(models.Protocols, strings.ToLower(args[0])) {
+		protocol, args = strings.ToLower(args[0]), args[1:]
+	}
+
+	name, ok := deviceName(strings.Join(args, " "))
+	if !ok {
+		m.botReply(ctx, chatID, "Give the device a name of up to 64 characters, e.g. /add Phone")
+		return nil
+	}
+
+	peer, err := m.provisionPeer(ctx, userID, name, "", protocol)
+	if msg, ok := provisionErrorMessage(err); ok {
+		m.botReply(ctx, chatID, msg+".")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return m.botSendConfig(ctx, chatID, peer, fmt.Sprintf("%s added.", peer.Name))
+}
+
+// botDevice runs command on the device named by the first of args
+func (m *Repository) botDevice(ctx context.Context, chatID string, userID int, command string, args []string) error {
+	var id int
+	if len(args) > 0 {
+		id, _ = strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+	}
+	if id <= 0 {
+		m.botReply(ctx, chatID, fmt.Sprintf("Give the number of the device from /devices, e.g. %s 12", command))
+		return nil
+	}
+
+	peer, err := m.loadDevice(ctx, userID, id)
+	if err == sql.ErrNoRows {
+		m.botReply(ctx, chatID, fmt.Sprintf("You have no device #%d. See /devices.", id))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "/config":
+		return m.botSendConfig(ctx, chatID, peer, peer.Name)
+
+	case "/rename":
+		name, ok := deviceName(strings.Join(args[1:], " "))
+		if !ok {
+			m.botReply(ctx, chatID, fmt.Sprintf("Give the new name of up to 64 characters, e.g. /rename %d Work laptop", id))
+			return nil
+		}
+		err = m.DB.RenameVpnPeer(ctx, peer.ID, name)
+		if err != nil {
+			return err
+		}
+		m.botReply(ctx, chatID, fmt.Sprintf("%s renamed to %s.", peer.Name, name))
+
+	case "/reissue":
+		peer, err = m.reissueDevice(ctx, peer)
+		if err != nil {
+			return err
+		}
+		return m.botSendConfig(ctx, chatID, peer, fmt.Sprintf("New keys issued for %s. The old config stops working as soon as the server drops it; /devices confirms it.", peer.Name))
+
+	case "/revoke":
+		err = m.DB.RevokeVpnPeer(ctx, peer.ID)
+		if err != nil {
+			return err
+		}
+		m.App.Logger.InfoContext(ctx, "VPN peer revoked", "user_id", peer.UserID, "peer_id", peer.ID)
+		m.botReply(ctx, chatID, fmt.Sprintf("%s revoked.", peer.Name))
+	}
+
+	return nil
+}
+
+// botSendConfig sends the config of peer as a file and, when scannable, as a
+// QR code
+func (m *Repository) botSendConfig(ctx context.Context, chatID string, peer models.VpnPeer, caption string) error {
+	conf, err := m.deviceConfig(ctx, peer)
+	if err != nil {
+		return err
+	}
+
+	err = m.Bot.SendDocument(ctx, chatID, configFilename(peer), conf, caption+"\n"+configHint(peer))
+	if err != nil || !scannable(peer) {
+		return err
+	}
+
+	png, err := vpn.QRCode(conf)
+	if err != nil {
+		return err
+	}
+	return m.Bot.SendPhoto(ctx, chatID, fmt.Sprintf("fastnet-%d.png", peer.ID), png, "")
+}
+
+// botReply sends text to the chat chatID. A failure is logged; the user can
+// send the command again.
+func (m *Repository) botReply(ctx context.Context, chatID, text string) {
+	err := m.Bot.SendMessage(ctx, chatID, text)
+	if err != nil {
+		m.App.Logger.ErrorContext(ctx, "unable to answer on Telegram", "error", err)
+	}
+}
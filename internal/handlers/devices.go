@@ -0,0 +1,597 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/failover"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/forms"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/helpers"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/quota"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/render"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/rotation"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/tokens"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/usage"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/vpn"
+)
+
+// deviceOnlineWindow is how recent a handshake must be for a device to show as
+// online. WireGuard renews the handshake every two minutes while in use.
+const deviceOnlineWindow = 3 * time.Minute
+
+// telegramLinkTTL is how long a Telegram link code can be used
+const telegramLinkTTL = 15 * time.Minute
+
+// keyChangesShown is how many of the latest key changes the devices page lists
+const keyChangesShown = 10
+
+// device is a peer of a user as the devices page and the bot show it
+type device struct {
+	Peer models.VpnPeer
+	// Protocol is the title of the protocol of the peer
+	Protocol string
+	// Location is the country and name of the node, or empty for the default server
+	Location string
+	// NodeDown reports whether the node of the peer is down, so the device
+	// can be moved to another
+	NodeDown bool
+	// Traffic is the traffic of the peer this month
+	Traffic string
+	Online  bool
+	// QRCode reports whether the config is offered as a QR code
+	QRCode bool
+}
+
+// deviceProtocol is a protocol a new device can use
+type deviceProtocol struct {
+	Name  string
+	Title string
+}
+
+// deviceLimit is how many devices a user has against the limit of their plan
+type deviceLimit struct {
+	Used int
+	// Limit is 0 when unlimited
+	Limit int
+	// Active reports whether the user has an active subscription to add devices on
+	Active bool
+}
+
+// Full reports whether no more devices can be added
+func (l deviceLimit) Full() bool {
+	return !l.Active || (l.Limit > 0 && l.Used >= l.Limit)
+}
+
+// keyChange is an entry of the revocation list of a user as the devices page
+// and the bot show it
+type keyChange struct {
+	Revocation models.KeyRevocation
+	Action     string
+	Status     string
+	// Done reports whether the old keys are known to no longer work
+	Done bool
+}
+
+// newKeyChange describes r at now. The default server has no agent to confirm
+// removals, so its keys count as gone once they are no longer served.
+func newKeyChange(r models.KeyRevocation, now time.Time) keyChange {
+	c := keyChange{Revocation: r}
+
+	switch r.Reason {
+	case models.KeysRotated:
+		c.Action = "Keys rotated"
+	case models.KeysReissued:
+		c.Action = "Keys reissued"
+	default:
+		c.Action = "Device revoked"
+	}
+
+	switch {
+	case r.Served(now):
+		c.Status = "old config works until " + r.ServeUntil.UTC().Format("2006-01-02 15:04") + " UTC"
+	case r.NodeID == 0:
+		c.Status, c.Done = "old keys revoked", true
+	case r.IsConfirmed():
+		c.Status, c.Done = "old keys removed from the server at "+r.ConfirmedAt.UTC().Format("2006-01-02 15:04")+" UTC", true
+	default:
+		c.Status = "waiting for the server to remove the old keys"
+	}
+
+	return c
+}
+
+// userKeyChanges returns the latest key changes of a user, newest first
+func (m *Repository) userKeyChanges(ctx context.Context, userID int, now time.Time) ([]keyChange, error) {
+	revocations, err := m.DB.GetKeyRevocationsByUserId(ctx, userID, keyChangesShown)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]keyChange, 0, len(revocations))
+	for _, r := range revocations {
+		changes = append(changes, newKeyChange(r, now))
+	}
+
+	return changes, nil
+}
+
+// userDevices returns the unrevoked peers of a user, oldest first
+func (m *Repository) userDevices(ctx context.Context, userID int, now time.Time) ([]device, error) {
+	peers, err := m.DB.GetVpnPeersByUserId(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, err := m.DB.GetVpnNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	locations := make(map[int]string, len(nodes))
+	down := make(map[int]bool)
+	for _, n := range nodes {
+		locations[n.ID] = n.Country + " · " + n.Name
+		down[n.ID] = n.IsDown()
+	}
+
+	traffic, err := m.DB.GetPeerTrafficByUserId(ctx, userID, models.UsageMonth, models.UsageBucket(models.UsageMonth, now))
+	if err != nil {
+		return nil, err
+	}
+	monthly := make(map[int]int64, len(traffic))
+	for _, t := range traffic {
+		monthly[t.PeerID] = t.RxBytes + t.TxBytes
+	}
+
+	devices := make([]device, 0, len(peers))
+	for _, p := range peers {
+		if p.IsRevoked() {
+			continue
+		}
+		devices = append(devices, device{
+			Peer:     p,
+			Protocol: vpn.Title(p.Protocol),
+			Location: locations[p.NodeID],
+			NodeDown: down[p.NodeID],
+			Traffic:  usage.FormatBytes(monthly[p.ID]),
+			Online:   !p.LastHandshakeAt.IsZero() && now.Sub(p.LastHandshakeAt) < deviceOnlineWindow,
+			QRCode:   scannable(p),
+		})
+	}
+
+	return devices, nil
+}
+
+// userDeviceLimit returns how many devices the user has on their active
+// subscription against its limit
+func (m *Repository) userDeviceLimit(ctx context.Context, userID int, devices []device) (deviceLimit, error) {
+	sub, err := m.DB.GetActiveSubscriptionByUserId(ctx, userID)
+	if err == sql.ErrNoRows {
+		return deviceLimit{}, nil
+	}
+	if err != nil {
+		return deviceLimit{}, err
+	}
+
+	q, err := m.DB.GetUserQuota(ctx, userID)
+	if err != nil {
+		return deviceLimit{}, err
+	}
+
+	limit := deviceLimit{Limit: quota.Effective(sub.Plan, q).DeviceLimit, Active: true}
+	for _, d := range devices {
+		if d.Peer.SubscriptionID == sub.ID {
+			limit.Used++
+		}
+	}
+
+	return limit, nil
+}
+
+// userProtocols returns the protocols the plan of the active subscription of
+// the user includes, none without one
+func (m *Repository) userProtocols(ctx context.Context, userID int) ([]deviceProtocol, error) {
+	sub, err := m.DB.GetActiveSubscriptionByUserId(ctx, userID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var protocols []deviceProtocol
+	for _, name := range sub.Plan.AllowedProtocols() {
+		protocols = append(protocols, deviceProtocol{Name: name, Title: vpn.Title(name)})
+	}
+	return protocols, nil
+}
+
+// loadDevice returns the unrevoked peer id of the user, or sql.ErrNoRows
+func (m *Repository) loadDevice(ctx context.Context, userID, id int) (models.VpnPeer, error) {
+	peer, err := m.DB.GetVpnPeerById(ctx, id)
+	if err != nil {
+		return models.VpnPeer{}, err
+	}
+	if peer.UserID != userID || peer.IsRevoked() {
+		return models.VpnPeer{}, sql.ErrNoRows
+	}
+
+	return peer, nil
+}
+
+// deviceConfig renders the client configuration of peer: a wg-quick file for
+// WireGuard, an .ovpn profile for OpenVPN, a share link for the other
+// protocols. OpenVPN peers get their certificate issued on the first call.
+func (m *Repository) deviceConfig(ctx context.Context, peer models.VpnPeer) ([]byte, error) {
+	protocol, err := vpn.Lookup(peer.Protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	peer, err = m.peerCertificate(ctx, peer)
+	if err != nil {
+		return nil, err
+	}
+	server, err := m.serverConfig(ctx, peer)
+	if err != nil {
+		return nil, err
+	}
+
+	return protocol.ClientConfig(peer, server)
+}
+
+// configFilename returns the name the client configuration of peer downloads as
+func configFilename(peer models.VpnPeer) string {
+	switch peer.Protocol {
+	case models.ProtocolWireGuard:
+		return fmt.Sprintf("fastnet-%d.conf", peer.ID)
+	case models.ProtocolOpenVPN:
+		return fmt.Sprintf("fastnet-%d.ovpn", peer.ID)
+	}
+	return fmt.Sprintf("fastnet-%d.txt", peer.ID)
+}
+
+// configHint tells the user how to import the client configuration of peer
+func configHint(peer models.VpnPeer) string {
+	switch peer.Protocol {
+	case models.ProtocolWireGuard:
+		return "Import the file into the WireGuard app, or scan the QR code."
+	case models.ProtocolOpenVPN:
+		return "Import the .ovpn file into OpenVPN Connect or another OpenVPN client."
+	}
+	return "Paste the link into v2rayNG, Hiddify, Shadowrocket or another Xray client, or scan the QR code."
+}
+
+// scannable reports whether the client configuration of peer is offered as a
+// QR code. OpenVPN profiles carry certificates too long to scan reliably.
+func scannable(peer models.VpnPeer) bool {
+	return peer.Protocol != models.ProtocolOpenVPN
+}
+
+// reissueDevice revokes the keys of peer and gives it new ones, which
+// invalidates every config of it downloaded before. The node agents swap the
+// keys on their next sync and confirm the old ones gone.
+func (m *Repository) reissueDevice(ctx context.Context, peer models.VpnPeer) (models.VpnPeer, error) {
+	peer, _, err := rotation.Reissue(ctx, m.DB, peer, time.Now())
+	if err != nil {
+		return models.VpnPeer{}, err
+	}
+
+	m.App.Logger.InfoContext(ctx, "VPN peer keys reissued", "user_id", peer.UserID, "peer_id", peer.ID)
+	return peer, nil
+}
+
+// deviceName trims name and reports whether it is a valid device name
+func deviceName(name string) (string, bool) {
+	name = strings.TrimSpace(name)
+	return name, name != "" && len(name) <= 64
+}
+
+// provisionErrorMessage returns the message telling the user why a device
+// could not be added, or false for an unexpected error
+func provisionErrorMessage(err error) (string, bool) {
+	switch {
+	case errors.Is(err, errNoActiveSubscription):
+		return "An active subscription is required to add a device", true
+	case errors.Is(err, errDeviceLimit):
+		return "Your plan allows no more devices; revoke one to add another", true
+	case errors.Is(err, errUnknownLocation):
+		return "There are no servers in that location", true
+	case errors.Is(err, errProtocolNotInPlan):
+		return "Your plan does not include that protocol", true
+	case errors.Is(err, errProtocolUnavailable):
+		return "No server in that location offers that protocol yet", true
+	case errors.Is(err, vpn.ErrSubnetExhausted), errors.Is(err, errNoCapacity):
+		return "No servers have room for another device right now, please try again later", true
+	}
+	return "", false
+}
+
+// Devices shows the VPN devices of the user
+func (m *Repository) Devices(w http.ResponseWriter, r *http.Request) {
+	m.renderDevices(w, r, forms.New(nil))
+}
+
+// PostDevice adds a device for the user
+func (m *Repository) PostDevice(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	name, ok := deviceName(form.Get("name"))
+	if !ok {
+		form.Errors.Add("name", "Name must be between 1 and 64 characters")
+		m.renderDevices(w, r, form)
+		return
+	}
+
+	userID := m.App.Session.GetInt(r.Context(), "user_id")
+	location := strings.ToUpper(strings.TrimSpace(form.Get("location")))
+	peer, err := m.provisionPeer(r.Context(), userID, name, location, strings.TrimSpace(form.Get("protocol")))
+	if msg, ok := provisionErrorMessage(err); ok {
+		form.Errors.Add("name", msg)
+		m.renderDevices(w, r, form)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("%s added. %s", peer.Name, configHint(peer)))
+	http.Redirect(w, r, "/devices", http.StatusSeeOther)
+}
+
+// DeviceConfig downloads the wg-quick configuration or the share link of a device
+func (m *Repository) DeviceConfig(w http.ResponseWriter, r *http.Request) {
+	peer, ok := m.webLoadDevice(w, r)
+	if !ok {
+		return
+	}
+
+	conf, err := m.deviceConfig(r.Context(), peer)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, configFilename(peer)))
+	_, _ = w.Write(conf)
+}
+
+// DeviceQRCode shows the configuration of a device as a QR code
+func (m *Repository) DeviceQRCode(w http.ResponseWriter, r *http.Request) {
+	peer, ok := m.webLoadDevice(w, r)
+	if !ok {
+		return
+	}
+	if !scannable(peer) {
+		helpers.ClientError(w, r, http.StatusNotFound)
+		return
+	}
+
+	conf, err := m.deviceConfig(r.Context(), peer)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	png, err := vpn.QRCode(conf)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	// the code holds the private key
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "image/png")
+	_, _ = w.Write(png)
+}
+
+// PostRenameDevice renames a device
+func (m *Repository) PostRenameDevice(w http.ResponseWriter, r *http.Request) {
+	peer, ok := m.webLoadDevice(w, r)
+	if !ok {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	name, ok := deviceName(r.PostForm.Get("name"))
+	if !ok {
+		m.App.Session.Put(r.Context(), "error", "Name must be between 1 and 64 characters")
+		http.Redirect(w, r, "/devices", http.StatusSeeOther)
+		return
+	}
+
+	err = m.DB.RenameVpnPeer(r.Context(), peer.ID, name)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("%s renamed to %s", peer.Name, name))
+	http.Redirect(w, r, "/devices", http.StatusSeeOther)
+}
+
+// PostReissueDevice revokes the keys of a device and gives it new ones
+func (m *Repository) PostReissueDevice(w http.ResponseWriter, r *http.Request) {
+	peer, ok := m.webLoadDevice(w, r)
+	if !ok {
+		return
+	}
+
+	_, err := m.reissueDevice(r.Context(), peer)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("New keys issued for %s. Download its config again; the old one stops working as soon as the server drops it.", peer.Name))
+	http.Redirect(w, r, "/devices", http.StatusSeeOther)
+}
+
+// PostMoveDevice moves a device off a node that is down to another node in
+// the same country
+func (m *Repository) PostMoveDevice(w http.ResponseWriter, r *http.Request) {
+	peer, ok := m.webLoadDevice(w, r)
+	if !ok {
+		return
+	}
+	if peer.NodeID == 0 {
+		helpers.ClientError(w, r, http.StatusNotFound)
+		return
+	}
+
+	node, err := m.DB.GetVpnNodeById(r.Context(), peer.NodeID)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	if !node.IsDown() {
+		m.App.Session.Put(r.Context(), "error", fmt.Sprintf("The server of %s is up again; it does not need to move", peer.Name))
+		http.Redirect(w, r, "/devices", http.StatusSeeOther)
+		return
+	}
+
+	_, target, err := failover.MoveOff(r.Context(), m.DB, peer, node)
+	if errors.Is(err, failover.ErrNoNode) || errors.Is(err, vpn.ErrSubnetExhausted) {
+		m.App.Session.Put(r.Context(), "error", fmt.Sprintf("No other %s server has room for %s right now, please try again later", node.Country, peer.Name))
+		http.Redirect(w, r, "/devices", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	m.App.Logger.InfoContext(r.Context(), "VPN peer moved off down node", "user_id", peer.UserID, "peer_id", peer.ID, "from", node.ID, "to", target.ID)
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("%s moved to %s. Download its config again.", peer.Name, target.Country+" · "+target.Name))
+	http.Redirect(w, r, "/devices", http.StatusSeeOther)
+}
+
+// PostRevokeDevice revokes a device
+func (m *Repository) PostRevokeDevice(w http.ResponseWriter, r *http.Request) {
+	peer, ok := m.webLoadDevice(w, r)
+	if !ok {
+		return
+	}
+
+	err := m.DB.RevokeVpnPeer(r.Context(), peer.ID)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	m.App.Logger.InfoContext(r.Context(), "VPN peer revoked", "user_id", peer.UserID, "peer_id", peer.ID)
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("%s revoked", peer.Name))
+	http.Redirect(w, r, "/devices", http.StatusSeeOther)
+}
+
+// PostTelegramLink issues a code linking a Telegram chat to the user, shown
+// once on the devices page
+func (m *Repository) PostTelegramLink(w http.ResponseWriter, r *http.Request) {
+	if m.App.TelegramBot == "" {
+		helpers.ClientError(w, r, http.StatusNotFound)
+		return
+	}
+
+	plain, _, hash, err := tokens.Generate(tokens.TelegramLinkPrefix)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	userID := m.App.Session.GetInt(r.Context(), "user_id")
+	err = m.DB.SetTelegramLinkCode(r.Context(), userID, hash, time.Now().Add(telegramLinkTTL))
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "telegram_link_code", plain)
+	http.Redirect(w, r, "/devices", http.StatusSeeOther)
+}
+
+// webLoadDevice loads the device named by the id URL parameter. It writes the
+// error response itself and reports whether the handler should continue.
+func (m *Repository) webLoadDevice(w http.ResponseWriter, r *http.Request) (models.VpnPeer, bool) {
+	id, ok := urlParamID(r, "id")
+	if !ok {
+		helpers.ClientError(w, r, http.StatusNotFound)
+		return models.VpnPeer{}, false
+	}
+
+	peer, err := m.loadDevice(r.Context(), m.App.Session.GetInt(r.Context(), "user_id"), id)
+	if err == sql.ErrNoRows {
+		helpers.ClientError(w, r, http.StatusNotFound)
+		return models.VpnPeer{}, false
+	}
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return models.VpnPeer{}, false
+	}
+
+	return peer, true
+}
+
+// renderDevices shows the devices page with the form adding a device
+func (m *Repository) renderDevices(w http.ResponseWriter, r *http.Request, form *forms.Form) {
+	userID := m.App.Session.GetInt(r.Context(), "user_id")
+
+	devices, err := m.userDevices(r.Context(), userID, time.Now())
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	limit, err := m.userDeviceLimit(r.Context(), userID, devices)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	locations, err := m.locations(r.Context())
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	protocols, err := m.userProtocols(r.Context(), userID)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	keyChanges, err := m.userKeyChanges(r.Context(), userID, time.Now())
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	stringMap := make(map[string]string)
+	stringMap["telegram_bot"] = m.App.TelegramBot
+	stringMap["telegram_link_code"] = m.App.Session.PopString(r.Context(), "telegram_link_code")
+	stringMap["subscription_url"] = m.App.Session.PopString(r.Context(), "subscription_url")
+
+	data := make(map[string]interface{})
+	data["devices"] = devices
+	data["limit"] = limit
+	data["locations"] = locations
+	data["protocols"] = protocols
+	data["key_changes"] = keyChanges
+
+	render.Template(w, r, "devices.page.tmpl", &models.TemplateData{
+		StringMap: stringMap,
+		Form:      form,
+		Data:      data,
+	})
+}
@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/helpers"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/quota"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/tokens"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/vpn"
+	"github.com/go-chi/chi/v5"
+)
+
+// SubscriptionPath prefixes the subscription URLs, which end in the token of
+// their user
+const SubscriptionPath = "/sub/"
+
+// feedUpdateHours is how often client apps are asked to refresh the feed
+const feedUpdateHours = 12
+
+// SubscriptionFeed serves the VPN configs of the active subscription of the
+// user owning the token in the URL, in the format named by the format query
+// parameter or, without one, the format the client app is known to import.
+// The subscription-userinfo header tells the app the traffic used in the
+// billing cycle, the data cap and the expiry.
+func (m *Repository) SubscriptionFeed(w http.ResponseWriter, r *http.Request) {
+	// client errors are answered without helpers.ClientError and server
+	// errors through feedServerError, since the helpers log the path holding
+	// the token
+	token := chi.URLParam(r, "token")
+	if !strings.HasPrefix(token, tokens.SubscriptionPrefix) {
+		http.NotFound(w, r)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = vpn.FeedFormatFor(r.UserAgent())
+	}
+	if !slices.Contains(vpn.FeedFormats, format) {
+		http.Error(w, "format must be one of "+strings.Join(vpn.FeedFormats, ", "), http.StatusBadRequest)
+		return
+	}
+
+	userID, err := m.DB.GetUserIdBySubscriptionToken(r.Context(), tokens.Hash(token))
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		feedServerError(w, r, err)
+		return
+	}
+
+	entries, status, err := m.feedEntries(r.Context(), userID, time.Now())
+	if err != nil {
+		feedServerError(w, r, err)
+		return
+	}
+	data, err := vpn.RenderFeed(format, entries)
+	if err != nil {
+		feedServerError(w, r, err)
+		return
+	}
+
+	// the feed holds the private keys of the devices
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", vpn.FeedContentType(format))
+	w.Header().Set("Content-Disposition", `attachment; filename="Fastnet VPN"`)
+	w.Header().Set("Profile-Title", "Fastnet VPN")
+	w.Header().Set("Profile-Update-Interval", fmt.Sprint(feedUpdateHours))
+	w.Header().Set("Profile-Web-Page-Url", m.publicURL(r)+"/devices")
+	if status != nil {
+		w.Header().Set("Subscription-Userinfo", fmt.Sprintf("upload=%d; download=%d; total=%d; expire=%d",
+			status.UploadBytes, status.DownloadBytes, status.CapBytes(), status.Subscription.ExpiresAt.Unix()))
+	}
+	_, _ = w.Write(data)
+}
+
+// feedServerError answers like helpers.ServerError, logging the path of the
+// request without the token
+func feedServerError(w http.ResponseWriter, r *http.Request, err error) {
+	redacted := r.Clone(r.Context())
+	redacted.URL.Path, redacted.URL.RawPath = SubscriptionPath+"[redacted]", ""
+	helpers.ServerError(w, redacted, err)
+}
+
+// feedEntries returns the unrevoked peers of the active subscription of a
+// user with their servers, and where the user stands against the data cap.
+// The status is nil and there are no entries without an active subscription.
+// OpenVPN peers are left out; none of the apps importing the feed speak it.
+func (m *Repository) feedEntries(ctx context.Context, userID int, now time.Time) ([]vpn.FeedEntry, *quota.Status, error) {
+	sub, err := m.DB.GetActiveSubscriptionByUserId(ctx, userID)
+	if err == sql.ErrNoRows {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	status, err := quota.Load(ctx, m.DB, sub, now)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	peers, err := m.DB.GetVpnPeersByUserId(ctx, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var entries []vpn.FeedEntry
+	for _, p := range peers {
+		if p.IsRevoked() || p.SubscriptionID != sub.ID || p.Protocol == models.ProtocolOpenVPN {
+			continue
+		}
+		server, err := m.serverConfig(ctx, p)
+		if err != nil {
+			return nil, nil, err
+		}
+		entries = append(entries, vpn.FeedEntry{Peer: p, Server: server})
+	}
+
+	return entries, &status, nil
+}
+
+// publicURL returns the URL users reach the panel at: the configured one, or
+// the host the request was sent to
+func (m *Repository) publicURL(r *http.Request) string {
+	if m.App.PublicURL != "" {
+		return m.App.PublicURL
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// PostSubscriptionURL issues a new subscription URL for the user and shows it
+// once on the devices page. The previous URL stops working.
+func (m *Repository) PostSubscriptionURL(w http.ResponseWriter, r *http.Request) {
+	plain, _, hash, err := tokens.Generate(tokens.SubscriptionPrefix)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	userID := m.App.Session.GetInt(r.Context(), "user_id")
+	err = m.DB.SetSubscriptionToken(r.Context(), userID, hash)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	m.App.Logger.InfoContext(r.Context(), "subscription URL issued", "user_id", userID)
+	m.App.Session.Put(r.Context(), "subscription_url", m.publicURL(r)+SubscriptionPath+plain)
+	http.Redirect(w, r, "/devices", http.StatusSeeOther)
+}
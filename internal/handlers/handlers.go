@@ -1,20 +1,29 @@
 package handlers
 
 import (
+	"database/sql"
 	"fmt"
-	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/bayramovrahman/fastnet_vpn_bot/internal/config"
 	"github.com/bayramovrahman/fastnet_vpn_bot/internal/driver"
 	"github.com/bayramovrahman/fastnet_vpn_bot/internal/email"
 	"github.com/bayramovrahman/fastnet_vpn_bot/internal/forms"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/health"
 	"github.com/bayramovrahman/fastnet_vpn_bot/internal/helpers"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/metrics"
 	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/notify"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/quota"
 	"github.com/bayramovrahman/fastnet_vpn_bot/internal/render"
 	"github.com/bayramovrahman/fastnet_vpn_bot/internal/repository"
 	"github.com/bayramovrahman/fastnet_vpn_bot/internal/repository/dbrepo"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/tokens"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/usage"
+	"github.com/go-chi/chi/v5"
 )
 
 // Repo the repository used by the handlers
@@ -24,15 +33,20 @@ var Repo *Repository
 type Repository struct {
 	App          *config.AppConfig
 	DB           repository.DatabaseRepo
-	EmailService *email.EmailService
+	EmailService *email.Service
+	Notifier     *notify.Notifier
+	Quota        *quota.Enforcer
+	Health       *health.Checker
+	// Bot answers Telegram commands; nil when the bot does not take commands
+	Bot BotSender
 }
 
 // NewRepo creates a new repository
-func NewRepo(a *config.AppConfig, db *driver.DB) *Repository {
+func NewRepo(a *config.AppConfig, db *driver.DB, emailService *email.Service) *Repository {
 	return &Repository{
 		App:          a,
 		DB:           dbrepo.NewPostgresRepo(db.SQL, a),
-		EmailService: email.NewEmailService(),
+		EmailService: emailService,
 	}
 }
 
@@ -41,8 +55,53 @@ func NewHandlers(repo *Repository) {
 	Repo = repo
 }
 
+// Home shows the dashboard with the user's data usage
 func (m *Repository) Home(w http.ResponseWriter, r *http.Request) {
-	render.Template(w, r, "home.page.tmpl", &models.TemplateData{})
+	userID := m.App.Session.GetInt(r.Context(), "user_id")
+
+	charts, month, err := m.usageCharts(r.Context(), userID, time.Now())
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	stringMap := make(map[string]string)
+	stringMap["usage_month"] = usage.FormatBytes(month.RxBytes + month.TxBytes)
+	stringMap["usage_month_download"] = usage.FormatBytes(month.TxBytes)
+	stringMap["usage_month_upload"] = usage.FormatBytes(month.RxBytes)
+
+	data := make(map[string]interface{})
+	data["usage_charts"] = charts
+
+	sub, err := m.DB.GetActiveSubscriptionByUserId(r.Context(), userID)
+	if err != nil && err != sql.ErrNoRows {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	if err == nil {
+		status, err := quota.Load(r.Context(), m.DB, sub, time.Now())
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+		if status.CapBytes() > 0 {
+			stringMap["quota_used"] = usage.FormatBytes(status.UsedBytes)
+			stringMap["quota_cap"] = usage.FormatBytes(status.CapBytes())
+			data["quota"] = status
+
+			offers, err := m.topUpOffers(r.Context())
+			if err != nil {
+				helpers.ServerError(w, r, err)
+				return
+			}
+			data["topups"] = offers
+		}
+	}
+
+	render.Template(w, r, "home.page.tmpl", &models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+	})
 }
 
 func (m *Repository) Invoice(w http.ResponseWriter, r *http.Request) {
@@ -57,25 +116,126 @@ func (m *Repository) Profile(w http.ResponseWriter, r *http.Request) {
 	userID := m.App.Session.GetInt(r.Context(), "user_id")
 	
 	// Get user security settings
-	security, err := m.DB.GetUserLoginSecurity(userID)
+	security, err := m.DB.GetUserLoginSecurity(r.Context(), userID)
 	if err != nil {
-		log.Println("Error getting security settings:", err)
+		m.App.Logger.ErrorContext(r.Context(), "error getting security settings", "error", err)
 		security.EmailVerification = false
 		security.PhoneVerification = false
 		security.MultiFactorAuth = false
 	}
 
+	apiTokens, err := m.DB.GetAPITokensByUserId(r.Context(), userID)
+	if err != nil {
+		m.App.Logger.ErrorContext(r.Context(), "error getting API tokens", "error", err)
+	}
+
+	notificationPrefs, err := m.DB.GetNotificationPreferences(r.Context(), userID)
+	if err != nil {
+		m.App.Logger.ErrorContext(r.Context(), "error getting notification preferences", "error", err)
+	}
+
 	// Prepare template data
 	stringMap := make(map[string]string)
 	stringMap["email_verification"] = fmt.Sprintf("%t", security.EmailVerification)
 	stringMap["phone_verification"] = fmt.Sprintf("%t", security.PhoneVerification)
 	stringMap["multi_factor_auth"] = fmt.Sprintf("%t", security.MultiFactorAuth)
+	stringMap["new_api_token"] = m.App.Session.PopString(r.Context(), "new_api_token")
+
+	data := make(map[string]interface{})
+	data["api_tokens"] = apiTokens
+	data["api_scopes"] = tokens.AllScopes
+	data["notification_preferences"] = notificationPrefs
 
 	render.Template(w, r, "profile.page.tmpl", &models.TemplateData{
 		StringMap: stringMap,
+		Data:      data,
 	})
 }
 
+// PostCreateAPIToken creates a personal API token and shows it once on the profile page
+func (m *Repository) PostCreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Logger.ErrorContext(r.Context(), "unable to parse form", "error", err)
+		m.App.Session.Put(r.Context(), "error", "Unable to parse form")
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("name")
+
+	var scopes []string
+	for _, scope := range r.PostForm["scopes"] {
+		if !tokens.ValidScope(scope) {
+			form.Errors.Add("scopes", "Unknown scope")
+			continue
+		}
+		scopes = append(scopes, scope)
+	}
+	if len(scopes) == 0 {
+		form.Errors.Add("scopes", "Select at least one scope")
+	}
+
+	if !form.Valid() {
+		m.App.Session.Put(r.Context(), "error", "API token needs a name and at least one scope")
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+
+	plain, prefix, hash, err := tokens.Generate(tokens.APITokenPrefix)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	apiToken := models.APIToken{
+		UserID:    m.App.Session.GetInt(r.Context(), "user_id"),
+		Name:      strings.TrimSpace(form.Get("name")),
+		Prefix:    prefix,
+		TokenHash: hash,
+		Scopes:    scopes,
+	}
+
+	if days, err := strconv.Atoi(form.Get("expires_in_days")); err == nil && days > 0 {
+		apiToken.ExpiresAt = time.Now().AddDate(0, 0, days)
+	}
+
+	_, err = m.DB.InsertAPIToken(r.Context(), apiToken)
+	if err != nil {
+		m.App.Logger.ErrorContext(r.Context(), "error creating API token", "error", err)
+		m.App.Session.Put(r.Context(), "error", "Unable to create API token")
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "new_api_token", plain)
+	m.App.Session.Put(r.Context(), "flash", "API token created. Copy it now, it will not be shown again.")
+	http.Redirect(w, r, "/profile", http.StatusSeeOther)
+}
+
+// PostRevokeAPIToken revokes one of the personal API tokens of the logged in user
+func (m *Repository) PostRevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	userID := m.App.Session.GetInt(r.Context(), "user_id")
+
+	err = m.DB.RevokeAPIToken(r.Context(), id, userID)
+	if err != nil {
+		m.App.Logger.ErrorContext(r.Context(), "error revoking API token", "error", err)
+		m.App.Session.Put(r.Context(), "error", "Unable to revoke API token")
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "API token revoked")
+	http.Redirect(w, r, "/profile", http.StatusSeeOther)
+}
+
 func (m *Repository) Login(w http.ResponseWriter, r *http.Request) {
 	if helpers.IsAuthenticated(r) {
 		http.Redirect(w, r, "/home", http.StatusSeeOther)
@@ -92,7 +252,7 @@ func (m *Repository) PostLogin(w http.ResponseWriter, r *http.Request) {
 
 	err := r.ParseForm()
 	if err != nil {
-		log.Println(err)
+		m.App.Logger.ErrorContext(r.Context(), "unable to parse form", "error", err)
 		m.App.Session.Put(r.Context(), "error", "Unable to parse form")
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
@@ -113,26 +273,27 @@ func (m *Repository) PostLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	id, _, err := m.DB.Authenticate(emailForm, password)
+	id, _, err := m.DB.Authenticate(r.Context(), emailForm, password)
 	if err != nil {
-		log.Println(err)
+		m.App.Logger.InfoContext(r.Context(), "login failed", "email", email.MaskAddress(emailForm), "error", err)
+		metrics.LoginAttempts.WithLabelValues("failure").Inc()
 		m.App.Session.Put(r.Context(), "error", "Invalid e-mail or password")
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
-	user, err := m.DB.GetUserById(id)
+	user, err := m.DB.GetUserById(r.Context(), id)
 	if err != nil {
-		log.Println(err)
+		m.App.Logger.ErrorContext(r.Context(), "unable to retrieve user", "error", err)
 		m.App.Session.Put(r.Context(), "error", "Unable to retrieve user information")
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
 	// Check if email verification is enabled for this user
-	security, err := m.DB.GetUserLoginSecurity(id)
+	security, err := m.DB.GetUserLoginSecurity(r.Context(), id)
 	if err != nil {
-		log.Println("Error getting security settings:", err)
+		m.App.Logger.ErrorContext(r.Context(), "error getting security settings", "error", err)
 		security.EmailVerification = true // If we can't get security settings, default to requiring verification
 	}
 
@@ -148,6 +309,7 @@ func (m *Repository) PostLogin(w http.ResponseWriter, r *http.Request) {
 			m.App.Session.Put(r.Context(), "remember_me", true)
 		}
 
+		metrics.LoginAttempts.WithLabelValues("success").Inc()
 		m.App.Session.Put(r.Context(), "flash", "Logged in successfully")
 		http.Redirect(w, r, "/home", http.StatusSeeOther)
 		return
@@ -156,16 +318,16 @@ func (m *Repository) PostLogin(w http.ResponseWriter, r *http.Request) {
 	// Email verification is enabled - send verification code
 	code, err := email.GenerateVerificationCode()
 	if err != nil {
-		log.Println(err)
+		m.App.Logger.ErrorContext(r.Context(), "unable to generate verification code", "error", err)
 		m.App.Session.Put(r.Context(), "error", "Unable to generate verification code")
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
-	// Send verification email
-	err = m.EmailService.SendVerificationCode(user.Email, code)
+	// Queue verification email; the outbox workers deliver it
+	err = m.EmailService.SendVerificationCode(r.Context(), user.Email, code)
 	if err != nil {
-		log.Println("Email send error:", err)
+		m.App.Logger.ErrorContext(r.Context(), "unable to send verification email", "error", err)
 		m.App.Session.Put(r.Context(), "error", "Unable to send verification code. Please try again.")
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
@@ -203,7 +365,7 @@ func (m *Repository) Verify(w http.ResponseWriter, r *http.Request) {
 func (m *Repository) PostVerify(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
-		log.Println(err)
+		m.App.Logger.ErrorContext(r.Context(), "unable to parse form", "error", err)
 		m.App.Session.Put(r.Context(), "error", "Unable to parse form")
 		http.Redirect(w, r, "/verify", http.StatusSeeOther)
 		return
@@ -250,6 +412,7 @@ func (m *Repository) PostVerify(w http.ResponseWriter, r *http.Request) {
 	// Verify code
 	storedCode := m.App.Session.GetString(r.Context(), "verification_code")
 	if code != storedCode {
+		metrics.LoginAttempts.WithLabelValues("verification_failed").Inc()
 		m.App.Session.Put(r.Context(), "error", "Invalid verification code")
 		http.Redirect(w, r, "/verify", http.StatusSeeOther)
 		return
@@ -284,6 +447,7 @@ func (m *Repository) PostVerify(w http.ResponseWriter, r *http.Request) {
 	m.App.Session.Remove(r.Context(), "code_expires")
 	m.App.Session.Remove(r.Context(), "pending_remember_me")
 
+	metrics.LoginAttempts.WithLabelValues("success").Inc()
 	m.App.Session.Put(r.Context(), "flash", "Logged in successfully")
 	http.Redirect(w, r, "/home", http.StatusSeeOther)
 }
@@ -296,9 +460,9 @@ func (m *Repository) ResendCode(w http.ResponseWriter, r *http.Request) {
 	}
 
 	userId := m.App.Session.GetInt(r.Context(), "pending_user_id")
-	user, err := m.DB.GetUserById(userId)
+	user, err := m.DB.GetUserById(r.Context(), userId)
 	if err != nil {
-		log.Println(err)
+		m.App.Logger.ErrorContext(r.Context(), "unable to retrieve user", "error", err)
 		m.App.Session.Put(r.Context(), "error", "Unable to retrieve user information")
 		http.Redirect(w, r, "/verify", http.StatusSeeOther)
 		return
@@ -307,16 +471,16 @@ func (m *Repository) ResendCode(w http.ResponseWriter, r *http.Request) {
 	// Generate new verification code
 	code, err := email.GenerateVerificationCode()
 	if err != nil {
-		log.Println(err)
+		m.App.Logger.ErrorContext(r.Context(), "unable to generate verification code", "error", err)
 		m.App.Session.Put(r.Context(), "error", "Unable to generate verification code")
 		http.Redirect(w, r, "/verify", http.StatusSeeOther)
 		return
 	}
 
-	// Send verification email
-	err = m.EmailService.SendVerificationCode(user.Email, code)
+	// Queue verification email; the outbox workers deliver it
+	err = m.EmailService.SendVerificationCode(r.Context(), user.Email, code)
 	if err != nil {
-		log.Println("E-mail send error:", err)
+		m.App.Logger.ErrorContext(r.Context(), "unable to send verification email", "error", err)
 		m.App.Session.Put(r.Context(), "error", "Unable to send verification code. Please try again.")
 		http.Redirect(w, r, "/verify", http.StatusSeeOther)
 		return
@@ -338,12 +502,17 @@ func (m *Repository) Logout(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
 }
 
+// securitySettingResponse is the JSON body returned by UpdateSecuritySetting
+type securitySettingResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+}
+
 // UpdateSecuritySetting handles AJAX requests to update security settings
 func (m *Repository) UpdateSecuritySetting(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"success": false, "message": "Unable to parse form"}`))
+		helpers.WriteJSON(w, http.StatusBadRequest, securitySettingResponse{Message: "Unable to parse form"})
 		return
 	}
 
@@ -351,11 +520,10 @@ func (m *Repository) UpdateSecuritySetting(w http.ResponseWriter, r *http.Reques
 	settingType := r.Form.Get("type")
 	value := r.Form.Get("value") == "true"
 
-	security, err := m.DB.GetUserLoginSecurity(userID)
+	security, err := m.DB.GetUserLoginSecurity(r.Context(), userID)
 	if err != nil {
-		log.Println("Error getting security settings:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(`{"success": false, "message": "Unable to get security settings"}`))
+		m.App.Logger.ErrorContext(r.Context(), "error getting security settings", "error", err)
+		helpers.WriteJSON(w, http.StatusInternalServerError, securitySettingResponse{Message: "Unable to get security settings"})
 		return
 	}
 
@@ -367,27 +535,24 @@ func (m *Repository) UpdateSecuritySetting(w http.ResponseWriter, r *http.Reques
 	case "multi_factor_auth":
 		security.MultiFactorAuth = value
 	default:
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"success": false, "message": "Invalid setting type"}`))
+		helpers.WriteJSON(w, http.StatusBadRequest, securitySettingResponse{Message: "Invalid setting type"})
 		return
 	}
 
-	err = m.DB.UpdateUserLoginSecurity(security)
+	err = m.DB.UpdateUserLoginSecurity(r.Context(), security)
 	if err != nil {
-		log.Println("Error updating security settings:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(`{"success": false, "message": "Unable to update security settings"}`))
+		m.App.Logger.ErrorContext(r.Context(), "error updating security settings", "error", err)
+		helpers.WriteJSON(w, http.StatusInternalServerError, securitySettingResponse{Message: "Unable to update security settings"})
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	
 	statusText := "disabled"
 	if value {
 		statusText = "enabled"
 	}
-	
-	response := fmt.Sprintf(`{"success": true, "message": "Successfully %s"}`, statusText)
-	w.Write([]byte(response))
+
+	helpers.WriteJSON(w, http.StatusOK, securitySettingResponse{
+		Success: true,
+		Message: fmt.Sprintf("Successfully %s", statusText),
+	})
 }
@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/health"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/helpers"
+)
+
+// Healthz reports that the process is alive and serving requests
+func (m *Repository) Healthz(w http.ResponseWriter, r *http.Request) {
+	helpers.WriteJSON(w, http.StatusOK, health.Report{
+		Status:     health.StatusUp,
+		Components: map[string]health.ComponentStatus{},
+	})
+}
+
+// Readyz reports whether the service and its dependencies can serve traffic
+func (m *Repository) Readyz(w http.ResponseWriter, r *http.Request) {
+	if m.Health == nil {
+		helpers.ErrorJSON(w, http.StatusServiceUnavailable, "not_ready", "Readiness checks are not configured")
+		return
+	}
+
+	report := m.Health.Run(r.Context())
+
+	status := http.StatusOK
+	if report.Status == health.StatusDown {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	helpers.WriteJSON(w, status, report)
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/forms"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/helpers"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/notify"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/render"
+)
+
+// notificationsPageSize is how many notifications the notifications page lists
+const notificationsPageSize = 50
+
+// Notifications shows the notification feed of the user
+func (m *Repository) Notifications(w http.ResponseWriter, r *http.Request) {
+	userID := m.App.Session.GetInt(r.Context(), "user_id")
+
+	notifications, err := m.DB.GetNotificationsByUserId(r.Context(), userID, notificationsPageSize)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["notifications"] = notifications
+
+	render.Template(w, r, "notifications.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// PostMarkNotificationsRead marks every notification of the user as read
+func (m *Repository) PostMarkNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	err := m.DB.MarkNotificationsRead(r.Context(), m.App.Session.GetInt(r.Context(), "user_id"))
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/notifications", http.StatusSeeOther)
+}
+
+// PostNotificationPreferences saves the channels the user wants to be notified on
+func (m *Repository) PostNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Logger.ErrorContext(r.Context(), "unable to parse form", "error", err)
+		m.App.Session.Put(r.Context(), "error", "Unable to parse form")
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.MaxLength("telegram_chat_id", 64)
+
+	chatID := strings.TrimSpace(form.Get("telegram_chat_id"))
+	if form.Has("telegram") && chatID == "" {
+		form.Errors.Add("telegram_chat_id", "Enter your Telegram chat ID to get notifications on Telegram")
+	}
+
+	if !form.Valid() {
+		m.App.Session.Put(r.Context(), "error", form.Errors.Get("telegram_chat_id"))
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+
+	userID := m.App.Session.GetInt(r.Context(), "user_id")
+
+	prefs, err := m.DB.GetNotificationPreferences(r.Context(), userID)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	prefs.Email = form.Has("email")
+	prefs.Telegram = form.Has("telegram")
+	prefs.InApp = form.Has("in_app")
+	prefs.TelegramChatID = chatID
+
+	err = m.DB.UpdateNotificationPreferences(r.Context(), prefs)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Notification settings saved")
+	http.Redirect(w, r, "/profile", http.StatusSeeOther)
+}
+
+// notify sends e when a Notifier is configured. Notifications are a side
+// effect of the action that raised them, so a failure is logged, not returned.
+func (m *Repository) notify(ctx context.Context, e notify.Event) {
+	if m.Notifier == nil {
+		return
+	}
+
+	err := m.Notifier.Notify(ctx, e)
+	if err != nil {
+		m.App.Logger.ErrorContext(ctx, "unable to notify user", "user_id", e.UserID, "event", e.Name, "error", err)
+	}
+}
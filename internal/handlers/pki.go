@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/pki"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/vpn"
+)
+
+// authorityName is the common name of the OpenVPN CA
+const authorityName = "Fastnet VPN CA"
+
+// errPKIUnavailable is returned when an OpenVPN certificate is needed but no
+// PKI_ENCRYPTION_KEY is configured to protect the CA key with
+var errPKIUnavailable = errors.New("OpenVPN is unavailable without PKI_ENCRYPTION_KEY")
+
+// authority returns the OpenVPN CA with its key decrypted, creating it on
+// first use, and its stored row
+func (m *Repository) authority(ctx context.Context) (*pki.Authority, models.CertificateAuthority, error) {
+	if m.App.PKIKey == nil {
+		return nil, models.CertificateAuthority{}, errPKIUnavailable
+	}
+
+	row, err := m.DB.GetCertificateAuthority(ctx)
+	if err == sql.ErrNoRows {
+		err = m.createAuthority(ctx)
+		if err != nil {
+			return nil, models.CertificateAuthority{}, err
+		}
+		row, err = m.DB.GetCertificateAuthority(ctx)
+	}
+	if err != nil {
+		return nil, models.CertificateAuthority{}, err
+	}
+
+	ca, err := pki.LoadAuthority(row.Certificate, row.EncryptedKey, m.App.PKIKey)
+	if err != nil {
+		return nil, models.CertificateAuthority{}, err
+	}
+	return ca, row, nil
+}
+
+// createAuthority creates the OpenVPN CA and stores it with its key sealed.
+// A CA created by a concurrent request meanwhile is kept.
+func (m *Repository) createAuthority(ctx context.Context) error {
+	ca, err := pki.NewAuthority(authorityName, time.Now())
+	if err != nil {
+		return err
+	}
+	sealed, err := ca.SealedKey(m.App.PKIKey)
+	if err != nil {
+		return err
+	}
+
+	err = m.DB.InsertCertificateAuthority(ctx, models.CertificateAuthority{Certificate: ca.CertificatePEM(), EncryptedKey: sealed})
+	if err != nil {
+		return err
+	}
+
+	m.App.Logger.InfoContext(ctx, "OpenVPN certificate authority created")
+	return nil
+}
+
+// peerCertificate issues the certificate of an OpenVPN peer that has none
+// yet and returns the peer with it; other peers are returned as they are
+func (m *Repository) peerCertificate(ctx context.Context, peer models.VpnPeer) (models.VpnPeer, error) {
+	if peer.Protocol != models.ProtocolOpenVPN || peer.Certificate != "" {
+		return peer, nil
+	}
+
+	ca, _, err := m.authority(ctx)
+	if err != nil {
+		return models.VpnPeer{}, err
+	}
+	cert, err := ca.IssueClient(peer.PublicKey, fmt.Sprintf("peer-%d", peer.ID), peer.PrivateKey, time.Now())
+	if err != nil {
+		return models.VpnPeer{}, err
+	}
+
+	err = m.DB.SetVpnPeerCertificate(ctx, peer.ID, peer.PublicKey, cert)
+	if err != nil {
+		return models.VpnPeer{}, err
+	}
+
+	peer.Certificate = cert
+	return peer, nil
+}
+
+// nodeCertificate issues node the key and the certificate its OpenVPN server
+// presents to clients, unless it has them already
+func (m *Repository) nodeCertificate(ctx context.Context, node *models.VpnNode) error {
+	if node.OpenVPNPort == 0 || node.OpenVPNCertificate != "" {
+		return nil
+	}
+
+	ca, _, err := m.authority(ctx)
+	if err != nil {
+		return err
+	}
+	serial, err := pki.NewSerial()
+	if err != nil {
+		return err
+	}
+	key, err := pki.GenerateKey()
+	if err != nil {
+		return err
+	}
+	cert, err := ca.IssueServer(serial, node.Name, key, time.Now())
+	if err != nil {
+		return err
+	}
+
+	node.OpenVPNCertificate, node.OpenVPNPrivateKey = cert, key
+	return nil
+}
+
+// currentCRL returns the revocation list the nodes check OpenVPN clients
+// against, signing a new one when a certificate was revoked since the last
+// or the last is due for a refresh
+func (m *Repository) currentCRL(ctx context.Context, now time.Time) (string, error) {
+	ca, row, err := m.authority(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	revoked, err := m.DB.GetRevokedCertificates(ctx, now)
+	if err != nil {
+		return "", err
+	}
+	list := make([]pki.Revoked, 0, len(revoked))
+	for _, r := range revoked {
+		list = append(list, pki.Revoked{Serial: r.Serial, RevokedAt: r.RevokedAt})
+	}
+
+	// a list is only handed out once stored under its number, so two requests
+	// signing at once cannot give the nodes different lists with one number
+	for {
+		if ca.CRLCurrent(row.CRL, list, now) {
+			return row.CRL, nil
+		}
+
+		crl, err := ca.CRL(list, row.CRLNumber+1, now)
+		if err != nil {
+			return "", err
+		}
+		stored, err := m.DB.UpdateCRL(ctx, row.CRLNumber+1, crl)
+		if err != nil {
+			return "", err
+		}
+		if stored {
+			m.App.Logger.InfoContext(ctx, "OpenVPN CRL signed", "number", row.CRLNumber+1, "revoked", len(list))
+			return crl, nil
+		}
+
+		// another request stored a list meanwhile; use it unless it is stale too
+		row, err = m.DB.GetCertificateAuthority(ctx)
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// openVPNServer returns the OpenVPN server of node, without a port when it
+// does not serve OpenVPN
+func (m *Repository) openVPNServer(ctx context.Context, node models.VpnNode) (vpn.OpenVPNServer, error) {
+	if !node.Serves(models.ProtocolOpenVPN) {
+		return vpn.OpenVPNServer{}, nil
+	}
+
+	row, err := m.DB.GetCertificateAuthority(ctx)
+	if err != nil {
+		return vpn.OpenVPNServer{}, err
+	}
+	return vpn.OpenVPNServer{Port: node.OpenVPNPort, CA: row.Certificate}, nil
+}
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"context"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/forms"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/quota"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/repository"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/usage"
+)
+
+// bytesPerGB is how the quota forms convert gigabytes, in decimal units like
+// usage.FormatBytes
+const bytesPerGB = 1_000_000_000
+
+// checkQuota checks the user's data cap right away, so a block is lifted or
+// applied without waiting for the enforcer. A failure is logged; the next
+// periodic check catches up.
+func (m *Repository) checkQuota(ctx context.Context, userID int) {
+	if m.Quota == nil {
+		return
+	}
+
+	_, err := m.Quota.Check(ctx, userID, time.Now())
+	if err != nil {
+		m.App.Logger.ErrorContext(ctx, "unable to check quota", "user_id", userID, "error", err)
+	}
+}
+
+// checkDeviceLimit returns errDeviceLimit when the user already has as many
+// peers on sub as the plan, or their override, allows, reading through repo,
+// which may be bound to a transaction
+func (m *Repository) checkDeviceLimit(ctx context.Context, repo repository.DatabaseRepo, sub models.Subscription) error {
+	q, err := repo.GetUserQuota(ctx, sub.UserID)
+	if err != nil {
+		return err
+	}
+
+	limits := quota.Effective(sub.Plan, q)
+	if limits.DeviceLimit == 0 {
+		return nil
+	}
+
+	peers, err := repo.GetVpnPeersByUserId(ctx, sub.UserID)
+	if err != nil {
+		return err
+	}
+
+	var devices int
+	for _, p := range peers {
+		if p.SubscriptionID == sub.ID && !p.IsRevoked() {
+			devices++
+		}
+	}
+	if devices >= limits.DeviceLimit {
+		return errDeviceLimit
+	}
+
+	return nil
+}
+
+// quotaRow is a user on the admin quotas page
+type quotaRow struct {
+	User   models.User
+	Status quota.Status
+	Used   string
+	Cap    string
+}
+
+// newQuotaRow returns the row of user at status
+func newQuotaRow(user models.User, status quota.Status) quotaRow {
+	row := quotaRow{User: user, Status: status, Used: usage.FormatBytes(status.UsedBytes), Cap: "unlimited"}
+	if capBytes := status.CapBytes(); capBytes > 0 {
+		row.Cap = usage.FormatBytes(capBytes)
+	}
+	return row
+}
+
+// quotaFormValues returns the override form fields of q; a limit taken from
+// the plan is left blank
+func quotaFormValues(q models.UserQuota) url.Values {
+	values := url.Values{"note": {q.Note}}
+	if q.DataCapBytes != models.QuotaFromPlan {
+		values["data_cap_gb"] = []string{strconv.FormatFloat(float64(q.DataCapBytes)/bytesPerGB, 'f', -1, 64)}
+	}
+	if q.DeviceLimit != models.QuotaFromPlan {
+		values["device_limit"] = []string{strconv.Itoa(q.DeviceLimit)}
+	}
+	return values
+}
+
+// quotaFromForm validates the override form and returns the override it
+// describes. A blank limit falls back to the plan and 0 lifts it.
+func quotaFromForm(form *forms.Form, userID int) models.UserQuota {
+	form.MaxLength("note", 255)
+
+	q := models.UserQuota{
+		UserID:       userID,
+		DataCapBytes: models.QuotaFromPlan,
+		DeviceLimit:  models.QuotaFromPlan,
+		Note:         strings.TrimSpace(form.Get("note")),
+	}
+
+	if capGB := strings.TrimSpace(form.Get("data_cap_gb")); capGB != "" {
+		gb, err := strconv.ParseFloat(capGB, 64)
+		if err != nil || gb < 0 || math.IsInf(gb, 0) || gb*bytesPerGB > math.MaxInt64 {
+			form.Errors.Add("data_cap_gb", "Use a number of gigabytes, or 0 for unlimited")
+		} else {
+			q.DataCapBytes = int64(math.Round(gb * bytesPerGB))
+		}
+	}
+	if limit := strings.TrimSpace(form.Get("device_limit")); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			form.Errors.Add("device_limit", "Use a number of devices, or 0 for unlimited")
+		} else {
+			q.DeviceLimit = n
+		}
+	}
+
+	return q
+}
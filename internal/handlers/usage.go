@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/usage"
+)
+
+// usageRange is a range of the dashboard usage chart
+type usageRange struct {
+	Key    string
+	Period string
+	// Buckets is how many period buckets the range shows, the current one included
+	Buckets int
+}
+
+// usageRanges are the ranges the dashboard can chart, the first shown by default
+var usageRanges = []usageRange{
+	{Key: "24h", Period: models.UsageHour, Buckets: 24},
+	{Key: "30d", Period: models.UsageDay, Buckets: 30},
+	{Key: "12m", Period: models.UsageMonth, Buckets: 12},
+}
+
+// usageCharts returns the charts of the user's traffic for every usage range,
+// keyed by range, and the traffic of the current month
+func (m *Repository) usageCharts(ctx context.Context, userID int, now time.Time) (map[string]usage.Chart, models.UsagePoint, error) {
+	charts := make(map[string]usage.Chart, len(usageRanges))
+	var month models.UsagePoint
+
+	for _, ur := range usageRanges {
+		from := models.UsageBucket(ur.Period, now)
+		for range ur.Buckets - 1 {
+			from = models.PreviousUsageBucket(ur.Period, from)
+		}
+
+		points, err := m.DB.GetUsageByUserId(ctx, userID, ur.Period, from)
+		if err != nil {
+			return nil, models.UsagePoint{}, err
+		}
+
+		series := usage.Series(points, ur.Period, from, now)
+		charts[ur.Key] = usage.NewChart(series, ur.Period)
+		if ur.Period == models.UsageMonth {
+			month = series[len(series)-1]
+		}
+	}
+
+	return charts, month, nil
+}
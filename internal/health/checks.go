@@ -0,0 +1,90 @@
+package health
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/config"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/worker"
+)
+
+// Database pings the connection pool
+func Database(db *sql.DB) Check {
+	return func(ctx context.Context) error {
+		return db.PingContext(ctx)
+	}
+}
+
+// Templates verifies the template cache was loaded
+func Templates(app *config.AppConfig) Check {
+	return func(ctx context.Context) error {
+		if len(app.TemplateCache) == 0 {
+			return errors.New("template cache is empty")
+		}
+		return nil
+	}
+}
+
+// TCP dials addr to verify it accepts connections, e.g. the SMTP relay
+func TCP(addr string) Check {
+	return func(ctx context.Context) error {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// WireGuard verifies the VPN backend peers are provisioned against is fully configured
+func WireGuard(app *config.AppConfig) Check {
+	return func(ctx context.Context) error {
+		var missing []string
+		if app.WireGuard.Endpoint == "" {
+			missing = append(missing, "endpoint")
+		}
+		if app.WireGuard.PublicKey == "" {
+			missing = append(missing, "server public key")
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("missing %s", strings.Join(missing, " and "))
+		}
+
+		_, err := netip.ParsePrefix(app.WireGuard.Subnet)
+		if err != nil {
+			return fmt.Errorf("invalid subnet: %w", err)
+		}
+		return nil
+	}
+}
+
+// Workers reports background workers that stopped before shutdown
+func Workers(workers *worker.Group) Check {
+	return func(ctx context.Context) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var stopped []string
+		for _, s := range workers.Statuses() {
+			if !s.Running {
+				desc := s.Name
+				if s.LastError != "" {
+					desc += ": " + s.LastError
+				}
+				stopped = append(stopped, desc)
+			}
+		}
+
+		if len(stopped) > 0 {
+			return fmt.Errorf("stopped workers: %s", strings.Join(stopped, ", "))
+		}
+		return nil
+	}
+}
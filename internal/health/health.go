@@ -0,0 +1,148 @@
+package health
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/worker"
+)
+
+// Component statuses
+const (
+	StatusUp       = "up"
+	StatusDown     = "down"
+	StatusDegraded = "degraded"
+	StatusUnknown  = "unknown"
+)
+
+// Check probes a single dependency. It returns a non-nil error when the dependency is unhealthy.
+type Check func(ctx context.Context) error
+
+// ComponentStatus is the outcome of a single check
+type ComponentStatus struct {
+	Status    string    `json:"status"`
+	Critical  bool      `json:"critical"`
+	LatencyMS float64   `json:"latency_ms"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// Report is the readiness of the service and every component
+type Report struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentStatus `json:"components"`
+}
+
+type component struct {
+	name     string
+	critical bool
+	check    Check
+	interval time.Duration
+}
+
+// Checker runs readiness checks. Inline checks run on every request; periodic
+// checks run in the background and their last result is reported.
+type Checker struct {
+	timeout    time.Duration
+	components []component
+
+	mu     sync.RWMutex
+	cached map[string]ComponentStatus
+}
+
+// NewChecker returns a Checker giving each inline check timeout to complete
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{
+		timeout: timeout,
+		cached:  map[string]ComponentStatus{},
+	}
+}
+
+// Add registers a check run on every readiness request.
+// A failing critical check makes the service not ready; others only degrade it.
+func (c *Checker) Add(name string, critical bool, check Check) {
+	c.components = append(c.components, component{name: name, critical: critical, check: check})
+}
+
+// AddPeriodic registers a check that runs every interval on workers instead of per request
+func (c *Checker) AddPeriodic(workers *worker.Group, name string, critical bool, interval time.Duration, check Check) {
+	c.components = append(c.components, component{name: name, critical: critical, check: check, interval: interval})
+
+	c.mu.Lock()
+	c.cached[name] = ComponentStatus{Status: StatusUnknown, Critical: critical}
+	c.mu.Unlock()
+
+	workers.Go("health:"+name, func(ctx context.Context) error {
+		return worker.Every(ctx, interval, func(ctx context.Context) {
+			status := c.run(ctx, component{name: name, critical: critical, check: check})
+
+			c.mu.Lock()
+			c.cached[name] = status
+			c.mu.Unlock()
+		})
+	})
+}
+
+// Run executes the inline checks concurrently and combines them with the latest periodic results
+func (c *Checker) Run(ctx context.Context) Report {
+	report := Report{
+		Status:     StatusUp,
+		Components: make(map[string]ComponentStatus, len(c.components)),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, comp := range c.components {
+		if comp.interval > 0 {
+			c.mu.RLock()
+			report.Components[comp.name] = c.cached[comp.name]
+			c.mu.RUnlock()
+			continue
+		}
+
+		wg.Add(1)
+		go func(comp component) {
+			defer wg.Done()
+			status := c.run(ctx, comp)
+
+			mu.Lock()
+			report.Components[comp.name] = status
+			mu.Unlock()
+		}(comp)
+	}
+	wg.Wait()
+
+	for _, status := range report.Components {
+		switch {
+		case status.Status == StatusUp:
+		case status.Critical && status.Status != StatusUnknown:
+			report.Status = StatusDown
+		case report.Status == StatusUp:
+			report.Status = StatusDegraded
+		}
+	}
+
+	return report
+}
+
+func (c *Checker) run(ctx context.Context, comp component) ComponentStatus {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := comp.check(ctx)
+
+	status := ComponentStatus{
+		Status:    StatusUp,
+		Critical:  comp.critical,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+		CheckedAt: start,
+	}
+	if err != nil {
+		status.Status = StatusDown
+		status.Error = err.Error()
+	}
+
+	return status
+}
@@ -1,31 +1,120 @@
 package helpers
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"runtime/debug"
 
 	"github.com/bayramovrahman/fastnet_vpn_bot/internal/config"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/logging"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
 )
 
 var app *config.AppConfig
 
+type contextKey string
+
+const (
+	apiTokenContextKey contextKey = "api_token"
+	vpnNodeContextKey  contextKey = "vpn_node"
+)
+
 func NewHelpers(a *config.AppConfig) {
 	app = a
 }
 
-func ClientError(w http.ResponseWriter, status int) {
-	app.InfoLog.Println("Client error with status of", status)
+func ClientError(w http.ResponseWriter, r *http.Request, status int) {
+	app.Logger.InfoContext(r.Context(), "client error", "status", status, "method", r.Method, "path", r.URL.Path)
 	http.Error(w, http.StatusText(status), status)
 }
 
-func ServerError(w http.ResponseWriter, err error) {
-	trace := fmt.Sprintf("%s\n%s", err.Error(), debug.Stack())
-	app.ErrorLog.Println(trace)
-	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+// ServerError logs err with a stack trace and answers with a 500 that quotes the
+// request ID, so users can reference the failure when contacting support
+func ServerError(w http.ResponseWriter, r *http.Request, err error) {
+	requestID := logging.RequestID(r.Context())
+	app.Logger.ErrorContext(r.Context(), "server error", "error", err, "method", r.Method, "path", r.URL.Path, "stack", string(debug.Stack()))
+
+	message := http.StatusText(http.StatusInternalServerError)
+	if requestID != "" {
+		message = fmt.Sprintf("%s (request ID %s)", message, requestID)
+	}
+	http.Error(w, message, http.StatusInternalServerError)
 }
 
 func IsAuthenticated(r *http.Request) bool {
 	exist := app.Session.Exists(r.Context(), "user_id")
 	return exist
 }
+
+// JSONError is the error envelope returned by JSON endpoints
+type JSONError struct {
+	Error JSONErrorBody `json:"error"`
+}
+
+// JSONErrorBody describes a single error returned by JSON endpoints
+type JSONErrorBody struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// WriteJSON writes data as a JSON response with the given status
+func WriteJSON(w http.ResponseWriter, status int, data interface{}) {
+	out, err := json.Marshal(data)
+	if err != nil {
+		app.Logger.Error("unable to encode JSON response", "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(out)
+}
+
+// ErrorJSON writes an error envelope with the given status and machine readable code
+func ErrorJSON(w http.ResponseWriter, status int, code, message string) {
+	WriteJSON(w, status, JSONError{
+		Error: JSONErrorBody{
+			Code:    code,
+			Message: message,
+		},
+	})
+}
+
+// ServerErrorJSON logs err and writes a generic internal error envelope carrying the request ID
+func ServerErrorJSON(w http.ResponseWriter, r *http.Request, err error) {
+	app.Logger.ErrorContext(r.Context(), "server error", "error", err, "method", r.Method, "path", r.URL.Path, "stack", string(debug.Stack()))
+
+	WriteJSON(w, http.StatusInternalServerError, JSONError{
+		Error: JSONErrorBody{
+			Code:      "internal_error",
+			Message:   http.StatusText(http.StatusInternalServerError),
+			RequestID: logging.RequestID(r.Context()),
+		},
+	})
+}
+
+// WithAPIToken returns a copy of ctx carrying the authenticated API token
+func WithAPIToken(ctx context.Context, token models.APIToken) context.Context {
+	return context.WithValue(ctx, apiTokenContextKey, token)
+}
+
+// APIToken returns the API token the request was authenticated with
+func APIToken(r *http.Request) (models.APIToken, bool) {
+	token, ok := r.Context().Value(apiTokenContextKey).(models.APIToken)
+	return token, ok
+}
+
+// WithVpnNode returns a copy of ctx carrying the VPN node whose agent made the request
+func WithVpnNode(ctx context.Context, node models.VpnNode) context.Context {
+	return context.WithValue(ctx, vpnNodeContextKey, node)
+}
+
+// VpnNode returns the VPN node the agent request was authenticated as
+func VpnNode(r *http.Request) (models.VpnNode, bool) {
+	node, ok := r.Context().Value(vpnNodeContextKey).(models.VpnNode)
+	return node, ok
+}
@@ -0,0 +1,211 @@
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net/http"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/repository"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "fastnet"
+
+// Registry holds every metric exposed by the panel
+var Registry = prometheus.NewRegistry()
+
+var (
+	// HTTPRequests counts served requests by chi route pattern
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests served, by method, route pattern and status code.",
+	}, []string{"method", "route", "status"})
+
+	// HTTPRequestDuration observes request latency by chi route pattern
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency, by method and route pattern.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	// LoginAttempts counts logins by result: success, failure or verification_failed
+	LoginAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "login_attempts_total",
+		Help:      "Login attempts, by result.",
+	}, []string{"result"})
+
+	// VerificationEmails counts verification e-mails by result: sent or failed
+	VerificationEmails = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "verification_emails_total",
+		Help:      "Verification e-mails, by result.",
+	}, []string{"result"})
+
+	// OutboxDeliveries counts outbound messages by outcome: queued, sent, retried, deferred or dead
+	OutboxDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "outbox_deliveries_total",
+		Help:      "Outbound message queue events, by outcome.",
+	}, []string{"outcome"})
+
+	// PaymentEvents counts payment events by type, e.g. succeeded or failed
+	PaymentEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "payment_events_total",
+		Help:      "Payment events, by event type.",
+	}, []string{"event"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequests,
+		HTTPRequestDuration,
+		LoginAttempts,
+		VerificationEmails,
+		OutboxDeliveries,
+		PaymentEvents,
+	)
+}
+
+// RegisterDatabase exposes connection pool statistics of db and the
+// subscription, peer and outbox counts read through repo at scrape time
+func RegisterDatabase(db *sql.DB, repo repository.DatabaseRepo, logger *slog.Logger) {
+	Registry.MustRegister(
+		collectors.NewDBStatsCollector(db, "main"),
+		&repositoryCollector{repo: repo, logger: logger},
+	)
+}
+
+// RegisterPool exposes the statistics of the native pgxpool. database/sql only
+// sees the connections it borrowed from the pool, so with the pool enabled its
+// statistics leave out the idle connections and the waits inside the pool.
+func RegisterPool(pool *pgxpool.Pool) {
+	Registry.MustRegister(&poolCollector{pool: pool})
+}
+
+// Handler serves the registry in the Prometheus text exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+var (
+	activeSubscriptionsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "active_subscriptions"),
+		"Subscriptions that are currently active.",
+		nil, nil,
+	)
+	provisionedPeersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "provisioned_vpn_peers"),
+		"VPN peers that are provisioned and not revoked.",
+		nil, nil,
+	)
+	outboxMessagesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "outbox_messages"),
+		"Messages in the outbound queue, by status.",
+		[]string{"status"}, nil,
+	)
+)
+
+// repositoryCollector reads business gauges from the database on every scrape
+type repositoryCollector struct {
+	repo   repository.DatabaseRepo
+	logger *slog.Logger
+}
+
+func (c *repositoryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- activeSubscriptionsDesc
+	ch <- provisionedPeersDesc
+	ch <- outboxMessagesDesc
+}
+
+func (c *repositoryCollector) Collect(ch chan<- prometheus.Metric) {
+	// the collector interface carries no context; the repository bounds each query
+	ctx := context.Background()
+
+	subscriptions, err := c.repo.CountActiveSubscriptions(ctx)
+	if err != nil {
+		c.logger.Error("unable to count active subscriptions", "error", err)
+		ch <- prometheus.NewInvalidMetric(activeSubscriptionsDesc, err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(activeSubscriptionsDesc, prometheus.GaugeValue, float64(subscriptions))
+	}
+
+	peers, err := c.repo.CountActiveVpnPeers(ctx)
+	if err != nil {
+		c.logger.Error("unable to count VPN peers", "error", err)
+		ch <- prometheus.NewInvalidMetric(provisionedPeersDesc, err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(provisionedPeersDesc, prometheus.GaugeValue, float64(peers))
+	}
+
+	outbox, err := c.repo.CountOutboxMessagesByStatus(ctx)
+	if err != nil {
+		c.logger.Error("unable to count outbox messages", "error", err)
+		ch <- prometheus.NewInvalidMetric(outboxMessagesDesc, err)
+		return
+	}
+	for _, status := range []string{models.OutboxPending, models.OutboxSending, models.OutboxSent, models.OutboxDead} {
+		ch <- prometheus.MustNewConstMetric(outboxMessagesDesc, prometheus.GaugeValue, float64(outbox[status]), status)
+	}
+}
+
+var (
+	poolConnsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "pgxpool", "conns"),
+		"Connections in the pgxpool, by state.",
+		[]string{"state"}, nil,
+	)
+	poolMaxConnsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "pgxpool", "max_conns"),
+		"Maximum number of connections in the pgxpool.",
+		nil, nil,
+	)
+	poolAcquiresDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "pgxpool", "acquires_total"),
+		"Connections acquired from the pgxpool, by result: immediate, waited or canceled.",
+		[]string{"result"}, nil,
+	)
+	poolAcquireDurationDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "pgxpool", "acquire_duration_seconds_total"),
+		"Time spent acquiring connections from the pgxpool.",
+		nil, nil,
+	)
+)
+
+// poolCollector reads the statistics of a pgxpool on every scrape
+type poolCollector struct {
+	pool *pgxpool.Pool
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolConnsDesc
+	ch <- poolMaxConnsDesc
+	ch <- poolAcquiresDesc
+	ch <- poolAcquireDurationDesc
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	stat := c.pool.Stat()
+
+	ch <- prometheus.MustNewConstMetric(poolConnsDesc, prometheus.GaugeValue, float64(stat.AcquiredConns()), "acquired")
+	ch <- prometheus.MustNewConstMetric(poolConnsDesc, prometheus.GaugeValue, float64(stat.IdleConns()), "idle")
+	ch <- prometheus.MustNewConstMetric(poolConnsDesc, prometheus.GaugeValue, float64(stat.ConstructingConns()), "constructing")
+	ch <- prometheus.MustNewConstMetric(poolMaxConnsDesc, prometheus.GaugeValue, float64(stat.MaxConns()))
+
+	// an acquire that found no idle connection had to wait for one
+	waited := stat.EmptyAcquireCount()
+	ch <- prometheus.MustNewConstMetric(poolAcquiresDesc, prometheus.CounterValue, float64(stat.AcquireCount()-waited), "immediate")
+	ch <- prometheus.MustNewConstMetric(poolAcquiresDesc, prometheus.CounterValue, float64(waited), "waited")
+	ch <- prometheus.MustNewConstMetric(poolAcquiresDesc, prometheus.CounterValue, float64(stat.CanceledAcquireCount()), "canceled")
+	ch <- prometheus.MustNewConstMetric(poolAcquireDurationDesc, prometheus.CounterValue, stat.AcquireDuration().Seconds())
+}
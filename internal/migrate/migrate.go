@@ -0,0 +1,374 @@
+// Package migrate applies the embedded SQL migrations and records them in
+// the schema_migrations table.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lockKey is the pg_advisory_lock key held while migrating, so replicas
+// starting at the same time apply each migration exactly once
+const lockKey int64 = 0x66617374_6e657476 // "fastnetv"
+
+var fileName = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// ErrNoChange is returned by Down when there is nothing left to roll back
+var ErrNoChange = errors.New("no migrations to roll back")
+
+// Migration is a single versioned schema change
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status describes whether a migration has been applied
+type Status struct {
+	Migration
+	AppliedAt time.Time
+}
+
+// Applied reports whether the migration has been run against the database
+func (s Status) Applied() bool {
+	return !s.AppliedAt.IsZero()
+}
+
+// Migrator runs migrations against a Postgres database
+type Migrator struct {
+	DB         *sql.DB
+	Logger     *slog.Logger
+	migrations []Migration
+}
+
+// New parses the migrations in fsys and returns a Migrator for db
+func New(db *sql.DB, fsys fs.FS, logger *slog.Logger) (*Migrator, error) {
+	migrations, err := Load(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{DB: db, Logger: logger, migrations: migrations}, nil
+}
+
+// Load reads every <version>_<name>.{up,down}.sql file at the root of fsys
+// and returns the migrations sorted by version
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".sql") {
+			continue
+		}
+
+		match := fileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migration %s: name must look like <version>_<name>.up.sql", entry.Name())
+		}
+
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: %w", entry.Name(), err)
+		}
+
+		body, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, m.Name, match[2])
+		}
+
+		if match[3] == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if strings.TrimSpace(m.Up) == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up script", m.Version, m.Name)
+		}
+		if strings.TrimSpace(m.Down) == "" {
+			return nil, fmt.Errorf("migration %d_%s has no down script", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// Up applies every pending migration in version order and returns how many ran
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	count := 0
+
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, mig := range m.migrations {
+			if _, ok := applied[mig.Version]; ok {
+				continue
+			}
+
+			m.Logger.Info("applying migration", "version", mig.Version, "name", mig.Name)
+			err = inTx(ctx, conn, func(tx *sql.Tx) error {
+				if _, err := tx.ExecContext(ctx, mig.Up); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx,
+					`insert into schema_migrations (version, name, applied_at) values ($1, $2, $3)`,
+					mig.Version, mig.Name, time.Now())
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", mig.Version, mig.Name, err)
+			}
+			count++
+		}
+
+		return nil
+	})
+
+	return count, err
+}
+
+// Down rolls back the most recently applied steps migrations
+func (m *Migrator) Down(ctx context.Context, steps int) (int, error) {
+	count := 0
+
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			return ErrNoChange
+		}
+
+		for i := len(m.migrations) - 1; i >= 0 && count < steps; i-- {
+			mig := m.migrations[i]
+			if _, ok := applied[mig.Version]; !ok {
+				continue
+			}
+
+			m.Logger.Info("rolling back migration", "version", mig.Version, "name", mig.Name)
+			err = inTx(ctx, conn, func(tx *sql.Tx) error {
+				if _, err := tx.ExecContext(ctx, mig.Down); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx, `delete from schema_migrations where version = $1`, mig.Version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", mig.Version, mig.Name, err)
+			}
+			count++
+		}
+
+		return nil
+	})
+
+	return count, err
+}
+
+// Status lists every known migration with the time it was applied, if it was
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	var statuses []Status
+
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, mig := range m.migrations {
+			statuses = append(statuses, Status{Migration: mig, AppliedAt: applied[mig.Version]})
+		}
+
+		return nil
+	})
+
+	return statuses, err
+}
+
+// Pending reports how many migrations have not been applied yet
+func (m *Migrator) Pending(ctx context.Context) (int, error) {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	pending := 0
+	for _, s := range statuses {
+		if !s.Applied() {
+			pending++
+		}
+	}
+
+	return pending, nil
+}
+
+// withLock runs fn on a single connection holding the migration advisory
+// lock, creating the schema_migrations table first if needed
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, `select pg_advisory_lock($1)`, lockKey)
+	if err != nil {
+		return fmt.Errorf("acquire migration lock: %w", err)
+	}
+	defer func() {
+		// use a fresh context so the lock is released even if ctx was cancelled
+		_, err := conn.ExecContext(context.Background(), `select pg_advisory_unlock($1)`, lockKey)
+		if err != nil {
+			m.Logger.Error("release migration lock", "error", err)
+		}
+	}()
+
+	err = ensureTable(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	return fn(conn)
+}
+
+// ensureTable creates schema_migrations. Databases previously managed with
+// soda have their versions copied over from its schema_migration table, so
+// the existing tables are not created a second time.
+func ensureTable(ctx context.Context, conn *sql.Conn) error {
+	var exists bool
+	err := conn.QueryRowContext(ctx, `select to_regclass('schema_migrations') is not null`).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	return inTx(ctx, conn, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+			create table schema_migrations (
+				version    bigint primary key,
+				name       varchar(255) not null,
+				applied_at timestamp not null
+			)`)
+		if err != nil {
+			return err
+		}
+
+		var legacy bool
+		err = tx.QueryRowContext(ctx, `select to_regclass('schema_migration') is not null`).Scan(&legacy)
+		if err != nil || !legacy {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			insert into schema_migrations (version, name, applied_at)
+			select version::bigint, 'imported_from_soda', now() from schema_migration`)
+		return err
+	})
+}
+
+func appliedVersions(ctx context.Context, conn *sql.Conn) (map[int64]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, `select version, applied_at from schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int64]time.Time)
+	for rows.Next() {
+		var version int64
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+
+	return applied, rows.Err()
+}
+
+func inTx(ctx context.Context, conn *sql.Conn, fn func(tx *sql.Tx) error) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Create writes an empty up/down pair named after the current UTC time into
+// dir and returns the paths of the new files
+func Create(dir, name string, now time.Time) ([]string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	name = strings.Join(strings.FieldsFunc(name, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9')
+	}), "_")
+	if name == "" {
+		return nil, errors.New("migration name is required")
+	}
+
+	version := now.UTC().Format("20060102150405")
+	var paths []string
+	for _, direction := range []string{"up", "down"} {
+		path := filepath.Join(dir, fmt.Sprintf("%s_%s.%s.sql", version, name, direction))
+
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err != nil {
+			return paths, err
+		}
+		_, err = fmt.Fprintf(f, "-- %s migration for %s\n", direction, name)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return paths, err
+		}
+
+		paths = append(paths, path)
+	}
+
+	return paths, nil
+}
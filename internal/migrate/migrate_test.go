@@ -0,0 +1,91 @@
+package migrate
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/migrations"
+)
+
+func TestLoadSortsAndPairs(t *testing.T) {
+	fsys := fstest.MapFS{
+		"2_second.up.sql":   {Data: []byte("create table b ();")},
+		"2_second.down.sql": {Data: []byte("drop table b;")},
+		"1_first.up.sql":    {Data: []byte("create table a ();")},
+		"1_first.down.sql":  {Data: []byte("drop table a;")},
+		"migrations.go":     {Data: []byte("package migrations")},
+	}
+
+	got, err := Load(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Version != 1 || got[1].Version != 2 {
+		t.Fatalf("unexpected order: %+v", got)
+	}
+	if got[0].Name != "first" || got[0].Down != "drop table a;" {
+		t.Fatalf("unexpected migration: %+v", got[0])
+	}
+}
+
+func TestLoadRejectsBrokenSets(t *testing.T) {
+	cases := map[string]fstest.MapFS{
+		"missing down": {
+			"1_first.up.sql": {Data: []byte("select 1;")},
+		},
+		"bad name": {
+			"first.up.sql": {Data: []byte("select 1;")},
+		},
+		"name mismatch": {
+			"1_first.up.sql":   {Data: []byte("select 1;")},
+			"1_other.down.sql": {Data: []byte("select 1;")},
+		},
+	}
+
+	for name, fsys := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Load(fsys); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestEmbeddedMigrationsLoad(t *testing.T) {
+	got, err := Load(migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) == 0 {
+		t.Fatal("no embedded migrations")
+	}
+}
+
+func TestCreate(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2026, 10, 19, 12, 30, 0, 0, time.UTC)
+
+	paths, err := Create(dir, "Add Outbox table", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		filepath.Join(dir, "20261019123000_add_outbox_table.up.sql"),
+		filepath.Join(dir, "20261019123000_add_outbox_table.down.sql"),
+	}
+	if strings.Join(paths, ",") != strings.Join(want, ",") {
+		t.Fatalf("got %v, want %v", paths, want)
+	}
+
+	if _, err := Load(os.DirFS(dir)); err != nil {
+		t.Fatalf("created files do not load: %v", err)
+	}
+	if _, err := Create(dir, "Add Outbox table", now); err == nil {
+		t.Fatal("expected an error when the files already exist")
+	}
+}
@@ -0,0 +1,33 @@
+package models
+
+import (
+	"slices"
+	"time"
+)
+
+type APIToken struct {
+	ID         int
+	UserID     int
+	Name       string
+	Prefix     string
+	TokenHash  string
+	Scopes     []string
+	LastUsedAt time.Time
+	ExpiresAt  time.Time
+	RevokedAt  time.Time
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// HasScope reports whether the token was granted the given scope
+func (t APIToken) HasScope(scope string) bool {
+	return slices.Contains(t.Scopes, scope)
+}
+
+// IsUsable reports whether the token is neither revoked nor expired
+func (t APIToken) IsUsable(now time.Time) bool {
+	if !t.RevokedAt.IsZero() {
+		return false
+	}
+	return t.ExpiresAt.IsZero() || now.Before(t.ExpiresAt)
+}
@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// CertificateAuthority is the CA of the OpenVPN peers, created when the first
+// certificate is issued. EncryptedKey is its private key sealed with the key
+// of PKI_ENCRYPTION_KEY. CRL is the revocation list last signed, numbered
+// CRLNumber; empty and 0 until the first one.
+type CertificateAuthority struct {
+	Certificate  string
+	EncryptedKey string
+	CRL          string
+	CRLNumber    int64
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// RevokedCertificate is a certificate nodes must refuse
+type RevokedCertificate struct {
+	// Serial is the serial number in hex, the public key of its peer
+	Serial    string
+	RevokedAt time.Time
+}
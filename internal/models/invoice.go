@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+type Invoice struct {
+	ID             int
+	UserID         int
+	SubscriptionID int
+	Number         string
+	AmountCents    int
+	Currency       string
+	Status         string
+	IssuedAt       time.Time
+	PaidAt         time.Time
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
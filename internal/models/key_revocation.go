@@ -0,0 +1,48 @@
+package models
+
+import "time"
+
+// Why the keys of a KeyRevocation were taken off their peer
+const (
+	// KeysRotated keys were replaced on the rotation schedule of the plan
+	KeysRotated = "rotated"
+	// KeysReissued keys were replaced on request and stop working at once
+	KeysReissued = "reissued"
+	// KeysRevoked keys belong to a revoked peer
+	KeysRevoked = "revoked"
+)
+
+// KeyRevocation is a public key a peer no longer holds, with the address it
+// was served on. The node keeps serving it until ServeUntil, the grace window
+// of a rotation, and its agent confirms once the key is off the interface.
+type KeyRevocation struct {
+	ID           int
+	PeerID       int
+	NodeID       int
+	PublicKey    string
+	PresharedKey string
+	Address      string
+	Reason       string
+	// RxCounter and TxCounter are the interface byte counters of the key as
+	// last reported, so the traffic of the grace window is accounted
+	RxCounter  int64
+	TxCounter  int64
+	ServeUntil time.Time
+	// ConfirmedAt is zero until the agent of the node reports the key gone.
+	// Keys of the default server are never confirmed.
+	ConfirmedAt time.Time
+	CreatedAt   time.Time
+	// PeerName and Protocol are those of the peer
+	PeerName string
+	Protocol string
+}
+
+// Served reports whether the node still serves the key at now
+func (r KeyRevocation) Served(now time.Time) bool {
+	return now.Before(r.ServeUntil)
+}
+
+// IsConfirmed reports whether the agent confirmed the key is gone
+func (r KeyRevocation) IsConfirmed() bool {
+	return !r.ConfirmedAt.IsZero()
+}
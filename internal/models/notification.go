@@ -0,0 +1,36 @@
+package models
+
+import "time"
+
+// Notification is an event a user was notified about. Every notification is
+// recorded, but only those with InApp set appear in the panel's feed.
+type Notification struct {
+	ID        int
+	UserID    int
+	Event     string
+	Title     string
+	Body      string
+	Link      string
+	InApp     bool
+	DedupeKey string
+	ReadAt    time.Time
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// IsRead reports whether the user has seen the notification
+func (n Notification) IsRead() bool {
+	return !n.ReadAt.IsZero()
+}
+
+// NotificationPreferences are the channels a user wants to be notified on
+type NotificationPreferences struct {
+	ID             int
+	UserID         int
+	Email          bool
+	Telegram       bool
+	InApp          bool
+	TelegramChatID string
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
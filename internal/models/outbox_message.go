@@ -0,0 +1,39 @@
+package models
+
+import "time"
+
+// Outbox message states. Messages move from pending to sending when a worker
+// claims them, then to sent, or back to pending for a retry, or to dead once
+// every attempt has failed.
+const (
+	OutboxPending = "pending"
+	OutboxSending = "sending"
+	OutboxSent    = "sent"
+	OutboxDead    = "dead"
+)
+
+// Outbox channels. An e-mail message carries an email.Message as its payload and
+// is addressed to an e-mail address; a Telegram message carries its text and is
+// addressed to a chat ID.
+const (
+	ChannelEmail    = "email"
+	ChannelTelegram = "telegram"
+)
+
+// OutboxMessage is a message waiting in, or delivered from, the outbound queue
+type OutboxMessage struct {
+	ID            int
+	Channel       string
+	Recipient     string
+	Subject       string
+	Payload       []byte
+	Status        string
+	Attempts      int
+	MaxAttempts   int
+	NextAttemptAt time.Time
+	LockedUntil   time.Time
+	LastError     string
+	SentAt        time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
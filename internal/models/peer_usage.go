@@ -0,0 +1,65 @@
+package models
+
+import "time"
+
+// Usage bucket periods. Traffic is summed into a bucket of every period.
+const (
+	UsageHour  = "hour"
+	UsageDay   = "day"
+	UsageMonth = "month"
+)
+
+// UsagePeriods lists the usage bucket periods from the finest to the coarsest
+var UsagePeriods = []string{UsageHour, UsageDay, UsageMonth}
+
+// PeerTraffic is an amount of traffic of a peer, seen from the node: RxBytes
+// were received from the peer (its upload), TxBytes sent to it (its download)
+type PeerTraffic struct {
+	PeerID  int
+	RxBytes int64
+	TxBytes int64
+}
+
+// UsagePoint is the traffic in the bucket starting at BucketStart
+type UsagePoint struct {
+	BucketStart time.Time
+	RxBytes     int64
+	TxBytes     int64
+}
+
+// UsageBucket returns the start of the period bucket holding t, in UTC
+func UsageBucket(period string, t time.Time) time.Time {
+	t = t.UTC()
+	switch period {
+	case UsageHour:
+		return t.Truncate(time.Hour)
+	case UsageDay:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	default:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+}
+
+// NextUsageBucket returns the start of the bucket after the one starting at start
+func NextUsageBucket(period string, start time.Time) time.Time {
+	switch period {
+	case UsageHour:
+		return start.Add(time.Hour)
+	case UsageDay:
+		return start.AddDate(0, 0, 1)
+	default:
+		return start.AddDate(0, 1, 0)
+	}
+}
+
+// PreviousUsageBucket returns the start of the bucket before the one starting at start
+func PreviousUsageBucket(period string, start time.Time) time.Time {
+	switch period {
+	case UsageHour:
+		return start.Add(-time.Hour)
+	case UsageDay:
+		return start.AddDate(0, 0, -1)
+	default:
+		return start.AddDate(0, -1, 0)
+	}
+}
@@ -0,0 +1,16 @@
+package models
+
+// VPN protocols peers are provisioned with. WireGuard is served by every node
+// and the default server; VLESS with Reality and Shadowsocks-2022 are served by
+// Xray on the nodes that enable them, and get through DPI that blocks WireGuard.
+// OpenVPN is served on the nodes that enable it, for networks that allow
+// nothing else; its peers authenticate with certificates of the panel's CA.
+const (
+	ProtocolWireGuard   = "wireguard"
+	ProtocolVLESS       = "vless"
+	ProtocolShadowsocks = "shadowsocks"
+	ProtocolOpenVPN     = "openvpn"
+)
+
+// Protocols lists the VPN protocols in the order the pages offer them
+var Protocols = []string{ProtocolWireGuard, ProtocolVLESS, ProtocolShadowsocks, ProtocolOpenVPN}
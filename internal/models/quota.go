@@ -0,0 +1,56 @@
+package models
+
+import "time"
+
+// QuotaFromPlan is the UserQuota limit keeping the limit of the user's plan
+const QuotaFromPlan = -1
+
+// UserQuota holds the limits an admin set for a user in place of those of the
+// plan, and whether the user is blocked for going over the data cap.
+// DataCapBytes and DeviceLimit are QuotaFromPlan to keep the plan's limit and
+// 0 to lift it.
+type UserQuota struct {
+	UserID       int
+	DataCapBytes int64
+	DeviceLimit  int
+	Note         string
+	// BlockedUntil is the end of the billing cycle the cap was hit in; the
+	// peers of the user are not served before then
+	BlockedUntil time.Time
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// HasOverride reports whether an admin overrode a limit of the plan
+func (q UserQuota) HasOverride() bool {
+	return q.DataCapBytes != QuotaFromPlan || q.DeviceLimit != QuotaFromPlan
+}
+
+// IsBlocked reports whether the user is blocked at now
+func (q UserQuota) IsBlocked(now time.Time) bool {
+	return now.Before(q.BlockedUntil)
+}
+
+// TopUpPack is extra data on sale for users who hit their data cap
+type TopUpPack struct {
+	ID         int
+	Name       string
+	DataBytes  int64
+	PriceCents int
+	Currency   string
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// TopUp is a TopUpPack bought by a user. It raises the data cap from StartsAt
+// until ExpiresAt, the end of the billing cycle it was bought in.
+type TopUp struct {
+	ID             int
+	UserID         int
+	SubscriptionID int
+	PackID         int
+	DataBytes      int64
+	StartsAt       time.Time
+	ExpiresAt      time.Time
+	CreatedAt      time.Time
+}
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"slices"
+	"time"
+)
+
+type Plan struct {
+	ID           int
+	Name         string
+	PriceCents   int
+	Currency     string
+	DurationDays int
+	// DataCapBytes caps the traffic of a billing cycle and DeviceLimit the
+	// number of peers; 0 leaves them unlimited
+	DataCapBytes int64
+	DeviceLimit  int
+	// KeyRotationDays is how often the keys of the peers are rotated, 0 for
+	// never. The old keys keep working for KeyGraceHours after a rotation.
+	KeyRotationDays int
+	KeyGraceHours   int
+	// Protocols are the VPN protocols peers on the plan may use; a plan
+	// listing none includes WireGuard only
+	Protocols []string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// AllowedProtocols returns the protocols peers on the plan may use, in the
+// order the plan lists them
+func (p Plan) AllowedProtocols() []string {
+	if len(p.Protocols) == 0 {
+		return []string{ProtocolWireGuard}
+	}
+	return p.Protocols
+}
+
+// Includes reports whether peers on the plan may use protocol
+func (p Plan) Includes(protocol string) bool {
+	return slices.Contains(p.AllowedProtocols(), protocol)
+}
+
+type Subscription struct {
+	ID        int
+	UserID    int
+	PlanID    int
+	Status    string
+	StartsAt  time.Time
+	ExpiresAt time.Time
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Plan      Plan
+}
+
+// IsActive reports whether the subscription can be used at the given time
+func (s Subscription) IsActive(now time.Time) bool {
+	return s.Status == "active" && now.After(s.StartsAt) && now.Before(s.ExpiresAt)
+}
@@ -13,4 +13,8 @@ type TemplateData struct {
 	Warning         string
 	Error           string
 	IsAuthenticated int
+
+	// the notification bell of the signed-in user
+	Notifications       []Notification
+	UnreadNotifications int
 }
@@ -0,0 +1,141 @@
+package models
+
+import "time"
+
+// VPN node states. Only enabled nodes take new peers; a draining node keeps
+// serving its peers until they are moved or revoked, a disabled node serves none.
+const (
+	NodeEnabled  = "enabled"
+	NodeDraining = "draining"
+	NodeDisabled = "disabled"
+)
+
+// NodeStates lists the VPN node states in the order the admin pages offer them
+var NodeStates = []string{NodeEnabled, NodeDraining, NodeDisabled}
+
+// VPN node health, as the failover monitor last found it. Unlike the state it
+// is not set by admins. A degraded node works but needs a look; a down node
+// takes no new peers and its peers are moved to another node.
+const (
+	NodeHealthy  = "healthy"
+	NodeDegraded = "degraded"
+	NodeDown     = "down"
+)
+
+// VpnNode is an exit server peers are provisioned on. Every node serves
+// WireGuard; VLESS and Shadowsocks are served by Xray when their port is set,
+// OpenVPN when its port is.
+type VpnNode struct {
+	ID int
+	// Name identifies the node to admins, e.g. de-fra-1
+	Name string
+	// Country is the ISO 3166-1 alpha-2 code customers choose a location by
+	Country   string
+	Endpoint  string
+	PublicKey string
+	Subnet    string
+	// Capacity is the most active peers the node takes
+	Capacity int
+	State    string
+	// VLESSPort enables VLESS with Reality, which passes for TLS to
+	// RealityServerName. The panel generates the Reality key pair and short
+	// ID; the private key is handed to the node agent only.
+	VLESSPort         int
+	RealityServerName string
+	RealityPrivateKey string
+	RealityPublicKey  string
+	RealityShortID    string
+	// ShadowsocksPort enables Shadowsocks-2022; ShadowsocksKey is the server
+	// key every client presents next to its user key
+	ShadowsocksPort int
+	ShadowsocksKey  string
+	// OpenVPNPort enables OpenVPN. The panel's CA issues the node the
+	// certificate it presents to clients; the key is handed to the node
+	// agent only.
+	OpenVPNPort        int
+	OpenVPNCertificate string
+	OpenVPNPrivateKey  string
+	// ActivePeers is the number of unrevoked peers on the node
+	ActivePeers int
+	// AgentSeenAt is when the node agent last reported, AgentAppliedAt when it
+	// last brought the WireGuard interface in line with the panel
+	AgentSeenAt    time.Time
+	AgentAppliedAt time.Time
+	// AgentPeers is the number of peers on the interface at the last report
+	AgentPeers int
+	// AgentError is why the last reconcile failed, empty when it succeeded
+	AgentError string
+	// LastHandshakeAt is the latest handshake of any active peer on the node
+	LastHandshakeAt time.Time
+	Health          string
+	// HealthReason is what the last check found wrong, empty when healthy
+	HealthReason string
+	// HealthFailures is how many checks in a row found the node unreachable
+	HealthFailures  int
+	HealthCheckedAt time.Time
+	HealthChangedAt time.Time
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+// AcceptsPeers reports whether new peers may be placed on the node
+func (n VpnNode) AcceptsPeers() bool {
+	return n.State == NodeEnabled && !n.IsDown() && n.ActivePeers < n.Capacity
+}
+
+// IsDown reports whether the failover monitor found the node down
+func (n VpnNode) IsDown() bool {
+	return n.Health == NodeDown
+}
+
+// Serves reports whether the node serves peers using protocol
+func (n VpnNode) Serves(protocol string) bool {
+	switch protocol {
+	case ProtocolWireGuard:
+		return true
+	case ProtocolVLESS:
+		return n.VLESSPort > 0
+	case ProtocolShadowsocks:
+		return n.ShadowsocksPort > 0
+	case ProtocolOpenVPN:
+		return n.OpenVPNPort > 0
+	}
+	return false
+}
+
+// Protocols returns the protocols the node serves
+func (n VpnNode) Protocols() []string {
+	var protocols []string
+	for _, p := range Protocols {
+		if n.Serves(p) {
+			protocols = append(protocols, p)
+		}
+	}
+	return protocols
+}
+
+// LoadPercent is how full the node is, in percent of its capacity
+func (n VpnNode) LoadPercent() int {
+	if n.Capacity <= 0 {
+		return 100
+	}
+	return n.ActivePeers * 100 / n.Capacity
+}
+
+// VpnNodeHealth is the outcome of a health check of a node
+type VpnNodeHealth struct {
+	NodeID    int
+	Health    string
+	Reason    string
+	Failures  int
+	CheckedAt time.Time
+}
+
+// VpnNodeAgentStatus is what a node agent reports after reconciling its interface
+type VpnNodeAgentStatus struct {
+	NodeID int
+	// Applied is false when the agent could not configure the interface
+	Applied bool
+	Peers   int
+	Error   string
+}
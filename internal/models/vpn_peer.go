@@ -0,0 +1,42 @@
+package models
+
+import "time"
+
+// VpnPeer is a VPN client of a user. NodeID is the node it is provisioned on,
+// 0 for the default server. LastHandshakeAt and the counters are reported by
+// the node agent; LastHandshakeAt is zero until the peer first connects, and
+// stays zero for protocols without handshakes.
+type VpnPeer struct {
+	ID             int
+	UserID         int
+	SubscriptionID int
+	NodeID         int
+	Name           string
+	// Protocol is one of the Protocol constants
+	Protocol string
+	// PublicKey is what the node knows the peer by: the WireGuard public key,
+	// the VLESS user ID, the Shadowsocks user key or the serial number of the
+	// OpenVPN certificate. Only WireGuard peers have a PresharedKey and tunnel
+	// Address; WireGuard and OpenVPN peers have a PrivateKey.
+	PublicKey    string
+	PrivateKey   string
+	PresharedKey string
+	Address      string
+	// Certificate is the PEM encoded certificate of an OpenVPN peer, issued
+	// when its profile is first downloaded; empty until then
+	Certificate     string
+	RevokedAt       time.Time
+	LastHandshakeAt time.Time
+	// RxCounter and TxCounter are the interface byte counters of the last report
+	RxCounter int64
+	TxCounter int64
+	// KeysRotatedAt is when the peer got its current keys
+	KeysRotatedAt time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// IsRevoked reports whether the peer has been revoked
+func (p VpnPeer) IsRevoked() bool {
+	return !p.RevokedAt.IsZero()
+}
@@ -0,0 +1,218 @@
+// Package notify tells users about events on their account over the channels
+// they chose: e-mail, Telegram and the notification feed of the panel
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/email"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/repository"
+)
+
+// The events users are notified about. Each has a template in the notification
+// template directory and an e-mail template of the same name.
+const (
+	EventSubscriptionExpiring = "subscription_expiring"
+	EventPaymentSucceeded     = "payment_succeeded"
+	EventPaymentFailed        = "payment_failed"
+	EventDeviceAdded          = "device_added"
+	EventQuotaWarning         = "quota_warning"
+	EventQuotaExceeded        = "quota_exceeded"
+	EventTopUpPurchased       = "topup_purchased"
+	EventKeysRotated          = "keys_rotated"
+	EventNodeHealth           = "node_health"
+	EventNodeDown             = "node_down"
+	EventDeviceMoved          = "device_moved"
+)
+
+// SubscriptionExpiring is the data for the subscription_expiring event
+type SubscriptionExpiring struct {
+	PlanName  string
+	ExpiresAt time.Time
+}
+
+// PaymentSucceeded is the data for the payment_succeeded event
+type PaymentSucceeded struct {
+	PlanName      string
+	InvoiceNumber string
+	Amount        string
+	ExpiresAt     time.Time
+}
+
+// PaymentFailed is the data for the payment_failed event
+type PaymentFailed struct {
+	PlanName string
+}
+
+// DeviceAdded is the data for the device_added event
+type DeviceAdded struct {
+	Name    string
+	Address string
+}
+
+// QuotaWarning is the data for the quota_warning event
+type QuotaWarning struct {
+	Percent  int
+	Used     string
+	Cap      string
+	ResetsAt time.Time
+}
+
+// QuotaExceeded is the data for the quota_exceeded event
+type QuotaExceeded struct {
+	Cap      string
+	ResetsAt time.Time
+}
+
+// TopUpPurchased is the data for the topup_purchased event
+type TopUpPurchased struct {
+	PackName      string
+	Data          string
+	InvoiceNumber string
+	Amount        string
+	ExpiresAt     time.Time
+}
+
+// KeysRotated is the data for the keys_rotated event
+type KeysRotated struct {
+	Name string
+	// WorksUntil is when the config downloaded before stops working
+	WorksUntil time.Time
+}
+
+// NodeHealth is the data for the node_health event admins get when the health
+// of a node changed
+type NodeHealth struct {
+	Node    string
+	Country string
+	Health  string
+	Reason  string
+	// Peers is how many devices are on the node
+	Peers int
+}
+
+// NodeDown is the data for the node_down event
+type NodeDown struct {
+	Name    string
+	Country string
+	// MovesAt is when the device is moved to another server, zero when it is
+	// only moved by its user
+	MovesAt time.Time
+}
+
+// DeviceMoved is the data for the device_moved event
+type DeviceMoved struct {
+	Name    string
+	Country string
+}
+
+// Event is one notification to a user. Data is passed to the event's templates.
+type Event struct {
+	UserID int
+	Name   string
+	Data   any
+	// Link is where the notification leads in the panel, e.g. /profile
+	Link string
+	// DedupeKey makes the notification one-off: a second event with the same
+	// key for the same user is dropped, e.g. "subscription_expiring:42"
+	DedupeKey string
+}
+
+// TelegramQueue queues a Telegram message, see outbox.Queue
+type TelegramQueue interface {
+	SendTelegram(ctx context.Context, chatID, text string) error
+}
+
+// Notifier records notifications and sends them on the channels each user
+// enabled. E-mail and Telegram messages are queued, not sent, so Notify is
+// cheap to call from a request.
+type Notifier struct {
+	Repo         repository.DatabaseRepo
+	Templates    *Templates
+	EmailService *email.Service
+	// Telegram is nil when no bot is configured
+	Telegram TelegramQueue
+	Logger   *slog.Logger
+}
+
+// NewNotifier returns a Notifier sending e-mail through emailService. Set
+// Telegram to send Telegram messages as well.
+func NewNotifier(repo repository.DatabaseRepo, templates *Templates, emailService *email.Service, logger *slog.Logger) *Notifier {
+	return &Notifier{
+		Repo:         repo,
+		Templates:    templates,
+		EmailService: emailService,
+		Logger:       logger,
+	}
+}
+
+// Notify records e and sends it on the channels the user enabled. The
+// notification is recorded even when the user turned the panel feed off, so
+// a DedupeKey holds whichever channels are enabled. A failing channel does not
+// stop the others; their errors are returned together.
+func (n *Notifier) Notify(ctx context.Context, e Event) error {
+	prefs, err := n.Repo.GetNotificationPreferences(ctx, e.UserID)
+	if err != nil {
+		return fmt.Errorf("load notification preferences: %w", err)
+	}
+
+	title, body, err := n.Templates.Render(e.Name, e.Data)
+	if err != nil {
+		return err
+	}
+
+	id, err := n.Repo.InsertNotification(ctx, models.Notification{
+		UserID:    e.UserID,
+		Event:     e.Name,
+		Title:     title,
+		Body:      body,
+		Link:      e.Link,
+		InApp:     prefs.InApp,
+		DedupeKey: e.DedupeKey,
+	})
+	if err != nil {
+		return fmt.Errorf("insert notification: %w", err)
+	}
+	if id == 0 {
+		// already notified under this DedupeKey
+		return nil
+	}
+
+	log := n.Logger.With("user_id", e.UserID, "event", e.Name, "notification_id", id)
+	var errs []error
+
+	if prefs.Email {
+		if err := n.sendEmail(ctx, e); err != nil {
+			errs = append(errs, fmt.Errorf("email: %w", err))
+		}
+	}
+
+	if prefs.Telegram && prefs.TelegramChatID != "" {
+		if n.Telegram == nil {
+			log.WarnContext(ctx, "telegram notifications are enabled but no bot is configured")
+		} else if err := n.Telegram.SendTelegram(ctx, prefs.TelegramChatID, title+"\n\n"+body); err != nil {
+			errs = append(errs, fmt.Errorf("telegram: %w", err))
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	log.InfoContext(ctx, "user notified", "email", prefs.Email, "telegram", prefs.Telegram, "in_app", prefs.InApp)
+	return nil
+}
+
+func (n *Notifier) sendEmail(ctx context.Context, e Event) error {
+	user, err := n.Repo.GetUserById(ctx, e.UserID)
+	if err != nil {
+		return fmt.Errorf("load user: %w", err)
+	}
+
+	return n.EmailService.Send(ctx, user.Email, e.Name, e.Data)
+}
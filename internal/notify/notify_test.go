@@ -0,0 +1,232 @@
+package notify
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/config"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/email"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/outbox"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/repository/dbrepo"
+)
+
+type notifyTest struct {
+	repo     *dbrepo.TestingRepo
+	notifier *Notifier
+	userID   int
+}
+
+func setupNotifyTest(t *testing.T) *notifyTest {
+	t.Helper()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	repo := dbrepo.NewTestingRepo(&config.AppConfig{Logger: logger})
+
+	mailTemplates, err := email.ParseTemplates("../../templates/email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	templates, err := ParseTemplates("../../templates/notifications")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queue := outbox.NewQueue(repo, config.Defaults().Outbox, logger)
+	emailService := email.NewService(queue, mailTemplates, "Fastnet VPN <no-reply@example.com>", logger)
+	notifier := NewNotifier(repo, templates, emailService, logger)
+	notifier.Telegram = queue
+
+	userID, err := repo.AddUser(models.User{Username: "jane", Email: "jane@example.com"}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &notifyTest{repo: repo, notifier: notifier, userID: userID}
+}
+
+// queued returns the queued messages by channel
+func (n *notifyTest) queued(t *testing.T) map[string][]models.OutboxMessage {
+	t.Helper()
+
+	messages, err := n.repo.GetOutboxMessages(context.Background(), "", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byChannel := map[string][]models.OutboxMessage{}
+	for _, msg := range messages {
+		byChannel[msg.Channel] = append(byChannel[msg.Channel], msg)
+	}
+	return byChannel
+}
+
+func TestTemplatesRenderEveryEvent(t *testing.T) {
+	templates, err := ParseTemplates("../../templates/notifications")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailTemplates, err := email.ParseTemplates("../../templates/email")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for event, data := range map[string]any{
+		EventSubscriptionExpiring: SubscriptionExpiring{PlanName: "Monthly", ExpiresAt: time.Now()},
+		EventPaymentSucceeded:     PaymentSucceeded{PlanName: "Monthly", InvoiceNumber: "FN-1", Amount: "4.99 USD", ExpiresAt: time.Now()},
+		EventPaymentFailed:        PaymentFailed{PlanName: "Monthly"},
+		EventDeviceAdded:          DeviceAdded{Name: "Laptop", Address: "10.8.0.2/32"},
+		EventQuotaWarning:         QuotaWarning{Percent: 80, Used: "40.0 GB", Cap: "50.0 GB", ResetsAt: time.Now()},
+		EventQuotaExceeded:        QuotaExceeded{Cap: "50.0 GB", ResetsAt: time.Now()},
+		EventTopUpPurchased:       TopUpPurchased{PackName: "10 GB", Data: "10.0 GB", InvoiceNumber: "FN-T1", Amount: "2.99 USD", ExpiresAt: time.Now()},
+		EventKeysRotated:          KeysRotated{Name: "Laptop", WorksUntil: time.Now()},
+		EventNodeHealth:           NodeHealth{Node: "de-fra-1", Country: "DE", Health: models.NodeDown, Reason: "wireguard udp/51820 unreachable", Peers: 3},
+		EventNodeDown:             NodeDown{Name: "Laptop", Country: "DE", MovesAt: time.Now()},
+		EventDeviceMoved:          DeviceMoved{Name: "Laptop", Country: "DE"},
+	} {
+		title, body, err := templates.Render(event, data)
+		if err != nil {
+			t.Errorf("%s: %v", event, err)
+			continue
+		}
+		if title == "" || body == "" {
+			t.Errorf("%s: empty title %q or body %q", event, title, body)
+		}
+
+		msg, err := mailTemplates.Render(event, data)
+		if err != nil {
+			t.Errorf("%s e-mail: %v", event, err)
+			continue
+		}
+		if msg.HTML == "" {
+			t.Errorf("%s e-mail has no HTML body", event)
+		}
+	}
+}
+
+func TestNotifyUsesDefaultChannels(t *testing.T) {
+	n := setupNotifyTest(t)
+	ctx := context.Background()
+
+	err := n.notifier.Notify(ctx, Event{
+		UserID: n.userID,
+		Name:   EventDeviceAdded,
+		Data:   DeviceAdded{Name: "Laptop", Address: "10.8.0.2/32"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	feed, err := n.repo.GetNotificationsByUserId(ctx, n.userID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(feed) != 1 || feed[0].Title != "New device added" || !strings.Contains(feed[0].Body, `"Laptop"`) {
+		t.Fatalf("unexpected feed %+v", feed)
+	}
+
+	queued := n.queued(t)
+	if len(queued[models.ChannelEmail]) != 1 || queued[models.ChannelEmail][0].Recipient != "jane@example.com" {
+		t.Fatalf("expected one e-mail to jane, got %+v", queued[models.ChannelEmail])
+	}
+	if len(queued[models.ChannelTelegram]) != 0 {
+		t.Fatal("Telegram is off by default")
+	}
+}
+
+func TestNotifyFollowsPreferences(t *testing.T) {
+	n := setupNotifyTest(t)
+	ctx := context.Background()
+
+	prefs, err := n.repo.GetNotificationPreferences(ctx, n.userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefs.Email = false
+	prefs.InApp = false
+	prefs.Telegram = true
+	prefs.TelegramChatID = "123456"
+	if err := n.repo.UpdateNotificationPreferences(ctx, prefs); err != nil {
+		t.Fatal(err)
+	}
+
+	err = n.notifier.Notify(ctx, Event{UserID: n.userID, Name: EventPaymentFailed, Data: PaymentFailed{PlanName: "Monthly"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	feed, err := n.repo.GetNotificationsByUserId(ctx, n.userID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(feed) != 0 {
+		t.Fatalf("expected nothing in the feed, got %+v", feed)
+	}
+
+	queued := n.queued(t)
+	if len(queued[models.ChannelEmail]) != 0 {
+		t.Fatal("expected no e-mail")
+	}
+	telegram := queued[models.ChannelTelegram]
+	if len(telegram) != 1 || telegram[0].Recipient != "123456" || telegram[0].Subject != "Payment failed" {
+		t.Fatalf("expected one Telegram message to 123456, got %+v", telegram)
+	}
+}
+
+func TestSchedulerNotifiesOncePerSubscription(t *testing.T) {
+	n := setupNotifyTest(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	planID := n.repo.AddPlan(models.Plan{Name: "Monthly", DurationDays: 30})
+	subscribe := func(userID int, expiresAt time.Time) {
+		t.Helper()
+		_, err := n.repo.InsertSubscription(ctx, models.Subscription{UserID: userID, PlanID: planID, Status: "active", StartsAt: now.AddDate(0, -1, 0), ExpiresAt: expiresAt})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// expiring within the notice
+	subscribe(n.userID, now.Add(48*time.Hour))
+
+	// expiring, but already renewed
+	renewed, err := n.repo.AddUser(models.User{Username: "bob", Email: "bob@example.com"}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe(renewed, now.Add(24*time.Hour))
+	subscribe(renewed, now.Add(30*24*time.Hour))
+
+	// not expiring yet
+	later, err := n.repo.AddUser(models.User{Username: "ann", Email: "ann@example.com"}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribe(later, now.Add(10*24*time.Hour))
+
+	s := NewScheduler(n.notifier, config.Defaults().Notify, n.notifier.Logger)
+	for range 2 {
+		if _, err := s.RunOnce(ctx, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for userID, want := range map[int]int{n.userID: 1, renewed: 0, later: 0} {
+		feed, err := n.repo.GetNotificationsByUserId(ctx, userID, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(feed) != want {
+			t.Errorf("user %d: expected %d notifications, got %d", userID, want, len(feed))
+		}
+	}
+
+	if emails := n.queued(t)[models.ChannelEmail]; len(emails) != 1 || emails[0].Subject != "Fastnet VPN - Your plan expires soon" {
+		t.Fatalf("expected a single expiry e-mail, got %+v", emails)
+	}
+}
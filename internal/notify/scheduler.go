@@ -0,0 +1,70 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/config"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/worker"
+)
+
+// Scheduler raises the time-based events: it warns users whose service is
+// about to end ExpiryNotice before their last subscription expires
+type Scheduler struct {
+	Notifier *Notifier
+	Config   config.NotifyConfig
+	Logger   *slog.Logger
+}
+
+// NewScheduler returns a Scheduler notifying through notifier
+func NewScheduler(notifier *Notifier, cfg config.NotifyConfig, logger *slog.Logger) *Scheduler {
+	return &Scheduler{
+		Notifier: notifier,
+		Config:   cfg,
+		Logger:   logger,
+	}
+}
+
+// Run checks for due events every Interval until ctx is done. It is meant to
+// be started on a worker.Group.
+func (s *Scheduler) Run(ctx context.Context) error {
+	return worker.Every(ctx, s.Config.Interval, func(ctx context.Context) {
+		n, err := s.RunOnce(ctx, time.Now())
+		if err != nil && ctx.Err() == nil {
+			s.Logger.ErrorContext(ctx, "scheduled notifications failed", "notified", n, "error", err)
+		}
+	})
+}
+
+// RunOnce raises the events due at now and returns how many expiring
+// subscriptions it handled. Each is notified about once, however often it runs.
+func (s *Scheduler) RunOnce(ctx context.Context, now time.Time) (int, error) {
+	subscriptions, err := s.Notifier.Repo.GetSubscriptionsExpiringBetween(ctx, now, now.Add(s.Config.ExpiryNotice))
+	if err != nil {
+		return 0, fmt.Errorf("load expiring subscriptions: %w", err)
+	}
+
+	var n int
+	for _, sub := range subscriptions {
+		err := s.Notifier.Notify(ctx, Event{
+			UserID: sub.UserID,
+			Name:   EventSubscriptionExpiring,
+			Data: SubscriptionExpiring{
+				PlanName:  sub.Plan.Name,
+				ExpiresAt: sub.ExpiresAt,
+			},
+			Link:      "/profile",
+			DedupeKey: fmt.Sprintf("%s:%d", EventSubscriptionExpiring, sub.ID),
+		})
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "unable to notify about expiring subscription",
+				"subscription_id", sub.ID, "user_id", sub.UserID, "error", err)
+			continue
+		}
+		n++
+	}
+
+	return n, nil
+}
@@ -0,0 +1,61 @@
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Templates renders the in-panel and Telegram text of notifications from a
+// directory holding event.tmpl for every event, which defines a "title" template
+// and whose body is the notification's text
+type Templates struct {
+	events map[string]*template.Template
+}
+
+// ParseTemplates parses every notification template in dir
+func ParseTemplates(dir string) (*Templates, error) {
+	t := &Templates{events: map[string]*template.Template{}}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		event := strings.TrimSuffix(filepath.Base(path), ".tmpl")
+		tmpl, err := template.New(filepath.Base(path)).Option("missingkey=error").ParseFiles(path)
+		if err != nil {
+			return nil, err
+		}
+		if tmpl.Lookup("title") == nil {
+			return nil, fmt.Errorf("notification template %s does not define a title", path)
+		}
+		t.events[event] = tmpl
+	}
+
+	if len(t.events) == 0 {
+		return nil, fmt.Errorf("no notification templates found in %s", dir)
+	}
+
+	return t, nil
+}
+
+// Render returns the title and text of the notification for event
+func (t *Templates) Render(event string, data any) (title, body string, err error) {
+	tmpl, ok := t.events[event]
+	if !ok {
+		return "", "", fmt.Errorf("unknown notification template %q", event)
+	}
+
+	var titleBuf, bodyBuf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&titleBuf, "title", data); err != nil {
+		return "", "", fmt.Errorf("rendering %s title: %w", event, err)
+	}
+	if err := tmpl.Execute(&bodyBuf, data); err != nil {
+		return "", "", fmt.Errorf("rendering %s body: %w", event, err)
+	}
+
+	return strings.TrimSpace(titleBuf.String()), strings.TrimSpace(bodyBuf.String()), nil
+}
@@ -0,0 +1,137 @@
+package openapi
+
+import (
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Reflector builds schemas from Go types, registering every named struct as a component
+type Reflector struct {
+	Schemas map[string]*Schema
+}
+
+// NewReflector returns a Reflector with an empty component registry
+func NewReflector() *Reflector {
+	return &Reflector{Schemas: map[string]*Schema{}}
+}
+
+// Schema returns the schema of v's type. Named structs are returned as references.
+func (r *Reflector) Schema(v any) *Schema {
+	return r.schemaOf(reflect.TypeOf(v))
+}
+
+func (r *Reflector) schemaOf(t reflect.Type) *Schema {
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case t.Kind() == reflect.Pointer:
+		s := r.schemaOf(t.Elem())
+		return nullable(s)
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: r.schemaOf(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object"}
+	case reflect.Struct:
+		return r.structSchema(t)
+	}
+
+	return &Schema{}
+}
+
+func (r *Reflector) structSchema(t reflect.Type) *Schema {
+	name := ComponentName(t.Name())
+	if name != "" {
+		if _, ok := r.Schemas[name]; ok {
+			return &Schema{Ref: "#/components/schemas/" + name}
+		}
+		// register before walking the fields so recursive types terminate
+		r.Schemas[name] = &Schema{}
+	}
+
+	closed := false
+	s := &Schema{
+		Type:                 "object",
+		Properties:           map[string]*Schema{},
+		AdditionalProperties: &closed,
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		fieldName, omitEmpty := jsonName(f)
+		if fieldName == "-" {
+			continue
+		}
+
+		s.Properties[fieldName] = r.schemaOf(f.Type)
+		if !omitEmpty {
+			s.Required = append(s.Required, fieldName)
+		}
+	}
+
+	if name == "" {
+		return s
+	}
+
+	*r.Schemas[name] = *s
+	return &Schema{Ref: "#/components/schemas/" + name}
+}
+
+// ComponentName derives the component name of a Go type, dropping an unexported "api" prefix
+func ComponentName(typeName string) string {
+	name := strings.TrimPrefix(typeName, "api")
+	if name == "" {
+		return ""
+	}
+
+	runes := []rune(name)
+	runes[0] = unicode.ToUpper(runes[0])
+	return string(runes)
+}
+
+func jsonName(f reflect.StructField) (string, bool) {
+	tag := f.Tag.Get("json")
+	if tag == "" {
+		return f.Name, false
+	}
+
+	name, opts, _ := strings.Cut(tag, ",")
+	if name == "" {
+		name = f.Name
+	}
+	return name, strings.Contains(opts, "omitempty")
+}
+
+// nullable allows null in addition to the types of s
+func nullable(s *Schema) *Schema {
+	if s.Ref != "" {
+		return &Schema{AnyOf: []*Schema{s, {Type: "null"}}}
+	}
+
+	switch t := s.Type.(type) {
+	case string:
+		s.Type = []string{t, "null"}
+	case []string:
+		s.Type = append(t, "null")
+	}
+	return s
+}
@@ -0,0 +1,112 @@
+package openapi
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Validate checks a decoded JSON value (as produced by encoding/json into an any)
+// against schema, resolving references through the document components.
+func (d *Document) Validate(schema *Schema, value any) error {
+	return d.validate(schema, value, "$")
+}
+
+func (d *Document) validate(schema *Schema, value any, path string) error {
+	if schema.Ref != "" {
+		name := strings.TrimPrefix(schema.Ref, "#/components/schemas/")
+		resolved, ok := d.Components.Schemas[name]
+		if !ok {
+			return fmt.Errorf("%s: unresolved reference %s", path, schema.Ref)
+		}
+		return d.validate(resolved, value, path)
+	}
+
+	if len(schema.AnyOf) > 0 {
+		var errs []string
+		for _, s := range schema.AnyOf {
+			err := d.validate(s, value, path)
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, err.Error())
+		}
+		return fmt.Errorf("%s: matches none of the allowed schemas (%s)", path, strings.Join(errs, "; "))
+	}
+
+	if schema.Type == nil {
+		return nil
+	}
+
+	var types []string
+	switch t := schema.Type.(type) {
+	case string:
+		types = []string{t}
+	case []string:
+		types = t
+	}
+
+	actual := jsonType(value)
+	if !slices.Contains(types, actual) && !(actual == "integer" && slices.Contains(types, "number")) {
+		return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(types, " or "), actual)
+	}
+
+	switch v := value.(type) {
+	case string:
+		if schema.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339, v); err != nil {
+				return fmt.Errorf("%s: %q is not a date-time", path, v)
+			}
+		}
+	case []any:
+		if schema.Items != nil {
+			for i, item := range v {
+				if err := d.validate(schema.Items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]any:
+		for _, name := range schema.Required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s: missing required property %q", path, name)
+			}
+		}
+		for name, item := range v {
+			prop, ok := schema.Properties[name]
+			if !ok {
+				if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+					return fmt.Errorf("%s: unexpected property %q", path, name)
+				}
+				continue
+			}
+			if err := d.validate(prop, item, path+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func jsonType(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == float64(int64(v)) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
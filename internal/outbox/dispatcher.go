@@ -0,0 +1,221 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/textproto"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/config"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/email"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/metrics"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/repository"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/worker"
+)
+
+// TelegramSender sends a Telegram message, see telegram.Client
+type TelegramSender interface {
+	SendMessage(ctx context.Context, chatID, text string) error
+}
+
+// Dispatcher delivers queued e-mail through Mailer and Telegram messages
+// through Telegram, which is nil when no bot is configured. Any number of
+// dispatchers may run against the same outbox, in one process or several.
+type Dispatcher struct {
+	Repo     repository.DatabaseRepo
+	Mailer   email.Mailer
+	Telegram TelegramSender
+	Config   config.OutboxConfig
+	Logger   *slog.Logger
+}
+
+// NewDispatcher returns a Dispatcher sending e-mail through mailer. Set
+// Telegram to deliver Telegram messages as well.
+func NewDispatcher(repo repository.DatabaseRepo, mailer email.Mailer, cfg config.OutboxConfig, logger *slog.Logger) *Dispatcher {
+	return &Dispatcher{
+		Repo:   repo,
+		Mailer: mailer,
+		Config: cfg,
+		Logger: logger,
+	}
+}
+
+// Run delivers due messages every PollInterval until ctx is done, draining
+// full batches without waiting. It is meant to be started on a worker.Group.
+func (d *Dispatcher) Run(ctx context.Context) error {
+	return worker.Every(ctx, d.Config.PollInterval, func(ctx context.Context) {
+		for ctx.Err() == nil {
+			n, err := d.RunOnce(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					d.Logger.ErrorContext(ctx, "unable to claim outbox messages", "error", err)
+				}
+				return
+			}
+			if n < d.Config.BatchSize {
+				return
+			}
+		}
+	})
+}
+
+// RunOnce claims one batch of due messages and attempts each of them,
+// returning how many were claimed
+func (d *Dispatcher) RunOnce(ctx context.Context) (int, error) {
+	messages, err := d.Repo.ClaimOutboxMessages(ctx, d.Config.BatchSize, d.Config.Lease)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, msg := range messages {
+		d.deliver(ctx, msg)
+	}
+
+	return len(messages), nil
+}
+
+// deliver attempts msg once and records the outcome. The outcome is stored even
+// when ctx is cancelled mid-send, so a shutdown does not leave messages locked.
+func (d *Dispatcher) deliver(ctx context.Context, msg models.OutboxMessage) {
+	to := msg.Recipient
+	if msg.Channel == models.ChannelEmail {
+		to = email.MaskAddress(to)
+	}
+	log := d.Logger.With("outbox_id", msg.ID, "channel", msg.Channel, "to", to)
+	now := time.Now()
+
+	msg.LockedUntil = time.Time{}
+
+	limited, err := d.overRecipientLimit(ctx, msg.Recipient, now)
+	if err != nil {
+		log.WarnContext(ctx, "unable to check recipient send limit", "error", err)
+	}
+	if limited {
+		msg.Status = models.OutboxPending
+		msg.NextAttemptAt = now.Add(d.Config.RecipientWindow / time.Duration(d.Config.RecipientLimit))
+		d.save(ctx, log, msg, "deferred")
+		log.InfoContext(ctx, "message deferred, recipient send limit reached", "next_attempt_at", msg.NextAttemptAt)
+		return
+	}
+
+	err = d.send(ctx, msg)
+
+	// a send cut short by shutdown is not the message's fault
+	if err != nil && ctx.Err() != nil {
+		msg.Status = models.OutboxPending
+		d.save(ctx, log, msg, "")
+		return
+	}
+
+	msg.Attempts++
+	switch {
+	case err == nil:
+		msg.Status = models.OutboxSent
+		msg.SentAt = time.Now()
+		d.save(ctx, log, msg, "sent")
+		log.InfoContext(ctx, "message sent", "subject", msg.Subject, "attempts", msg.Attempts)
+	case msg.Attempts >= msg.MaxAttempts || isPermanent(err):
+		msg.Status = models.OutboxDead
+		msg.LastError = err.Error()
+		d.save(ctx, log, msg, "dead")
+		log.ErrorContext(ctx, "message dead-lettered", "subject", msg.Subject, "attempts", msg.Attempts, "error", err)
+	default:
+		msg.Status = models.OutboxPending
+		msg.LastError = err.Error()
+		msg.NextAttemptAt = now.Add(d.backoff(msg.Attempts))
+		d.save(ctx, log, msg, "retried")
+		log.WarnContext(ctx, "message failed, will retry", "subject", msg.Subject, "attempts", msg.Attempts,
+			"next_attempt_at", msg.NextAttemptAt, "error", err)
+	}
+}
+
+// send hands msg to the transport of its channel
+func (d *Dispatcher) send(ctx context.Context, msg models.OutboxMessage) error {
+	switch msg.Channel {
+	case models.ChannelEmail:
+		var message email.Message
+		if err := json.Unmarshal(msg.Payload, &message); err != nil {
+			return permanentError{fmt.Errorf("decode payload: %w", err)}
+		}
+		return d.Mailer.Send(ctx, &message)
+	case models.ChannelTelegram:
+		if d.Telegram == nil {
+			return permanentError{errors.New("telegram is not configured")}
+		}
+		var message TelegramMessage
+		if err := json.Unmarshal(msg.Payload, &message); err != nil {
+			return permanentError{fmt.Errorf("decode payload: %w", err)}
+		}
+		return d.Telegram.SendMessage(ctx, msg.Recipient, message.Text)
+	default:
+		return permanentError{fmt.Errorf("unknown channel %q", msg.Channel)}
+	}
+}
+
+// save stores the new state of msg and counts outcome, when given
+func (d *Dispatcher) save(ctx context.Context, log *slog.Logger, msg models.OutboxMessage, outcome string) {
+	err := d.Repo.UpdateOutboxMessage(context.WithoutCancel(ctx), msg)
+	if err != nil {
+		// the lease runs out and the message is claimed again
+		log.ErrorContext(ctx, "unable to update outbox message", "status", msg.Status, "error", err)
+		return
+	}
+
+	if outcome != "" {
+		metrics.OutboxDeliveries.WithLabelValues(outcome).Inc()
+	}
+}
+
+// overRecipientLimit reports whether recipient has already been sent
+// RecipientLimit messages within the last RecipientWindow
+func (d *Dispatcher) overRecipientLimit(ctx context.Context, recipient string, now time.Time) (bool, error) {
+	if d.Config.RecipientLimit <= 0 {
+		return false, nil
+	}
+
+	sent, err := d.Repo.CountOutboxSentSince(ctx, recipient, now.Add(-d.Config.RecipientWindow))
+	if err != nil {
+		return false, err
+	}
+	return sent >= d.Config.RecipientLimit, nil
+}
+
+// backoff returns the delay after the given number of failed attempts:
+// RetryBackoff doubled for every earlier failure, capped at MaxBackoff, plus
+// up to 10% jitter so messages that failed together do not retry together
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.Config.RetryBackoff
+	for i := 1; i < attempts && delay < d.Config.MaxBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, d.Config.MaxBackoff)
+
+	return delay + rand.N(delay/10+1)
+}
+
+// permanentError marks a failure that retrying cannot fix
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string   { return e.err.Error() }
+func (e permanentError) Unwrap() error   { return e.err }
+func (e permanentError) Permanent() bool { return true }
+
+// isPermanent reports whether err is a permanent failure: an error that says
+// so, such as an undecodable message or a rejection by the Bot API, or a 5xx
+// rejection from the mail server
+func isPermanent(err error) bool {
+	var permanent interface{ Permanent() bool }
+	if errors.As(err, &permanent) && permanent.Permanent() {
+		return true
+	}
+
+	var smtpErr *textproto.Error
+	return errors.As(err, &smtpErr) && smtpErr.Code >= 500
+}
@@ -0,0 +1,118 @@
+// Package outbox queues outbound e-mail and Telegram messages in the database
+// and delivers them from background workers, so that a slow or failing mail
+// server never holds up a request and a failed send is retried instead of lost.
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/config"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/email"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/metrics"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/repository"
+)
+
+// Queue is an email.Mailer that stores messages in the outbox instead of
+// sending them. A Dispatcher delivers them later.
+type Queue struct {
+	Repo        repository.DatabaseRepo
+	MaxAttempts int
+	Logger      *slog.Logger
+}
+
+var _ email.Mailer = (*Queue)(nil)
+
+// NewQueue returns a Queue giving every message cfg.MaxAttempts delivery attempts
+func NewQueue(repo repository.DatabaseRepo, cfg config.OutboxConfig, logger *slog.Logger) *Queue {
+	return &Queue{
+		Repo:        repo,
+		MaxAttempts: cfg.MaxAttempts,
+		Logger:      logger,
+	}
+}
+
+// Send queues one copy of msg per recipient and returns once they are stored
+func (q *Queue) Send(ctx context.Context, msg *email.Message) error {
+	// rendering validates the message and fixes its Date and Message-ID, so
+	// every delivery attempt sends the same message
+	if _, err := msg.Bytes(); err != nil {
+		return err
+	}
+	_, recipients, err := msg.Envelope()
+	if err != nil {
+		return err
+	}
+
+	ids := make([]int, 0, len(recipients))
+	err = q.Repo.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		for i, recipient := range recipients {
+			single := *msg
+			single.To = []string{msg.To[i]}
+
+			payload, err := json.Marshal(single)
+			if err != nil {
+				return err
+			}
+
+			id, err := repo.InsertOutboxMessage(ctx, models.OutboxMessage{
+				Recipient:   strings.ToLower(recipient),
+				Subject:     msg.Subject,
+				Payload:     payload,
+				MaxAttempts: q.MaxAttempts,
+			})
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	metrics.OutboxDeliveries.WithLabelValues("queued").Add(float64(len(ids)))
+	q.Logger.DebugContext(ctx, "email queued", "outbox_ids", ids, "subject", msg.Subject, "message_id", msg.MessageID)
+	return nil
+}
+
+// TelegramMessage is the payload of a message on the Telegram channel
+type TelegramMessage struct {
+	Text string `json:"text"`
+}
+
+// SendTelegram queues text for the Telegram chat chatID
+func (q *Queue) SendTelegram(ctx context.Context, chatID, text string) error {
+	payload, err := json.Marshal(TelegramMessage{Text: text})
+	if err != nil {
+		return err
+	}
+
+	id, err := q.Repo.InsertOutboxMessage(ctx, models.OutboxMessage{
+		Channel:     models.ChannelTelegram,
+		Recipient:   chatID,
+		Subject:     firstLine(text),
+		Payload:     payload,
+		MaxAttempts: q.MaxAttempts,
+	})
+	if err != nil {
+		return err
+	}
+
+	metrics.OutboxDeliveries.WithLabelValues("queued").Inc()
+	q.Logger.DebugContext(ctx, "telegram message queued", "outbox_id", id)
+	return nil
+}
+
+// firstLine shortens text to its first line, to describe it on the outbox page
+func firstLine(text string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(text), "\n")
+	if len(line) > 255 {
+		line = line[:255]
+	}
+	return line
+}
@@ -0,0 +1,402 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/config"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/email"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/repository/dbrepo"
+)
+
+type outboxTest struct {
+	repo       *dbrepo.TestingRepo
+	mailer     *email.MemoryMailer
+	queue      *Queue
+	dispatcher *Dispatcher
+}
+
+func setupOutboxTest(t *testing.T) *outboxTest {
+	t.Helper()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cfg := config.Defaults().Outbox
+
+	repo := dbrepo.NewTestingRepo(&config.AppConfig{Logger: logger})
+	mailer := email.NewMemoryMailer()
+
+	return &outboxTest{
+		repo:       repo,
+		mailer:     mailer,
+		queue:      NewQueue(repo, cfg, logger),
+		dispatcher: NewDispatcher(repo, mailer, cfg, logger),
+	}
+}
+
+func testMessage(to ...string) *email.Message {
+	return &email.Message{
+		From:    "Fastnet VPN <no-reply@example.com>",
+		To:      to,
+		Subject: "Hello",
+		Text:    "Hello there",
+		HTML:    "<p>Hello there</p>",
+	}
+}
+
+// message returns the only queued message
+func (o *outboxTest) message(t *testing.T) models.OutboxMessage {
+	t.Helper()
+
+	messages, err := o.repo.GetOutboxMessages(context.Background(), "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 queued message, got %d", len(messages))
+	}
+	return messages[0]
+}
+
+// makeDue moves the next attempt of msg into the past
+func (o *outboxTest) makeDue(t *testing.T, msg models.OutboxMessage) {
+	t.Helper()
+
+	msg.NextAttemptAt = time.Now().Add(-time.Second)
+	if err := o.repo.UpdateOutboxMessage(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueueDelivers(t *testing.T) {
+	o := setupOutboxTest(t)
+	ctx := context.Background()
+	var logs bytes.Buffer
+	o.dispatcher.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+
+	if err := o.queue.Send(ctx, testMessage("Ann <Ann@example.com>", "bob@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(o.mailer.Messages()); n != 0 {
+		t.Fatalf("queueing sent %d messages", n)
+	}
+
+	n, err := o.dispatcher.RunOnce(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 claimed messages, got %d", n)
+	}
+
+	sent := o.mailer.Messages()
+	if len(sent) != 2 {
+		t.Fatalf("expected 2 sent messages, got %d", len(sent))
+	}
+	for _, msg := range sent {
+		if len(msg.To) != 1 || msg.Subject != "Hello" || msg.HTML != "<p>Hello there</p>" {
+			t.Fatalf("unexpected message %+v", msg)
+		}
+	}
+	if sent[0].MessageID == "" || sent[0].MessageID != sent[1].MessageID {
+		t.Fatalf("expected both copies to keep the queued Message-ID, got %q and %q", sent[0].MessageID, sent[1].MessageID)
+	}
+	if _, ok := o.mailer.Last("Ann <Ann@example.com>"); !ok {
+		t.Fatal("expected the display name to be kept in To")
+	}
+	if strings.Contains(logs.String(), "bob@example.com") || !strings.Contains(logs.String(), "to=b***@example.com") {
+		t.Fatalf("expected the recipients masked in the logs, got\n%s", logs.String())
+	}
+
+	counts, err := o.repo.CountOutboxMessagesByStatus(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts[models.OutboxSent] != 2 {
+		t.Fatalf("expected 2 sent messages, got %v", counts)
+	}
+
+	recipients, err := o.repo.CountOutboxSentSince(ctx, "ann@example.com", time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recipients != 1 {
+		t.Fatalf("expected the recipient to be stored lower-cased, got %d messages for ann@example.com", recipients)
+	}
+}
+
+func TestQueueRejectsInvalidMessages(t *testing.T) {
+	o := setupOutboxTest(t)
+
+	msg := testMessage("not an address")
+	if err := o.queue.Send(context.Background(), msg); err == nil {
+		t.Fatal("expected an invalid recipient to be rejected")
+	}
+
+	counts, err := o.repo.CountOutboxMessagesByStatus(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 0 {
+		t.Fatalf("expected nothing to be queued, got %v", counts)
+	}
+}
+
+func TestDispatcherRetriesWithBackoff(t *testing.T) {
+	o := setupOutboxTest(t)
+	ctx := context.Background()
+	o.mailer.Err = errors.New("connection refused")
+
+	if err := o.queue.Send(ctx, testMessage("ann@example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now()
+	if _, err := o.dispatcher.RunOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := o.message(t)
+	if msg.Status != models.OutboxPending || msg.Attempts != 1 || msg.LastError != "connection refused" {
+		t.Fatalf("expected a pending retry, got %+v", msg)
+	}
+	if wait := msg.NextAttemptAt.Sub(before); wait < o.dispatcher.Config.RetryBackoff {
+		t.Fatalf("expected the retry to wait at least %s, got %s", o.dispatcher.Config.RetryBackoff, wait)
+	}
+
+	// not due yet
+	if n, _ := o.dispatcher.RunOnce(ctx); n != 0 {
+		t.Fatalf("expected nothing to be due, claimed %d", n)
+	}
+
+	o.makeDue(t, msg)
+	o.mailer.Err = nil
+	if _, err := o.dispatcher.RunOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	msg = o.message(t)
+	if msg.Status != models.OutboxSent || msg.Attempts != 2 || msg.SentAt.IsZero() {
+		t.Fatalf("expected the retry to be sent, got %+v", msg)
+	}
+}
+
+func TestDispatcherDeadLetters(t *testing.T) {
+	o := setupOutboxTest(t)
+	ctx := context.Background()
+	o.dispatcher.Config.MaxAttempts = 2
+	o.queue.MaxAttempts = 2
+	o.mailer.Err = errors.New("connection refused")
+
+	if err := o.queue.Send(ctx, testMessage("ann@example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		o.makeDue(t, o.message(t))
+		if _, err := o.dispatcher.RunOnce(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msg := o.message(t)
+	if msg.Status != models.OutboxDead || msg.Attempts != 2 {
+		t.Fatalf("expected a dead message after 2 attempts, got %+v", msg)
+	}
+
+	o.makeDue(t, msg)
+	if n, _ := o.dispatcher.RunOnce(ctx); n != 0 {
+		t.Fatalf("dead messages must not be claimed, claimed %d", n)
+	}
+
+	if err := o.repo.RetryOutboxMessage(ctx, msg.ID); err != nil {
+		t.Fatal(err)
+	}
+	o.mailer.Err = nil
+	if _, err := o.dispatcher.RunOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if msg := o.message(t); msg.Status != models.OutboxSent {
+		t.Fatalf("expected the requeued message to be sent, got %+v", msg)
+	}
+}
+
+func TestDispatcherDeadLettersPermanentFailures(t *testing.T) {
+	o := setupOutboxTest(t)
+	ctx := context.Background()
+	o.mailer.Err = fmt.Errorf("smtp RCPT TO ann@example.com: %w", &textproto.Error{Code: 550, Msg: "no such user"})
+
+	if err := o.queue.Send(ctx, testMessage("ann@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.dispatcher.RunOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := o.message(t)
+	if msg.Status != models.OutboxDead || msg.Attempts != 1 {
+		t.Fatalf("expected a 5xx rejection to dead-letter at once, got %+v", msg)
+	}
+}
+
+func TestDispatcherRecipientLimit(t *testing.T) {
+	o := setupOutboxTest(t)
+	ctx := context.Background()
+	o.dispatcher.Config.RecipientLimit = 2
+
+	for range 3 {
+		if err := o.queue.Send(ctx, testMessage("ann@example.com")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := o.queue.Send(ctx, testMessage("bob@example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := o.dispatcher.RunOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(o.mailer.Messages()); n != 3 {
+		t.Fatalf("expected 2 messages to ann and 1 to bob, got %d", n)
+	}
+
+	pending, err := o.repo.GetOutboxMessages(ctx, models.OutboxPending, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].Recipient != "ann@example.com" || pending[0].Attempts != 0 {
+		t.Fatalf("expected ann's third message to be deferred without using an attempt, got %+v", pending)
+	}
+	if !pending[0].NextAttemptAt.After(time.Now()) {
+		t.Fatal("expected the deferred message to be scheduled later")
+	}
+}
+
+func TestDispatcherReleasesMessagesOnShutdown(t *testing.T) {
+	o := setupOutboxTest(t)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if err := o.queue.Send(ctx, testMessage("ann@example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := o.repo.ClaimOutboxMessages(ctx, 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	o.mailer.Err = context.Canceled
+	o.dispatcher.deliver(ctx, msg[0])
+
+	released := o.message(t)
+	if released.Status != models.OutboxPending || released.Attempts != 0 || !released.LockedUntil.IsZero() {
+		t.Fatalf("expected the message to be released without using an attempt, got %+v", released)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	d := &Dispatcher{Config: config.OutboxConfig{RetryBackoff: 30 * time.Second, MaxBackoff: 10 * time.Minute}}
+
+	for _, tt := range []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{5, 8 * time.Minute},
+		{6, 10 * time.Minute},
+		{50, 10 * time.Minute},
+	} {
+		got := d.backoff(tt.attempts)
+		if got < tt.want || got > tt.want+tt.want/10 {
+			t.Errorf("backoff(%d) = %s, want %s plus at most 10%% jitter", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+// telegramSender records the messages sent to it and fails with err
+type telegramSender struct {
+	sent []string
+	err  error
+}
+
+func (s *telegramSender) SendMessage(ctx context.Context, chatID, text string) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.sent = append(s.sent, chatID+": "+text)
+	return nil
+}
+
+// permanentSendError is a rejection that says it cannot succeed, like telegram.APIError
+type permanentSendError struct{}
+
+func (permanentSendError) Error() string {
+	return "telegram: 403 Forbidden: bot was blocked by the user"
+}
+func (permanentSendError) Permanent() bool { return true }
+
+func TestDispatcherDeliversTelegram(t *testing.T) {
+	o := setupOutboxTest(t)
+	ctx := context.Background()
+	sender := &telegramSender{}
+
+	if err := o.queue.SendTelegram(ctx, "123456", "Payment received\n\nDetails"); err != nil {
+		t.Fatal(err)
+	}
+
+	// without a bot the message cannot be delivered
+	if _, err := o.dispatcher.RunOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	msg := o.message(t)
+	if msg.Channel != models.ChannelTelegram || msg.Subject != "Payment received" || msg.Status != models.OutboxDead {
+		t.Fatalf("expected a dead Telegram message, got %+v", msg)
+	}
+
+	if err := o.repo.RetryOutboxMessage(ctx, msg.ID); err != nil {
+		t.Fatal(err)
+	}
+	o.dispatcher.Telegram = sender
+	if _, err := o.dispatcher.RunOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sender.sent) != 1 || sender.sent[0] != "123456: Payment received\n\nDetails" {
+		t.Fatalf("unexpected Telegram messages %q", sender.sent)
+	}
+	if len(o.mailer.Messages()) != 0 {
+		t.Fatal("a Telegram message must not be e-mailed")
+	}
+	if msg := o.message(t); msg.Status != models.OutboxSent {
+		t.Fatalf("expected the message to be sent, got %+v", msg)
+	}
+}
+
+func TestDispatcherDeadLettersPermanentTelegramFailures(t *testing.T) {
+	o := setupOutboxTest(t)
+	ctx := context.Background()
+	o.dispatcher.Telegram = &telegramSender{err: fmt.Errorf("send: %w", permanentSendError{})}
+
+	if err := o.queue.SendTelegram(ctx, "123456", "Hello"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.dispatcher.RunOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := o.message(t)
+	if msg.Status != models.OutboxDead || msg.Attempts != 1 {
+		t.Fatalf("expected a blocked bot to dead-letter at once, got %+v", msg)
+	}
+}
@@ -0,0 +1,347 @@
+// Package pki is the certificate authority of the OpenVPN peers: it issues the
+// certificates of the devices and of the nodes, signs the revocation list the
+// nodes check clients against, and keeps its private key encrypted at rest.
+package pki
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"time"
+)
+
+// Validity of what the authority signs. A CRL is reissued well before it
+// expires, see CRLRefresh.
+const (
+	AuthorityValidity   = 20 * 365 * 24 * time.Hour
+	CertificateValidity = 10 * 365 * 24 * time.Hour
+	CRLValidity         = 7 * 24 * time.Hour
+	// CRLRefresh is the age at which a CRL is reissued even if no certificate
+	// was revoked since
+	CRLRefresh = 24 * time.Hour
+)
+
+// backdate is how far NotBefore and ThisUpdate are set in the past, for nodes
+// whose clock runs behind
+const backdate = time.Hour
+
+// KeySize is the length in bytes of the key encrypting the authority key
+const KeySize = 32
+
+// ErrDecrypt is returned when the authority key cannot be decrypted, most
+// likely because it was encrypted with another key
+var ErrDecrypt = errors.New("unable to decrypt the certificate authority key")
+
+// Authority signs certificates and CRLs
+type Authority struct {
+	Certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+}
+
+// Revoked is a certificate on the revocation list
+type Revoked struct {
+	// Serial is the serial number in hex
+	Serial    string
+	RevokedAt time.Time
+}
+
+// NewAuthority generates the key and the self-signed certificate of an
+// authority named commonName
+func NewAuthority(commonName string, now time.Time) (*Authority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-backdate),
+		NotAfter:              now.Add(AuthorityValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Authority{Certificate: cert, key: key}, nil
+}
+
+// LoadAuthority returns the authority of the PEM encoded certificate and of
+// the key sealed with Seal under encryptionKey
+func LoadAuthority(certPEM, sealedKey string, encryptionKey []byte) (*Authority, error) {
+	cert, err := parseCertificate(certPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := Open(encryptionKey, sealedKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("certificate authority key: %w", err)
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok || !ecKey.PublicKey.Equal(cert.PublicKey) {
+		return nil, errors.New("certificate authority key does not match its certificate")
+	}
+
+	return &Authority{Certificate: cert, key: ecKey}, nil
+}
+
+// CertificatePEM returns the PEM encoded certificate of the authority
+func (a *Authority) CertificatePEM() string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: a.Certificate.Raw}))
+}
+
+// SealedKey returns the key of the authority encrypted with encryptionKey
+func (a *Authority) SealedKey(encryptionKey []byte) (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(a.key)
+	if err != nil {
+		return "", err
+	}
+	return Seal(encryptionKey, der)
+}
+
+// IssueClient signs the certificate of a device, with serial in hex and the
+// public half of the PEM encoded keyPEM
+func (a *Authority) IssueClient(serial, commonName, keyPEM string, now time.Time) (string, error) {
+	return a.issue(serial, commonName, keyPEM, x509.ExtKeyUsageClientAuth, now)
+}
+
+// IssueServer signs the certificate a node presents to OpenVPN clients
+func (a *Authority) IssueServer(serial, commonName, keyPEM string, now time.Time) (string, error) {
+	return a.issue(serial, commonName, keyPEM, x509.ExtKeyUsageServerAuth, now)
+}
+
+func (a *Authority) issue(serial, commonName, keyPEM string, usage x509.ExtKeyUsage, now time.Time) (string, error) {
+	n, ok := parseSerial(serial)
+	if !ok {
+		return "", fmt.Errorf("invalid serial number %q", serial)
+	}
+	key, err := parseKey(keyPEM)
+	if err != nil {
+		return "", err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: n,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now.Add(-backdate),
+		NotAfter:     now.Add(CertificateValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyAgreement,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	if template.NotAfter.After(a.Certificate.NotAfter) {
+		template.NotAfter = a.Certificate.NotAfter
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, a.Certificate, &key.PublicKey, a.key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), nil
+}
+
+// CRL signs the revocation list numbered number, listing revoked. A serial
+// given twice is listed once.
+func (a *Authority) CRL(revoked []Revoked, number int64, now time.Time) (string, error) {
+	entries := make([]x509.RevocationListEntry, 0, len(revoked))
+	listed := make(map[string]bool, len(revoked))
+	for _, r := range revoked {
+		n, ok := parseSerial(r.Serial)
+		if !ok {
+			return "", fmt.Errorf("invalid serial number %q", r.Serial)
+		}
+		if listed[n.Text(16)] {
+			continue
+		}
+		listed[n.Text(16)] = true
+		entries = append(entries, x509.RevocationListEntry{SerialNumber: n, RevocationTime: r.RevokedAt.UTC()})
+	}
+
+	template := &x509.RevocationList{
+		RevokedCertificateEntries: entries,
+		Number:                    big.NewInt(number),
+		ThisUpdate:                now.Add(-backdate),
+		NextUpdate:                now.Add(CRLValidity),
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, a.Certificate, a.key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})), nil
+}
+
+// CRLCurrent reports whether crlPEM, signed by the authority, lists exactly
+// the serials of revoked and needs no refresh at now
+func (a *Authority) CRLCurrent(crlPEM string, revoked []Revoked, now time.Time) bool {
+	block, _ := pem.Decode([]byte(crlPEM))
+	if block == nil {
+		return false
+	}
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil || crl.CheckSignatureFrom(a.Certificate) != nil {
+		return false
+	}
+	if now.Sub(crl.ThisUpdate.Add(backdate)) >= CRLRefresh {
+		return false
+	}
+
+	listed := make([]string, 0, len(crl.RevokedCertificateEntries))
+	for _, e := range crl.RevokedCertificateEntries {
+		listed = append(listed, e.SerialNumber.Text(16))
+	}
+	wanted := make([]string, 0, len(revoked))
+	for _, r := range revoked {
+		n, ok := parseSerial(r.Serial)
+		if !ok {
+			return false
+		}
+		wanted = append(wanted, n.Text(16))
+	}
+	slices.Sort(listed)
+	slices.Sort(wanted)
+	return slices.Equal(listed, slices.Compact(wanted))
+}
+
+// NewSerial returns a random certificate serial number in hex
+func NewSerial() (string, error) {
+	n, err := randomSerial()
+	if err != nil {
+		return "", err
+	}
+	return n.Text(16), nil
+}
+
+// GenerateKey returns a new PEM encoded P-256 private key
+func GenerateKey() (string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
+
+// ParseEncryptionKey decodes the base64 encoded key the authority key is
+// encrypted with
+func ParseEncryptionKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(key) != KeySize {
+		return nil, fmt.Errorf("must be %d base64 encoded bytes", KeySize)
+	}
+	return key, nil
+}
+
+// Seal encrypts plaintext with AES-256-GCM under key, and returns the nonce
+// and the ciphertext in base64
+func Seal(key, plaintext []byte) (string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, plaintext, nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts what Seal returned
+func Open(key []byte, sealed string) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	b, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(b) < aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+
+	plaintext, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes", KeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// randomSerial returns a positive serial number of up to 127 random bits,
+// well within the 20 octets RFC 5280 allows
+func randomSerial() (*big.Int, error) {
+	n, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return nil, err
+	}
+	return n.Add(n, big.NewInt(1)), nil
+}
+
+func parseSerial(serial string) (*big.Int, bool) {
+	n, ok := new(big.Int).SetString(serial, 16)
+	return n, ok && n.Sign() > 0
+}
+
+func parseCertificate(certPEM string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no PEM encoded certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func parseKey(keyPEM string) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, errors.New("no PEM encoded private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not an ECDSA key")
+	}
+	return ecKey, nil
+}
@@ -0,0 +1,139 @@
+package pki
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"testing"
+	"time"
+)
+
+var testEncryptionKey = bytes.Repeat([]byte{7}, KeySize)
+
+func parsePEM(t *testing.T, s string) []byte {
+	t.Helper()
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		t.Fatalf("expected PEM, got %q", s)
+	}
+	return block.Bytes
+}
+
+func TestAuthority(t *testing.T) {
+	now := time.Now()
+	ca, err := NewAuthority("Test CA", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := ca.SealedKey(testEncryptionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains([]byte(sealed), []byte("PRIVATE KEY")) {
+		t.Fatal("expected the key encrypted")
+	}
+	if _, err := LoadAuthority(ca.CertificatePEM(), sealed, bytes.Repeat([]byte{8}, KeySize)); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("expected ErrDecrypt with another key, got %v", err)
+	}
+	ca, err = LoadAuthority(ca.CertificatePEM(), sealed, testEncryptionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Certificate)
+
+	serial, err := NewSerial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, err := ca.IssueClient(serial, "laptop", key, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(parsePEM(t, certPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.SerialNumber.Text(16) != serial || cert.Subject.CommonName != "laptop" {
+		t.Errorf("unexpected certificate %s %s", cert.SerialNumber.Text(16), cert.Subject.CommonName)
+	}
+	_, err = cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	if err != nil {
+		t.Errorf("expected a client certificate of the authority: %v", err)
+	}
+	_, err = cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+	if err == nil {
+		t.Error("expected the client certificate to be refused as a server certificate")
+	}
+
+	if _, err := ca.IssueServer("0", "node", key, now); err == nil {
+		t.Error("expected serial 0 to be refused")
+	}
+}
+
+func TestCRL(t *testing.T) {
+	now := time.Now()
+	ca, err := NewAuthority("Test CA", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revoked := []Revoked{{Serial: "0a", RevokedAt: now}, {Serial: "b", RevokedAt: now}, {Serial: "A", RevokedAt: now}}
+	crlPEM, err := ca.CRL(revoked, 3, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := x509.ParseRevocationList(parsePEM(t, crlPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crl.Number.Int64() != 3 || len(crl.RevokedCertificateEntries) != 2 {
+		t.Fatalf("expected CRL 3 with 2 entries, got %d with %d", crl.Number, len(crl.RevokedCertificateEntries))
+	}
+	if err := crl.CheckSignatureFrom(ca.Certificate); err != nil {
+		t.Fatal(err)
+	}
+
+	if !ca.CRLCurrent(crlPEM, revoked[:2], now.Add(time.Hour)) {
+		t.Error("expected the CRL current for the same serials")
+	}
+	if ca.CRLCurrent(crlPEM, append(revoked, Revoked{Serial: "c", RevokedAt: now}), now) {
+		t.Error("expected a new revocation to need a new CRL")
+	}
+	if ca.CRLCurrent(crlPEM, revoked, now.Add(CRLRefresh)) {
+		t.Error("expected an old CRL to need a refresh")
+	}
+
+	other, err := NewAuthority("Other CA", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.CRLCurrent(crlPEM, revoked, now) {
+		t.Error("expected the CRL of another authority to be refused")
+	}
+}
+
+func TestSeal(t *testing.T) {
+	sealed, err := Seal(testEncryptionKey, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := Open(testEncryptionKey, sealed)
+	if err != nil || string(plain) != "secret" {
+		t.Fatalf("expected the plaintext back, got %q, %v", plain, err)
+	}
+	if _, err := Open(testEncryptionKey, sealed[:len(sealed)-4]+"AAA="); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("expected a tampered ciphertext to fail, got %v", err)
+	}
+
+	if _, err := ParseEncryptionKey("c2hvcnQ="); err == nil {
+		t.Error("expected a short key to be refused")
+	}
+}
@@ -0,0 +1,177 @@
+package quota
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/config"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/notify"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/repository"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/usage"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/worker"
+)
+
+// lockKey is the advisory lock held while checking, so of several replicas
+// only one blocks and notifies users
+const lockKey int64 = 0x66617374_71756f74 // "fastquot"
+
+// Enforcer checks the usage of users against their data cap. It warns them at
+// WarnPercent, and at the cap blocks them until the cycle ends, which keeps
+// their peers off the nodes. A top-up or a raised cap lifts the block on the
+// next check.
+type Enforcer struct {
+	Repo repository.DatabaseRepo
+	// Notifier is nil when users are not to be notified
+	Notifier *notify.Notifier
+	Config   config.QuotaConfig
+	Logger   *slog.Logger
+}
+
+// NewEnforcer returns an Enforcer notifying through notifier
+func NewEnforcer(repo repository.DatabaseRepo, notifier *notify.Notifier, cfg config.QuotaConfig, logger *slog.Logger) *Enforcer {
+	return &Enforcer{
+		Repo:     repo,
+		Notifier: notifier,
+		Config:   cfg,
+		Logger:   logger,
+	}
+}
+
+// Run checks every user every Interval until ctx is done. It is meant to be
+// started on a worker.Group.
+func (e *Enforcer) Run(ctx context.Context) error {
+	return worker.Every(ctx, e.Config.Interval, func(ctx context.Context) {
+		n, err := e.RunOnce(ctx, time.Now())
+		if err != nil && ctx.Err() == nil {
+			e.Logger.ErrorContext(ctx, "quota check failed", "blocked", n, "error", err)
+		}
+	})
+}
+
+// RunOnce checks every user with an active subscription at now and returns how
+// many are blocked, unless another replica is checking them. A user that
+// cannot be checked is logged and skipped.
+func (e *Enforcer) RunOnce(ctx context.Context, now time.Time) (int, error) {
+	var blocked int
+	ran, err := e.Repo.WithLock(ctx, lockKey, func() error {
+		var err error
+		blocked, err = e.checkAll(ctx, now)
+		return err
+	})
+	if err == nil && !ran {
+		e.Logger.DebugContext(ctx, "quota check skipped, another replica is running it")
+	}
+	return blocked, err
+}
+
+// checkAll checks every user with an active subscription at now and returns
+// how many are blocked
+func (e *Enforcer) checkAll(ctx context.Context, now time.Time) (int, error) {
+	subscriptions, err := e.Repo.GetActiveSubscriptions(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("load active subscriptions: %w", err)
+	}
+
+	var blocked int
+	for _, sub := range subscriptions {
+		status, err := Load(ctx, e.Repo, sub, now)
+		if err == nil {
+			err = e.enforce(ctx, status, now)
+		}
+		if err != nil {
+			e.Logger.ErrorContext(ctx, "unable to check quota", "user_id", sub.UserID, "error", err)
+			continue
+		}
+		if status.Exceeded() {
+			blocked++
+		}
+	}
+
+	return blocked, nil
+}
+
+// Check checks the user right away, e.g. after a top-up or a changed
+// override, and returns the status. A user without an active subscription has
+// nothing to check and gets a zero Status.
+func (e *Enforcer) Check(ctx context.Context, userID int, now time.Time) (Status, error) {
+	sub, err := e.Repo.GetActiveSubscriptionByUserId(ctx, userID)
+	if err == sql.ErrNoRows {
+		return Status{}, nil
+	}
+	if err != nil {
+		return Status{}, fmt.Errorf("load active subscription: %w", err)
+	}
+
+	status, err := Load(ctx, e.Repo, sub, now)
+	if err != nil {
+		return Status{}, err
+	}
+
+	return status, e.enforce(ctx, status, now)
+}
+
+// enforce blocks or unblocks the user of status and sends the warnings due
+func (e *Enforcer) enforce(ctx context.Context, status Status, now time.Time) error {
+	userID := status.Subscription.UserID
+	capBytes := status.CapBytes()
+
+	if status.Exceeded() {
+		if !status.Quota.BlockedUntil.Equal(status.CycleEnd) {
+			err := e.Repo.SetUserQuotaBlock(ctx, userID, status.CycleEnd)
+			if err != nil {
+				return fmt.Errorf("block user: %w", err)
+			}
+			e.Logger.InfoContext(ctx, "user blocked over data cap", "user_id", userID,
+				"used_bytes", status.UsedBytes, "cap_bytes", capBytes, "until", status.CycleEnd)
+		}
+
+		e.notify(ctx, status, notify.EventQuotaExceeded, notify.QuotaExceeded{
+			Cap:      usage.FormatBytes(capBytes),
+			ResetsAt: status.CycleEnd,
+		})
+		return nil
+	}
+
+	if status.Quota.IsBlocked(now) {
+		err := e.Repo.SetUserQuotaBlock(ctx, userID, time.Time{})
+		if err != nil {
+			return fmt.Errorf("unblock user: %w", err)
+		}
+		e.Logger.InfoContext(ctx, "data cap block lifted", "user_id", userID,
+			"used_bytes", status.UsedBytes, "cap_bytes", capBytes)
+	}
+
+	if capBytes > 0 && status.Percent() >= WarnPercent {
+		e.notify(ctx, status, notify.EventQuotaWarning, notify.QuotaWarning{
+			Percent:  status.Percent(),
+			Used:     usage.FormatBytes(status.UsedBytes),
+			Cap:      usage.FormatBytes(capBytes),
+			ResetsAt: status.CycleEnd,
+		})
+	}
+
+	return nil
+}
+
+// notify sends event once per cycle and cap, so a top-up that raises the cap
+// warns again when the new cap runs low. A failure is logged, not returned.
+func (e *Enforcer) notify(ctx context.Context, status Status, event string, data any) {
+	if e.Notifier == nil {
+		return
+	}
+
+	userID := status.Subscription.UserID
+	err := e.Notifier.Notify(ctx, notify.Event{
+		UserID:    userID,
+		Name:      event,
+		Data:      data,
+		Link:      "/home",
+		DedupeKey: fmt.Sprintf("%s:%s:%d", event, status.CycleStart.Format("2006-01-02"), status.CapBytes()),
+	})
+	if err != nil {
+		e.Logger.ErrorContext(ctx, "unable to notify user about quota", "user_id", userID, "event", event, "error", err)
+	}
+}
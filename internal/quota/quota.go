@@ -0,0 +1,128 @@
+// Package quota enforces the data caps and device limits of plans over the
+// traffic accounted from the node agents
+package quota
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/repository"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/usage"
+)
+
+// WarnPercent is the share of the data cap at which users are warned
+const WarnPercent = 80
+
+// Limits are the limits that apply to a user; 0 leaves a limit off
+type Limits struct {
+	DataCapBytes int64
+	DeviceLimit  int
+}
+
+// Effective returns the limits of plan with the overrides in q applied
+func Effective(plan models.Plan, q models.UserQuota) Limits {
+	limits := Limits{DataCapBytes: plan.DataCapBytes, DeviceLimit: plan.DeviceLimit}
+	if q.DataCapBytes != models.QuotaFromPlan {
+		limits.DataCapBytes = q.DataCapBytes
+	}
+	if q.DeviceLimit != models.QuotaFromPlan {
+		limits.DeviceLimit = q.DeviceLimit
+	}
+	return limits
+}
+
+// Cycle returns the billing cycle of sub holding now. Cycles are a month long
+// and start at midnight UTC, the granularity of the daily usage buckets, of the
+// day the subscription started, or of the last day of shorter months; the last
+// one ends with the subscription.
+func Cycle(sub models.Subscription, now time.Time) (start, end time.Time) {
+	first := models.UsageBucket(models.UsageDay, sub.StartsAt)
+
+	start, end = first, addMonths(first, 1)
+	for months := 2; !end.After(now); months++ {
+		start, end = end, addMonths(first, months)
+	}
+
+	if sub.ExpiresAt.Before(end) {
+		end = sub.ExpiresAt
+	}
+	return start, end
+}
+
+// addMonths returns midnight t months later, clamped to the last day of the
+// month where AddDate would roll over into the next one
+func addMonths(t time.Time, months int) time.Time {
+	year, month, day := t.Date()
+	month += time.Month(months)
+	// day 0 of the following month is the last day of month
+	last := time.Date(year, month+1, 0, 0, 0, 0, 0, t.Location()).Day()
+	return time.Date(year, month, min(day, last), 0, 0, 0, 0, t.Location())
+}
+
+// Status is where a user stands against the data cap in the current cycle
+type Status struct {
+	Subscription models.Subscription
+	Quota        models.UserQuota
+	Limits       Limits
+	CycleStart   time.Time
+	CycleEnd     time.Time
+	UsedBytes    int64
+	// UploadBytes and DownloadBytes split UsedBytes into the traffic from and
+	// to the devices of the user
+	UploadBytes   int64
+	DownloadBytes int64
+	// TopUpBytes is the data bought on top of the cap for the cycle
+	TopUpBytes int64
+}
+
+// CapBytes returns the data the user may use in the cycle, top-ups included,
+// or 0 when the data is not capped
+func (s Status) CapBytes() int64 {
+	if s.Limits.DataCapBytes == 0 {
+		return 0
+	}
+	return s.Limits.DataCapBytes + s.TopUpBytes
+}
+
+// Percent returns how much of the cap is used, at most 100
+func (s Status) Percent() int {
+	capBytes := s.CapBytes()
+	if capBytes == 0 {
+		return 0
+	}
+	return int(min(s.UsedBytes*100/capBytes, 100))
+}
+
+// Exceeded reports whether the user used up the cap
+func (s Status) Exceeded() bool {
+	capBytes := s.CapBytes()
+	return capBytes > 0 && s.UsedBytes >= capBytes
+}
+
+// Load returns where the owner of sub stands against the data cap at now
+func Load(ctx context.Context, repo repository.DatabaseRepo, sub models.Subscription, now time.Time) (Status, error) {
+	q, err := repo.GetUserQuota(ctx, sub.UserID)
+	if err != nil {
+		return Status{}, fmt.Errorf("load quota: %w", err)
+	}
+
+	status := Status{Subscription: sub, Quota: q, Limits: Effective(sub.Plan, q)}
+	status.CycleStart, status.CycleEnd = Cycle(sub, now)
+
+	points, err := repo.GetUsageByUserId(ctx, sub.UserID, models.UsageDay, status.CycleStart)
+	if err != nil {
+		return Status{}, fmt.Errorf("load usage: %w", err)
+	}
+	total := usage.Total(points)
+	status.UsedBytes = total.RxBytes + total.TxBytes
+	status.UploadBytes, status.DownloadBytes = total.RxBytes, total.TxBytes
+
+	status.TopUpBytes, err = repo.SumTopUpBytes(ctx, sub.UserID, now)
+	if err != nil {
+		return Status{}, fmt.Errorf("load top-ups: %w", err)
+	}
+
+	return status, nil
+}
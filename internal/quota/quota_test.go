@@ -0,0 +1,180 @@
+package quota
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/config"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/email"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/notify"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/outbox"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/repository/dbrepo"
+)
+
+func TestCycle(t *testing.T) {
+	sub := models.Subscription{
+		StartsAt:  time.Date(2026, 1, 31, 18, 0, 0, 0, time.UTC),
+		ExpiresAt: time.Date(2026, 5, 15, 0, 0, 0, 0, time.UTC),
+	}
+
+	for _, tc := range []struct {
+		now        time.Time
+		start, end time.Time
+	}{
+		{
+			// February has no 31st, the cycle ends on its last day
+			now:   time.Date(2026, 2, 10, 0, 0, 0, 0, time.UTC),
+			start: time.Date(2026, 1, 31, 0, 0, 0, 0, time.UTC),
+			end:   time.Date(2026, 2, 28, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			// and the next one is back on the 31st
+			now:   time.Date(2026, 3, 3, 0, 0, 0, 0, time.UTC),
+			start: time.Date(2026, 2, 28, 0, 0, 0, 0, time.UTC),
+			end:   time.Date(2026, 3, 31, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			now:   time.Date(2026, 4, 15, 0, 0, 0, 0, time.UTC),
+			start: time.Date(2026, 3, 31, 0, 0, 0, 0, time.UTC),
+			end:   time.Date(2026, 4, 30, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			now:   time.Date(2026, 5, 5, 0, 0, 0, 0, time.UTC),
+			start: time.Date(2026, 4, 30, 0, 0, 0, 0, time.UTC),
+			end:   sub.ExpiresAt,
+		},
+	} {
+		start, end := Cycle(sub, tc.now)
+		if !start.Equal(tc.start) || !end.Equal(tc.end) {
+			t.Errorf("%s: expected %s to %s, got %s to %s", tc.now, tc.start, tc.end, start, end)
+		}
+	}
+}
+
+func TestEffective(t *testing.T) {
+	plan := models.Plan{DataCapBytes: 50_000_000_000, DeviceLimit: 3}
+
+	got := Effective(plan, models.UserQuota{DataCapBytes: models.QuotaFromPlan, DeviceLimit: models.QuotaFromPlan})
+	if got != (Limits{DataCapBytes: 50_000_000_000, DeviceLimit: 3}) {
+		t.Errorf("expected the plan's limits, got %+v", got)
+	}
+
+	got = Effective(plan, models.UserQuota{DataCapBytes: 0, DeviceLimit: models.QuotaFromPlan})
+	if got != (Limits{DataCapBytes: 0, DeviceLimit: 3}) {
+		t.Errorf("expected the data cap to be lifted, got %+v", got)
+	}
+}
+
+func TestEnforcer(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	repo := dbrepo.NewTestingRepo(&config.AppConfig{Logger: logger})
+
+	mailTemplates, err := email.ParseTemplates("../../templates/email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	templates, err := notify.ParseTemplates("../../templates/notifications")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := outbox.NewQueue(repo, config.Defaults().Outbox, logger)
+	notifier := notify.NewNotifier(repo, templates, email.NewService(queue, mailTemplates, "Fastnet VPN <no-reply@example.com>", logger), logger)
+	enforcer := NewEnforcer(repo, notifier, config.Defaults().Quota, logger)
+
+	userID, err := repo.AddUser(models.User{Username: "jane", Email: "jane@example.com"}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	planID := repo.AddPlan(models.Plan{Name: "Lite", DurationDays: 90, DataCapBytes: 1_000_000})
+	subID, err := repo.InsertSubscription(ctx, models.Subscription{
+		UserID: userID, PlanID: planID, Status: "active", StartsAt: now.AddDate(0, 0, -3), ExpiresAt: now.AddDate(0, 2, 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerID, err := repo.InsertVpnPeer(ctx, models.VpnPeer{UserID: userID, SubscriptionID: subID, PublicKey: "laptop", Address: "10.8.0.2/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	use := func(at time.Time, n int64) {
+		t.Helper()
+		if err := repo.AddPeerUsage(ctx, at, []models.PeerTraffic{{PeerID: peerID, TxBytes: n}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run := func() int {
+		t.Helper()
+		blocked, err := enforcer.RunOnce(ctx, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return blocked
+	}
+	events := func() map[string]int {
+		t.Helper()
+		feed, err := repo.GetNotificationsByUserId(ctx, userID, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts := map[string]int{}
+		for _, n := range feed {
+			counts[n.Event]++
+		}
+		return counts
+	}
+
+	// traffic before the cycle does not count
+	use(now.AddDate(0, -1, 0), 5_000_000)
+	use(now, 700_000)
+	if run() != 0 || len(events()) != 0 {
+		t.Fatalf("expected nothing below %d%%, got %v", WarnPercent, events())
+	}
+
+	use(now, 150_000)
+	run()
+	run()
+	if got := events(); got[notify.EventQuotaWarning] != 1 {
+		t.Fatalf("expected a single warning at 85%%, got %v", got)
+	}
+
+	use(now, 150_000)
+	if run() != 1 {
+		t.Fatal("expected the user to be blocked at the cap")
+	}
+	q, err := repo.GetUserQuota(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, cycleEnd := Cycle(models.Subscription{StartsAt: now.AddDate(0, 0, -3), ExpiresAt: now.AddDate(0, 2, 0)}, now)
+	if !q.BlockedUntil.Equal(cycleEnd) {
+		t.Fatalf("expected the block to last until %s, got %s", cycleEnd, q.BlockedUntil)
+	}
+	run()
+	if got := events(); got[notify.EventQuotaExceeded] != 1 {
+		t.Fatalf("expected a single exceeded notice, got %v", got)
+	}
+
+	packID := repo.AddTopUpPack(models.TopUpPack{Name: "1 MB", DataBytes: 1_000_000, PriceCents: 100, Currency: "USD"})
+	_, err = repo.InsertTopUp(ctx, models.TopUp{UserID: userID, SubscriptionID: subID, PackID: packID, DataBytes: 1_000_000, StartsAt: now, ExpiresAt: cycleEnd})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := enforcer.Check(ctx, userID, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err = repo.GetUserQuota(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Exceeded() || status.Percent() != 50 || q.IsBlocked(now) {
+		t.Fatalf("expected the top-up to lift the block, got %+v", status)
+	}
+}
@@ -4,21 +4,27 @@ import (
 	"bytes"
 	"fmt"
 	"html/template"
-	"log"
 	"net/http"
 	"path/filepath"
 
 	"github.com/bayramovrahman/fastnet_vpn_bot/internal/config"
 	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/repository"
 	"github.com/justinas/nosurf"
 )
 
 var app *config.AppConfig
+var db repository.DatabaseRepo
 var pathToTemplates = "./templates"
 
-// NewTemplates sets the config for the template package
-func NewTemplates(a *config.AppConfig) {
+// bellSize is how many notifications the bell in the top bar lists
+const bellSize = 5
+
+// NewTemplates sets the config for the template package and the repository
+// the notification bell is loaded from
+func NewTemplates(a *config.AppConfig, repo repository.DatabaseRepo) {
 	app = a
+	db = repo
 }
 
 func AddDefaultData(tmplData *models.TemplateData, r *http.Request) *models.TemplateData {
@@ -43,11 +49,37 @@ func AddDefaultData(tmplData *models.TemplateData, r *http.Request) *models.Temp
 		tmplData.StringMap["user_last_name"] = lastName
 		tmplData.StringMap["user_username"] = username
 		tmplData.StringMap["user_email"] = email
+
+		addNotifications(tmplData, r)
 	}
 
 	return tmplData
 }
 
+// addNotifications loads the notification bell of the signed-in user. A failure
+// only leaves the bell empty; the page itself still renders.
+func addNotifications(tmplData *models.TemplateData, r *http.Request) {
+	if db == nil {
+		return
+	}
+
+	userID := app.Session.GetInt(r.Context(), "user_id")
+
+	notifications, err := db.GetNotificationsByUserId(r.Context(), userID, bellSize)
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "unable to load notifications", "error", err)
+		return
+	}
+	unread, err := db.CountUnreadNotifications(r.Context(), userID)
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "unable to count unread notifications", "error", err)
+		return
+	}
+
+	tmplData.Notifications = notifications
+	tmplData.UnreadNotifications = unread
+}
+
 func Template(w http.ResponseWriter, r *http.Request, tmpl string, tmplData *models.TemplateData) error {
 	// get the template cache from the app config
 
@@ -62,20 +94,22 @@ func Template(w http.ResponseWriter, r *http.Request, tmpl string, tmplData *mod
 	// get requested template from cache
 	templ, ok := templateCache[tmpl]
 	if !ok {
-		log.Fatal("could not get template from template cache")
+		err := fmt.Errorf("could not get template %s from template cache", tmpl)
+		app.Logger.ErrorContext(r.Context(), "unable to render template", "template", tmpl, "error", err)
+		return err
 	}
 
 	buf := new(bytes.Buffer)
 	tmplData = AddDefaultData(tmplData, r)
 	err := templ.Execute(buf, tmplData)
 	if err != nil {
-		log.Println(err)
+		app.Logger.ErrorContext(r.Context(), "unable to execute template", "template", tmpl, "error", err)
 	}
 
 	// render the template
 	_, err = buf.WriteTo(w)
 	if err != nil {
-		log.Println(err)
+		app.Logger.ErrorContext(r.Context(), "unable to write template", "template", tmpl, "error", err)
 	}
 
 	return nil
@@ -1,20 +1,92 @@
 package dbrepo
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 
 	"github.com/bayramovrahman/fastnet_vpn_bot/internal/config"
 	"github.com/bayramovrahman/fastnet_vpn_bot/internal/repository"
 )
 
+// dbtx is the part of *sql.DB and *sql.Tx the repository queries through
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
 type postgresDBRepo struct {
-	App *config.AppConfig
-	DB  *sql.DB
+	App  *config.AppConfig
+	DB   dbtx
+	conn *sql.DB
 }
 
 func NewPostgresRepo(conn *sql.DB, a *config.AppConfig) repository.DatabaseRepo {
 	return &postgresDBRepo{
-		App: a,
-		DB:  conn,
+		App:  a,
+		DB:   conn,
+		conn: conn,
+	}
+}
+
+// WithTx runs fn with a repository bound to a single transaction, committing
+// when fn returns nil and rolling back otherwise. Calls made on a repository
+// that is already inside a transaction join it.
+func (m *postgresDBRepo) WithTx(ctx context.Context, fn func(repo repository.DatabaseRepo) error) error {
+	if m.conn == nil {
+		return fn(m)
 	}
+
+	tx, err := m.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = fn(&postgresDBRepo{App: m.App, DB: tx})
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// WithLock runs fn on the pool holding the pg_advisory_lock key on a
+// connection of its own, so of the replicas running the same background job
+// only one runs it at a time. A replica finding the lock taken skips fn and
+// reports false. Inside a transaction the lock is held until it ends.
+func (m *postgresDBRepo) WithLock(ctx context.Context, key int64, fn func() error) (bool, error) {
+	if m.conn == nil {
+		var locked bool
+		err := m.DB.QueryRowContext(ctx, `SELECT pg_try_advisory_xact_lock($1)`, key).Scan(&locked)
+		if err != nil || !locked {
+			return false, err
+		}
+		return true, fn()
+	}
+
+	conn, err := m.conn.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	var locked bool
+	err = conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, key).Scan(&locked)
+	if err != nil {
+		return false, fmt.Errorf("acquire lock %x: %w", key, err)
+	}
+	if !locked {
+		return false, nil
+	}
+	defer func() {
+		// use a fresh context so the lock is released even if ctx was cancelled
+		_, err := conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, key)
+		if err != nil {
+			m.App.Logger.Error("release advisory lock", "key", key, "error", err)
+		}
+	}()
+
+	return true, fn()
 }
@@ -4,9 +4,12 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/tokens"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -14,8 +17,8 @@ func (m *postgresDBRepo) AllUsers() bool {
 	return true
 }
 
-func (m *postgresDBRepo) GetUserById(id int) (models.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) GetUserById(ctx context.Context, id int) (models.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	query := `select id, username, first_name, last_name, email, password, is_verified, is_admin, access_level, signup_ip, signup_country, created_at, updated_at
@@ -48,11 +51,12 @@ func (m *postgresDBRepo) GetUserById(id int) (models.User, error) {
 }
 
 // UpdateUser updates a user in the database
-func (m *postgresDBRepo) UpdateUser(user models.User) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) UpdateUser(ctx context.Context, user models.User) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	query := `update users set first_name = $1, last_name = $2, email = $3, access_level = $4, updated_at = $5`
+	query := `update users set first_name = $1, last_name = $2, email = $3, access_level = $4, updated_at = $5
+			  where id = $6`
 
 	_, err := m.DB.ExecContext(ctx, query,
 		user.FirstName,
@@ -60,6 +64,7 @@ func (m *postgresDBRepo) UpdateUser(user models.User) error {
 		user.Email,
 		user.AccessLevel,
 		time.Now(),
+		user.ID,
 	)
 
 	if err != nil {
@@ -70,8 +75,8 @@ func (m *postgresDBRepo) UpdateUser(user models.User) error {
 }
 
 // Authenticate authenticates a user
-func (m *postgresDBRepo) Authenticate(email, testPassword string) (int, string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) Authenticate(ctx context.Context, email, testPassword string) (int, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	query := `select id, password from users where email = $1`
@@ -96,64 +101,65 @@ func (m *postgresDBRepo) Authenticate(email, testPassword string) (int, string,
 	return id, hashedPassword, nil
 }
 
-// GetUserLoginSecurity gets user login security settings by user ID
-func (m *postgresDBRepo) GetUserLoginSecurity(userID int) (models.UserLoginSecurity, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// GetAdminUserIds returns the IDs of the admin users
+func (m *postgresDBRepo) GetAdminUserIds(ctx context.Context) ([]int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	query := `SELECT id, user_id, email_verification, phone_verification, multi_factor_auth, 
-			  COALESCE(verification_code, ''), COALESCE(code_expires_at, '0001-01-01'), 
-			  COALESCE(phone_number, ''), COALESCE(last_verification_sent_at, '0001-01-01'),
-			  failed_attempts, COALESCE(locked_until, '0001-01-01'), created_at, updated_at
-			  FROM user_login_security WHERE user_id = $1`
-
-	row := m.DB.QueryRowContext(ctx, query, userID)
+	query := `SELECT id FROM users WHERE is_admin ORDER BY id`
 
-	var security models.UserLoginSecurity
-	err := row.Scan(
-		&security.ID,
-		&security.UserID,
-		&security.EmailVerification,
-		&security.PhoneVerification,
-		&security.MultiFactorAuth,
-		&security.VerificationCode,
-		&security.CodeExpiresAt,
-		&security.PhoneNumber,
-		&security.LastVerificationSentAt,
-		&security.FailedAttempts,
-		&security.LockedUntil,
-		&security.CreatedAt,
-		&security.UpdatedAt,
-	)
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	if err == sql.ErrNoRows {
-		security = models.UserLoginSecurity{
-			UserID:            userID,
-			EmailVerification: false,
-			PhoneVerification: false,
-			MultiFactorAuth:   false,
-			FailedAttempts:    0,
-			CreatedAt:         time.Now(),
-			UpdatedAt:         time.Now(),
-		}
-		err = m.CreateUserLoginSecurity(security)
+	var ids []int
+	for rows.Next() {
+		var id int
+		err := rows.Scan(&id)
 		if err != nil {
-			return security, err
+			return nil, err
 		}
-		
-		return m.GetUserLoginSecurity(userID)
+		ids = append(ids, id)
 	}
 
-	if err != nil {
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// GetUserLoginSecurity gets user login security settings by user ID, creating
+// the default row on first use. The create is a single upsert returning the row,
+// so concurrent first requests for the same user agree on one row.
+func (m *postgresDBRepo) GetUserLoginSecurity(ctx context.Context, userID int) (models.UserLoginSecurity, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	columns := `id, user_id, email_verification, phone_verification, multi_factor_auth,
+			  COALESCE(verification_code, ''), COALESCE(code_expires_at, '0001-01-01'),
+			  COALESCE(phone_number, ''), COALESCE(last_verification_sent_at, '0001-01-01'),
+			  failed_attempts, COALESCE(locked_until, '0001-01-01'), created_at, updated_at`
+
+	security, err := scanUserLoginSecurity(m.DB.QueryRowContext(ctx,
+		`SELECT `+columns+` FROM user_login_security WHERE user_id = $1`, userID))
+	if err != sql.ErrNoRows {
 		return security, err
 	}
 
-	return security, nil
+	query := `INSERT INTO user_login_security (user_id, created_at, updated_at)
+			  VALUES ($1, $2, $2)
+			  ON CONFLICT (user_id) DO UPDATE SET user_id = excluded.user_id
+			  RETURNING ` + columns
+
+	return scanUserLoginSecurity(m.DB.QueryRowContext(ctx, query, userID, time.Now()))
 }
 
 // UpdateUserLoginSecurity updates user login security settings
-func (m *postgresDBRepo) UpdateUserLoginSecurity(security models.UserLoginSecurity) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) UpdateUserLoginSecurity(ctx context.Context, security models.UserLoginSecurity) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	query := `UPDATE user_login_security 
@@ -181,8 +187,8 @@ func (m *postgresDBRepo) UpdateUserLoginSecurity(security models.UserLoginSecuri
 }
 
 // CreateUserLoginSecurity creates new user login security settings
-func (m *postgresDBRepo) CreateUserLoginSecurity(security models.UserLoginSecurity) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) CreateUserLoginSecurity(ctx context.Context, security models.UserLoginSecurity) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	query := `INSERT INTO user_login_security 
@@ -201,3 +207,2265 @@ func (m *postgresDBRepo) CreateUserLoginSecurity(security models.UserLoginSecuri
 
 	return err
 }
+
+// GetPlans returns the plans on sale, cheapest first
+func (m *postgresDBRepo) GetPlans(ctx context.Context) ([]models.Plan, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + planColumns + ` FROM plans ORDER BY price_cents, id`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var plans []models.Plan
+	for rows.Next() {
+		p, err := scanPlan(rows)
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return plans, nil
+}
+
+// GetPlanById returns a plan by ID
+func (m *postgresDBRepo) GetPlanById(ctx context.Context, id int) (models.Plan, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + planColumns + ` FROM plans WHERE id = $1`
+
+	return scanPlan(m.DB.QueryRowContext(ctx, query, id))
+}
+
+// InsertSubscription inserts a new subscription and returns its ID
+func (m *postgresDBRepo) InsertSubscription(ctx context.Context, subscription models.Subscription) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `INSERT INTO subscriptions
+			  (user_id, plan_id, status, starts_at, expires_at, created_at, updated_at)
+			  VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, query,
+		subscription.UserID,
+		subscription.PlanID,
+		subscription.Status,
+		subscription.StartsAt,
+		subscription.ExpiresAt,
+		time.Now(),
+		time.Now(),
+	).Scan(&id)
+
+	return id, err
+}
+
+const subscriptionColumns = `s.id, s.user_id, s.plan_id, s.status, s.starts_at, s.expires_at, s.created_at, s.updated_at,
+			  p.id, p.name, p.price_cents, p.currency, p.duration_days, p.data_cap_bytes, p.device_limit,
+			  p.key_rotation_days, p.key_grace_hours, array_to_string(p.protocols, ','), p.created_at, p.updated_at`
+
+// GetSubscriptionsByUserId returns all subscriptions of a user, newest first
+func (m *postgresDBRepo) GetSubscriptionsByUserId(ctx context.Context, userID int) ([]models.Subscription, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + subscriptionColumns + `
+			  FROM subscriptions s
+			  LEFT JOIN plans p ON (p.id = s.plan_id)
+			  WHERE s.user_id = $1
+			  ORDER BY s.starts_at DESC`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subscriptions []models.Subscription
+	for rows.Next() {
+		s, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return subscriptions, nil
+}
+
+// GetActiveSubscriptionByUserId returns the subscription of a user that expires last among the active ones
+func (m *postgresDBRepo) GetActiveSubscriptionByUserId(ctx context.Context, userID int) (models.Subscription, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + subscriptionColumns + `
+			  FROM subscriptions s
+			  LEFT JOIN plans p ON (p.id = s.plan_id)
+			  WHERE s.user_id = $1 AND s.status = 'active' AND s.starts_at <= $2 AND s.expires_at > $2
+			  ORDER BY s.expires_at DESC
+			  LIMIT 1`
+
+	return scanSubscription(m.DB.QueryRowContext(ctx, query, userID, time.Now()))
+}
+
+// GetActiveSubscriptions returns the active subscription of every user that has
+// one, picking the one that expires last like GetActiveSubscriptionByUserId
+func (m *postgresDBRepo) GetActiveSubscriptions(ctx context.Context) ([]models.Subscription, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT DISTINCT ON (s.user_id) ` + subscriptionColumns + `
+			  FROM subscriptions s
+			  LEFT JOIN plans p ON (p.id = s.plan_id)
+			  WHERE s.status = 'active' AND s.starts_at <= $1 AND s.expires_at > $1
+			  ORDER BY s.user_id, s.expires_at DESC`
+
+	rows, err := m.DB.QueryContext(ctx, query, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subscriptions []models.Subscription
+	for rows.Next() {
+		s, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return subscriptions, nil
+}
+
+// CountActiveSubscriptions counts subscriptions that are active right now
+func (m *postgresDBRepo) CountActiveSubscriptions(ctx context.Context) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT count(*) FROM subscriptions
+			  WHERE status = 'active' AND starts_at <= $1 AND expires_at > $1`
+
+	var count int
+	err := m.DB.QueryRowContext(ctx, query, time.Now()).Scan(&count)
+	return count, err
+}
+
+// GetSubscriptionsExpiringBetween returns the active subscriptions that expire
+// in [from, to) and are not followed by a later active subscription of the same
+// user, i.e. those whose owner will be left without service
+func (m *postgresDBRepo) GetSubscriptionsExpiringBetween(ctx context.Context, from, to time.Time) ([]models.Subscription, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + subscriptionColumns + `
+			  FROM subscriptions s
+			  LEFT JOIN plans p ON (p.id = s.plan_id)
+			  WHERE s.status = 'active' AND s.expires_at >= $1 AND s.expires_at < $2
+			  AND NOT EXISTS (
+				  SELECT 1 FROM subscriptions later
+				  WHERE later.user_id = s.user_id AND later.status = 'active' AND later.expires_at > s.expires_at
+			  )
+			  ORDER BY s.expires_at`
+
+	rows, err := m.DB.QueryContext(ctx, query, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subscriptions []models.Subscription
+	for rows.Next() {
+		s, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return subscriptions, nil
+}
+
+// LockSubscription holds a row lock on the subscription until the transaction
+// ends, so a check of its peers and the insert that follows it cannot
+// interleave with another caller's. Call it inside WithTx.
+func (m *postgresDBRepo) LockSubscription(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var locked int
+	return m.DB.QueryRowContext(ctx, `SELECT id FROM subscriptions WHERE id = $1 FOR UPDATE`, id).Scan(&locked)
+}
+
+const vpnPeerColumns = `id, user_id, subscription_id, COALESCE(node_id, 0), name, protocol, public_key, private_key, preshared_key, address,
+			  certificate, COALESCE(revoked_at, '0001-01-01'), COALESCE(last_handshake_at, '0001-01-01'), rx_counter, tx_counter,
+			  keys_rotated_at, created_at, updated_at`
+
+// GetVpnPeersByUserId returns all VPN peers of a user, including revoked ones
+func (m *postgresDBRepo) GetVpnPeersByUserId(ctx context.Context, userID int) ([]models.VpnPeer, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + vpnPeerColumns + `
+			  FROM vpn_peers WHERE user_id = $1 ORDER BY id`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var peers []models.VpnPeer
+	for rows.Next() {
+		p, err := scanVpnPeer(rows)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return peers, nil
+}
+
+// GetVpnPeerById returns a VPN peer by ID
+func (m *postgresDBRepo) GetVpnPeerById(ctx context.Context, id int) (models.VpnPeer, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + vpnPeerColumns + `
+			  FROM vpn_peers WHERE id = $1`
+
+	return scanVpnPeer(m.DB.QueryRowContext(ctx, query, id))
+}
+
+// GetVpnPeerAddresses returns the addresses held by peers on the node that are
+// not revoked, and by their old keys still in a grace window. Node 0 is the
+// default server.
+func (m *postgresDBRepo) GetVpnPeerAddresses(ctx context.Context, nodeID int) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT address FROM vpn_peers WHERE revoked_at IS NULL AND COALESCE(node_id, 0) = $1 AND address <> ''
+			  UNION
+			  SELECT address FROM vpn_key_revocations WHERE serve_until > $2 AND COALESCE(node_id, 0) = $1 AND address <> ''`
+
+	rows, err := m.DB.QueryContext(ctx, query, nodeID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var addresses []string
+	for rows.Next() {
+		var address string
+		if err := rows.Scan(&address); err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, address)
+	}
+
+	return addresses, rows.Err()
+}
+
+// peerAddressLock is the class of the advisory locks serialising the address
+// allocation of each node
+const peerAddressLock int32 = 0x70656572 // "peer"
+
+// LockVpnPeerAddresses holds the address allocation lock of the node until the
+// transaction ends, so two callers cannot pick the same free address. Call it
+// inside WithTx before GetVpnPeerAddresses. Node 0 is the default server, which
+// has no row to lock, hence an advisory lock.
+func (m *postgresDBRepo) LockVpnPeerAddresses(ctx context.Context, nodeID int) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1, $2)`, peerAddressLock, nodeID)
+	return err
+}
+
+// InsertVpnPeer inserts a new VPN peer and returns its ID
+func (m *postgresDBRepo) InsertVpnPeer(ctx context.Context, peer models.VpnPeer) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `INSERT INTO vpn_peers
+			  (user_id, subscription_id, node_id, name, protocol, public_key, private_key, preshared_key, address, keys_rotated_at, created_at, updated_at)
+			  VALUES ($1, $2, $3, $4, COALESCE(NULLIF($5, ''), 'wireguard'), $6, $7, $8, $9, $10, $10, $10) RETURNING id`
+
+	var nodeID sql.NullInt64
+	if peer.NodeID != 0 {
+		nodeID = sql.NullInt64{Int64: int64(peer.NodeID), Valid: true}
+	}
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, query,
+		peer.UserID,
+		peer.SubscriptionID,
+		nodeID,
+		peer.Name,
+		peer.Protocol,
+		peer.PublicKey,
+		peer.PrivateKey,
+		peer.PresharedKey,
+		peer.Address,
+		time.Now(),
+	).Scan(&id)
+
+	return id, err
+}
+
+// RevokeVpnPeer marks a VPN peer as revoked and adds its keys to the
+// revocation list, for its node agent to confirm them gone
+func (m *postgresDBRepo) RevokeVpnPeer(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `WITH peer AS (
+				  UPDATE vpn_peers SET revoked_at = $1, updated_at = $1 WHERE id = $2 AND revoked_at IS NULL
+				  RETURNING id, node_id, public_key, preshared_key, address, rx_counter, tx_counter
+			  )
+			  INSERT INTO vpn_key_revocations
+			  (peer_id, node_id, public_key, preshared_key, address, reason, rx_counter, tx_counter, serve_until, created_at)
+			  SELECT id, node_id, public_key, preshared_key, address, $3, rx_counter, tx_counter, $1, $1 FROM peer`
+
+	_, err := m.DB.ExecContext(ctx, query, time.Now(), id, models.KeysRevoked)
+	return err
+}
+
+// RenameVpnPeer renames a VPN peer
+func (m *postgresDBRepo) RenameVpnPeer(ctx context.Context, id int, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `UPDATE vpn_peers SET name = $1, updated_at = $2 WHERE id = $3`
+
+	_, err := m.DB.ExecContext(ctx, query, name, time.Now(), id)
+	return err
+}
+
+// MoveVpnPeer places a VPN peer that has not been revoked on another node with
+// address, keeping its keys. The new node knows nothing of the peer, so its
+// counters and handshake are reset.
+func (m *postgresDBRepo) MoveVpnPeer(ctx context.Context, id, nodeID int, address string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `UPDATE vpn_peers
+			  SET node_id = $1, address = $2, last_handshake_at = NULL, rx_counter = 0, tx_counter = 0, updated_at = $3
+			  WHERE id = $4 AND revoked_at IS NULL`
+
+	result, err := m.DB.ExecContext(ctx, query, nodeID, address, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// UpdateVpnPeerKeys stores new keys and address for a VPN peer that has not
+// been revoked. The node serves the new public key as a new peer, so the
+// counters and the handshake of the old one are reset, and the certificate
+// of the old key is dropped.
+func (m *postgresDBRepo) UpdateVpnPeerKeys(ctx context.Context, peer models.VpnPeer) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `UPDATE vpn_peers
+			  SET public_key = $1, private_key = $2, preshared_key = $3, address = $4, certificate = '',
+				  last_handshake_at = NULL, rx_counter = 0, tx_counter = 0, keys_rotated_at = $5, updated_at = $5
+			  WHERE id = $6 AND revoked_at IS NULL`
+
+	result, err := m.DB.ExecContext(ctx, query, peer.PublicKey, peer.PrivateKey, peer.PresharedKey, peer.Address, time.Now(), peer.ID)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// CountActiveVpnPeers counts VPN peers that have not been revoked
+func (m *postgresDBRepo) CountActiveVpnPeers(ctx context.Context) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var count int
+	err := m.DB.QueryRowContext(ctx, `SELECT count(*) FROM vpn_peers WHERE revoked_at IS NULL`).Scan(&count)
+	return count, err
+}
+
+// GetServedVpnPeersByNodeId returns the peers the node should serve: those on
+// it that are not revoked, whose subscription is active and whose owner is not
+// blocked over the data cap, in ID order
+func (m *postgresDBRepo) GetServedVpnPeersByNodeId(ctx context.Context, nodeID int) ([]models.VpnPeer, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + vpnPeerColumns + `
+			  FROM vpn_peers
+			  WHERE node_id = $1 AND revoked_at IS NULL AND subscription_id IN (
+				  SELECT id FROM subscriptions WHERE status = 'active' AND starts_at <= $2 AND expires_at > $2
+			  )
+			  AND user_id NOT IN (SELECT user_id FROM user_quotas WHERE blocked_until > $2)
+			  ORDER BY id`
+
+	rows, err := m.DB.QueryContext(ctx, query, nodeID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var peers []models.VpnPeer
+	for rows.Next() {
+		p, err := scanVpnPeer(rows)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return peers, nil
+}
+
+// UpdateVpnPeerHandshakes records the latest handshake of peers on the node,
+// keyed by public key. Keys of peers not on the node are ignored.
+func (m *postgresDBRepo) UpdateVpnPeerHandshakes(ctx context.Context, nodeID int, handshakes map[string]time.Time) error {
+	if len(handshakes) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	keys := make([]string, 0, len(handshakes))
+	times := make([]time.Time, 0, len(handshakes))
+	for key, at := range handshakes {
+		keys = append(keys, key)
+		times = append(times, at)
+	}
+
+	query := `UPDATE vpn_peers p SET last_handshake_at = h.at
+			  FROM unnest($2::text[], $3::timestamp[]) AS h (public_key, at)
+			  WHERE p.node_id = $1 AND p.public_key = h.public_key
+			  AND p.last_handshake_at IS DISTINCT FROM h.at`
+
+	_, err := m.DB.ExecContext(ctx, query, nodeID, keys, times)
+
+	return err
+}
+
+// GetActiveVpnPeersByNodeId returns the unrevoked VPN peers on a node, whether
+// or not they are still served
+func (m *postgresDBRepo) GetActiveVpnPeersByNodeId(ctx context.Context, nodeID int) ([]models.VpnPeer, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + vpnPeerColumns + `
+			  FROM vpn_peers WHERE node_id = $1 AND revoked_at IS NULL ORDER BY id`
+
+	rows, err := m.DB.QueryContext(ctx, query, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var peers []models.VpnPeer
+	for rows.Next() {
+		p, err := scanVpnPeer(rows)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return peers, nil
+}
+
+// UpdateVpnPeerCounters stores the interface byte counters last reported for
+// peers, given as PeerTraffic
+func (m *postgresDBRepo) UpdateVpnPeerCounters(ctx context.Context, counters []models.PeerTraffic) error {
+	if len(counters) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ids, rx, tx := splitPeerTraffic(counters)
+
+	query := `UPDATE vpn_peers p SET rx_counter = c.rx, tx_counter = c.tx
+			  FROM unnest($1::integer[], $2::bigint[], $3::bigint[]) AS c (id, rx, tx)
+			  WHERE p.id = c.id`
+
+	_, err := m.DB.ExecContext(ctx, query, ids, rx, tx)
+
+	return err
+}
+
+const keyRevocationColumns = `r.id, r.peer_id, COALESCE(r.node_id, 0), r.public_key, r.preshared_key, r.address, r.reason,
+			  r.rx_counter, r.tx_counter, r.serve_until, COALESCE(r.confirmed_at, '0001-01-01'), r.created_at, p.name, p.protocol`
+
+// InsertKeyRevocation adds keys taken off a peer to the revocation list and
+// returns the ID of the entry
+func (m *postgresDBRepo) InsertKeyRevocation(ctx context.Context, r models.KeyRevocation) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `INSERT INTO vpn_key_revocations
+			  (peer_id, node_id, public_key, preshared_key, address, reason, rx_counter, tx_counter, serve_until, created_at)
+			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id`
+
+	var nodeID sql.NullInt64
+	if r.NodeID != 0 {
+		nodeID = sql.NullInt64{Int64: int64(r.NodeID), Valid: true}
+	}
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, query,
+		r.PeerID,
+		nodeID,
+		r.PublicKey,
+		r.PresharedKey,
+		r.Address,
+		r.Reason,
+		r.RxCounter,
+		r.TxCounter,
+		r.ServeUntil,
+		time.Now(),
+	).Scan(&id)
+
+	return id, err
+}
+
+// GetKeyRevocationsByUserId returns the latest limit keys taken off the peers
+// of a user, newest first
+func (m *postgresDBRepo) GetKeyRevocationsByUserId(ctx context.Context, userID, limit int) ([]models.KeyRevocation, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + keyRevocationColumns + `
+			  FROM vpn_key_revocations r
+			  JOIN vpn_peers p ON (p.id = r.peer_id)
+			  WHERE p.user_id = $1
+			  ORDER BY r.id DESC
+			  LIMIT $2`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revocations []models.KeyRevocation
+	for rows.Next() {
+		r, err := scanKeyRevocation(rows)
+		if err != nil {
+			return nil, err
+		}
+		revocations = append(revocations, r)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return revocations, nil
+}
+
+// GetServedKeyRevocationsByNodeId returns the old keys the node serves next to
+// the current ones: those in a grace window of peers the node serves
+func (m *postgresDBRepo) GetServedKeyRevocationsByNodeId(ctx context.Context, nodeID int) ([]models.KeyRevocation, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + keyRevocationColumns + `
+			  FROM vpn_key_revocations r
+			  JOIN vpn_peers p ON (p.id = r.peer_id)
+			  WHERE r.node_id = $1 AND r.serve_until > $2 AND p.revoked_at IS NULL AND p.subscription_id IN (
+				  SELECT id FROM subscriptions WHERE status = 'active' AND starts_at <= $2 AND expires_at > $2
+			  )
+			  AND p.user_id NOT IN (SELECT user_id FROM user_quotas WHERE blocked_until > $2)
+			  ORDER BY r.id`
+
+	rows, err := m.DB.QueryContext(ctx, query, nodeID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revocations []models.KeyRevocation
+	for rows.Next() {
+		r, err := scanKeyRevocation(rows)
+		if err != nil {
+			return nil, err
+		}
+		revocations = append(revocations, r)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return revocations, nil
+}
+
+// GetPendingKeyRevocationsByNodeId returns the revoked keys on the node that
+// its agent has not confirmed gone yet, served or not
+func (m *postgresDBRepo) GetPendingKeyRevocationsByNodeId(ctx context.Context, nodeID int) ([]models.KeyRevocation, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + keyRevocationColumns + `
+			  FROM vpn_key_revocations r
+			  JOIN vpn_peers p ON (p.id = r.peer_id)
+			  WHERE r.node_id = $1 AND r.confirmed_at IS NULL
+			  ORDER BY r.id`
+
+	rows, err := m.DB.QueryContext(ctx, query, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revocations []models.KeyRevocation
+	for rows.Next() {
+		r, err := scanKeyRevocation(rows)
+		if err != nil {
+			return nil, err
+		}
+		revocations = append(revocations, r)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return revocations, nil
+}
+
+// UpdateKeyRevocationCounters stores the interface byte counters last reported
+// for revoked keys, given as PeerTraffic holding the ID of the revocation
+func (m *postgresDBRepo) UpdateKeyRevocationCounters(ctx context.Context, counters []models.PeerTraffic) error {
+	if len(counters) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ids, rx, tx := splitPeerTraffic(counters)
+
+	query := `UPDATE vpn_key_revocations r SET rx_counter = c.rx, tx_counter = c.tx
+			  FROM unnest($1::integer[], $2::bigint[], $3::bigint[]) AS c (id, rx, tx)
+			  WHERE r.id = c.id`
+
+	_, err := m.DB.ExecContext(ctx, query, ids, rx, tx)
+
+	return err
+}
+
+// ConfirmKeyRevocations marks the revoked keys on the node that are past their
+// grace window and not among present, the keys on its interface, as gone. It
+// returns how many it confirmed.
+func (m *postgresDBRepo) ConfirmKeyRevocations(ctx context.Context, nodeID int, present []string, at time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	if present == nil {
+		present = []string{}
+	}
+
+	query := `UPDATE vpn_key_revocations SET confirmed_at = $3
+			  WHERE node_id = $1 AND confirmed_at IS NULL AND serve_until <= $3 AND public_key <> ALL($2::text[])`
+
+	result, err := m.DB.ExecContext(ctx, query, nodeID, present, at)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+// AddPeerUsage adds traffic to the hour, day and month usage buckets holding
+// at. Each peer may appear in traffic only once.
+func (m *postgresDBRepo) AddPeerUsage(ctx context.Context, at time.Time, traffic []models.PeerTraffic) error {
+	if len(traffic) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ids, rx, tx := splitPeerTraffic(traffic)
+	starts := make([]time.Time, 0, len(models.UsagePeriods))
+	for _, period := range models.UsagePeriods {
+		starts = append(starts, models.UsageBucket(period, at))
+	}
+
+	query := `INSERT INTO peer_usage (peer_id, period, bucket_start, rx_bytes, tx_bytes)
+			  SELECT t.peer_id, b.period, b.bucket_start, t.rx_bytes, t.tx_bytes
+			  FROM unnest($1::integer[], $2::bigint[], $3::bigint[]) AS t (peer_id, rx_bytes, tx_bytes)
+			  CROSS JOIN unnest($4::text[], $5::timestamp[]) AS b (period, bucket_start)
+			  ON CONFLICT (peer_id, period, bucket_start) DO UPDATE
+			  SET rx_bytes = peer_usage.rx_bytes + EXCLUDED.rx_bytes,
+				  tx_bytes = peer_usage.tx_bytes + EXCLUDED.tx_bytes`
+
+	_, err := m.DB.ExecContext(ctx, query, ids, rx, tx, models.UsagePeriods, starts)
+
+	return err
+}
+
+// GetUsageByUserId returns the traffic of all peers of a user per period
+// bucket, for the buckets starting at or after from. Buckets without traffic
+// are left out.
+func (m *postgresDBRepo) GetUsageByUserId(ctx context.Context, userID int, period string, from time.Time) ([]models.UsagePoint, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT u.bucket_start, SUM(u.rx_bytes)::bigint, SUM(u.tx_bytes)::bigint
+			  FROM peer_usage u
+			  JOIN vpn_peers p ON p.id = u.peer_id
+			  WHERE p.user_id = $1 AND u.period = $2 AND u.bucket_start >= $3
+			  GROUP BY u.bucket_start
+			  ORDER BY u.bucket_start`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, period, from.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var points []models.UsagePoint
+	for rows.Next() {
+		var p models.UsagePoint
+		if err := rows.Scan(&p.BucketStart, &p.RxBytes, &p.TxBytes); err != nil {
+			return nil, err
+		}
+		p.BucketStart = p.BucketStart.UTC()
+		points = append(points, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return points, nil
+}
+
+// GetPeerTrafficByUserId returns the traffic of each peer of a user in the
+// period buckets starting at or after from. Peers without traffic are left out.
+func (m *postgresDBRepo) GetPeerTrafficByUserId(ctx context.Context, userID int, period string, from time.Time) ([]models.PeerTraffic, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT u.peer_id, SUM(u.rx_bytes)::bigint, SUM(u.tx_bytes)::bigint
+			  FROM peer_usage u
+			  JOIN vpn_peers p ON p.id = u.peer_id
+			  WHERE p.user_id = $1 AND u.period = $2 AND u.bucket_start >= $3
+			  GROUP BY u.peer_id
+			  ORDER BY u.peer_id`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, period, from.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var traffic []models.PeerTraffic
+	for rows.Next() {
+		var t models.PeerTraffic
+		if err := rows.Scan(&t.PeerID, &t.RxBytes, &t.TxBytes); err != nil {
+			return nil, err
+		}
+		traffic = append(traffic, t)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return traffic, nil
+}
+
+// DeletePeerUsageBefore deletes the period buckets starting before before and
+// returns how many it deleted
+func (m *postgresDBRepo) DeletePeerUsageBefore(ctx context.Context, period string, before time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `DELETE FROM peer_usage WHERE period = $1 AND bucket_start < $2`
+
+	result, err := m.DB.ExecContext(ctx, query, period, before.UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := result.RowsAffected()
+
+	return int(n), err
+}
+
+// splitProtocols splits the comma-separated protocols of a plan
+func splitProtocols(protocols string) []string {
+	if protocols == "" {
+		return nil
+	}
+	return strings.Split(protocols, ",")
+}
+
+// splitPeerTraffic returns the columns of traffic as arrays for unnest
+func splitPeerTraffic(traffic []models.PeerTraffic) (ids []int, rx, tx []int64) {
+	for _, t := range traffic {
+		ids = append(ids, t.PeerID)
+		rx = append(rx, t.RxBytes)
+		tx = append(tx, t.TxBytes)
+	}
+	return ids, rx, tx
+}
+
+const vpnNodeColumns = `n.id, n.name, n.country, n.endpoint, n.public_key, n.subnet, n.capacity, n.state,
+			  n.vless_port, n.reality_server_name, n.reality_private_key, n.reality_public_key, n.reality_short_id,
+			  n.shadowsocks_port, n.shadowsocks_key, n.openvpn_port, n.openvpn_certificate, n.openvpn_private_key,
+			  (SELECT count(*) FROM vpn_peers p WHERE p.node_id = n.id AND p.revoked_at IS NULL),
+			  COALESCE(n.agent_seen_at, '0001-01-01'), COALESCE(n.agent_applied_at, '0001-01-01'), n.agent_peers, n.agent_error,
+			  (SELECT COALESCE(max(p.last_handshake_at), '0001-01-01') FROM vpn_peers p WHERE p.node_id = n.id AND p.revoked_at IS NULL),
+			  n.health, n.health_reason, n.health_failures,
+			  COALESCE(n.health_checked_at, '0001-01-01'), COALESCE(n.health_changed_at, '0001-01-01'),
+			  n.created_at, n.updated_at`
+
+// GetVpnNodes returns every VPN node with its active peer count, by country and name
+func (m *postgresDBRepo) GetVpnNodes(ctx context.Context) ([]models.VpnNode, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + vpnNodeColumns + ` FROM vpn_nodes n ORDER BY n.country, n.name`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var nodes []models.VpnNode
+	for rows.Next() {
+		n, err := scanVpnNode(rows)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return nodes, nil
+}
+
+// GetVpnNodeById returns a VPN node by ID
+func (m *postgresDBRepo) GetVpnNodeById(ctx context.Context, id int) (models.VpnNode, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + vpnNodeColumns + ` FROM vpn_nodes n WHERE n.id = $1`
+
+	return scanVpnNode(m.DB.QueryRowContext(ctx, query, id))
+}
+
+// InsertVpnNode inserts a new VPN node and returns its ID
+func (m *postgresDBRepo) InsertVpnNode(ctx context.Context, node models.VpnNode) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `INSERT INTO vpn_nodes (name, country, endpoint, public_key, subnet, capacity, state,
+				  vless_port, reality_server_name, reality_private_key, reality_public_key, reality_short_id,
+				  shadowsocks_port, shadowsocks_key, openvpn_port, openvpn_certificate, openvpn_private_key, created_at, updated_at)
+			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $18) RETURNING id`
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, query,
+		node.Name,
+		node.Country,
+		node.Endpoint,
+		node.PublicKey,
+		node.Subnet,
+		node.Capacity,
+		node.State,
+		node.VLESSPort,
+		node.RealityServerName,
+		node.RealityPrivateKey,
+		node.RealityPublicKey,
+		node.RealityShortID,
+		node.ShadowsocksPort,
+		node.ShadowsocksKey,
+		node.OpenVPNPort,
+		node.OpenVPNCertificate,
+		node.OpenVPNPrivateKey,
+		time.Now(),
+	).Scan(&id)
+
+	return id, err
+}
+
+// UpdateVpnNode updates a VPN node
+func (m *postgresDBRepo) UpdateVpnNode(ctx context.Context, node models.VpnNode) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `UPDATE vpn_nodes
+			  SET name = $1, country = $2, endpoint = $3, public_key = $4, subnet = $5, capacity = $6, state = $7,
+				  vless_port = $8, reality_server_name = $9, reality_private_key = $10, reality_public_key = $11, reality_short_id = $12,
+				  shadowsocks_port = $13, shadowsocks_key = $14,
+				  openvpn_port = $15, openvpn_certificate = $16, openvpn_private_key = $17, updated_at = $18
+			  WHERE id = $19`
+
+	_, err := m.DB.ExecContext(ctx, query,
+		node.Name,
+		node.Country,
+		node.Endpoint,
+		node.PublicKey,
+		node.Subnet,
+		node.Capacity,
+		node.State,
+		node.VLESSPort,
+		node.RealityServerName,
+		node.RealityPrivateKey,
+		node.RealityPublicKey,
+		node.RealityShortID,
+		node.ShadowsocksPort,
+		node.ShadowsocksKey,
+		node.OpenVPNPort,
+		node.OpenVPNCertificate,
+		node.OpenVPNPrivateKey,
+		time.Now(),
+		node.ID,
+	)
+
+	return err
+}
+
+// DeleteVpnNode deletes a VPN node that no peer, not even a revoked one, was
+// ever provisioned on. It returns sql.ErrNoRows for any other node.
+func (m *postgresDBRepo) DeleteVpnNode(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `DELETE FROM vpn_nodes WHERE id = $1 AND NOT EXISTS (SELECT 1 FROM vpn_peers WHERE node_id = $1)`
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// SelectVpnNode returns the node a new peer using protocol should be placed
+// on: the enabled node that is not down, serving protocol with spare capacity
+// and the lowest load, in country unless country is empty, other than the node
+// excludeID. It returns sql.ErrNoRows when no node can take the peer. The choice is not locked, so concurrent provisioning
+// may overshoot a capacity slightly.
+func (m *postgresDBRepo) SelectVpnNode(ctx context.Context, country, protocol string, excludeID int) (models.VpnNode, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT * FROM (
+				  SELECT ` + vpnNodeColumns + ` FROM vpn_nodes n
+				  WHERE n.state = $1 AND n.health <> $8 AND n.id <> $9 AND ($2::text = '' OR n.country = $2::text)
+				  AND CASE $3::text WHEN $4 THEN true WHEN $5 THEN n.vless_port > 0 WHEN $6 THEN n.shadowsocks_port > 0
+				      WHEN $7 THEN n.openvpn_port > 0 ELSE false END
+			  ) nodes (id, name, country, endpoint, public_key, subnet, capacity, state,
+			           vless_port, reality_server_name, reality_private_key, reality_public_key, reality_short_id,
+			           shadowsocks_port, shadowsocks_key, openvpn_port, openvpn_certificate, openvpn_private_key, active_peers,
+			           agent_seen_at, agent_applied_at, agent_peers, agent_error, last_handshake_at,
+			           health, health_reason, health_failures, health_checked_at, health_changed_at, created_at, updated_at)
+			  WHERE active_peers < capacity
+			  ORDER BY active_peers::float / capacity, active_peers, id
+			  LIMIT 1`
+
+	return scanVpnNode(m.DB.QueryRowContext(ctx, query, models.NodeEnabled, country, protocol,
+		models.ProtocolWireGuard, models.ProtocolVLESS, models.ProtocolShadowsocks, models.ProtocolOpenVPN, models.NodeDown, excludeID))
+}
+
+// SetVpnNodeAgentToken replaces the hash of the token the node agent authenticates with
+func (m *postgresDBRepo) SetVpnNodeAgentToken(ctx context.Context, id int, tokenHash string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `UPDATE vpn_nodes SET agent_token_hash = $1, updated_at = $2 WHERE id = $3`
+
+	_, err := m.DB.ExecContext(ctx, query, tokenHash, time.Now(), id)
+
+	return err
+}
+
+// GetVpnNodeByAgentToken returns the node whose agent token hashes to tokenHash
+func (m *postgresDBRepo) GetVpnNodeByAgentToken(ctx context.Context, tokenHash string) (models.VpnNode, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + vpnNodeColumns + ` FROM vpn_nodes n WHERE n.agent_token_hash = $1`
+
+	return scanVpnNode(m.DB.QueryRowContext(ctx, query, tokenHash))
+}
+
+// UpdateVpnNodeAgentStatus records a report of the node agent. The applied
+// time only moves when the agent managed to configure the interface.
+func (m *postgresDBRepo) UpdateVpnNodeAgentStatus(ctx context.Context, status models.VpnNodeAgentStatus) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `UPDATE vpn_nodes
+			  SET agent_seen_at = $1, agent_applied_at = CASE WHEN $2 THEN $1 ELSE agent_applied_at END,
+			  agent_peers = $3, agent_error = $4
+			  WHERE id = $5`
+
+	_, err := m.DB.ExecContext(ctx, query, time.Now(), status.Applied, status.Peers, status.Error, status.NodeID)
+
+	return err
+}
+
+// UpdateVpnNodeHealth records a health check of a node. The change time only
+// moves when the health changed.
+func (m *postgresDBRepo) UpdateVpnNodeHealth(ctx context.Context, health models.VpnNodeHealth) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `UPDATE vpn_nodes
+			  SET health_changed_at = CASE WHEN health <> $1 THEN $4 ELSE health_changed_at END,
+			  health = $1, health_reason = $2, health_failures = $3, health_checked_at = $4
+			  WHERE id = $5`
+
+	_, err := m.DB.ExecContext(ctx, query, health.Health, health.Reason, health.Failures, health.CheckedAt, health.NodeID)
+
+	return err
+}
+
+// GetInvoicesByUserId returns all invoices of a user, newest first
+func (m *postgresDBRepo) GetInvoicesByUserId(ctx context.Context, userID int) ([]models.Invoice, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT id, user_id, COALESCE(subscription_id, 0), number, amount_cents, currency, status,
+			  issued_at, COALESCE(paid_at, '0001-01-01'), created_at, updated_at
+			  FROM invoices WHERE user_id = $1 ORDER BY issued_at DESC`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invoices []models.Invoice
+	for rows.Next() {
+		var i models.Invoice
+		err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.SubscriptionID,
+			&i.Number,
+			&i.AmountCents,
+			&i.Currency,
+			&i.Status,
+			&i.IssuedAt,
+			&i.PaidAt,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		invoices = append(invoices, i)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return invoices, nil
+}
+
+// GetInvoiceById returns an invoice by ID
+func (m *postgresDBRepo) GetInvoiceById(ctx context.Context, id int) (models.Invoice, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT id, user_id, COALESCE(subscription_id, 0), number, amount_cents, currency, status,
+			  issued_at, COALESCE(paid_at, '0001-01-01'), created_at, updated_at
+			  FROM invoices WHERE id = $1`
+
+	row := m.DB.QueryRowContext(ctx, query, id)
+
+	var i models.Invoice
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.SubscriptionID,
+		&i.Number,
+		&i.AmountCents,
+		&i.Currency,
+		&i.Status,
+		&i.IssuedAt,
+		&i.PaidAt,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+	)
+
+	return i, err
+}
+
+// InsertInvoice inserts a new invoice and returns its ID
+func (m *postgresDBRepo) InsertInvoice(ctx context.Context, invoice models.Invoice) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `INSERT INTO invoices
+			  (user_id, subscription_id, number, amount_cents, currency, status, issued_at, paid_at, created_at, updated_at)
+			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id`
+
+	var subscriptionID sql.NullInt64
+	if invoice.SubscriptionID != 0 {
+		subscriptionID = sql.NullInt64{Int64: int64(invoice.SubscriptionID), Valid: true}
+	}
+
+	var paidAt sql.NullTime
+	if !invoice.PaidAt.IsZero() {
+		paidAt = sql.NullTime{Time: invoice.PaidAt, Valid: true}
+	}
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, query,
+		invoice.UserID,
+		subscriptionID,
+		invoice.Number,
+		invoice.AmountCents,
+		invoice.Currency,
+		invoice.Status,
+		invoice.IssuedAt,
+		paidAt,
+		time.Now(),
+		time.Now(),
+	).Scan(&id)
+
+	return id, err
+}
+
+// GetAPITokensByUserId returns all API tokens of a user, including revoked ones
+func (m *postgresDBRepo) GetAPITokensByUserId(ctx context.Context, userID int) ([]models.APIToken, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT id, user_id, name, prefix, token_hash, scopes,
+			  COALESCE(last_used_at, '0001-01-01'), COALESCE(expires_at, '0001-01-01'),
+			  COALESCE(revoked_at, '0001-01-01'), created_at, updated_at
+			  FROM api_tokens WHERE user_id = $1 ORDER BY created_at DESC`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var apiTokens []models.APIToken
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		apiTokens = append(apiTokens, t)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return apiTokens, nil
+}
+
+// GetAPITokenByHash returns the API token with the given hash
+func (m *postgresDBRepo) GetAPITokenByHash(ctx context.Context, hash string) (models.APIToken, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT id, user_id, name, prefix, token_hash, scopes,
+			  COALESCE(last_used_at, '0001-01-01'), COALESCE(expires_at, '0001-01-01'),
+			  COALESCE(revoked_at, '0001-01-01'), created_at, updated_at
+			  FROM api_tokens WHERE token_hash = $1`
+
+	return scanAPIToken(m.DB.QueryRowContext(ctx, query, hash))
+}
+
+// InsertAPIToken inserts a new API token and returns its ID
+func (m *postgresDBRepo) InsertAPIToken(ctx context.Context, token models.APIToken) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `INSERT INTO api_tokens
+			  (user_id, name, prefix, token_hash, scopes, expires_at, created_at, updated_at)
+			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`
+
+	var expiresAt sql.NullTime
+	if !token.ExpiresAt.IsZero() {
+		expiresAt = sql.NullTime{Time: token.ExpiresAt, Valid: true}
+	}
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, query,
+		token.UserID,
+		token.Name,
+		token.Prefix,
+		token.TokenHash,
+		strings.Join(token.Scopes, ","),
+		expiresAt,
+		time.Now(),
+		time.Now(),
+	).Scan(&id)
+
+	return id, err
+}
+
+// RevokeAPIToken revokes an API token owned by the given user
+func (m *postgresDBRepo) RevokeAPIToken(ctx context.Context, id, userID int) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `UPDATE api_tokens SET revoked_at = $1, updated_at = $1
+			  WHERE id = $2 AND user_id = $3 AND revoked_at IS NULL`
+
+	result, err := m.DB.ExecContext(ctx, query, time.Now(), id, userID)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// TouchAPIToken records that an API token has just been used
+func (m *postgresDBRepo) TouchAPIToken(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `UPDATE api_tokens SET last_used_at = $1 WHERE id = $2`, time.Now(), id)
+	return err
+}
+
+const outboxColumns = `id, channel, recipient, subject, payload, status, attempts, max_attempts, next_attempt_at,
+			  COALESCE(locked_until, '0001-01-01'), last_error, COALESCE(sent_at, '0001-01-01'),
+			  created_at, updated_at`
+
+// InsertOutboxMessage queues a message for delivery on its channel, e-mail
+// unless set, and returns its ID
+func (m *postgresDBRepo) InsertOutboxMessage(ctx context.Context, msg models.OutboxMessage) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `INSERT INTO outbox
+			  (channel, recipient, subject, payload, status, max_attempts, next_attempt_at, created_at, updated_at)
+			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`
+
+	now := time.Now()
+	nextAttemptAt := msg.NextAttemptAt
+	if nextAttemptAt.IsZero() {
+		nextAttemptAt = now
+	}
+	channel := msg.Channel
+	if channel == "" {
+		channel = models.ChannelEmail
+	}
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, query,
+		channel,
+		msg.Recipient,
+		msg.Subject,
+		msg.Payload,
+		models.OutboxPending,
+		msg.MaxAttempts,
+		nextAttemptAt,
+		now,
+		now,
+	).Scan(&id)
+
+	return id, err
+}
+
+// ClaimOutboxMessages locks up to limit messages that are due for delivery to
+// the caller for lease. Messages whose lease ran out while sending, because
+// their worker died, are claimed again. Concurrent callers never claim the same message.
+func (m *postgresDBRepo) ClaimOutboxMessages(ctx context.Context, limit int, lease time.Duration) ([]models.OutboxMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `UPDATE outbox SET status = $1, locked_until = $2, updated_at = $3
+			  WHERE id IN (
+				  SELECT id FROM outbox
+				  WHERE (status = $4 AND next_attempt_at <= $3) OR (status = $1 AND locked_until < $3)
+				  ORDER BY next_attempt_at, id
+				  LIMIT $5
+				  FOR UPDATE SKIP LOCKED
+			  )
+			  RETURNING ` + outboxColumns
+
+	now := time.Now()
+	rows, err := m.DB.QueryContext(ctx, query, models.OutboxSending, now.Add(lease), now, models.OutboxPending, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []models.OutboxMessage
+	for rows.Next() {
+		msg, err := scanOutboxMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(messages, func(a, b models.OutboxMessage) int {
+		return a.NextAttemptAt.Compare(b.NextAttemptAt)
+	})
+
+	return messages, nil
+}
+
+// UpdateOutboxMessage stores the delivery state of a message: its status,
+// attempts, next attempt, lock, last error and sent time
+func (m *postgresDBRepo) UpdateOutboxMessage(ctx context.Context, msg models.OutboxMessage) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `UPDATE outbox SET status = $1, attempts = $2, next_attempt_at = $3, locked_until = $4,
+			  last_error = $5, sent_at = $6, updated_at = $7
+			  WHERE id = $8`
+
+	var lockedUntil, sentAt sql.NullTime
+	if !msg.LockedUntil.IsZero() {
+		lockedUntil = sql.NullTime{Time: msg.LockedUntil, Valid: true}
+	}
+	if !msg.SentAt.IsZero() {
+		sentAt = sql.NullTime{Time: msg.SentAt, Valid: true}
+	}
+
+	result, err := m.DB.ExecContext(ctx, query,
+		msg.Status,
+		msg.Attempts,
+		msg.NextAttemptAt,
+		lockedUntil,
+		msg.LastError,
+		sentAt,
+		time.Now(),
+		msg.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// RetryOutboxMessage moves a dead message back to pending with a fresh set of attempts
+func (m *postgresDBRepo) RetryOutboxMessage(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `UPDATE outbox SET status = $1, attempts = 0, next_attempt_at = $2, locked_until = NULL, updated_at = $2
+			  WHERE id = $3 AND status = $4`
+
+	result, err := m.DB.ExecContext(ctx, query, models.OutboxPending, time.Now(), id, models.OutboxDead)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// GetOutboxMessages returns up to limit messages with the given status, or of
+// any status when status is empty, newest first
+func (m *postgresDBRepo) GetOutboxMessages(ctx context.Context, status string, limit int) ([]models.OutboxMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + outboxColumns + `
+			  FROM outbox WHERE $1 = '' OR status = $1
+			  ORDER BY created_at DESC, id DESC LIMIT $2`
+
+	rows, err := m.DB.QueryContext(ctx, query, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []models.OutboxMessage
+	for rows.Next() {
+		msg, err := scanOutboxMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// CountOutboxMessagesByStatus counts queued messages by status
+func (m *postgresDBRepo) CountOutboxMessagesByStatus(ctx context.Context) (map[string]int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, `SELECT status, count(*) FROM outbox GROUP BY status`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[string]int{}
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			return nil, err
+		}
+		counts[status] = count
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+// CountOutboxSentSince counts the messages delivered to recipient since the given time
+func (m *postgresDBRepo) CountOutboxSentSince(ctx context.Context, recipient string, since time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	// the literal status lets the planner use the partial index on sent messages
+	query := `SELECT count(*) FROM outbox WHERE recipient = $1 AND status = 'sent' AND sent_at >= $2`
+
+	var count int
+	err := m.DB.QueryRowContext(ctx, query, recipient, since).Scan(&count)
+	return count, err
+}
+
+const notificationColumns = `id, user_id, event, title, body, link, in_app, COALESCE(dedupe_key, ''),
+			  COALESCE(read_at, '0001-01-01'), created_at, updated_at`
+
+// InsertNotification records a notification and returns its ID. A notification
+// with a DedupeKey the user was already notified under is not stored again and 0 is returned.
+func (m *postgresDBRepo) InsertNotification(ctx context.Context, notification models.Notification) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `INSERT INTO notifications (user_id, event, title, body, link, in_app, dedupe_key, created_at, updated_at)
+			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $8)
+			  ON CONFLICT (user_id, dedupe_key) DO NOTHING
+			  RETURNING id`
+
+	var dedupeKey sql.NullString
+	if notification.DedupeKey != "" {
+		dedupeKey = sql.NullString{String: notification.DedupeKey, Valid: true}
+	}
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, query,
+		notification.UserID,
+		notification.Event,
+		notification.Title,
+		notification.Body,
+		notification.Link,
+		notification.InApp,
+		dedupeKey,
+		time.Now(),
+	).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return id, err
+}
+
+// GetNotificationsByUserId returns up to limit notifications of the user's
+// in-panel feed, newest first
+func (m *postgresDBRepo) GetNotificationsByUserId(ctx context.Context, userID, limit int) ([]models.Notification, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + notificationColumns + `
+			  FROM notifications WHERE user_id = $1 AND in_app
+			  ORDER BY created_at DESC, id DESC LIMIT $2`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notifications []models.Notification
+	for rows.Next() {
+		n, err := scanNotification(rows)
+		if err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, n)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return notifications, nil
+}
+
+// CountUnreadNotifications counts the unread notifications in the user's in-panel feed
+func (m *postgresDBRepo) CountUnreadNotifications(ctx context.Context, userID int) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT count(*) FROM notifications WHERE user_id = $1 AND in_app AND read_at IS NULL`
+
+	var count int
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&count)
+	return count, err
+}
+
+// MarkNotificationsRead marks every notification of the user as read
+func (m *postgresDBRepo) MarkNotificationsRead(ctx context.Context, userID int) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `UPDATE notifications SET read_at = $1, updated_at = $1 WHERE user_id = $2 AND read_at IS NULL`
+
+	_, err := m.DB.ExecContext(ctx, query, time.Now(), userID)
+	return err
+}
+
+// GetNotificationPreferences gets the notification channels of a user,
+// creating the default row on first use like GetUserLoginSecurity
+func (m *postgresDBRepo) GetNotificationPreferences(ctx context.Context, userID int) (models.NotificationPreferences, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	columns := `id, user_id, email, telegram, in_app, telegram_chat_id, created_at, updated_at`
+
+	prefs, err := scanNotificationPreferences(m.DB.QueryRowContext(ctx,
+		`SELECT `+columns+` FROM notification_preferences WHERE user_id = $1`, userID))
+	if err != sql.ErrNoRows {
+		return prefs, err
+	}
+
+	query := `INSERT INTO notification_preferences (user_id, created_at, updated_at)
+			  VALUES ($1, $2, $2)
+			  ON CONFLICT (user_id) DO UPDATE SET user_id = excluded.user_id
+			  RETURNING ` + columns
+
+	return scanNotificationPreferences(m.DB.QueryRowContext(ctx, query, userID, time.Now()))
+}
+
+// UpdateNotificationPreferences updates the notification channels of a user
+func (m *postgresDBRepo) UpdateNotificationPreferences(ctx context.Context, prefs models.NotificationPreferences) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `UPDATE notification_preferences
+			  SET email = $1, telegram = $2, in_app = $3, telegram_chat_id = $4, updated_at = $5
+			  WHERE user_id = $6`
+
+	_, err := m.DB.ExecContext(ctx, query,
+		prefs.Email,
+		prefs.Telegram,
+		prefs.InApp,
+		prefs.TelegramChatID,
+		time.Now(),
+		prefs.UserID,
+	)
+
+	return err
+}
+
+// GetUserQuota returns the quota overrides and block of a user. A user without
+// a row keeps the limits of the plan and is not blocked.
+func (m *postgresDBRepo) GetUserQuota(ctx context.Context, userID int) (models.UserQuota, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT user_id, COALESCE(data_cap_bytes, -1), COALESCE(device_limit, -1), note,
+			  COALESCE(blocked_until, '0001-01-01'), created_at, updated_at
+			  FROM user_quotas WHERE user_id = $1`
+
+	var q models.UserQuota
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(
+		&q.UserID,
+		&q.DataCapBytes,
+		&q.DeviceLimit,
+		&q.Note,
+		&q.BlockedUntil,
+		&q.CreatedAt,
+		&q.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return models.UserQuota{UserID: userID, DataCapBytes: models.QuotaFromPlan, DeviceLimit: models.QuotaFromPlan}, nil
+	}
+
+	return q, err
+}
+
+// UpdateUserQuotaOverride stores the limits and note an admin set for a user,
+// leaving the block alone
+func (m *postgresDBRepo) UpdateUserQuotaOverride(ctx context.Context, q models.UserQuota) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `INSERT INTO user_quotas (user_id, data_cap_bytes, device_limit, note, created_at, updated_at)
+			  VALUES ($1, NULLIF($2::bigint, -1), NULLIF($3::integer, -1), $4, $5, $5)
+			  ON CONFLICT (user_id) DO UPDATE
+			  SET data_cap_bytes = excluded.data_cap_bytes, device_limit = excluded.device_limit,
+				  note = excluded.note, updated_at = excluded.updated_at`
+
+	_, err := m.DB.ExecContext(ctx, query, q.UserID, q.DataCapBytes, q.DeviceLimit, q.Note, time.Now())
+
+	return err
+}
+
+// SetUserQuotaBlock blocks the peers of a user until until, or lifts the block
+// when until is zero
+func (m *postgresDBRepo) SetUserQuotaBlock(ctx context.Context, userID int, until time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var blockedUntil sql.NullTime
+	if !until.IsZero() {
+		blockedUntil = sql.NullTime{Time: until, Valid: true}
+	}
+
+	query := `INSERT INTO user_quotas (user_id, blocked_until, created_at, updated_at)
+			  VALUES ($1, $2, $3, $3)
+			  ON CONFLICT (user_id) DO UPDATE
+			  SET blocked_until = excluded.blocked_until, updated_at = excluded.updated_at`
+
+	_, err := m.DB.ExecContext(ctx, query, userID, blockedUntil, time.Now())
+
+	return err
+}
+
+// GetTopUpPacks returns the top-up packs on sale, smallest first
+func (m *postgresDBRepo) GetTopUpPacks(ctx context.Context) ([]models.TopUpPack, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + topUpPackColumns + ` FROM topup_packs ORDER BY data_bytes, id`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var packs []models.TopUpPack
+	for rows.Next() {
+		p, err := scanTopUpPack(rows)
+		if err != nil {
+			return nil, err
+		}
+		packs = append(packs, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return packs, nil
+}
+
+// GetTopUpPackById returns a top-up pack by ID
+func (m *postgresDBRepo) GetTopUpPackById(ctx context.Context, id int) (models.TopUpPack, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + topUpPackColumns + ` FROM topup_packs WHERE id = $1`
+
+	return scanTopUpPack(m.DB.QueryRowContext(ctx, query, id))
+}
+
+// InsertTopUp inserts a bought top-up and returns its ID
+func (m *postgresDBRepo) InsertTopUp(ctx context.Context, topUp models.TopUp) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `INSERT INTO topups (user_id, subscription_id, pack_id, data_bytes, starts_at, expires_at, created_at)
+			  VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, query,
+		topUp.UserID,
+		topUp.SubscriptionID,
+		topUp.PackID,
+		topUp.DataBytes,
+		topUp.StartsAt,
+		topUp.ExpiresAt,
+		time.Now(),
+	).Scan(&id)
+
+	return id, err
+}
+
+// SumTopUpBytes returns the data of the top-ups of a user that are valid at at
+func (m *postgresDBRepo) SumTopUpBytes(ctx context.Context, userID int, at time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT COALESCE(SUM(data_bytes), 0)::bigint FROM topups
+			  WHERE user_id = $1 AND starts_at <= $2 AND expires_at > $2`
+
+	var total int64
+	err := m.DB.QueryRowContext(ctx, query, userID, at).Scan(&total)
+
+	return total, err
+}
+
+// SetTelegramLinkCode stores the code a user links a Telegram chat with,
+// replacing any earlier code of the user
+func (m *postgresDBRepo) SetTelegramLinkCode(ctx context.Context, userID int, codeHash string, expiresAt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `INSERT INTO telegram_link_codes (user_id, code_hash, expires_at, created_at)
+			  VALUES ($1, $2, $3, $4)
+			  ON CONFLICT (user_id) DO UPDATE
+			  SET code_hash = excluded.code_hash, expires_at = excluded.expires_at, created_at = excluded.created_at`
+
+	_, err := m.DB.ExecContext(ctx, query, userID, codeHash, expiresAt, time.Now())
+
+	return err
+}
+
+// LinkTelegramChat uses up the unexpired link code with codeHash to link the
+// chat chatID to the code's user, and returns the user's ID. It returns
+// sql.ErrNoRows when there is no such code.
+func (m *postgresDBRepo) LinkTelegramChat(ctx context.Context, codeHash string, chatID int64) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `WITH code AS (
+				  DELETE FROM telegram_link_codes WHERE code_hash = $1 AND expires_at > $3 RETURNING user_id
+			  )
+			  INSERT INTO telegram_chats (chat_id, user_id, linked_at)
+			  SELECT $2, user_id, $3 FROM code
+			  ON CONFLICT (chat_id) DO UPDATE SET user_id = excluded.user_id, linked_at = excluded.linked_at
+			  RETURNING user_id`
+
+	var userID int
+	err := m.DB.QueryRowContext(ctx, query, codeHash, chatID, time.Now()).Scan(&userID)
+
+	return userID, err
+}
+
+// GetUserIdByTelegramChat returns the user a Telegram chat is linked to
+func (m *postgresDBRepo) GetUserIdByTelegramChat(ctx context.Context, chatID int64) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var userID int
+	err := m.DB.QueryRowContext(ctx, `SELECT user_id FROM telegram_chats WHERE chat_id = $1`, chatID).Scan(&userID)
+
+	return userID, err
+}
+
+const planColumns = `id, name, price_cents, currency, duration_days, data_cap_bytes, device_limit,
+	key_rotation_days, key_grace_hours, array_to_string(protocols, ','), created_at, updated_at`
+
+const topUpPackColumns = `id, name, data_bytes, price_cents, currency, created_at, updated_at`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanUserLoginSecurity(row rowScanner) (models.UserLoginSecurity, error) {
+	var security models.UserLoginSecurity
+	err := row.Scan(
+		&security.ID,
+		&security.UserID,
+		&security.EmailVerification,
+		&security.PhoneVerification,
+		&security.MultiFactorAuth,
+		&security.VerificationCode,
+		&security.CodeExpiresAt,
+		&security.PhoneNumber,
+		&security.LastVerificationSentAt,
+		&security.FailedAttempts,
+		&security.LockedUntil,
+		&security.CreatedAt,
+		&security.UpdatedAt,
+	)
+
+	return security, err
+}
+
+func scanAPIToken(row rowScanner) (models.APIToken, error) {
+	var t models.APIToken
+	var scopes string
+	err := row.Scan(
+		&t.ID,
+		&t.UserID,
+		&t.Name,
+		&t.Prefix,
+		&t.TokenHash,
+		&scopes,
+		&t.LastUsedAt,
+		&t.ExpiresAt,
+		&t.RevokedAt,
+		&t.CreatedAt,
+		&t.UpdatedAt,
+	)
+	t.Scopes = tokens.ParseScopes(scopes)
+
+	return t, err
+}
+
+func scanOutboxMessage(row rowScanner) (models.OutboxMessage, error) {
+	var msg models.OutboxMessage
+	err := row.Scan(
+		&msg.ID,
+		&msg.Channel,
+		&msg.Recipient,
+		&msg.Subject,
+		&msg.Payload,
+		&msg.Status,
+		&msg.Attempts,
+		&msg.MaxAttempts,
+		&msg.NextAttemptAt,
+		&msg.LockedUntil,
+		&msg.LastError,
+		&msg.SentAt,
+		&msg.CreatedAt,
+		&msg.UpdatedAt,
+	)
+
+	return msg, err
+}
+
+func scanNotification(row rowScanner) (models.Notification, error) {
+	var n models.Notification
+	err := row.Scan(
+		&n.ID,
+		&n.UserID,
+		&n.Event,
+		&n.Title,
+		&n.Body,
+		&n.Link,
+		&n.InApp,
+		&n.DedupeKey,
+		&n.ReadAt,
+		&n.CreatedAt,
+		&n.UpdatedAt,
+	)
+
+	return n, err
+}
+
+func scanNotificationPreferences(row rowScanner) (models.NotificationPreferences, error) {
+	var prefs models.NotificationPreferences
+	err := row.Scan(
+		&prefs.ID,
+		&prefs.UserID,
+		&prefs.Email,
+		&prefs.Telegram,
+		&prefs.InApp,
+		&prefs.TelegramChatID,
+		&prefs.CreatedAt,
+		&prefs.UpdatedAt,
+	)
+
+	return prefs, err
+}
+
+func scanSubscription(row rowScanner) (models.Subscription, error) {
+	var s models.Subscription
+	var protocols string
+	err := row.Scan(
+		&s.ID,
+		&s.UserID,
+		&s.PlanID,
+		&s.Status,
+		&s.StartsAt,
+		&s.ExpiresAt,
+		&s.CreatedAt,
+		&s.UpdatedAt,
+		&s.Plan.ID,
+		&s.Plan.Name,
+		&s.Plan.PriceCents,
+		&s.Plan.Currency,
+		&s.Plan.DurationDays,
+		&s.Plan.DataCapBytes,
+		&s.Plan.DeviceLimit,
+		&s.Plan.KeyRotationDays,
+		&s.Plan.KeyGraceHours,
+		&protocols,
+		&s.Plan.CreatedAt,
+		&s.Plan.UpdatedAt,
+	)
+	s.Plan.Protocols = splitProtocols(protocols)
+
+	return s, err
+}
+
+func scanPlan(row rowScanner) (models.Plan, error) {
+	var p models.Plan
+	var protocols string
+	err := row.Scan(
+		&p.ID,
+		&p.Name,
+		&p.PriceCents,
+		&p.Currency,
+		&p.DurationDays,
+		&p.DataCapBytes,
+		&p.DeviceLimit,
+		&p.KeyRotationDays,
+		&p.KeyGraceHours,
+		&protocols,
+		&p.CreatedAt,
+		&p.UpdatedAt,
+	)
+	p.Protocols = splitProtocols(protocols)
+
+	return p, err
+}
+
+func scanTopUpPack(row rowScanner) (models.TopUpPack, error) {
+	var p models.TopUpPack
+	err := row.Scan(
+		&p.ID,
+		&p.Name,
+		&p.DataBytes,
+		&p.PriceCents,
+		&p.Currency,
+		&p.CreatedAt,
+		&p.UpdatedAt,
+	)
+
+	return p, err
+}
+
+func scanVpnPeer(row rowScanner) (models.VpnPeer, error) {
+	var p models.VpnPeer
+	err := row.Scan(
+		&p.ID,
+		&p.UserID,
+		&p.SubscriptionID,
+		&p.NodeID,
+		&p.Name,
+		&p.Protocol,
+		&p.PublicKey,
+		&p.PrivateKey,
+		&p.PresharedKey,
+		&p.Address,
+		&p.Certificate,
+		&p.RevokedAt,
+		&p.LastHandshakeAt,
+		&p.RxCounter,
+		&p.TxCounter,
+		&p.KeysRotatedAt,
+		&p.CreatedAt,
+		&p.UpdatedAt,
+	)
+
+	return p, err
+}
+
+func scanKeyRevocation(row rowScanner) (models.KeyRevocation, error) {
+	var r models.KeyRevocation
+	err := row.Scan(
+		&r.ID,
+		&r.PeerID,
+		&r.NodeID,
+		&r.PublicKey,
+		&r.PresharedKey,
+		&r.Address,
+		&r.Reason,
+		&r.RxCounter,
+		&r.TxCounter,
+		&r.ServeUntil,
+		&r.ConfirmedAt,
+		&r.CreatedAt,
+		&r.PeerName,
+		&r.Protocol,
+	)
+
+	return r, err
+}
+
+func scanVpnNode(row rowScanner) (models.VpnNode, error) {
+	var n models.VpnNode
+	err := row.Scan(
+		&n.ID,
+		&n.Name,
+		&n.Country,
+		&n.Endpoint,
+		&n.PublicKey,
+		&n.Subnet,
+		&n.Capacity,
+		&n.State,
+		&n.VLESSPort,
+		&n.RealityServerName,
+		&n.RealityPrivateKey,
+		&n.RealityPublicKey,
+		&n.RealityShortID,
+		&n.ShadowsocksPort,
+		&n.ShadowsocksKey,
+		&n.OpenVPNPort,
+		&n.OpenVPNCertificate,
+		&n.OpenVPNPrivateKey,
+		&n.ActivePeers,
+		&n.AgentSeenAt,
+		&n.AgentAppliedAt,
+		&n.AgentPeers,
+		&n.AgentError,
+		&n.LastHandshakeAt,
+		&n.Health,
+		&n.HealthReason,
+		&n.HealthFailures,
+		&n.HealthCheckedAt,
+		&n.HealthChangedAt,
+		&n.CreatedAt,
+		&n.UpdatedAt,
+	)
+
+	return n, err
+}
+
+// SetSubscriptionToken replaces the hash of the token in the subscription URL
+// of a user; the URL with the previous token stops working
+func (m *postgresDBRepo) SetSubscriptionToken(ctx context.Context, userID int, tokenHash string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `UPDATE users SET subscription_token_hash = $1, updated_at = $2 WHERE id = $3`
+
+	_, err := m.DB.ExecContext(ctx, query, tokenHash, time.Now(), userID)
+
+	return err
+}
+
+// GetUserIdBySubscriptionToken returns the user whose subscription URL token
+// hashes to tokenHash
+func (m *postgresDBRepo) GetUserIdBySubscriptionToken(ctx context.Context, tokenHash string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var userID int
+	err := m.DB.QueryRowContext(ctx, `SELECT id FROM users WHERE subscription_token_hash = $1`, tokenHash).Scan(&userID)
+
+	return userID, err
+}
+
+// SetVpnPeerCertificate stores the certificate issued for the key publicKey of
+// a VPN peer. It returns sql.ErrNoRows when the peer holds other keys by now.
+func (m *postgresDBRepo) SetVpnPeerCertificate(ctx context.Context, id int, publicKey, certificate string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `UPDATE vpn_peers SET certificate = $1, updated_at = $2 WHERE id = $3 AND public_key = $4`
+
+	result, err := m.DB.ExecContext(ctx, query, certificate, time.Now(), id, publicKey)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// GetCertificateAuthority returns the CA of the OpenVPN peers, or
+// sql.ErrNoRows until it is created
+func (m *postgresDBRepo) GetCertificateAuthority(ctx context.Context) (models.CertificateAuthority, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT certificate, encrypted_key, crl, crl_number, created_at, updated_at FROM certificate_authorities`
+
+	var ca models.CertificateAuthority
+	err := m.DB.QueryRowContext(ctx, query).Scan(
+		&ca.Certificate,
+		&ca.EncryptedKey,
+		&ca.CRL,
+		&ca.CRLNumber,
+		&ca.CreatedAt,
+		&ca.UpdatedAt,
+	)
+
+	return ca, err
+}
+
+// InsertCertificateAuthority stores the CA of the OpenVPN peers unless one
+// exists already, which is kept; read it back with GetCertificateAuthority
+func (m *postgresDBRepo) InsertCertificateAuthority(ctx context.Context, ca models.CertificateAuthority) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `INSERT INTO certificate_authorities (certificate, encrypted_key, created_at, updated_at)
+			  VALUES ($1, $2, $3, $3) ON CONFLICT (id) DO NOTHING`
+
+	_, err := m.DB.ExecContext(ctx, query, ca.Certificate, ca.EncryptedKey, time.Now())
+	return err
+}
+
+// UpdateCRL stores the revocation list numbered number in place of the one
+// numbered number-1, reporting false when another list was stored meanwhile
+func (m *postgresDBRepo) UpdateCRL(ctx context.Context, number int64, crl string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `UPDATE certificate_authorities SET crl = $1, crl_number = $2, updated_at = $3 WHERE crl_number = $2 - 1`
+
+	result, err := m.DB.ExecContext(ctx, query, crl, number, time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// GetRevokedCertificates returns the certificates of OpenVPN peers nodes must
+// refuse at now: the keys revoked with their peer or rotated out past their
+// grace window, and the current keys of peers that are not served because
+// their subscription is inactive or their owner is blocked over the data cap
+func (m *postgresDBRepo) GetRevokedCertificates(ctx context.Context, now time.Time) ([]models.RevokedCertificate, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT r.public_key, r.serve_until
+			  FROM vpn_key_revocations r
+			  JOIN vpn_peers p ON p.id = r.peer_id
+			  WHERE p.protocol = $2 AND r.serve_until <= $1
+			  UNION ALL
+			  SELECT public_key, $1::timestamp
+			  FROM vpn_peers
+			  WHERE protocol = $2 AND revoked_at IS NULL AND (
+				  subscription_id NOT IN (
+					  SELECT id FROM subscriptions WHERE status = 'active' AND starts_at <= $1 AND expires_at > $1
+				  )
+				  OR user_id IN (SELECT user_id FROM user_quotas WHERE blocked_until > $1)
+			  )
+			  ORDER BY 2, 1`
+
+	rows, err := m.DB.QueryContext(ctx, query, now, models.ProtocolOpenVPN)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revoked []models.RevokedCertificate
+	for rows.Next() {
+		var r models.RevokedCertificate
+		err := rows.Scan(&r.Serial, &r.RevokedAt)
+		if err != nil {
+			return nil, err
+		}
+		revoked = append(revoked, r)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return revoked, nil
+}
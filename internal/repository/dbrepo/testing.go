@@ -0,0 +1,1833 @@
+package dbrepo
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/config"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/repository"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrDuplicate is returned by TestingRepo where Postgres would report a unique violation
+var ErrDuplicate = errors.New("duplicate key value violates unique constraint")
+
+// TestingRepo is an in-memory DatabaseRepo for tests. It mirrors the behaviour
+// of the Postgres repository, including sql.ErrNoRows for missing rows.
+type TestingRepo struct {
+	App *config.AppConfig
+
+	mu    sync.Mutex
+	state testingState
+	// locks are the keys held through WithLock
+	locks map[int64]bool
+}
+
+var _ repository.DatabaseRepo = (*TestingRepo)(nil)
+
+type testingState struct {
+	nextID        int
+	users         map[int]models.User
+	loginSecurity map[int]models.UserLoginSecurity
+	plans         map[int]models.Plan
+	subscriptions map[int]models.Subscription
+	peers         map[int]models.VpnPeer
+	revocations   map[int]models.KeyRevocation
+	nodes         map[int]models.VpnNode
+	agentTokens   map[int]string
+	invoices      map[int]models.Invoice
+	apiTokens     map[int]models.APIToken
+	outbox        map[int]models.OutboxMessage
+	notifications map[int]models.Notification
+	notifyPrefs   map[int]models.NotificationPreferences
+	usage         map[usageKey]models.UsagePoint
+	userQuotas    map[int]models.UserQuota
+	topUpPacks    map[int]models.TopUpPack
+	topUps        map[int]models.TopUp
+	telegramCodes map[int]telegramLinkCode
+	telegramChats map[int64]int
+	subTokens     map[int]string
+	// ca is replaced, never modified, so that clones may share it
+	ca *models.CertificateAuthority
+}
+
+// telegramLinkCode is the Telegram link code of a user
+type telegramLinkCode struct {
+	hash      string
+	expiresAt time.Time
+}
+
+type usageKey struct {
+	peerID int
+	period string
+	start  int64
+}
+
+// NewTestingRepo returns an empty in-memory repository
+func NewTestingRepo(a *config.AppConfig) *TestingRepo {
+	return &TestingRepo{
+		App: a,
+		state: testingState{
+			users:         map[int]models.User{},
+			loginSecurity: map[int]models.UserLoginSecurity{},
+			plans:         map[int]models.Plan{},
+			subscriptions: map[int]models.Subscription{},
+			peers:         map[int]models.VpnPeer{},
+			revocations:   map[int]models.KeyRevocation{},
+			nodes:         map[int]models.VpnNode{},
+			agentTokens:   map[int]string{},
+			invoices:      map[int]models.Invoice{},
+			apiTokens:     map[int]models.APIToken{},
+			outbox:        map[int]models.OutboxMessage{},
+			notifications: map[int]models.Notification{},
+			notifyPrefs:   map[int]models.NotificationPreferences{},
+			usage:         map[usageKey]models.UsagePoint{},
+			userQuotas:    map[int]models.UserQuota{},
+			topUpPacks:    map[int]models.TopUpPack{},
+			topUps:        map[int]models.TopUp{},
+			telegramCodes: map[int]telegramLinkCode{},
+			telegramChats: map[int64]int{},
+			subTokens:     map[int]string{},
+		},
+	}
+}
+
+func (s testingState) clone() testingState {
+	s.users = maps.Clone(s.users)
+	s.loginSecurity = maps.Clone(s.loginSecurity)
+	s.plans = maps.Clone(s.plans)
+	s.subscriptions = maps.Clone(s.subscriptions)
+	s.peers = maps.Clone(s.peers)
+	s.revocations = maps.Clone(s.revocations)
+	s.nodes = maps.Clone(s.nodes)
+	s.agentTokens = maps.Clone(s.agentTokens)
+	s.invoices = maps.Clone(s.invoices)
+	s.apiTokens = maps.Clone(s.apiTokens)
+	s.outbox = maps.Clone(s.outbox)
+	s.notifications = maps.Clone(s.notifications)
+	s.notifyPrefs = maps.Clone(s.notifyPrefs)
+	s.usage = maps.Clone(s.usage)
+	s.userQuotas = maps.Clone(s.userQuotas)
+	s.topUpPacks = maps.Clone(s.topUpPacks)
+	s.topUps = maps.Clone(s.topUps)
+	s.telegramCodes = maps.Clone(s.telegramCodes)
+	s.telegramChats = maps.Clone(s.telegramChats)
+	s.subTokens = maps.Clone(s.subTokens)
+	return s
+}
+
+func (m *TestingRepo) newID() int {
+	m.state.nextID++
+	return m.state.nextID
+}
+
+// AddUser stores user with password hashed and returns its ID
+func (m *TestingRepo) AddUser(user models.User, password string) (int, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, u := range m.state.users {
+		if u.Username == user.Username {
+			return 0, ErrDuplicate
+		}
+	}
+
+	user.ID = m.newID()
+	user.Password = string(hash)
+	user.CreatedAt = time.Now()
+	user.UpdatedAt = time.Now()
+	m.state.users[user.ID] = user
+
+	return user.ID, nil
+}
+
+// AddPlan stores plan and returns its ID
+func (m *TestingRepo) AddPlan(plan models.Plan) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	plan.ID = m.newID()
+	m.state.plans[plan.ID] = plan
+
+	return plan.ID
+}
+
+// AddTopUpPack stores pack and returns its ID
+func (m *TestingRepo) AddTopUpPack(pack models.TopUpPack) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pack.ID = m.newID()
+	m.state.topUpPacks[pack.ID] = pack
+
+	return pack.ID
+}
+
+// AddAPIToken stores token as given, keeping its timestamps, and returns its ID
+func (m *TestingRepo) AddAPIToken(token models.APIToken) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token.ID = m.newID()
+	m.state.apiTokens[token.ID] = token
+
+	return token.ID
+}
+
+func (m *TestingRepo) AllUsers() bool {
+	return true
+}
+
+// WithTx runs fn against this repository and restores the previous state if fn
+// fails. It gives atomicity, not isolation from concurrent callers.
+func (m *TestingRepo) WithTx(ctx context.Context, fn func(repo repository.DatabaseRepo) error) error {
+	m.mu.Lock()
+	snapshot := m.state.clone()
+	m.mu.Unlock()
+
+	err := fn(m)
+	if err != nil {
+		m.mu.Lock()
+		m.state = snapshot
+		m.mu.Unlock()
+	}
+
+	return err
+}
+
+// WithLock runs fn unless another caller is inside WithLock with the same key
+func (m *TestingRepo) WithLock(ctx context.Context, key int64, fn func() error) (bool, error) {
+	m.mu.Lock()
+	if m.locks[key] {
+		m.mu.Unlock()
+		return false, nil
+	}
+	if m.locks == nil {
+		m.locks = map[int64]bool{}
+	}
+	m.locks[key] = true
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		delete(m.locks, key)
+		m.mu.Unlock()
+	}()
+
+	return true, fn()
+}
+
+func (m *TestingRepo) GetUserById(ctx context.Context, id int) (models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.state.users[id]
+	if !ok {
+		return models.User{}, sql.ErrNoRows
+	}
+	return user, nil
+}
+
+func (m *TestingRepo) UpdateUser(ctx context.Context, user models.User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.state.users[user.ID]
+	if !ok {
+		return nil
+	}
+
+	existing.FirstName = user.FirstName
+	existing.LastName = user.LastName
+	existing.Email = user.Email
+	existing.AccessLevel = user.AccessLevel
+	existing.UpdatedAt = time.Now()
+	m.state.users[user.ID] = existing
+
+	return nil
+}
+
+func (m *TestingRepo) Authenticate(ctx context.Context, email, testPassword string) (int, string, error) {
+	m.mu.Lock()
+	var found *models.User
+	for _, u := range m.state.users {
+		if u.Email == email {
+			found = &u
+			break
+		}
+	}
+	m.mu.Unlock()
+
+	if found == nil {
+		return 0, "", sql.ErrNoRows
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(found.Password), []byte(testPassword))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return 0, "", errors.New("incorrect password")
+	} else if err != nil {
+		return 0, "", err
+	}
+
+	return found.ID, found.Password, nil
+}
+
+func (m *TestingRepo) GetAdminUserIds(ctx context.Context) ([]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ids []int
+	for _, u := range m.state.users {
+		if u.IsAdmin {
+			ids = append(ids, u.ID)
+		}
+	}
+	slices.Sort(ids)
+
+	return ids, nil
+}
+
+func (m *TestingRepo) GetUserLoginSecurity(ctx context.Context, userID int) (models.UserLoginSecurity, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	security, ok := m.state.loginSecurity[userID]
+	if ok {
+		return security, nil
+	}
+
+	security = models.UserLoginSecurity{
+		ID:        m.newID(),
+		UserID:    userID,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	m.state.loginSecurity[userID] = security
+
+	return security, nil
+}
+
+func (m *TestingRepo) UpdateUserLoginSecurity(ctx context.Context, security models.UserLoginSecurity) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.state.loginSecurity[security.UserID]
+	if !ok {
+		return nil
+	}
+
+	security.ID = existing.ID
+	security.CreatedAt = existing.CreatedAt
+	security.UpdatedAt = time.Now()
+	m.state.loginSecurity[security.UserID] = security
+
+	return nil
+}
+
+func (m *TestingRepo) CreateUserLoginSecurity(ctx context.Context, security models.UserLoginSecurity) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.state.loginSecurity[security.UserID]; ok {
+		return ErrDuplicate
+	}
+
+	security.ID = m.newID()
+	security.CreatedAt = time.Now()
+	security.UpdatedAt = time.Now()
+	m.state.loginSecurity[security.UserID] = security
+
+	return nil
+}
+
+func (m *TestingRepo) GetPlans(ctx context.Context) ([]models.Plan, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	plans := slices.Collect(maps.Values(m.state.plans))
+	slices.SortFunc(plans, func(a, b models.Plan) int {
+		if a.PriceCents != b.PriceCents {
+			return a.PriceCents - b.PriceCents
+		}
+		return a.ID - b.ID
+	})
+
+	return plans, nil
+}
+
+func (m *TestingRepo) GetPlanById(ctx context.Context, id int) (models.Plan, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	plan, ok := m.state.plans[id]
+	if !ok {
+		return models.Plan{}, sql.ErrNoRows
+	}
+	return plan, nil
+}
+
+func (m *TestingRepo) InsertSubscription(ctx context.Context, subscription models.Subscription) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.state.plans[subscription.PlanID]; !ok {
+		return 0, errors.New("subscriptions_plan_id_fkey: plan does not exist")
+	}
+
+	subscription.ID = m.newID()
+	subscription.Plan = models.Plan{}
+	subscription.CreatedAt = time.Now()
+	subscription.UpdatedAt = time.Now()
+	m.state.subscriptions[subscription.ID] = subscription
+
+	return subscription.ID, nil
+}
+
+// withPlan fills in the joined plan, as the Postgres queries do
+func (m *TestingRepo) withPlan(s models.Subscription) models.Subscription {
+	s.Plan = m.state.plans[s.PlanID]
+	return s
+}
+
+func (m *TestingRepo) GetSubscriptionsByUserId(ctx context.Context, userID int) ([]models.Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var subscriptions []models.Subscription
+	for _, s := range m.state.subscriptions {
+		if s.UserID == userID {
+			subscriptions = append(subscriptions, m.withPlan(s))
+		}
+	}
+
+	slices.SortFunc(subscriptions, func(a, b models.Subscription) int {
+		return b.StartsAt.Compare(a.StartsAt)
+	})
+
+	return subscriptions, nil
+}
+
+func (m *TestingRepo) GetSubscriptionsExpiringBetween(ctx context.Context, from, to time.Time) ([]models.Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var subscriptions []models.Subscription
+	for _, s := range m.state.subscriptions {
+		if s.Status != "active" || s.ExpiresAt.Before(from) || !s.ExpiresAt.Before(to) {
+			continue
+		}
+		renewed := false
+		for _, later := range m.state.subscriptions {
+			if later.UserID == s.UserID && later.Status == "active" && later.ExpiresAt.After(s.ExpiresAt) {
+				renewed = true
+				break
+			}
+		}
+		if !renewed {
+			subscriptions = append(subscriptions, m.withPlan(s))
+		}
+	}
+
+	slices.SortFunc(subscriptions, func(a, b models.Subscription) int {
+		return a.ExpiresAt.Compare(b.ExpiresAt)
+	})
+
+	return subscriptions, nil
+}
+
+// LockSubscription only checks the subscription exists; TestingRepo serialises
+// every call
+func (m *TestingRepo) LockSubscription(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.state.subscriptions[id]; !ok {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (m *TestingRepo) GetActiveSubscriptionByUserId(ctx context.Context, userID int) (models.Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var active *models.Subscription
+	for _, s := range m.state.subscriptions {
+		if s.UserID != userID || !s.IsActive(now) {
+			continue
+		}
+		if active == nil || s.ExpiresAt.After(active.ExpiresAt) {
+			active = &s
+		}
+	}
+
+	if active == nil {
+		return models.Subscription{}, sql.ErrNoRows
+	}
+	return m.withPlan(*active), nil
+}
+
+func (m *TestingRepo) GetActiveSubscriptions(ctx context.Context) ([]models.Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	byUser := map[int]models.Subscription{}
+	for _, s := range m.state.subscriptions {
+		if !s.IsActive(now) {
+			continue
+		}
+		if active, ok := byUser[s.UserID]; !ok || s.ExpiresAt.After(active.ExpiresAt) {
+			byUser[s.UserID] = m.withPlan(s)
+		}
+	}
+
+	subscriptions := slices.Collect(maps.Values(byUser))
+	slices.SortFunc(subscriptions, func(a, b models.Subscription) int {
+		return a.UserID - b.UserID
+	})
+
+	return subscriptions, nil
+}
+
+func (m *TestingRepo) CountActiveSubscriptions(ctx context.Context) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	count := 0
+	for _, s := range m.state.subscriptions {
+		if s.IsActive(now) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (m *TestingRepo) GetVpnPeersByUserId(ctx context.Context, userID int) ([]models.VpnPeer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var peers []models.VpnPeer
+	for _, p := range m.state.peers {
+		if p.UserID == userID {
+			peers = append(peers, p)
+		}
+	}
+
+	slices.SortFunc(peers, func(a, b models.VpnPeer) int {
+		return a.ID - b.ID
+	})
+
+	return peers, nil
+}
+
+func (m *TestingRepo) GetVpnPeerById(ctx context.Context, id int) (models.VpnPeer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	peer, ok := m.state.peers[id]
+	if !ok {
+		return models.VpnPeer{}, sql.ErrNoRows
+	}
+	return peer, nil
+}
+
+func (m *TestingRepo) GetVpnPeerAddresses(ctx context.Context, nodeID int) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var addresses []string
+	for _, p := range m.state.peers {
+		if !p.IsRevoked() && p.NodeID == nodeID && p.Address != "" {
+			addresses = append(addresses, p.Address)
+		}
+	}
+	for _, r := range m.state.revocations {
+		if r.Served(now) && r.NodeID == nodeID && r.Address != "" {
+			addresses = append(addresses, r.Address)
+		}
+	}
+
+	return addresses, nil
+}
+
+// LockVpnPeerAddresses does nothing; TestingRepo serialises every call
+func (m *TestingRepo) LockVpnPeerAddresses(ctx context.Context, nodeID int) error {
+	return nil
+}
+
+// addressTaken reports whether another unrevoked peer than id holds address on
+// the node, which the unique index on vpn_peers rejects
+func (m *TestingRepo) addressTaken(id, nodeID int, address string) bool {
+	for _, p := range m.state.peers {
+		if p.ID != id && !p.IsRevoked() && p.NodeID == nodeID && address != "" && p.Address == address {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *TestingRepo) InsertVpnPeer(ctx context.Context, peer models.VpnPeer) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.state.nodes[peer.NodeID]; peer.NodeID != 0 && !ok {
+		return 0, errors.New("vpn_peers_node_id_fkey: node does not exist")
+	}
+
+	for _, p := range m.state.peers {
+		if p.PublicKey == peer.PublicKey {
+			return 0, ErrDuplicate
+		}
+	}
+	if m.addressTaken(0, peer.NodeID, peer.Address) {
+		return 0, ErrDuplicate
+	}
+
+	if peer.Protocol == "" {
+		peer.Protocol = models.ProtocolWireGuard
+	}
+	peer.ID = m.newID()
+	peer.CreatedAt = time.Now()
+	peer.UpdatedAt = peer.CreatedAt
+	peer.KeysRotatedAt = peer.CreatedAt
+	m.state.peers[peer.ID] = peer
+
+	return peer.ID, nil
+}
+
+func (m *TestingRepo) RevokeVpnPeer(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	peer, ok := m.state.peers[id]
+	if !ok || peer.IsRevoked() {
+		return nil
+	}
+
+	peer.RevokedAt = time.Now()
+	peer.UpdatedAt = peer.RevokedAt
+	m.state.peers[id] = peer
+
+	r := models.KeyRevocation{
+		ID:           m.newID(),
+		PeerID:       peer.ID,
+		NodeID:       peer.NodeID,
+		PublicKey:    peer.PublicKey,
+		PresharedKey: peer.PresharedKey,
+		Address:      peer.Address,
+		Reason:       models.KeysRevoked,
+		RxCounter:    peer.RxCounter,
+		TxCounter:    peer.TxCounter,
+		ServeUntil:   peer.RevokedAt,
+		CreatedAt:    peer.RevokedAt,
+	}
+	m.state.revocations[r.ID] = r
+
+	return nil
+}
+
+func (m *TestingRepo) RenameVpnPeer(ctx context.Context, id int, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	peer, ok := m.state.peers[id]
+	if !ok {
+		return nil
+	}
+
+	peer.Name = name
+	peer.UpdatedAt = time.Now()
+	m.state.peers[id] = peer
+
+	return nil
+}
+
+func (m *TestingRepo) UpdateVpnPeerKeys(ctx context.Context, peer models.VpnPeer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.state.peers[peer.ID]
+	if !ok || p.IsRevoked() {
+		return sql.ErrNoRows
+	}
+	if m.addressTaken(p.ID, p.NodeID, peer.Address) {
+		return ErrDuplicate
+	}
+
+	p.PublicKey = peer.PublicKey
+	p.PrivateKey = peer.PrivateKey
+	p.PresharedKey = peer.PresharedKey
+	p.Address = peer.Address
+	p.Certificate = ""
+	p.LastHandshakeAt = time.Time{}
+	p.RxCounter, p.TxCounter = 0, 0
+	p.KeysRotatedAt = time.Now()
+	p.UpdatedAt = p.KeysRotatedAt
+	m.state.peers[peer.ID] = p
+
+	return nil
+}
+
+func (m *TestingRepo) MoveVpnPeer(ctx context.Context, id, nodeID int, address string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.state.peers[id]
+	if !ok || p.IsRevoked() {
+		return sql.ErrNoRows
+	}
+	if m.addressTaken(id, nodeID, address) {
+		return ErrDuplicate
+	}
+
+	p.NodeID = nodeID
+	p.Address = address
+	p.LastHandshakeAt = time.Time{}
+	p.RxCounter, p.TxCounter = 0, 0
+	p.UpdatedAt = time.Now()
+	m.state.peers[id] = p
+
+	return nil
+}
+
+func (m *TestingRepo) SetVpnPeerCertificate(ctx context.Context, id int, publicKey, certificate string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.state.peers[id]
+	if !ok || p.PublicKey != publicKey {
+		return sql.ErrNoRows
+	}
+
+	p.Certificate = certificate
+	p.UpdatedAt = time.Now()
+	m.state.peers[id] = p
+
+	return nil
+}
+
+func (m *TestingRepo) CountActiveVpnPeers(ctx context.Context) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var count int
+	for _, p := range m.state.peers {
+		if !p.IsRevoked() {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (m *TestingRepo) GetServedVpnPeersByNodeId(ctx context.Context, nodeID int) ([]models.VpnPeer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var peers []models.VpnPeer
+	for _, p := range m.state.peers {
+		if p.NodeID != nodeID || p.IsRevoked() || !m.state.subscriptions[p.SubscriptionID].IsActive(now) ||
+			m.state.userQuotas[p.UserID].IsBlocked(now) {
+			continue
+		}
+		peers = append(peers, p)
+	}
+
+	slices.SortFunc(peers, func(a, b models.VpnPeer) int {
+		return a.ID - b.ID
+	})
+
+	return peers, nil
+}
+
+func (m *TestingRepo) UpdateVpnPeerHandshakes(ctx context.Context, nodeID int, handshakes map[string]time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, p := range m.state.peers {
+		at, ok := handshakes[p.PublicKey]
+		if !ok || p.NodeID != nodeID {
+			continue
+		}
+		p.LastHandshakeAt = at
+		m.state.peers[id] = p
+	}
+
+	return nil
+}
+
+func (m *TestingRepo) GetActiveVpnPeersByNodeId(ctx context.Context, nodeID int) ([]models.VpnPeer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var peers []models.VpnPeer
+	for _, p := range m.state.peers {
+		if p.NodeID == nodeID && !p.IsRevoked() {
+			peers = append(peers, p)
+		}
+	}
+
+	slices.SortFunc(peers, func(a, b models.VpnPeer) int {
+		return a.ID - b.ID
+	})
+
+	return peers, nil
+}
+
+func (m *TestingRepo) UpdateVpnPeerCounters(ctx context.Context, counters []models.PeerTraffic) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, c := range counters {
+		p, ok := m.state.peers[c.PeerID]
+		if !ok {
+			continue
+		}
+		p.RxCounter = c.RxBytes
+		p.TxCounter = c.TxBytes
+		m.state.peers[c.PeerID] = p
+	}
+
+	return nil
+}
+
+func (m *TestingRepo) InsertKeyRevocation(ctx context.Context, r models.KeyRevocation) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.state.peers[r.PeerID]; !ok {
+		return 0, errors.New("vpn_key_revocations_peer_id_fkey: peer does not exist")
+	}
+
+	r.ID = m.newID()
+	r.ConfirmedAt = time.Time{}
+	r.CreatedAt = time.Now()
+	r.PeerName = ""
+	m.state.revocations[r.ID] = r
+
+	return r.ID, nil
+}
+
+func (m *TestingRepo) GetKeyRevocationsByUserId(ctx context.Context, userID, limit int) ([]models.KeyRevocation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	revocations := m.keyRevocations(func(r models.KeyRevocation, p models.VpnPeer) bool {
+		return p.UserID == userID
+	})
+	slices.Reverse(revocations)
+	if len(revocations) > limit {
+		revocations = revocations[:limit]
+	}
+
+	return revocations, nil
+}
+
+func (m *TestingRepo) GetServedKeyRevocationsByNodeId(ctx context.Context, nodeID int) ([]models.KeyRevocation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	return m.keyRevocations(func(r models.KeyRevocation, p models.VpnPeer) bool {
+		return r.NodeID == nodeID && r.Served(now) && !p.IsRevoked() &&
+			m.state.subscriptions[p.SubscriptionID].IsActive(now) && !m.state.userQuotas[p.UserID].IsBlocked(now)
+	}), nil
+}
+
+func (m *TestingRepo) GetPendingKeyRevocationsByNodeId(ctx context.Context, nodeID int) ([]models.KeyRevocation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.keyRevocations(func(r models.KeyRevocation, p models.VpnPeer) bool {
+		return r.NodeID == nodeID && !r.IsConfirmed()
+	}), nil
+}
+
+func (m *TestingRepo) UpdateKeyRevocationCounters(ctx context.Context, counters []models.PeerTraffic) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, c := range counters {
+		r, ok := m.state.revocations[c.PeerID]
+		if !ok {
+			continue
+		}
+		r.RxCounter = c.RxBytes
+		r.TxCounter = c.TxBytes
+		m.state.revocations[c.PeerID] = r
+	}
+
+	return nil
+}
+
+func (m *TestingRepo) ConfirmKeyRevocations(ctx context.Context, nodeID int, present []string, at time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int
+	for id, r := range m.state.revocations {
+		if r.NodeID != nodeID || r.IsConfirmed() || r.ServeUntil.After(at) || slices.Contains(present, r.PublicKey) {
+			continue
+		}
+		r.ConfirmedAt = at
+		m.state.revocations[id] = r
+		n++
+	}
+
+	return n, nil
+}
+
+// keyRevocations returns the revocations matching keep, oldest first, with the
+// names of their peers filled in
+func (m *TestingRepo) keyRevocations(keep func(r models.KeyRevocation, p models.VpnPeer) bool) []models.KeyRevocation {
+	var revocations []models.KeyRevocation
+	for _, r := range m.state.revocations {
+		p := m.state.peers[r.PeerID]
+		if !keep(r, p) {
+			continue
+		}
+		r.PeerName = p.Name
+		r.Protocol = p.Protocol
+		revocations = append(revocations, r)
+	}
+
+	slices.SortFunc(revocations, func(a, b models.KeyRevocation) int {
+		return a.ID - b.ID
+	})
+
+	return revocations
+}
+
+// withActivePeers fills in the active peer count and the latest handshake of n
+func (m *TestingRepo) withActivePeers(n models.VpnNode) models.VpnNode {
+	n.ActivePeers = 0
+	n.LastHandshakeAt = time.Time{}
+	for _, p := range m.state.peers {
+		if p.NodeID == n.ID && !p.IsRevoked() {
+			n.ActivePeers++
+			if p.LastHandshakeAt.After(n.LastHandshakeAt) {
+				n.LastHandshakeAt = p.LastHandshakeAt
+			}
+		}
+	}
+	return n
+}
+
+func (m *TestingRepo) GetVpnNodes(ctx context.Context) ([]models.VpnNode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var nodes []models.VpnNode
+	for _, n := range m.state.nodes {
+		nodes = append(nodes, m.withActivePeers(n))
+	}
+
+	slices.SortFunc(nodes, func(a, b models.VpnNode) int {
+		if c := strings.Compare(a.Country, b.Country); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return nodes, nil
+}
+
+func (m *TestingRepo) GetVpnNodeById(ctx context.Context, id int) (models.VpnNode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, ok := m.state.nodes[id]
+	if !ok {
+		return models.VpnNode{}, sql.ErrNoRows
+	}
+	return m.withActivePeers(node), nil
+}
+
+func (m *TestingRepo) InsertVpnNode(ctx context.Context, node models.VpnNode) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, n := range m.state.nodes {
+		if n.Name == node.Name {
+			return 0, ErrDuplicate
+		}
+	}
+
+	node.ID = m.newID()
+	node.ActivePeers = 0
+	node.Health, node.HealthReason, node.HealthFailures = models.NodeHealthy, "", 0
+	node.HealthCheckedAt, node.HealthChangedAt = time.Time{}, time.Time{}
+	node.CreatedAt = time.Now()
+	node.UpdatedAt = node.CreatedAt
+	m.state.nodes[node.ID] = node
+
+	return node.ID, nil
+}
+
+func (m *TestingRepo) UpdateVpnNode(ctx context.Context, node models.VpnNode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.state.nodes[node.ID]
+	if !ok {
+		return nil
+	}
+	for _, n := range m.state.nodes {
+		if n.ID != node.ID && n.Name == node.Name {
+			return ErrDuplicate
+		}
+	}
+
+	node.ActivePeers = 0
+	node.AgentSeenAt = existing.AgentSeenAt
+	node.AgentAppliedAt = existing.AgentAppliedAt
+	node.AgentPeers = existing.AgentPeers
+	node.AgentError = existing.AgentError
+	node.Health = existing.Health
+	node.HealthReason = existing.HealthReason
+	node.HealthFailures = existing.HealthFailures
+	node.HealthCheckedAt = existing.HealthCheckedAt
+	node.HealthChangedAt = existing.HealthChangedAt
+	node.CreatedAt = existing.CreatedAt
+	node.UpdatedAt = time.Now()
+	m.state.nodes[node.ID] = node
+
+	return nil
+}
+
+func (m *TestingRepo) DeleteVpnNode(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.state.nodes[id]; !ok {
+		return sql.ErrNoRows
+	}
+	for _, p := range m.state.peers {
+		if p.NodeID == id {
+			return sql.ErrNoRows
+		}
+	}
+
+	delete(m.state.nodes, id)
+	delete(m.state.agentTokens, id)
+	return nil
+}
+
+func (m *TestingRepo) SelectVpnNode(ctx context.Context, country, protocol string, excludeID int) (models.VpnNode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var best *models.VpnNode
+	for _, n := range m.state.nodes {
+		n = m.withActivePeers(n)
+		if n.ID == excludeID || !n.AcceptsPeers() || !n.Serves(protocol) || (country != "" && n.Country != country) {
+			continue
+		}
+		if best == nil || lessLoaded(n, *best) {
+			best = &n
+		}
+	}
+
+	if best == nil {
+		return models.VpnNode{}, sql.ErrNoRows
+	}
+	return *best, nil
+}
+
+func (m *TestingRepo) SetVpnNodeAgentToken(ctx context.Context, id int, tokenHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.state.nodes[id]; !ok {
+		return nil
+	}
+	for nodeID, hash := range m.state.agentTokens {
+		if nodeID != id && hash == tokenHash {
+			return ErrDuplicate
+		}
+	}
+
+	m.state.agentTokens[id] = tokenHash
+	return nil
+}
+
+func (m *TestingRepo) GetVpnNodeByAgentToken(ctx context.Context, tokenHash string) (models.VpnNode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, hash := range m.state.agentTokens {
+		if hash == tokenHash {
+			return m.withActivePeers(m.state.nodes[id]), nil
+		}
+	}
+	return models.VpnNode{}, sql.ErrNoRows
+}
+
+func (m *TestingRepo) UpdateVpnNodeAgentStatus(ctx context.Context, status models.VpnNodeAgentStatus) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, ok := m.state.nodes[status.NodeID]
+	if !ok {
+		return nil
+	}
+
+	node.AgentSeenAt = time.Now()
+	if status.Applied {
+		node.AgentAppliedAt = node.AgentSeenAt
+	}
+	node.AgentPeers = status.Peers
+	node.AgentError = status.Error
+	m.state.nodes[node.ID] = node
+
+	return nil
+}
+
+func (m *TestingRepo) UpdateVpnNodeHealth(ctx context.Context, health models.VpnNodeHealth) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, ok := m.state.nodes[health.NodeID]
+	if !ok {
+		return nil
+	}
+
+	if node.Health != health.Health {
+		node.HealthChangedAt = health.CheckedAt
+	}
+	node.Health = health.Health
+	node.HealthReason = health.Reason
+	node.HealthFailures = health.Failures
+	node.HealthCheckedAt = health.CheckedAt
+	m.state.nodes[node.ID] = node
+
+	return nil
+}
+
+// lessLoaded orders nodes like SelectVpnNode: by load, then active peers, then ID
+func lessLoaded(a, b models.VpnNode) bool {
+	// compare ActivePeers/Capacity without rounding
+	if x, y := a.ActivePeers*b.Capacity, b.ActivePeers*a.Capacity; x != y {
+		return x < y
+	}
+	if a.ActivePeers != b.ActivePeers {
+		return a.ActivePeers < b.ActivePeers
+	}
+	return a.ID < b.ID
+}
+
+func (m *TestingRepo) GetInvoicesByUserId(ctx context.Context, userID int) ([]models.Invoice, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var invoices []models.Invoice
+	for _, i := range m.state.invoices {
+		if i.UserID == userID {
+			invoices = append(invoices, i)
+		}
+	}
+
+	slices.SortFunc(invoices, func(a, b models.Invoice) int {
+		return b.IssuedAt.Compare(a.IssuedAt)
+	})
+
+	return invoices, nil
+}
+
+func (m *TestingRepo) GetInvoiceById(ctx context.Context, id int) (models.Invoice, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	invoice, ok := m.state.invoices[id]
+	if !ok {
+		return models.Invoice{}, sql.ErrNoRows
+	}
+	return invoice, nil
+}
+
+func (m *TestingRepo) InsertInvoice(ctx context.Context, invoice models.Invoice) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, i := range m.state.invoices {
+		if i.Number == invoice.Number {
+			return 0, ErrDuplicate
+		}
+	}
+
+	invoice.ID = m.newID()
+	invoice.CreatedAt = time.Now()
+	invoice.UpdatedAt = time.Now()
+	m.state.invoices[invoice.ID] = invoice
+
+	return invoice.ID, nil
+}
+
+func (m *TestingRepo) GetAPITokensByUserId(ctx context.Context, userID int) ([]models.APIToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var apiTokens []models.APIToken
+	for _, t := range m.state.apiTokens {
+		if t.UserID == userID {
+			apiTokens = append(apiTokens, t)
+		}
+	}
+
+	slices.SortFunc(apiTokens, func(a, b models.APIToken) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+
+	return apiTokens, nil
+}
+
+func (m *TestingRepo) GetAPITokenByHash(ctx context.Context, hash string) (models.APIToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, t := range m.state.apiTokens {
+		if t.TokenHash == hash {
+			return t, nil
+		}
+	}
+	return models.APIToken{}, sql.ErrNoRows
+}
+
+func (m *TestingRepo) InsertAPIToken(ctx context.Context, token models.APIToken) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, t := range m.state.apiTokens {
+		if t.TokenHash == token.TokenHash {
+			return 0, ErrDuplicate
+		}
+	}
+
+	token.ID = m.newID()
+	token.CreatedAt = time.Now()
+	token.UpdatedAt = time.Now()
+	m.state.apiTokens[token.ID] = token
+
+	return token.ID, nil
+}
+
+func (m *TestingRepo) RevokeAPIToken(ctx context.Context, id, userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, ok := m.state.apiTokens[id]
+	if !ok || token.UserID != userID || !token.RevokedAt.IsZero() {
+		return sql.ErrNoRows
+	}
+
+	token.RevokedAt = time.Now()
+	token.UpdatedAt = token.RevokedAt
+	m.state.apiTokens[id] = token
+
+	return nil
+}
+
+func (m *TestingRepo) TouchAPIToken(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, ok := m.state.apiTokens[id]
+	if ok {
+		token.LastUsedAt = time.Now()
+		m.state.apiTokens[id] = token
+	}
+
+	return nil
+}
+
+func (m *TestingRepo) InsertOutboxMessage(ctx context.Context, msg models.OutboxMessage) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msg.ID = m.newID()
+	if msg.Channel == "" {
+		msg.Channel = models.ChannelEmail
+	}
+	msg.Status = models.OutboxPending
+	msg.Attempts = 0
+	msg.CreatedAt = time.Now()
+	msg.UpdatedAt = msg.CreatedAt
+	if msg.NextAttemptAt.IsZero() {
+		msg.NextAttemptAt = msg.CreatedAt
+	}
+	m.state.outbox[msg.ID] = msg
+
+	return msg.ID, nil
+}
+
+func (m *TestingRepo) ClaimOutboxMessages(ctx context.Context, limit int, lease time.Duration) ([]models.OutboxMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var due []models.OutboxMessage
+	for _, msg := range m.state.outbox {
+		pending := msg.Status == models.OutboxPending && !msg.NextAttemptAt.After(now)
+		expired := msg.Status == models.OutboxSending && msg.LockedUntil.Before(now)
+		if pending || expired {
+			due = append(due, msg)
+		}
+	}
+
+	slices.SortFunc(due, func(a, b models.OutboxMessage) int {
+		if c := a.NextAttemptAt.Compare(b.NextAttemptAt); c != 0 {
+			return c
+		}
+		return a.ID - b.ID
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	for i := range due {
+		due[i].Status = models.OutboxSending
+		due[i].LockedUntil = now.Add(lease)
+		due[i].UpdatedAt = now
+		m.state.outbox[due[i].ID] = due[i]
+	}
+
+	return due, nil
+}
+
+func (m *TestingRepo) UpdateOutboxMessage(ctx context.Context, msg models.OutboxMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.state.outbox[msg.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	stored.Status = msg.Status
+	stored.Attempts = msg.Attempts
+	stored.NextAttemptAt = msg.NextAttemptAt
+	stored.LockedUntil = msg.LockedUntil
+	stored.LastError = msg.LastError
+	stored.SentAt = msg.SentAt
+	stored.UpdatedAt = time.Now()
+	m.state.outbox[msg.ID] = stored
+
+	return nil
+}
+
+func (m *TestingRepo) RetryOutboxMessage(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msg, ok := m.state.outbox[id]
+	if !ok || msg.Status != models.OutboxDead {
+		return sql.ErrNoRows
+	}
+
+	msg.Status = models.OutboxPending
+	msg.Attempts = 0
+	msg.NextAttemptAt = time.Now()
+	msg.LockedUntil = time.Time{}
+	msg.UpdatedAt = msg.NextAttemptAt
+	m.state.outbox[id] = msg
+
+	return nil
+}
+
+func (m *TestingRepo) GetOutboxMessages(ctx context.Context, status string, limit int) ([]models.OutboxMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var messages []models.OutboxMessage
+	for _, msg := range m.state.outbox {
+		if status == "" || msg.Status == status {
+			messages = append(messages, msg)
+		}
+	}
+
+	slices.SortFunc(messages, func(a, b models.OutboxMessage) int {
+		if c := b.CreatedAt.Compare(a.CreatedAt); c != 0 {
+			return c
+		}
+		return b.ID - a.ID
+	})
+	if len(messages) > limit {
+		messages = messages[:limit]
+	}
+
+	return messages, nil
+}
+
+func (m *TestingRepo) CountOutboxMessagesByStatus(ctx context.Context) (map[string]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counts := map[string]int{}
+	for _, msg := range m.state.outbox {
+		counts[msg.Status]++
+	}
+
+	return counts, nil
+}
+
+func (m *TestingRepo) CountOutboxSentSince(ctx context.Context, recipient string, since time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var count int
+	for _, msg := range m.state.outbox {
+		if msg.Recipient == recipient && msg.Status == models.OutboxSent && !msg.SentAt.Before(since) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (m *TestingRepo) InsertNotification(ctx context.Context, notification models.Notification) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if notification.DedupeKey != "" {
+		for _, n := range m.state.notifications {
+			if n.UserID == notification.UserID && n.DedupeKey == notification.DedupeKey {
+				return 0, nil
+			}
+		}
+	}
+
+	notification.ID = m.newID()
+	notification.CreatedAt = time.Now()
+	notification.UpdatedAt = notification.CreatedAt
+	m.state.notifications[notification.ID] = notification
+
+	return notification.ID, nil
+}
+
+func (m *TestingRepo) GetNotificationsByUserId(ctx context.Context, userID, limit int) ([]models.Notification, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var notifications []models.Notification
+	for _, n := range m.state.notifications {
+		if n.UserID == userID && n.InApp {
+			notifications = append(notifications, n)
+		}
+	}
+
+	slices.SortFunc(notifications, func(a, b models.Notification) int {
+		if c := b.CreatedAt.Compare(a.CreatedAt); c != 0 {
+			return c
+		}
+		return b.ID - a.ID
+	})
+	if len(notifications) > limit {
+		notifications = notifications[:limit]
+	}
+
+	return notifications, nil
+}
+
+func (m *TestingRepo) CountUnreadNotifications(ctx context.Context, userID int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var count int
+	for _, n := range m.state.notifications {
+		if n.UserID == userID && n.InApp && !n.IsRead() {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (m *TestingRepo) MarkNotificationsRead(ctx context.Context, userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for id, n := range m.state.notifications {
+		if n.UserID == userID && !n.IsRead() {
+			n.ReadAt = now
+			n.UpdatedAt = now
+			m.state.notifications[id] = n
+		}
+	}
+
+	return nil
+}
+
+func (m *TestingRepo) GetNotificationPreferences(ctx context.Context, userID int) (models.NotificationPreferences, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prefs, ok := m.state.notifyPrefs[userID]
+	if ok {
+		return prefs, nil
+	}
+
+	prefs = models.NotificationPreferences{
+		ID:        m.newID(),
+		UserID:    userID,
+		Email:     true,
+		InApp:     true,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	m.state.notifyPrefs[userID] = prefs
+
+	return prefs, nil
+}
+
+func (m *TestingRepo) UpdateNotificationPreferences(ctx context.Context, prefs models.NotificationPreferences) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.state.notifyPrefs[prefs.UserID]
+	if !ok {
+		return nil
+	}
+
+	prefs.ID = existing.ID
+	prefs.CreatedAt = existing.CreatedAt
+	prefs.UpdatedAt = time.Now()
+	m.state.notifyPrefs[prefs.UserID] = prefs
+
+	return nil
+}
+
+func (m *TestingRepo) AddPeerUsage(ctx context.Context, at time.Time, traffic []models.PeerTraffic) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, t := range traffic {
+		for _, period := range models.UsagePeriods {
+			start := models.UsageBucket(period, at)
+			key := usageKey{peerID: t.PeerID, period: period, start: start.Unix()}
+			point := m.state.usage[key]
+			point.BucketStart = start
+			point.RxBytes += t.RxBytes
+			point.TxBytes += t.TxBytes
+			m.state.usage[key] = point
+		}
+	}
+
+	return nil
+}
+
+func (m *TestingRepo) GetUsageByUserId(ctx context.Context, userID int, period string, from time.Time) ([]models.UsagePoint, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	byStart := map[int64]models.UsagePoint{}
+	for key, point := range m.state.usage {
+		if key.period != period || m.state.peers[key.peerID].UserID != userID || point.BucketStart.Before(from) {
+			continue
+		}
+		sum := byStart[key.start]
+		sum.BucketStart = point.BucketStart
+		sum.RxBytes += point.RxBytes
+		sum.TxBytes += point.TxBytes
+		byStart[key.start] = sum
+	}
+
+	points := slices.Collect(maps.Values(byStart))
+	slices.SortFunc(points, func(a, b models.UsagePoint) int {
+		return a.BucketStart.Compare(b.BucketStart)
+	})
+
+	return points, nil
+}
+
+func (m *TestingRepo) GetPeerTrafficByUserId(ctx context.Context, userID int, period string, from time.Time) ([]models.PeerTraffic, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	byPeer := map[int]models.PeerTraffic{}
+	for key, point := range m.state.usage {
+		if key.period != period || m.state.peers[key.peerID].UserID != userID || point.BucketStart.Before(from) {
+			continue
+		}
+		sum := byPeer[key.peerID]
+		sum.PeerID = key.peerID
+		sum.RxBytes += point.RxBytes
+		sum.TxBytes += point.TxBytes
+		byPeer[key.peerID] = sum
+	}
+
+	traffic := slices.Collect(maps.Values(byPeer))
+	slices.SortFunc(traffic, func(a, b models.PeerTraffic) int {
+		return cmp.Compare(a.PeerID, b.PeerID)
+	})
+
+	return traffic, nil
+}
+
+func (m *TestingRepo) DeletePeerUsageBefore(ctx context.Context, period string, before time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int
+	for key, point := range m.state.usage {
+		if key.period == period && point.BucketStart.Before(before) {
+			delete(m.state.usage, key)
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (m *TestingRepo) GetUserQuota(ctx context.Context, userID int) (models.UserQuota, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	q, ok := m.state.userQuotas[userID]
+	if !ok {
+		return models.UserQuota{UserID: userID, DataCapBytes: models.QuotaFromPlan, DeviceLimit: models.QuotaFromPlan}, nil
+	}
+	return q, nil
+}
+
+// quota returns the stored quota row of a user, or a new one keeping the plan's limits
+func (m *TestingRepo) quota(userID int) models.UserQuota {
+	q, ok := m.state.userQuotas[userID]
+	if !ok {
+		q = models.UserQuota{UserID: userID, DataCapBytes: models.QuotaFromPlan, DeviceLimit: models.QuotaFromPlan, CreatedAt: time.Now()}
+	}
+	q.UpdatedAt = time.Now()
+	return q
+}
+
+func (m *TestingRepo) UpdateUserQuotaOverride(ctx context.Context, quota models.UserQuota) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	q := m.quota(quota.UserID)
+	q.DataCapBytes = quota.DataCapBytes
+	q.DeviceLimit = quota.DeviceLimit
+	q.Note = quota.Note
+	m.state.userQuotas[quota.UserID] = q
+
+	return nil
+}
+
+func (m *TestingRepo) SetUserQuotaBlock(ctx context.Context, userID int, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	q := m.quota(userID)
+	q.BlockedUntil = until
+	m.state.userQuotas[userID] = q
+
+	return nil
+}
+
+func (m *TestingRepo) GetTopUpPacks(ctx context.Context) ([]models.TopUpPack, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	packs := slices.Collect(maps.Values(m.state.topUpPacks))
+	slices.SortFunc(packs, func(a, b models.TopUpPack) int {
+		if a.DataBytes != b.DataBytes {
+			return cmp.Compare(a.DataBytes, b.DataBytes)
+		}
+		return a.ID - b.ID
+	})
+
+	return packs, nil
+}
+
+func (m *TestingRepo) GetTopUpPackById(ctx context.Context, id int) (models.TopUpPack, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pack, ok := m.state.topUpPacks[id]
+	if !ok {
+		return models.TopUpPack{}, sql.ErrNoRows
+	}
+	return pack, nil
+}
+
+func (m *TestingRepo) InsertTopUp(ctx context.Context, topUp models.TopUp) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.state.topUpPacks[topUp.PackID]; !ok {
+		return 0, errors.New("topups_pack_id_fkey: pack does not exist")
+	}
+
+	topUp.ID = m.newID()
+	topUp.CreatedAt = time.Now()
+	m.state.topUps[topUp.ID] = topUp
+
+	return topUp.ID, nil
+}
+
+func (m *TestingRepo) SumTopUpBytes(ctx context.Context, userID int, at time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var total int64
+	for _, t := range m.state.topUps {
+		if t.UserID == userID && !t.StartsAt.After(at) && t.ExpiresAt.After(at) {
+			total += t.DataBytes
+		}
+	}
+
+	return total, nil
+}
+
+func (m *TestingRepo) SetTelegramLinkCode(ctx context.Context, userID int, codeHash string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.state.telegramCodes[userID] = telegramLinkCode{hash: codeHash, expiresAt: expiresAt}
+
+	return nil
+}
+
+func (m *TestingRepo) LinkTelegramChat(ctx context.Context, codeHash string, chatID int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for userID, code := range m.state.telegramCodes {
+		if code.hash != codeHash || !code.expiresAt.After(time.Now()) {
+			continue
+		}
+		delete(m.state.telegramCodes, userID)
+		m.state.telegramChats[chatID] = userID
+		return userID, nil
+	}
+
+	return 0, sql.ErrNoRows
+}
+
+func (m *TestingRepo) GetUserIdByTelegramChat(ctx context.Context, chatID int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	userID, ok := m.state.telegramChats[chatID]
+	if !ok {
+		return 0, sql.ErrNoRows
+	}
+
+	return userID, nil
+}
+
+func (m *TestingRepo) SetSubscriptionToken(ctx context.Context, userID int, tokenHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, hash := range m.state.subTokens {
+		if id != userID && hash == tokenHash {
+			return ErrDuplicate
+		}
+	}
+
+	m.state.subTokens[userID] = tokenHash
+	return nil
+}
+
+func (m *TestingRepo) GetUserIdBySubscriptionToken(ctx context.Context, tokenHash string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, hash := range m.state.subTokens {
+		if hash == tokenHash {
+			return id, nil
+		}
+	}
+	return 0, sql.ErrNoRows
+}
+
+func (m *TestingRepo) GetCertificateAuthority(ctx context.Context) (models.CertificateAuthority, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.state.ca == nil {
+		return models.CertificateAuthority{}, sql.ErrNoRows
+	}
+	return *m.state.ca, nil
+}
+
+func (m *TestingRepo) InsertCertificateAuthority(ctx context.Context, ca models.CertificateAuthority) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.state.ca != nil {
+		return nil
+	}
+
+	ca.CRL, ca.CRLNumber = "", 0
+	ca.CreatedAt = time.Now()
+	ca.UpdatedAt = ca.CreatedAt
+	m.state.ca = &ca
+
+	return nil
+}
+
+func (m *TestingRepo) UpdateCRL(ctx context.Context, number int64, crl string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.state.ca == nil || m.state.ca.CRLNumber != number-1 {
+		return false, nil
+	}
+
+	ca := *m.state.ca
+	ca.CRL, ca.CRLNumber = crl, number
+	ca.UpdatedAt = time.Now()
+	m.state.ca = &ca
+
+	return true, nil
+}
+
+func (m *TestingRepo) GetRevokedCertificates(ctx context.Context, now time.Time) ([]models.RevokedCertificate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var revoked []models.RevokedCertificate
+	for _, r := range m.state.revocations {
+		if m.state.peers[r.PeerID].Protocol == models.ProtocolOpenVPN && !r.Served(now) {
+			revoked = append(revoked, models.RevokedCertificate{Serial: r.PublicKey, RevokedAt: r.ServeUntil})
+		}
+	}
+	for _, p := range m.state.peers {
+		if p.Protocol != models.ProtocolOpenVPN || p.IsRevoked() {
+			continue
+		}
+		if !m.state.subscriptions[p.SubscriptionID].IsActive(now) || m.state.userQuotas[p.UserID].IsBlocked(now) {
+			revoked = append(revoked, models.RevokedCertificate{Serial: p.PublicKey, RevokedAt: now})
+		}
+	}
+
+	slices.SortFunc(revoked, func(a, b models.RevokedCertificate) int {
+		if c := a.RevokedAt.Compare(b.RevokedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Serial, b.Serial)
+	})
+
+	return revoked, nil
+}
@@ -1,16 +1,135 @@
 package repository
 
-import "github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+import (
+	"context"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+)
 
 type DatabaseRepo interface {
 	AllUsers() bool
 
-	GetUserById(id int) (models.User, error)
-	UpdateUser(user models.User) error
-	Authenticate(email, testPassword string) (int, string, error)
+	// WithTx runs fn inside a transaction; fn must use the repo it is given
+	WithTx(ctx context.Context, fn func(repo DatabaseRepo) error) error
+	// WithLock runs fn holding the advisory lock key unless another replica
+	// holds it, and reports whether fn ran
+	WithLock(ctx context.Context, key int64, fn func() error) (bool, error)
+
+	GetUserById(ctx context.Context, id int) (models.User, error)
+	UpdateUser(ctx context.Context, user models.User) error
+	Authenticate(ctx context.Context, email, testPassword string) (int, string, error)
+	GetAdminUserIds(ctx context.Context) ([]int, error)
 
 	// User Login Security methods
-	GetUserLoginSecurity(userID int) (models.UserLoginSecurity, error)
-	UpdateUserLoginSecurity(security models.UserLoginSecurity) error
-	CreateUserLoginSecurity(security models.UserLoginSecurity) error
+	GetUserLoginSecurity(ctx context.Context, userID int) (models.UserLoginSecurity, error)
+	UpdateUserLoginSecurity(ctx context.Context, security models.UserLoginSecurity) error
+	CreateUserLoginSecurity(ctx context.Context, security models.UserLoginSecurity) error
+
+	// Plan and subscription methods
+	GetPlans(ctx context.Context) ([]models.Plan, error)
+	GetPlanById(ctx context.Context, id int) (models.Plan, error)
+	InsertSubscription(ctx context.Context, subscription models.Subscription) (int, error)
+	GetSubscriptionsByUserId(ctx context.Context, userID int) ([]models.Subscription, error)
+	GetActiveSubscriptionByUserId(ctx context.Context, userID int) (models.Subscription, error)
+	GetActiveSubscriptions(ctx context.Context) ([]models.Subscription, error)
+	CountActiveSubscriptions(ctx context.Context) (int, error)
+	GetSubscriptionsExpiringBetween(ctx context.Context, from, to time.Time) ([]models.Subscription, error)
+	LockSubscription(ctx context.Context, id int) error
+
+	// VPN peer methods
+	GetVpnPeersByUserId(ctx context.Context, userID int) ([]models.VpnPeer, error)
+	GetVpnPeerById(ctx context.Context, id int) (models.VpnPeer, error)
+	GetVpnPeerAddresses(ctx context.Context, nodeID int) ([]string, error)
+	LockVpnPeerAddresses(ctx context.Context, nodeID int) error
+	InsertVpnPeer(ctx context.Context, peer models.VpnPeer) (int, error)
+	RevokeVpnPeer(ctx context.Context, id int) error
+	RenameVpnPeer(ctx context.Context, id int, name string) error
+	UpdateVpnPeerKeys(ctx context.Context, peer models.VpnPeer) error
+	SetVpnPeerCertificate(ctx context.Context, id int, publicKey, certificate string) error
+	MoveVpnPeer(ctx context.Context, id, nodeID int, address string) error
+	CountActiveVpnPeers(ctx context.Context) (int, error)
+	GetServedVpnPeersByNodeId(ctx context.Context, nodeID int) ([]models.VpnPeer, error)
+	UpdateVpnPeerHandshakes(ctx context.Context, nodeID int, handshakes map[string]time.Time) error
+	GetActiveVpnPeersByNodeId(ctx context.Context, nodeID int) ([]models.VpnPeer, error)
+	UpdateVpnPeerCounters(ctx context.Context, counters []models.PeerTraffic) error
+
+	// Key revocation methods
+	InsertKeyRevocation(ctx context.Context, revocation models.KeyRevocation) (int, error)
+	GetKeyRevocationsByUserId(ctx context.Context, userID, limit int) ([]models.KeyRevocation, error)
+	GetServedKeyRevocationsByNodeId(ctx context.Context, nodeID int) ([]models.KeyRevocation, error)
+	GetPendingKeyRevocationsByNodeId(ctx context.Context, nodeID int) ([]models.KeyRevocation, error)
+	UpdateKeyRevocationCounters(ctx context.Context, counters []models.PeerTraffic) error
+	ConfirmKeyRevocations(ctx context.Context, nodeID int, present []string, at time.Time) (int, error)
+
+	// VPN node methods
+	GetVpnNodes(ctx context.Context) ([]models.VpnNode, error)
+	GetVpnNodeById(ctx context.Context, id int) (models.VpnNode, error)
+	InsertVpnNode(ctx context.Context, node models.VpnNode) (int, error)
+	UpdateVpnNode(ctx context.Context, node models.VpnNode) error
+	DeleteVpnNode(ctx context.Context, id int) error
+	SelectVpnNode(ctx context.Context, country, protocol string, excludeID int) (models.VpnNode, error)
+	SetVpnNodeAgentToken(ctx context.Context, id int, tokenHash string) error
+	GetVpnNodeByAgentToken(ctx context.Context, tokenHash string) (models.VpnNode, error)
+	UpdateVpnNodeAgentStatus(ctx context.Context, status models.VpnNodeAgentStatus) error
+	UpdateVpnNodeHealth(ctx context.Context, health models.VpnNodeHealth) error
+
+	// Invoice methods
+	GetInvoicesByUserId(ctx context.Context, userID int) ([]models.Invoice, error)
+	GetInvoiceById(ctx context.Context, id int) (models.Invoice, error)
+	InsertInvoice(ctx context.Context, invoice models.Invoice) (int, error)
+
+	// API token methods
+	GetAPITokensByUserId(ctx context.Context, userID int) ([]models.APIToken, error)
+	GetAPITokenByHash(ctx context.Context, hash string) (models.APIToken, error)
+	InsertAPIToken(ctx context.Context, token models.APIToken) (int, error)
+	RevokeAPIToken(ctx context.Context, id, userID int) error
+	TouchAPIToken(ctx context.Context, id int) error
+
+	// Outbox methods
+	InsertOutboxMessage(ctx context.Context, msg models.OutboxMessage) (int, error)
+	ClaimOutboxMessages(ctx context.Context, limit int, lease time.Duration) ([]models.OutboxMessage, error)
+	UpdateOutboxMessage(ctx context.Context, msg models.OutboxMessage) error
+	RetryOutboxMessage(ctx context.Context, id int) error
+	GetOutboxMessages(ctx context.Context, status string, limit int) ([]models.OutboxMessage, error)
+	CountOutboxMessagesByStatus(ctx context.Context) (map[string]int, error)
+	CountOutboxSentSince(ctx context.Context, recipient string, since time.Time) (int, error)
+
+	// Notification methods
+	InsertNotification(ctx context.Context, notification models.Notification) (int, error)
+	GetNotificationsByUserId(ctx context.Context, userID, limit int) ([]models.Notification, error)
+	CountUnreadNotifications(ctx context.Context, userID int) (int, error)
+	MarkNotificationsRead(ctx context.Context, userID int) error
+	GetNotificationPreferences(ctx context.Context, userID int) (models.NotificationPreferences, error)
+	UpdateNotificationPreferences(ctx context.Context, prefs models.NotificationPreferences) error
+
+	// Usage methods
+	AddPeerUsage(ctx context.Context, at time.Time, traffic []models.PeerTraffic) error
+	GetUsageByUserId(ctx context.Context, userID int, period string, from time.Time) ([]models.UsagePoint, error)
+	GetPeerTrafficByUserId(ctx context.Context, userID int, period string, from time.Time) ([]models.PeerTraffic, error)
+	DeletePeerUsageBefore(ctx context.Context, period string, before time.Time) (int, error)
+
+	// Quota methods
+	GetUserQuota(ctx context.Context, userID int) (models.UserQuota, error)
+	UpdateUserQuotaOverride(ctx context.Context, quota models.UserQuota) error
+	SetUserQuotaBlock(ctx context.Context, userID int, until time.Time) error
+	GetTopUpPacks(ctx context.Context) ([]models.TopUpPack, error)
+	GetTopUpPackById(ctx context.Context, id int) (models.TopUpPack, error)
+	InsertTopUp(ctx context.Context, topUp models.TopUp) (int, error)
+	SumTopUpBytes(ctx context.Context, userID int, at time.Time) (int64, error)
+
+	// Telegram methods
+	SetTelegramLinkCode(ctx context.Context, userID int, codeHash string, expiresAt time.Time) error
+	LinkTelegramChat(ctx context.Context, codeHash string, chatID int64) (int, error)
+	GetUserIdByTelegramChat(ctx context.Context, chatID int64) (int, error)
+
+	// Subscription URL methods
+	SetSubscriptionToken(ctx context.Context, userID int, tokenHash string) error
+	GetUserIdBySubscriptionToken(ctx context.Context, tokenHash string) (int, error)
+
+	// Certificate authority methods
+	GetCertificateAuthority(ctx context.Context) (models.CertificateAuthority, error)
+	InsertCertificateAuthority(ctx context.Context, ca models.CertificateAuthority) error
+	UpdateCRL(ctx context.Context, number int64, crl string) (bool, error)
+	GetRevokedCertificates(ctx context.Context, now time.Time) ([]models.RevokedCertificate, error)
 }
@@ -0,0 +1,107 @@
+// Package rotation replaces the keys of VPN peers: on the schedule
+// of their plan, keeping the old keys working for a grace window, or at once
+// when a config leaked. The old keys go to the revocation list, where the node
+// agents confirm them gone.
+package rotation
+
+import (
+	"context"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/repository"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/vpn"
+)
+
+// Reissue gives peer new keys and revokes the old ones at once; the node drops
+// them on its next sync. The peer keeps its address.
+func Reissue(ctx context.Context, repo repository.DatabaseRepo, peer models.VpnPeer, now time.Time) (models.VpnPeer, models.KeyRevocation, error) {
+	return replaceKeys(ctx, repo, peer, peer.Address, models.KeysReissued, now)
+}
+
+// Rotate gives peer new keys and, for tunneled protocols, a new address in
+// subnet, the subnet of its node. The node serves the old keys on the old
+// address until grace has passed, so configs downloaded before keep working
+// until then.
+func Rotate(ctx context.Context, repo repository.DatabaseRepo, peer models.VpnPeer, subnet string, grace time.Duration, now time.Time) (models.VpnPeer, models.KeyRevocation, error) {
+	protocol, err := vpn.Lookup(peer.Protocol)
+	if err != nil {
+		return models.VpnPeer{}, models.KeyRevocation{}, err
+	}
+	if !protocol.Tunneled() {
+		return replaceKeys(ctx, repo, peer, peer.Address, models.KeysRotated, now.Add(grace))
+	}
+
+	// a WireGuard interface routes an address to a single peer, so the old
+	// and the new keys cannot share one. The new address stays locked until
+	// the peer holding it is stored.
+	var revocation models.KeyRevocation
+	err = repo.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		err := repo.LockVpnPeerAddresses(ctx, peer.NodeID)
+		if err != nil {
+			return err
+		}
+		used, err := repo.GetVpnPeerAddresses(ctx, peer.NodeID)
+		if err != nil {
+			return err
+		}
+		address, err := vpn.NextAddress(subnet, used)
+		if err != nil {
+			return err
+		}
+
+		peer, revocation, err = replaceKeys(ctx, repo, peer, address, models.KeysRotated, now.Add(grace))
+		return err
+	})
+	if err != nil {
+		return models.VpnPeer{}, models.KeyRevocation{}, err
+	}
+
+	return peer, revocation, nil
+}
+
+// replaceKeys stores new keys and address for peer and adds its old keys to
+// the revocation list, served until serveUntil
+func replaceKeys(ctx context.Context, repo repository.DatabaseRepo, peer models.VpnPeer, address, reason string, serveUntil time.Time) (models.VpnPeer, models.KeyRevocation, error) {
+	protocol, err := vpn.Lookup(peer.Protocol)
+	if err != nil {
+		return models.VpnPeer{}, models.KeyRevocation{}, err
+	}
+	credentials, err := protocol.NewCredentials()
+	if err != nil {
+		return models.VpnPeer{}, models.KeyRevocation{}, err
+	}
+
+	revocation := models.KeyRevocation{
+		PeerID:       peer.ID,
+		NodeID:       peer.NodeID,
+		PublicKey:    peer.PublicKey,
+		PresharedKey: peer.PresharedKey,
+		Address:      peer.Address,
+		Reason:       reason,
+		RxCounter:    peer.RxCounter,
+		TxCounter:    peer.TxCounter,
+		ServeUntil:   serveUntil,
+		PeerName:     peer.Name,
+		Protocol:     peer.Protocol,
+	}
+
+	peer.PublicKey, peer.PrivateKey, peer.PresharedKey = credentials.PublicKey, credentials.PrivateKey, credentials.PresharedKey
+	peer.Address = address
+	peer.LastHandshakeAt = time.Time{}
+	peer.RxCounter, peer.TxCounter = 0, 0
+
+	err = repo.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		var err error
+		revocation.ID, err = repo.InsertKeyRevocation(ctx, revocation)
+		if err != nil {
+			return err
+		}
+		return repo.UpdateVpnPeerKeys(ctx, peer)
+	})
+	if err != nil {
+		return models.VpnPeer{}, models.KeyRevocation{}, err
+	}
+
+	return peer, revocation, nil
+}
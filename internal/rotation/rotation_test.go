@@ -0,0 +1,181 @@
+package rotation
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/config"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/email"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/notify"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/outbox"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/repository/dbrepo"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/vpn"
+)
+
+// addPeer stores a peer with fresh keys on subscription subID
+func addPeer(t *testing.T, repo *dbrepo.TestingRepo, userID, subID int, name, address string) models.VpnPeer {
+	t.Helper()
+
+	private, public, err := vpn.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := models.VpnPeer{
+		UserID: userID, SubscriptionID: subID, Name: name,
+		PublicKey: public, PrivateKey: private, PresharedKey: "psk", Address: address,
+	}
+	peer.ID, err = repo.InsertVpnPeer(context.Background(), peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err = repo.GetVpnPeerById(context.Background(), peer.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return peer
+}
+
+func TestReissue(t *testing.T) {
+	ctx := context.Background()
+	repo := dbrepo.NewTestingRepo(&config.AppConfig{})
+	peer := addPeer(t, repo, 1, 2, "Laptop", "10.8.0.2/32")
+	if err := repo.UpdateVpnPeerCounters(ctx, []models.PeerTraffic{{PeerID: peer.ID, RxBytes: 10, TxBytes: 20}}); err != nil {
+		t.Fatal(err)
+	}
+	peer, _ = repo.GetVpnPeerById(ctx, peer.ID)
+
+	now := time.Now()
+	reissued, revocation, err := Reissue(ctx, repo, peer, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reissued.PublicKey == peer.PublicKey || reissued.PrivateKey == peer.PrivateKey || reissued.Address != peer.Address {
+		t.Fatalf("expected new keys on the same address, got %+v", reissued)
+	}
+	if revocation.PublicKey != peer.PublicKey || revocation.Reason != models.KeysReissued || revocation.Served(now) {
+		t.Fatalf("expected the old keys revoked at once, got %+v", revocation)
+	}
+	if revocation.RxCounter != 10 || revocation.TxCounter != 20 {
+		t.Fatalf("expected the old keys to keep their counters, got %+v", revocation)
+	}
+
+	stored, err := repo.GetVpnPeerById(ctx, peer.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.PublicKey != reissued.PublicKey || stored.RxCounter != 0 || !stored.KeysRotatedAt.After(peer.KeysRotatedAt) {
+		t.Fatalf("expected the new keys stored with reset counters, got %+v", stored)
+	}
+}
+
+func TestRotator(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	repo := dbrepo.NewTestingRepo(&config.AppConfig{Logger: logger})
+
+	mailTemplates, err := email.ParseTemplates("../../templates/email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	templates, err := notify.ParseTemplates("../../templates/notifications")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := outbox.NewQueue(repo, config.Defaults().Outbox, logger)
+	notifier := notify.NewNotifier(repo, templates, email.NewService(queue, mailTemplates, "Fastnet VPN <no-reply@example.com>", logger), logger)
+	rotator := NewRotator(repo, notifier, config.Defaults().Rotation, "10.8.0.0/24", logger)
+
+	userID, err := repo.AddUser(models.User{Username: "jane", Email: "jane@example.com"}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	rotating := repo.AddPlan(models.Plan{Name: "Secure", DurationDays: 90, KeyRotationDays: 30, KeyGraceHours: 48})
+	subID, err := repo.InsertSubscription(ctx, models.Subscription{
+		UserID: userID, PlanID: rotating, Status: "active", StartsAt: now.Add(-time.Hour), ExpiresAt: now.AddDate(0, 3, 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	laptop := addPeer(t, repo, userID, subID, "Laptop", "10.8.0.2/32")
+	phone := addPeer(t, repo, userID, subID, "Phone", "10.8.0.3/32")
+	if err := repo.RevokeVpnPeer(ctx, phone.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	otherID, err := repo.AddUser(models.User{Username: "john", Email: "john@example.com"}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := repo.AddPlan(models.Plan{Name: "Monthly", DurationDays: 30})
+	otherSub, err := repo.InsertSubscription(ctx, models.Subscription{
+		UserID: otherID, PlanID: plain, Status: "active", StartsAt: now.Add(-time.Hour), ExpiresAt: now.AddDate(0, 3, 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := addPeer(t, repo, otherID, otherSub, "Laptop", "10.8.0.4/32")
+
+	run := func(at time.Time) int {
+		t.Helper()
+		n, err := rotator.RunOnce(ctx, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	if n := run(now.AddDate(0, 0, 29)); n != 0 {
+		t.Fatalf("expected no keys due before 30 days, rotated %d", n)
+	}
+
+	due := now.AddDate(0, 0, 31)
+	if n := run(due); n != 1 {
+		t.Fatalf("expected only the laptop to be rotated, rotated %d", n)
+	}
+
+	rotated, err := repo.GetVpnPeerById(ctx, laptop.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.PublicKey == laptop.PublicKey || rotated.Address == laptop.Address {
+		t.Fatalf("expected new keys on a new address, got %+v", rotated)
+	}
+	if unchanged, _ := repo.GetVpnPeerById(ctx, other.ID); unchanged.PublicKey != other.PublicKey {
+		t.Fatal("expected the peer of a plan without rotation to keep its keys")
+	}
+
+	served, err := repo.GetServedKeyRevocationsByNodeId(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(served) != 1 || served[0].PublicKey != laptop.PublicKey || served[0].Address != laptop.Address ||
+		!served[0].ServeUntil.Equal(due.Add(48*time.Hour)) {
+		t.Fatalf("expected the old laptop keys served for the grace window, got %+v", served)
+	}
+	addresses, err := repo.GetVpnPeerAddresses(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addresses) != 3 {
+		t.Fatalf("expected the old address to stay taken during the grace window, got %v", addresses)
+	}
+
+	feed, err := repo.GetNotificationsByUserId(ctx, userID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(feed) != 1 || feed[0].Event != notify.EventKeysRotated || feed[0].Link != "/devices" {
+		t.Fatalf("expected the user to be told to download the config again, got %+v", feed)
+	}
+
+	// the repository stamps the new keys with the wall clock
+	if n := run(time.Now().AddDate(0, 0, 29)); n != 0 {
+		t.Fatalf("expected freshly rotated keys to be left alone, rotated %d", n)
+	}
+}
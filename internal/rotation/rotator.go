@@ -0,0 +1,144 @@
+package rotation
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/config"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/notify"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/repository"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/worker"
+)
+
+// lockKey is the advisory lock held while rotating, so of several replicas
+// only one rotates the keys due
+const lockKey int64 = 0x66617374_726f7461 // "fastrota"
+
+// Rotator rotates the keys of the peers whose plan asks for it once they are
+// KeyRotationDays old, and tells their users to download the configs again
+// before the grace window of the plan ends
+type Rotator struct {
+	Repo repository.DatabaseRepo
+	// Notifier is nil when users are not to be notified
+	Notifier *notify.Notifier
+	Config   config.RotationConfig
+	// Subnet is the subnet of the default server, for the peers on no node
+	Subnet string
+	Logger *slog.Logger
+}
+
+// NewRotator returns a Rotator notifying through notifier
+func NewRotator(repo repository.DatabaseRepo, notifier *notify.Notifier, cfg config.RotationConfig, subnet string, logger *slog.Logger) *Rotator {
+	return &Rotator{
+		Repo:     repo,
+		Notifier: notifier,
+		Config:   cfg,
+		Subnet:   subnet,
+		Logger:   logger,
+	}
+}
+
+// Run rotates the keys due every Interval until ctx is done. It is meant to be
+// started on a worker.Group.
+func (r *Rotator) Run(ctx context.Context) error {
+	return worker.Every(ctx, r.Config.Interval, func(ctx context.Context) {
+		n, err := r.RunOnce(ctx, time.Now())
+		if err != nil && ctx.Err() == nil {
+			r.Logger.ErrorContext(ctx, "key rotation failed", "rotated", n, "error", err)
+		}
+	})
+}
+
+// RunOnce rotates the keys due at now and returns how many peers it rotated,
+// unless another replica is rotating them. A peer that cannot be rotated is
+// logged and tried again on the next run.
+func (r *Rotator) RunOnce(ctx context.Context, now time.Time) (int, error) {
+	var rotated int
+	ran, err := r.Repo.WithLock(ctx, lockKey, func() error {
+		var err error
+		rotated, err = r.rotateDue(ctx, now)
+		return err
+	})
+	if err == nil && !ran {
+		r.Logger.DebugContext(ctx, "key rotation skipped, another replica is running it")
+	}
+	return rotated, err
+}
+
+// rotateDue rotates the keys due at now and returns how many peers it rotated
+func (r *Rotator) rotateDue(ctx context.Context, now time.Time) (int, error) {
+	subscriptions, err := r.Repo.GetActiveSubscriptions(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("load active subscriptions: %w", err)
+	}
+
+	subnets := map[int]string{0: r.Subnet}
+	var rotated int
+	for _, sub := range subscriptions {
+		if sub.Plan.KeyRotationDays <= 0 {
+			continue
+		}
+
+		peers, err := r.Repo.GetVpnPeersByUserId(ctx, sub.UserID)
+		if err != nil {
+			r.Logger.ErrorContext(ctx, "unable to load peers to rotate", "user_id", sub.UserID, "error", err)
+			continue
+		}
+
+		for _, peer := range peers {
+			if peer.IsRevoked() || peer.SubscriptionID != sub.ID || now.Before(peer.KeysRotatedAt.AddDate(0, 0, sub.Plan.KeyRotationDays)) {
+				continue
+			}
+
+			err := r.rotate(ctx, peer, sub.Plan, subnets, now)
+			if err != nil {
+				r.Logger.ErrorContext(ctx, "unable to rotate peer keys", "user_id", peer.UserID, "peer_id", peer.ID, "error", err)
+				continue
+			}
+			rotated++
+		}
+	}
+
+	return rotated, nil
+}
+
+// rotate rotates the keys of peer with the grace window of plan. subnets
+// caches the subnets of the nodes by ID.
+func (r *Rotator) rotate(ctx context.Context, peer models.VpnPeer, plan models.Plan, subnets map[int]string, now time.Time) error {
+	subnet, ok := subnets[peer.NodeID]
+	if !ok {
+		node, err := r.Repo.GetVpnNodeById(ctx, peer.NodeID)
+		if err != nil {
+			return fmt.Errorf("load node: %w", err)
+		}
+		subnet = node.Subnet
+		subnets[node.ID] = subnet
+	}
+
+	grace := time.Duration(plan.KeyGraceHours) * time.Hour
+	peer, revocation, err := Rotate(ctx, r.Repo, peer, subnet, grace, now)
+	if err != nil {
+		return err
+	}
+	r.Logger.InfoContext(ctx, "VPN peer keys rotated", "user_id", peer.UserID, "peer_id", peer.ID, "old_keys_until", revocation.ServeUntil)
+
+	if r.Notifier == nil {
+		return nil
+	}
+	err = r.Notifier.Notify(ctx, notify.Event{
+		UserID:    peer.UserID,
+		Name:      notify.EventKeysRotated,
+		Data:      notify.KeysRotated{Name: peer.Name, WorksUntil: revocation.ServeUntil},
+		Link:      "/devices",
+		DedupeKey: fmt.Sprintf("%s:%d", notify.EventKeysRotated, revocation.ID),
+	})
+	if err != nil {
+		// the keys are rotated; the devices page shows the new config all the same
+		r.Logger.ErrorContext(ctx, "unable to notify user about rotated keys", "user_id", peer.UserID, "peer_id", peer.ID, "error", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package telegram
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// pollRetryDelay is how long the Poller waits after a failed getUpdates
+const pollRetryDelay = 5 * time.Second
+
+// Poller long-polls the updates of the bot and hands every message to Handle,
+// one at a time in the order they were received
+type Poller struct {
+	Client *Client
+	Handle func(ctx context.Context, msg Message)
+	// Timeout is how long a single getUpdates call waits for messages
+	Timeout time.Duration
+	Logger  *slog.Logger
+}
+
+// NewPoller returns a Poller handing the messages received through client to handle
+func NewPoller(client *Client, handle func(ctx context.Context, msg Message), timeout time.Duration, logger *slog.Logger) *Poller {
+	return &Poller{
+		Client:  client,
+		Handle:  handle,
+		Timeout: timeout,
+		Logger:  logger,
+	}
+}
+
+// Run polls until ctx is done. It is meant to be started on a worker.Group.
+// A message is confirmed once it was handled, so the updates received while
+// the panel was down are handled after a restart.
+func (p *Poller) Run(ctx context.Context) error {
+	var offset int64
+	for {
+		updates, err := p.Client.GetUpdates(ctx, offset, p.Timeout)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			p.Logger.ErrorContext(ctx, "unable to get Telegram updates", "error", err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(pollRetryDelay):
+			}
+			continue
+		}
+
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+			if u.Message != nil {
+				p.Handle(ctx, *u.Message)
+			}
+		}
+	}
+}
@@ -0,0 +1,189 @@
+// Package telegram talks to the Telegram Bot API: it sends messages and files
+// and long-polls the updates the bot receives
+package telegram
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/config"
+)
+
+// Client sends messages as the bot identified by Token
+type Client struct {
+	Token      string
+	APIURL     string
+	HTTPClient *http.Client
+}
+
+// NewClient returns a Client for the bot configured in cfg
+func NewClient(cfg config.TelegramConfig) *Client {
+	return &Client{
+		Token:      cfg.BotToken,
+		APIURL:     strings.TrimSuffix(cfg.APIURL, "/"),
+		HTTPClient: &http.Client{Timeout: cfg.Timeout},
+	}
+}
+
+// APIError is an error answered by the Bot API, e.g. 403 when the user blocked the bot
+type APIError struct {
+	Code        int
+	Description string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("telegram: %d %s", e.Code, e.Description)
+}
+
+// Permanent reports whether sending again cannot succeed: every client error
+// except 429, which asks to slow down
+func (e *APIError) Permanent() bool {
+	return e.Code >= 400 && e.Code < 500 && e.Code != http.StatusTooManyRequests
+}
+
+// Update is an update received by the bot. Only messages are asked for.
+type Update struct {
+	UpdateID int64    `json:"update_id"`
+	Message  *Message `json:"message"`
+}
+
+// Message is a message sent to the bot
+type Message struct {
+	MessageID int64  `json:"message_id"`
+	Chat      Chat   `json:"chat"`
+	Text      string `json:"text"`
+}
+
+// Chat is the chat a message was sent in
+type Chat struct {
+	ID   int64  `json:"id"`
+	Type string `json:"type"`
+}
+
+// ChatID returns the chat ID the way SendMessage takes it
+func (c Chat) ChatID() string {
+	return strconv.FormatInt(c.ID, 10)
+}
+
+type sendMessageRequest struct {
+	ChatID                string `json:"chat_id"`
+	Text                  string `json:"text"`
+	DisableWebPagePreview bool   `json:"disable_web_page_preview"`
+}
+
+type getUpdatesRequest struct {
+	Offset         int64    `json:"offset"`
+	Timeout        int      `json:"timeout"`
+	AllowedUpdates []string `json:"allowed_updates"`
+}
+
+type apiResponse struct {
+	OK          bool            `json:"ok"`
+	ErrorCode   int             `json:"error_code"`
+	Description string          `json:"description"`
+	Result      json.RawMessage `json:"result"`
+}
+
+// SendMessage sends text as a plain message to the chat chatID
+func (c *Client) SendMessage(ctx context.Context, chatID, text string) error {
+	body, err := json.Marshal(sendMessageRequest{ChatID: chatID, Text: text, DisableWebPagePreview: true})
+	if err != nil {
+		return err
+	}
+
+	return c.call(ctx, c.HTTPClient, "sendMessage", "application/json", bytes.NewReader(body), nil)
+}
+
+// SendDocument sends data as the file filename to the chat chatID
+func (c *Client) SendDocument(ctx context.Context, chatID, filename string, data []byte, caption string) error {
+	return c.sendFile(ctx, "sendDocument", "document", chatID, filename, data, caption)
+}
+
+// SendPhoto sends the image data to the chat chatID
+func (c *Client) SendPhoto(ctx context.Context, chatID, filename string, data []byte, caption string) error {
+	return c.sendFile(ctx, "sendPhoto", "photo", chatID, filename, data, caption)
+}
+
+// GetUpdates waits up to timeout for the messages the bot received from offset
+// on. Passing the ID after the last update returned confirms it, so it is not
+// returned again.
+func (c *Client) GetUpdates(ctx context.Context, offset int64, timeout time.Duration) ([]Update, error) {
+	body, err := json.Marshal(getUpdatesRequest{Offset: offset, Timeout: int(timeout.Seconds()), AllowedUpdates: []string{"message"}})
+	if err != nil {
+		return nil, err
+	}
+
+	// the request is held open for up to timeout on top of the usual round trip
+	client := *c.HTTPClient
+	client.Timeout += timeout
+
+	var updates []Update
+	err = c.call(ctx, &client, "getUpdates", "application/json", bytes.NewReader(body), &updates)
+	return updates, err
+}
+
+// sendFile uploads data as the field of a multipart request to method
+func (c *Client) sendFile(ctx context.Context, method, field, chatID, filename string, data []byte, caption string) error {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	_ = mw.WriteField("chat_id", chatID)
+	if caption != "" {
+		_ = mw.WriteField("caption", caption)
+	}
+	part, err := mw.CreateFormFile(field, filename)
+	if err != nil {
+		return err
+	}
+	_, _ = part.Write(data)
+	if err := mw.Close(); err != nil {
+		return err
+	}
+
+	return c.call(ctx, c.HTTPClient, method, mw.FormDataContentType(), &body, nil)
+}
+
+// call posts body to method and decodes the result into result, if not nil
+func (c *Client) call(ctx context.Context, client *http.Client, method, contentType string, body io.Reader, result any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.APIURL+"/bot"+c.Token+"/"+method, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		// the request URL carries the bot token; keep it out of logs and the outbox
+		return fmt.Errorf("telegram %s: %s", method, strings.ReplaceAll(err.Error(), c.Token, "[REDACTED]"))
+	}
+	defer resp.Body.Close()
+
+	var answer apiResponse
+	err = json.NewDecoder(resp.Body).Decode(&answer)
+	if err != nil {
+		return fmt.Errorf("telegram %s: %s: %w", method, resp.Status, err)
+	}
+	if !answer.OK {
+		code := answer.ErrorCode
+		if code == 0 {
+			code = resp.StatusCode
+		}
+		return &APIError{Code: code, Description: answer.Description}
+	}
+
+	if result != nil {
+		err = json.Unmarshal(answer.Result, result)
+		if err != nil {
+			return fmt.Errorf("telegram %s: %w", method, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,154 @@
+package telegram
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/config"
+)
+
+func TestSendMessage(t *testing.T) {
+	var got sendMessageRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/botsecret-token/sendMessage" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+		w.Write([]byte(`{"ok":true,"result":{}}`))
+	}))
+	defer server.Close()
+
+	c := NewClient(config.TelegramConfig{BotToken: "secret-token", APIURL: server.URL + "/", Timeout: time.Second})
+	if err := c.SendMessage(context.Background(), "123456", "Hello"); err != nil {
+		t.Fatal(err)
+	}
+	if got.ChatID != "123456" || got.Text != "Hello" {
+		t.Fatalf("unexpected request %+v", got)
+	}
+}
+
+func TestSendMessageErrors(t *testing.T) {
+	for _, tt := range []struct {
+		status    int
+		body      string
+		permanent bool
+	}{
+		{http.StatusForbidden, `{"ok":false,"error_code":403,"description":"Forbidden: bot was blocked by the user"}`, true},
+		{http.StatusBadRequest, `{"ok":false,"error_code":400,"description":"Bad Request: chat not found"}`, true},
+		{http.StatusTooManyRequests, `{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 5"}`, false},
+		{http.StatusBadGateway, `{"ok":false,"description":"Bad Gateway"}`, false},
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+			w.Write([]byte(tt.body))
+		}))
+
+		c := NewClient(config.TelegramConfig{BotToken: "secret-token", APIURL: server.URL, Timeout: time.Second})
+		err := c.SendMessage(context.Background(), "123456", "Hello")
+		server.Close()
+
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) {
+			t.Errorf("%d: expected an APIError, got %v", tt.status, err)
+			continue
+		}
+		if apiErr.Code != tt.status || apiErr.Permanent() != tt.permanent {
+			t.Errorf("%d: got code %d, permanent %t", tt.status, apiErr.Code, apiErr.Permanent())
+		}
+	}
+}
+
+func TestSendMessageRedactsToken(t *testing.T) {
+	c := NewClient(config.TelegramConfig{BotToken: "secret-token", APIURL: "http://127.0.0.1:1", Timeout: time.Second})
+
+	err := c.SendMessage(context.Background(), "123456", "Hello")
+	if err == nil {
+		t.Fatal("expected a connection error")
+	}
+	if strings.Contains(err.Error(), "secret-token") {
+		t.Fatalf("the bot token leaked into %q", err)
+	}
+}
+
+func TestSendDocument(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/botsecret-token/sendDocument" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if r.FormValue("chat_id") != "123456" || r.FormValue("caption") != "Laptop" {
+			t.Errorf("unexpected fields %v", r.MultipartForm.Value)
+		}
+		file, header, err := r.FormFile("document")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		data, _ := io.ReadAll(file)
+		if header.Filename != "fastnet-1.conf" || string(data) != "[Interface]" {
+			t.Errorf("unexpected file %s: %q", header.Filename, data)
+		}
+		w.Write([]byte(`{"ok":true,"result":{}}`))
+	}))
+	defer server.Close()
+
+	c := NewClient(config.TelegramConfig{BotToken: "secret-token", APIURL: server.URL, Timeout: time.Second})
+	err := c.SendDocument(context.Background(), "123456", "fastnet-1.conf", []byte("[Interface]"), "Laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoller(t *testing.T) {
+	var offsets []int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req getUpdatesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		offsets = append(offsets, req.Offset)
+		if req.Offset == 0 {
+			w.Write([]byte(`{"ok":true,"result":[
+				{"update_id":7,"message":{"message_id":1,"chat":{"id":42,"type":"private"},"text":"/devices"}},
+				{"update_id":8},
+				{"update_id":9,"message":{"message_id":2,"chat":{"id":42,"type":"private"},"text":"/help"}}]}`))
+			return
+		}
+		w.Write([]byte(`{"ok":true,"result":[]}`))
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var texts []string
+	c := NewClient(config.TelegramConfig{BotToken: "secret-token", APIURL: server.URL, Timeout: time.Second})
+	p := NewPoller(c, func(ctx context.Context, msg Message) {
+		if msg.Chat.ChatID() != "42" {
+			t.Errorf("unexpected chat %d", msg.Chat.ID)
+		}
+		texts = append(texts, msg.Text)
+		if len(texts) == 2 {
+			cancel()
+		}
+	}, 0, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	if err := p.Run(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the poller to stop with the context, got %v", err)
+	}
+	if strings.Join(texts, ",") != "/devices,/help" {
+		t.Fatalf("unexpected messages %v", texts)
+	}
+	if len(offsets) != 1 {
+		t.Fatalf("expected a single poll before cancelling, got offsets %v", offsets)
+	}
+}
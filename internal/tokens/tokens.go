@@ -0,0 +1,76 @@
+package tokens
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"slices"
+	"strings"
+)
+
+// Token prefixes make leaked tokens easy to recognise: APITokenPrefix starts
+// every personal API token, AgentTokenPrefix every node agent token,
+// TelegramLinkPrefix every code linking a Telegram chat and
+// SubscriptionPrefix every token of a subscription URL
+const (
+	APITokenPrefix     = "fnv_"
+	AgentTokenPrefix   = "fnn_"
+	TelegramLinkPrefix = "fnl_"
+	SubscriptionPrefix = "fns_"
+)
+
+// API token scopes
+const (
+	ScopeUserRead          = "user:read"
+	ScopeSubscriptionsRead = "subscriptions:read"
+	ScopePeersRead         = "peers:read"
+	ScopePeersWrite        = "peers:write"
+	ScopeInvoicesRead      = "invoices:read"
+)
+
+// AllScopes lists every scope a personal API token can be granted
+var AllScopes = []string{
+	ScopeUserRead,
+	ScopeSubscriptionsRead,
+	ScopePeersRead,
+	ScopePeersWrite,
+	ScopeInvoicesRead,
+}
+
+// Generate returns a new random token with the given prefix, the short display prefix and its hash
+func Generate(prefix string) (plain, display, hash string, err error) {
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	plain = prefix + base64.RawURLEncoding.EncodeToString(b)
+	display = plain[:len(prefix)+8]
+
+	return plain, display, Hash(plain), nil
+}
+
+// Hash returns the hex encoded SHA-256 of a token, which is the only form stored in the database
+func Hash(plain string) string {
+	sum := sha256.Sum256([]byte(plain))
+	return hex.EncodeToString(sum[:])
+}
+
+// ValidScope reports whether scope is a known API token scope
+func ValidScope(scope string) bool {
+	return slices.Contains(AllScopes, scope)
+}
+
+// ParseScopes splits a comma separated scope list as stored in the database
+func ParseScopes(s string) []string {
+	var scopes []string
+	for _, scope := range strings.Split(s, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
@@ -0,0 +1,63 @@
+package usage
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/config"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/repository"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/worker"
+)
+
+// Pruner deletes the hourly and daily usage buckets that have outlived their
+// retention. Monthly buckets are never pruned.
+type Pruner struct {
+	Repo   repository.DatabaseRepo
+	Config config.UsageConfig
+	Logger *slog.Logger
+}
+
+// NewPruner returns a Pruner deleting from repo
+func NewPruner(repo repository.DatabaseRepo, cfg config.UsageConfig, logger *slog.Logger) *Pruner {
+	return &Pruner{
+		Repo:   repo,
+		Config: cfg,
+		Logger: logger,
+	}
+}
+
+// Run prunes every PruneInterval until ctx is done. It is meant to be started
+// on a worker.Group.
+func (p *Pruner) Run(ctx context.Context) error {
+	return worker.Every(ctx, p.Config.PruneInterval, func(ctx context.Context) {
+		n, err := p.RunOnce(ctx, time.Now())
+		if err != nil && ctx.Err() == nil {
+			p.Logger.ErrorContext(ctx, "pruning usage failed", "deleted", n, "error", err)
+		}
+	})
+}
+
+// RunOnce deletes the buckets that are out of retention at now and returns
+// how many it deleted
+func (p *Pruner) RunOnce(ctx context.Context, now time.Time) (int, error) {
+	var total int
+	for period, retention := range map[string]time.Duration{
+		models.UsageHour: p.Config.HourlyRetention,
+		models.UsageDay:  p.Config.DailyRetention,
+	} {
+		n, err := p.Repo.DeletePeerUsageBefore(ctx, period, now.Add(-retention))
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("prune %s usage: %w", period, err)
+		}
+	}
+
+	if total > 0 {
+		p.Logger.InfoContext(ctx, "usage pruned", "deleted", total)
+	}
+
+	return total, nil
+}
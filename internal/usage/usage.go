@@ -0,0 +1,170 @@
+// Package usage accounts the traffic of VPN peers from the byte counters node
+// agents report, and shapes it for the dashboard charts
+package usage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/agent"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+)
+
+// Delta returns the bytes a counter counted since it stood at last. A counter
+// below last has started over, e.g. because the peer was re-added or the
+// node rebooted, so everything it counted is new.
+func Delta(last, current int64) int64 {
+	if current < last {
+		return current
+	}
+	return current - last
+}
+
+// Account matches the counters an agent reported to the peers of its node by
+// public key. It returns the counters to store on the peers that changed and
+// the traffic of each peer since the previous report. Counters of keys that are
+// not among peers are ignored.
+func Account(peers []models.VpnPeer, counters []agent.Counter) (stored, traffic []models.PeerTraffic) {
+	byKey := make(map[string]models.VpnPeer, len(peers))
+	for _, p := range peers {
+		byKey[p.PublicKey] = p
+	}
+
+	for _, c := range counters {
+		p, ok := byKey[c.PublicKey]
+		if !ok || c.RxBytes < 0 || c.TxBytes < 0 {
+			continue
+		}
+		// a peer reported twice counts once
+		delete(byKey, c.PublicKey)
+
+		if c.RxBytes == p.RxCounter && c.TxBytes == p.TxCounter {
+			continue
+		}
+		stored = append(stored, models.PeerTraffic{PeerID: p.ID, RxBytes: c.RxBytes, TxBytes: c.TxBytes})
+
+		rx, tx := Delta(p.RxCounter, c.RxBytes), Delta(p.TxCounter, c.TxBytes)
+		if rx > 0 || tx > 0 {
+			traffic = append(traffic, models.PeerTraffic{PeerID: p.ID, RxBytes: rx, TxBytes: tx})
+		}
+	}
+
+	return stored, traffic
+}
+
+// AccountRevoked is Account for revoked keys still on the interface of the
+// node, e.g. in the grace window of a rotation. It returns the counters to
+// store by revocation ID and the traffic by peer ID.
+func AccountRevoked(revocations []models.KeyRevocation, counters []agent.Counter) (stored, traffic []models.PeerTraffic) {
+	keys := make([]models.VpnPeer, 0, len(revocations))
+	peerIDs := make(map[int]int, len(revocations))
+	for _, r := range revocations {
+		keys = append(keys, models.VpnPeer{ID: r.ID, PublicKey: r.PublicKey, RxCounter: r.RxCounter, TxCounter: r.TxCounter})
+		peerIDs[r.ID] = r.PeerID
+	}
+
+	stored, traffic = Account(keys, counters)
+	for i := range traffic {
+		traffic[i].PeerID = peerIDs[traffic[i].PeerID]
+	}
+
+	return stored, traffic
+}
+
+// Merge sums the traffic of peers that appear more than once, e.g. with their
+// current and their old keys, keeping the order of first appearance
+func Merge(traffic []models.PeerTraffic) []models.PeerTraffic {
+	index := make(map[int]int, len(traffic))
+	merged := make([]models.PeerTraffic, 0, len(traffic))
+	for _, t := range traffic {
+		i, ok := index[t.PeerID]
+		if !ok {
+			index[t.PeerID] = len(merged)
+			merged = append(merged, t)
+			continue
+		}
+		merged[i].RxBytes += t.RxBytes
+		merged[i].TxBytes += t.TxBytes
+	}
+	return merged
+}
+
+// Series returns a point for every period bucket from the one holding from to
+// the one holding to, taking the traffic from points and zero for the
+// buckets missing from it
+func Series(points []models.UsagePoint, period string, from, to time.Time) []models.UsagePoint {
+	byStart := make(map[int64]models.UsagePoint, len(points))
+	for _, p := range points {
+		byStart[p.BucketStart.Unix()] = p
+	}
+
+	var series []models.UsagePoint
+	end := models.UsageBucket(period, to)
+	for start := models.UsageBucket(period, from); !start.After(end); start = models.NextUsageBucket(period, start) {
+		p, ok := byStart[start.Unix()]
+		if !ok {
+			p = models.UsagePoint{BucketStart: start}
+		}
+		series = append(series, p)
+	}
+
+	return series
+}
+
+// Total returns the sum of the traffic of points
+func Total(points []models.UsagePoint) models.UsagePoint {
+	var total models.UsagePoint
+	for _, p := range points {
+		total.RxBytes += p.RxBytes
+		total.TxBytes += p.TxBytes
+	}
+	return total
+}
+
+// FormatBytes formats n in decimal units, e.g. 1.5 GB
+func FormatBytes(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	value := float64(n)
+	for _, suffix := range []string{"KB", "MB", "GB", "TB"} {
+		value /= unit
+		if value < unit || suffix == "TB" {
+			return fmt.Sprintf("%.1f %s", value, suffix)
+		}
+	}
+
+	return ""
+}
+
+// Chart is a usage series as the dashboard draws it. Download is the traffic
+// sent to the user's devices, Upload the traffic received from them.
+type Chart struct {
+	Labels   []string `json:"labels"`
+	Download []int64  `json:"download"`
+	Upload   []int64  `json:"upload"`
+}
+
+// labelLayouts are the time layouts of the chart labels by period
+var labelLayouts = map[string]string{
+	models.UsageHour:  "15:04",
+	models.UsageDay:   "Jan 2",
+	models.UsageMonth: "Jan 2006",
+}
+
+// NewChart returns the chart of series, whose buckets are of period
+func NewChart(series []models.UsagePoint, period string) Chart {
+	chart := Chart{
+		Labels:   make([]string, 0, len(series)),
+		Download: make([]int64, 0, len(series)),
+		Upload:   make([]int64, 0, len(series)),
+	}
+	for _, p := range series {
+		chart.Labels = append(chart.Labels, p.BucketStart.Format(labelLayouts[period]))
+		chart.Download = append(chart.Download, p.TxBytes)
+		chart.Upload = append(chart.Upload, p.RxBytes)
+	}
+	return chart
+}
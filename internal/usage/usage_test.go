@@ -0,0 +1,182 @@
+package usage
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/agent"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/config"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/repository/dbrepo"
+)
+
+func TestAccount(t *testing.T) {
+	peers := []models.VpnPeer{
+		{ID: 1, PublicKey: "grown", RxCounter: 100, TxCounter: 1000},
+		{ID: 2, PublicKey: "reset", RxCounter: 500, TxCounter: 5000},
+		{ID: 3, PublicKey: "idle", RxCounter: 10, TxCounter: 20},
+		{ID: 4, PublicKey: "new"},
+	}
+	counters := []agent.Counter{
+		{PublicKey: "grown", RxBytes: 150, TxBytes: 1600},
+		{PublicKey: "reset", RxBytes: 40, TxBytes: 7000},
+		{PublicKey: "idle", RxBytes: 10, TxBytes: 20},
+		{PublicKey: "new", RxBytes: 1, TxBytes: 2},
+		{PublicKey: "new", RxBytes: 1, TxBytes: 2},
+		{PublicKey: "unknown", RxBytes: 9, TxBytes: 9},
+	}
+
+	stored, traffic := Account(peers, counters)
+
+	wantStored := []models.PeerTraffic{
+		{PeerID: 1, RxBytes: 150, TxBytes: 1600},
+		{PeerID: 2, RxBytes: 40, TxBytes: 7000},
+		{PeerID: 4, RxBytes: 1, TxBytes: 2},
+	}
+	wantTraffic := []models.PeerTraffic{
+		{PeerID: 1, RxBytes: 50, TxBytes: 600},
+		{PeerID: 2, RxBytes: 40, TxBytes: 2000},
+		{PeerID: 4, RxBytes: 1, TxBytes: 2},
+	}
+	if len(stored) != len(wantStored) || len(traffic) != len(wantTraffic) {
+		t.Fatalf("expected counters %+v and traffic %+v, got %+v and %+v", wantStored, wantTraffic, stored, traffic)
+	}
+	for i := range wantStored {
+		if stored[i] != wantStored[i] {
+			t.Errorf("expected counters %+v, got %+v", wantStored[i], stored[i])
+		}
+		if traffic[i] != wantTraffic[i] {
+			t.Errorf("expected traffic %+v, got %+v", wantTraffic[i], traffic[i])
+		}
+	}
+}
+
+func TestAccountRevoked(t *testing.T) {
+	revocations := []models.KeyRevocation{
+		{ID: 10, PeerID: 1, PublicKey: "old-laptop", RxCounter: 100, TxCounter: 1000},
+		{ID: 11, PeerID: 2, PublicKey: "old-phone"},
+	}
+	counters := []agent.Counter{
+		{PublicKey: "laptop", RxBytes: 5, TxBytes: 50},
+		{PublicKey: "old-laptop", RxBytes: 120, TxBytes: 1300},
+	}
+
+	stored, traffic := AccountRevoked(revocations, counters)
+	if len(stored) != 1 || stored[0] != (models.PeerTraffic{PeerID: 10, RxBytes: 120, TxBytes: 1300}) {
+		t.Errorf("expected the counters stored by revocation, got %+v", stored)
+	}
+	if len(traffic) != 1 || traffic[0] != (models.PeerTraffic{PeerID: 1, RxBytes: 20, TxBytes: 300}) {
+		t.Errorf("expected the traffic accounted to the peer, got %+v", traffic)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	got := Merge([]models.PeerTraffic{
+		{PeerID: 2, RxBytes: 1, TxBytes: 10},
+		{PeerID: 1, RxBytes: 5, TxBytes: 50},
+		{PeerID: 2, RxBytes: 20, TxBytes: 300},
+	})
+
+	want := []models.PeerTraffic{
+		{PeerID: 2, RxBytes: 21, TxBytes: 310},
+		{PeerID: 1, RxBytes: 5, TxBytes: 50},
+	}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+}
+
+func TestSeries(t *testing.T) {
+	now := time.Date(2026, 10, 19, 14, 30, 0, 0, time.UTC)
+	points := []models.UsagePoint{
+		{BucketStart: time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC), RxBytes: 1, TxBytes: 2},
+		{BucketStart: time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC), RxBytes: 3, TxBytes: 4},
+	}
+
+	series := Series(points, models.UsageDay, now.AddDate(0, 0, -3), now)
+	if len(series) != 4 {
+		t.Fatalf("expected a point for each of 4 days, got %+v", series)
+	}
+	for i, want := range []int64{0, 2, 0, 4} {
+		if series[i].TxBytes != want {
+			t.Errorf("day %d: expected %d bytes, got %d", i, want, series[i].TxBytes)
+		}
+	}
+
+	chart := NewChart(series, models.UsageDay)
+	if chart.Labels[0] != "Oct 16" || chart.Download[3] != 4 || chart.Upload[3] != 3 {
+		t.Errorf("unexpected chart %+v", chart)
+	}
+}
+
+func TestUsageBucket(t *testing.T) {
+	at := time.Date(2026, 2, 28, 23, 45, 0, 0, time.FixedZone("UTC+3", 3*60*60))
+
+	for period, want := range map[string]time.Time{
+		models.UsageHour:  time.Date(2026, 2, 28, 20, 0, 0, 0, time.UTC),
+		models.UsageDay:   time.Date(2026, 2, 28, 0, 0, 0, 0, time.UTC),
+		models.UsageMonth: time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC),
+	} {
+		if got := models.UsageBucket(period, at); !got.Equal(want) {
+			t.Errorf("%s: expected %s, got %s", period, want, got)
+		}
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for n, want := range map[int64]string{
+		0:                 "0 B",
+		999:               "999 B",
+		1500:              "1.5 KB",
+		301_000_000:       "301.0 MB",
+		2_500_000_000_000: "2.5 TB",
+	} {
+		if got := FormatBytes(n); got != want {
+			t.Errorf("%d: expected %q, got %q", n, want, got)
+		}
+	}
+}
+
+func TestPruner(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	repo := dbrepo.NewTestingRepo(&config.AppConfig{Logger: logger})
+
+	userID, err := repo.AddUser(models.User{Username: "jane", Email: "jane@example.com"}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerID, err := repo.InsertVpnPeer(ctx, models.VpnPeer{UserID: userID, PublicKey: "laptop", Address: "10.8.0.2/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	old := now.AddDate(-2, 0, 0)
+	for _, at := range []time.Time{old, now} {
+		if err := repo.AddPeerUsage(ctx, at, []models.PeerTraffic{{PeerID: peerID, TxBytes: 100}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := NewPruner(repo, config.Defaults().Usage, logger).RunOnce(ctx, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expected the old hourly and daily buckets to be pruned, got %d", n)
+	}
+
+	for period, want := range map[string]int{models.UsageHour: 1, models.UsageDay: 1, models.UsageMonth: 2} {
+		points, err := repo.GetUsageByUserId(ctx, userID, period, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(points) != want {
+			t.Errorf("%s: expected %d buckets, got %+v", period, want, points)
+		}
+	}
+}
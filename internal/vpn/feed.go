@@ -0,0 +1,405 @@
+package vpn
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"gopkg.in/yaml.v3"
+)
+
+// Subscription feed formats: base64 encoded share links for v2rayNG, v2rayN
+// and Shadowrocket, a Clash (mihomo) profile and a sing-box config
+const (
+	FeedV2Ray   = "v2ray"
+	FeedClash   = "clash"
+	FeedSingBox = "singbox"
+)
+
+// FeedFormats lists every subscription feed format
+var FeedFormats = []string{FeedV2Ray, FeedClash, FeedSingBox}
+
+// feedGroup names the proxy group the Clash and sing-box feeds route through
+const feedGroup = "Fastnet VPN"
+
+// FeedEntry is a peer in a subscription feed with the server it connects to
+type FeedEntry struct {
+	Peer   models.VpnPeer
+	Server ServerConfig
+}
+
+// FeedFormatFor returns the feed format the app sending userAgent imports,
+// the v2ray share links for apps not known otherwise
+func FeedFormatFor(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	switch {
+	case strings.Contains(ua, "clash"), strings.Contains(ua, "mihomo"), strings.Contains(ua, "stash"):
+		return FeedClash
+	case strings.Contains(ua, "sing-box"), strings.Contains(ua, "singbox"):
+		return FeedSingBox
+	}
+	return FeedV2Ray
+}
+
+// FeedContentType returns the content type of the feed format
+func FeedContentType(format string) string {
+	switch format {
+	case FeedClash:
+		return "text/yaml; charset=utf-8"
+	case FeedSingBox:
+		return "application/json"
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// RenderFeed renders the entries in the feed format. The v2ray share links
+// have no WireGuard form the apps agree on, so WireGuard peers are only in
+// the Clash and sing-box feeds.
+func RenderFeed(format string, entries []FeedEntry) ([]byte, error) {
+	switch format {
+	case FeedV2Ray:
+		return v2rayFeed(entries)
+	case FeedClash:
+		return clashFeed(entries)
+	case FeedSingBox:
+		return singBoxFeed(entries)
+	}
+	return nil, fmt.Errorf("unknown feed format %q", format)
+}
+
+// v2rayFeed returns the share links of the entries, one per line, in base64
+func v2rayFeed(entries []FeedEntry) ([]byte, error) {
+	var links []string
+	for _, e := range entries {
+		if e.Peer.Protocol == models.ProtocolWireGuard {
+			continue
+		}
+		protocol, err := Lookup(e.Peer.Protocol)
+		if err != nil {
+			return nil, err
+		}
+		link, err := protocol.ClientConfig(e.Peer, e.Server)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, string(link))
+	}
+
+	return []byte(base64.StdEncoding.EncodeToString([]byte(strings.Join(links, "\n")))), nil
+}
+
+// feedTag returns the name the entry is shown by in the Clash and sing-box
+// feeds, which must be unique while device names need not be
+func feedTag(e FeedEntry) string {
+	return fmt.Sprintf("%s #%d", e.Peer.Name, e.Peer.ID)
+}
+
+// feedServer returns the host of the server of e and the port of its protocol
+func feedServer(e FeedEntry) (string, int, error) {
+	host, port, err := net.SplitHostPort(e.Server.Endpoint)
+	if err != nil {
+		return "", 0, fmt.Errorf("endpoint %q: %w", e.Server.Endpoint, err)
+	}
+
+	switch e.Peer.Protocol {
+	case models.ProtocolVLESS:
+		if e.Server.VLESS.Port == 0 {
+			return "", 0, fmt.Errorf("server %s does not serve VLESS", e.Server.Endpoint)
+		}
+		return host, e.Server.VLESS.Port, nil
+	case models.ProtocolShadowsocks:
+		if e.Server.Shadowsocks.Port == 0 {
+			return "", 0, fmt.Errorf("server %s does not serve Shadowsocks", e.Server.Endpoint)
+		}
+		return host, e.Server.Shadowsocks.Port, nil
+	}
+
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return "", 0, fmt.Errorf("endpoint %q: %w", e.Server.Endpoint, err)
+	}
+	return host, n, nil
+}
+
+// splitList splits a comma-separated list such as the DNS servers of a server
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// allowedIPs returns the networks WireGuard routes through the server
+func allowedIPs(server ServerConfig) []string {
+	if ips := splitList(server.AllowedIPs); len(ips) > 0 {
+		return ips
+	}
+	return []string{"0.0.0.0/0", "::/0"}
+}
+
+type clashProfile struct {
+	Proxies     []clashProxy `yaml:"proxies"`
+	ProxyGroups []clashGroup `yaml:"proxy-groups"`
+	Rules       []string     `yaml:"rules"`
+}
+
+type clashProxy struct {
+	Name   string `yaml:"name"`
+	Type   string `yaml:"type"`
+	Server string `yaml:"server"`
+	Port   int    `yaml:"port"`
+	UDP    bool   `yaml:"udp"`
+
+	// VLESS
+	UUID              string            `yaml:"uuid,omitempty"`
+	Network           string            `yaml:"network,omitempty"`
+	TLS               bool              `yaml:"tls,omitempty"`
+	Flow              string            `yaml:"flow,omitempty"`
+	ServerName        string            `yaml:"servername,omitempty"`
+	ClientFingerprint string            `yaml:"client-fingerprint,omitempty"`
+	RealityOpts       *clashRealityOpts `yaml:"reality-opts,omitempty"`
+
+	// Shadowsocks
+	Cipher   string `yaml:"cipher,omitempty"`
+	Password string `yaml:"password,omitempty"`
+
+	// WireGuard
+	IP           string   `yaml:"ip,omitempty"`
+	IPv6         string   `yaml:"ipv6,omitempty"`
+	PrivateKey   string   `yaml:"private-key,omitempty"`
+	PublicKey    string   `yaml:"public-key,omitempty"`
+	PreSharedKey string   `yaml:"pre-shared-key,omitempty"`
+	AllowedIPs   []string `yaml:"allowed-ips,omitempty"`
+	DNS          []string `yaml:"dns,omitempty"`
+}
+
+type clashRealityOpts struct {
+	PublicKey string `yaml:"public-key"`
+	ShortID   string `yaml:"short-id"`
+}
+
+type clashGroup struct {
+	Name    string   `yaml:"name"`
+	Type    string   `yaml:"type"`
+	Proxies []string `yaml:"proxies"`
+}
+
+// clashFeed returns a Clash profile routing everything through a group of
+// the entries
+func clashFeed(entries []FeedEntry) ([]byte, error) {
+	profile := clashProfile{
+		Proxies:     []clashProxy{},
+		ProxyGroups: []clashGroup{{Name: feedGroup, Type: "select", Proxies: []string{}}},
+		Rules:       []string{"MATCH," + feedGroup},
+	}
+
+	for _, e := range entries {
+		host, port, err := feedServer(e)
+		if err != nil {
+			return nil, err
+		}
+
+		proxy := clashProxy{Name: feedTag(e), Server: host, Port: port, UDP: true}
+		switch e.Peer.Protocol {
+		case models.ProtocolVLESS:
+			proxy.Type = "vless"
+			proxy.UUID = e.Peer.PublicKey
+			proxy.Network = "tcp"
+			proxy.TLS = true
+			proxy.Flow = VLESSFlow
+			proxy.ServerName = e.Server.VLESS.ServerName
+			proxy.ClientFingerprint = "chrome"
+			proxy.RealityOpts = &clashRealityOpts{PublicKey: e.Server.VLESS.PublicKey, ShortID: e.Server.VLESS.ShortID}
+		case models.ProtocolShadowsocks:
+			proxy.Type = "ss"
+			proxy.Cipher = ShadowsocksMethod
+			proxy.Password = e.Server.Shadowsocks.Key + ":" + e.Peer.PublicKey
+		default:
+			address, err := netip.ParsePrefix(e.Peer.Address)
+			if err != nil {
+				return nil, fmt.Errorf("peer %d: %w", e.Peer.ID, err)
+			}
+			proxy.Type = "wireguard"
+			if address.Addr().Is4() {
+				proxy.IP = address.Addr().String()
+			} else {
+				proxy.IPv6 = address.Addr().String()
+			}
+			proxy.PrivateKey = e.Peer.PrivateKey
+			proxy.PublicKey = e.Server.PublicKey
+			proxy.PreSharedKey = e.Peer.PresharedKey
+			proxy.AllowedIPs = allowedIPs(e.Server)
+			proxy.DNS = splitList(e.Server.DNS)
+		}
+
+		profile.Proxies = append(profile.Proxies, proxy)
+		profile.ProxyGroups[0].Proxies = append(profile.ProxyGroups[0].Proxies, proxy.Name)
+	}
+	if len(entries) == 0 {
+		// a group needs a member
+		profile.ProxyGroups[0].Proxies = append(profile.ProxyGroups[0].Proxies, "DIRECT")
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	err := enc.Encode(profile)
+	if err != nil {
+		return nil, err
+	}
+	err = enc.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type singBoxConfig struct {
+	Inbounds  []singBoxInbound  `json:"inbounds"`
+	Outbounds []singBoxOutbound `json:"outbounds"`
+	Endpoints []singBoxEndpoint `json:"endpoints,omitempty"`
+	Route     singBoxRoute      `json:"route"`
+}
+
+type singBoxInbound struct {
+	Type        string   `json:"type"`
+	Tag         string   `json:"tag"`
+	Address     []string `json:"address"`
+	AutoRoute   bool     `json:"auto_route"`
+	StrictRoute bool     `json:"strict_route"`
+}
+
+type singBoxOutbound struct {
+	Type string `json:"type"`
+	Tag  string `json:"tag"`
+
+	// selector
+	Outbounds []string `json:"outbounds,omitempty"`
+
+	Server     string `json:"server,omitempty"`
+	ServerPort int    `json:"server_port,omitempty"`
+
+	// VLESS
+	UUID string      `json:"uuid,omitempty"`
+	Flow string      `json:"flow,omitempty"`
+	TLS  *singBoxTLS `json:"tls,omitempty"`
+
+	// Shadowsocks
+	Method   string `json:"method,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+type singBoxTLS struct {
+	Enabled    bool           `json:"enabled"`
+	ServerName string         `json:"server_name"`
+	UTLS       singBoxUTLS    `json:"utls"`
+	Reality    singBoxReality `json:"reality"`
+}
+
+type singBoxUTLS struct {
+	Enabled     bool   `json:"enabled"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+type singBoxReality struct {
+	Enabled   bool   `json:"enabled"`
+	PublicKey string `json:"public_key"`
+	ShortID   string `json:"short_id"`
+}
+
+type singBoxEndpoint struct {
+	Type       string                 `json:"type"`
+	Tag        string                 `json:"tag"`
+	Address    []string               `json:"address"`
+	PrivateKey string                 `json:"private_key"`
+	Peers      []singBoxWireGuardPeer `json:"peers"`
+}
+
+type singBoxWireGuardPeer struct {
+	Address             string   `json:"address"`
+	Port                int      `json:"port"`
+	PublicKey           string   `json:"public_key"`
+	PreSharedKey        string   `json:"pre_shared_key,omitempty"`
+	AllowedIPs          []string `json:"allowed_ips"`
+	PersistentKeepalive int      `json:"persistent_keepalive_interval"`
+}
+
+type singBoxRoute struct {
+	Final               string `json:"final"`
+	AutoDetectInterface bool   `json:"auto_detect_interface"`
+}
+
+// singBoxFeed returns a sing-box config routing the traffic of a TUN
+// interface through a selector of the entries. WireGuard peers are
+// endpoints, which sing-box has taken the place of WireGuard outbounds since
+// 1.11.
+func singBoxFeed(entries []FeedEntry) ([]byte, error) {
+	cfg := singBoxConfig{
+		Inbounds: []singBoxInbound{{
+			Type: "tun", Tag: "tun-in", Address: []string{"172.19.0.1/30"}, AutoRoute: true, StrictRoute: true,
+		}},
+		Route: singBoxRoute{Final: feedGroup, AutoDetectInterface: true},
+	}
+
+	selector := singBoxOutbound{Type: "selector", Tag: feedGroup}
+	var outbounds []singBoxOutbound
+	for _, e := range entries {
+		host, port, err := feedServer(e)
+		if err != nil {
+			return nil, err
+		}
+
+		tag := feedTag(e)
+		selector.Outbounds = append(selector.Outbounds, tag)
+
+		switch e.Peer.Protocol {
+		case models.ProtocolVLESS:
+			outbounds = append(outbounds, singBoxOutbound{
+				Type: "vless", Tag: tag, Server: host, ServerPort: port,
+				UUID: e.Peer.PublicKey, Flow: VLESSFlow,
+				TLS: &singBoxTLS{
+					Enabled:    true,
+					ServerName: e.Server.VLESS.ServerName,
+					UTLS:       singBoxUTLS{Enabled: true, Fingerprint: "chrome"},
+					Reality:    singBoxReality{Enabled: true, PublicKey: e.Server.VLESS.PublicKey, ShortID: e.Server.VLESS.ShortID},
+				},
+			})
+		case models.ProtocolShadowsocks:
+			outbounds = append(outbounds, singBoxOutbound{
+				Type: "shadowsocks", Tag: tag, Server: host, ServerPort: port,
+				Method: ShadowsocksMethod, Password: e.Server.Shadowsocks.Key + ":" + e.Peer.PublicKey,
+			})
+		default:
+			cfg.Endpoints = append(cfg.Endpoints, singBoxEndpoint{
+				Type: "wireguard", Tag: tag, Address: []string{e.Peer.Address}, PrivateKey: e.Peer.PrivateKey,
+				Peers: []singBoxWireGuardPeer{{
+					Address: host, Port: port, PublicKey: e.Server.PublicKey, PreSharedKey: e.Peer.PresharedKey,
+					AllowedIPs: allowedIPs(e.Server), PersistentKeepalive: 25,
+				}},
+			})
+		}
+	}
+	if len(entries) == 0 {
+		// a selector needs a member
+		selector.Outbounds = []string{"direct"}
+	}
+
+	cfg.Outbounds = append([]singBoxOutbound{selector}, outbounds...)
+	cfg.Outbounds = append(cfg.Outbounds, singBoxOutbound{Type: "direct", Tag: "direct"})
+
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
@@ -0,0 +1,96 @@
+package vpn
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/pki"
+)
+
+// OpenVPNServer is the OpenVPN server of a node. CA is the PEM encoded
+// certificate of the authority that issued the node's and the peers'
+// certificates.
+type OpenVPNServer struct {
+	Port int
+	CA   string
+}
+
+// OpenVPN is the Protocol of OpenVPN peers. The node accepts any certificate
+// of the panel's authority that is not on its revocation list, so PublicKey is
+// the serial number of the certificate and the CRL is what takes it away.
+type OpenVPN struct{}
+
+func (OpenVPN) Name() string   { return models.ProtocolOpenVPN }
+func (OpenVPN) Title() string  { return "OpenVPN" }
+func (OpenVPN) Tunneled() bool { return false }
+
+// NewCredentials generates the serial number and the key of the certificate.
+// The authority signs the certificate when the profile is first downloaded.
+func (OpenVPN) NewCredentials() (Credentials, error) {
+	serial, err := pki.NewSerial()
+	if err != nil {
+		return Credentials{}, err
+	}
+	key, err := pki.GenerateKey()
+	if err != nil {
+		return Credentials{}, err
+	}
+	return Credentials{PublicKey: serial, PrivateKey: key}, nil
+}
+
+var openVPNProfileTemplate = template.Must(template.New("ovpn").Parse(`client
+dev tun
+proto udp
+remote {{.Host}} {{.Port}}
+resolv-retry infinite
+nobind
+persist-key
+persist-tun
+remote-cert-tls server
+data-ciphers AES-256-GCM:CHACHA20-POLY1305
+verb 3
+<ca>
+{{.CA}}
+</ca>
+<cert>
+{{.Certificate}}
+</cert>
+<key>
+{{.Key}}
+</key>
+`))
+
+// ClientConfig renders the .ovpn profile of peer with its certificate, its key
+// and the authority inline, which every OpenVPN client imports as one file
+func (OpenVPN) ClientConfig(peer models.VpnPeer, server ServerConfig) ([]byte, error) {
+	if server.OpenVPN.Port == 0 {
+		return nil, fmt.Errorf("server %s does not serve OpenVPN", server.Endpoint)
+	}
+	if peer.Certificate == "" {
+		return nil, fmt.Errorf("peer %d has no certificate", peer.ID)
+	}
+	host, err := endpointHost(server.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	err = openVPNProfileTemplate.Execute(buf, struct {
+		Host, CA, Certificate, Key string
+		Port                       int
+	}{
+		Host:        host,
+		Port:        server.OpenVPN.Port,
+		CA:          strings.TrimSpace(server.OpenVPN.CA),
+		Certificate: strings.TrimSpace(peer.Certificate),
+		Key:         strings.TrimSpace(peer.PrivateKey),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,64 @@
+package vpn
+
+import (
+	"errors"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+)
+
+// ErrUnknownProtocol is returned for a protocol no Protocol is registered for
+var ErrUnknownProtocol = errors.New("unknown VPN protocol")
+
+// Credentials are the secrets of a peer. PublicKey is what the node knows the
+// peer by; protocols whose clients present that same secret leave the other
+// fields empty.
+type Credentials struct {
+	PublicKey    string
+	PrivateKey   string
+	PresharedKey string
+}
+
+// Protocol provisions peers of one VPN protocol: it generates their
+// credentials and renders what their client app imports
+type Protocol interface {
+	// Name is one of the models.Protocol constants
+	Name() string
+	// Title names the protocol to users
+	Title() string
+	// Tunneled reports whether peers get a tunnel address in the node subnet
+	Tunneled() bool
+	NewCredentials() (Credentials, error)
+	// ClientConfig renders the configuration of peer for server: a wg-quick
+	// file or a share link
+	ClientConfig(peer models.VpnPeer, server ServerConfig) ([]byte, error)
+}
+
+var protocols = map[string]Protocol{
+	models.ProtocolWireGuard:   WireGuard{},
+	models.ProtocolVLESS:       VLESS{},
+	models.ProtocolShadowsocks: Shadowsocks{},
+	models.ProtocolOpenVPN:     OpenVPN{},
+}
+
+// Lookup returns the Protocol named name; an empty name is WireGuard, the
+// protocol of peers created without one
+func Lookup(name string) (Protocol, error) {
+	if name == "" {
+		name = models.ProtocolWireGuard
+	}
+
+	p, ok := protocols[name]
+	if !ok {
+		return nil, ErrUnknownProtocol
+	}
+	return p, nil
+}
+
+// Title returns the name users know protocol by, or protocol itself when unknown
+func Title(protocol string) string {
+	p, err := Lookup(protocol)
+	if err != nil {
+		return protocol
+	}
+	return p.Title()
+}
@@ -0,0 +1,168 @@
+package vpn
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/netip"
+	"text/template"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+	"github.com/skip2/go-qrcode"
+)
+
+// ErrSubnetExhausted is returned when no free address is left in the peer subnet
+var ErrSubnetExhausted = errors.New("no free address left in subnet")
+
+// ServerConfig describes the server peers connect to. Endpoint is the host and
+// WireGuard port; VLESS, Shadowsocks and OpenVPN listen on their own ports of
+// the host.
+type ServerConfig struct {
+	Endpoint    string
+	PublicKey   string
+	Subnet      string
+	DNS         string
+	AllowedIPs  string
+	VLESS       VLESSServer
+	Shadowsocks ShadowsocksServer
+	OpenVPN     OpenVPNServer
+}
+
+// WireGuard is the Protocol of WireGuard peers
+type WireGuard struct{}
+
+func (WireGuard) Name() string   { return models.ProtocolWireGuard }
+func (WireGuard) Title() string  { return "WireGuard" }
+func (WireGuard) Tunneled() bool { return true }
+
+// NewCredentials generates a key pair and a preshared key
+func (WireGuard) NewCredentials() (Credentials, error) {
+	privateKey, publicKey, err := GenerateKeyPair()
+	if err != nil {
+		return Credentials{}, err
+	}
+	presharedKey, err := GeneratePresharedKey()
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	return Credentials{PublicKey: publicKey, PrivateKey: privateKey, PresharedKey: presharedKey}, nil
+}
+
+// ClientConfig renders the wg-quick configuration file of peer
+func (WireGuard) ClientConfig(peer models.VpnPeer, server ServerConfig) ([]byte, error) {
+	return ClientConfig(peer, server)
+}
+
+// GenerateKeyPair generates a base64 encoded WireGuard (X25519) key pair
+func GenerateKeyPair() (privateKey, publicKey string, err error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	privateKey = base64.StdEncoding.EncodeToString(key.Bytes())
+	publicKey = base64.StdEncoding.EncodeToString(key.PublicKey().Bytes())
+
+	return privateKey, publicKey, nil
+}
+
+// GeneratePresharedKey generates a base64 encoded 32 byte preshared key
+func GeneratePresharedKey() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// ValidKey reports whether key is a base64 encoded 32 byte WireGuard key
+func ValidKey(key string) bool {
+	b, err := base64.StdEncoding.DecodeString(key)
+	return err == nil && len(b) == 32
+}
+
+// NextAddress returns the first host address in subnet that is not in used.
+// The first host address is reserved for the server itself.
+func NextAddress(subnet string, used []string) (string, error) {
+	prefix, err := netip.ParsePrefix(subnet)
+	if err != nil {
+		return "", err
+	}
+	prefix = prefix.Masked()
+
+	taken := make(map[netip.Addr]bool, len(used))
+	for _, u := range used {
+		p, err := netip.ParsePrefix(u)
+		if err != nil {
+			addr, err := netip.ParseAddr(u)
+			if err != nil {
+				continue
+			}
+			taken[addr] = true
+			continue
+		}
+		taken[p.Addr()] = true
+	}
+
+	// skip the network address and the server address
+	for addr := prefix.Addr().Next().Next(); prefix.Contains(addr); addr = addr.Next() {
+		// the last address of an IPv4 subnet is the broadcast address
+		if addr.Is4() && !prefix.Contains(addr.Next()) {
+			break
+		}
+		if !taken[addr] {
+			return netip.PrefixFrom(addr, addr.BitLen()).String(), nil
+		}
+	}
+
+	return "", ErrSubnetExhausted
+}
+
+var clientConfigTemplate = template.Must(template.New("wg").Parse(`[Interface]
+PrivateKey = {{.Peer.PrivateKey}}
+Address = {{.Peer.Address}}
+{{- if .Server.DNS}}
+DNS = {{.Server.DNS}}
+{{- end}}
+
+[Peer]
+PublicKey = {{.Server.PublicKey}}
+{{- if .Peer.PresharedKey}}
+PresharedKey = {{.Peer.PresharedKey}}
+{{- end}}
+Endpoint = {{.Server.Endpoint}}
+AllowedIPs = {{.AllowedIPs}}
+PersistentKeepalive = 25
+`))
+
+// ClientConfig renders the wg-quick configuration file for a peer
+func ClientConfig(peer models.VpnPeer, server ServerConfig) ([]byte, error) {
+	allowedIPs := server.AllowedIPs
+	if allowedIPs == "" {
+		allowedIPs = "0.0.0.0/0, ::/0"
+	}
+
+	buf := new(bytes.Buffer)
+	err := clientConfigTemplate.Execute(buf, struct {
+		Peer       models.VpnPeer
+		Server     ServerConfig
+		AllowedIPs string
+	}{peer, server, allowedIPs})
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// qrCodeSize is the width and height in pixels of the config QR codes
+const qrCodeSize = 512
+
+// QRCode renders conf as a PNG QR code the WireGuard mobile apps can scan
+func QRCode(conf []byte) ([]byte, error) {
+	return qrcode.Encode(string(conf), qrcode.Medium, qrCodeSize)
+}
@@ -0,0 +1,162 @@
+package vpn
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+
+	"github.com/bayramovrahman/fastnet_vpn_bot/internal/models"
+)
+
+// ShadowsocksMethod is the Shadowsocks-2022 cipher the nodes serve. Its keys
+// are 32 random bytes.
+const ShadowsocksMethod = "2022-blake3-aes-256-gcm"
+
+// VLESSFlow is the XTLS flow VLESS peers use over Reality
+const VLESSFlow = "xtls-rprx-vision"
+
+// VLESSServer is the VLESS with Reality inbound of a node. Reality makes the
+// server pass for ServerName to anyone without the key.
+type VLESSServer struct {
+	Port       int
+	ServerName string
+	PublicKey  string
+	ShortID    string
+}
+
+// ShadowsocksServer is the Shadowsocks-2022 inbound of a node. Clients
+// present Key next to their own user key.
+type ShadowsocksServer struct {
+	Port int
+	Key  string
+}
+
+// GenerateUUID generates a random (version 4) UUID, the ID of a VLESS user
+func GenerateUUID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// GenerateRealityKeyPair generates an X25519 key pair encoded the way Xray
+// expects Reality keys: unpadded URL-safe base64
+func GenerateRealityKeyPair() (privateKey, publicKey string, err error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	privateKey = base64.RawURLEncoding.EncodeToString(key.Bytes())
+	publicKey = base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes())
+
+	return privateKey, publicKey, nil
+}
+
+// GenerateShortID generates a Reality short ID of 16 hex digits
+func GenerateShortID() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// GenerateShadowsocksKey generates a base64 encoded Shadowsocks-2022 key
+func GenerateShadowsocksKey() (string, error) {
+	return GeneratePresharedKey()
+}
+
+// VLESS is the Protocol of VLESS peers, served by Xray with Reality
+type VLESS struct{}
+
+func (VLESS) Name() string   { return models.ProtocolVLESS }
+func (VLESS) Title() string  { return "VLESS Reality" }
+func (VLESS) Tunneled() bool { return false }
+
+// NewCredentials generates the user ID
+func (VLESS) NewCredentials() (Credentials, error) {
+	id, err := GenerateUUID()
+	if err != nil {
+		return Credentials{}, err
+	}
+	return Credentials{PublicKey: id}, nil
+}
+
+// ClientConfig renders the vless:// share link of peer
+func (VLESS) ClientConfig(peer models.VpnPeer, server ServerConfig) ([]byte, error) {
+	if server.VLESS.Port == 0 {
+		return nil, fmt.Errorf("server %s does not serve VLESS", server.Endpoint)
+	}
+	host, err := endpointHost(server.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{
+		"encryption": {"none"},
+		"flow":       {VLESSFlow},
+		"security":   {"reality"},
+		"sni":        {server.VLESS.ServerName},
+		"fp":         {"chrome"},
+		"pbk":        {server.VLESS.PublicKey},
+		"sid":        {server.VLESS.ShortID},
+		"type":       {"tcp"},
+	}
+
+	link := "vless://" + peer.PublicKey + "@" + net.JoinHostPort(host, strconv.Itoa(server.VLESS.Port)) +
+		"?" + query.Encode() + "#" + url.PathEscape(peer.Name)
+	return []byte(link), nil
+}
+
+// Shadowsocks is the Protocol of Shadowsocks-2022 peers, served by Xray
+type Shadowsocks struct{}
+
+func (Shadowsocks) Name() string   { return models.ProtocolShadowsocks }
+func (Shadowsocks) Title() string  { return "Shadowsocks" }
+func (Shadowsocks) Tunneled() bool { return false }
+
+// NewCredentials generates the user key
+func (Shadowsocks) NewCredentials() (Credentials, error) {
+	key, err := GenerateShadowsocksKey()
+	if err != nil {
+		return Credentials{}, err
+	}
+	return Credentials{PublicKey: key}, nil
+}
+
+// ClientConfig renders the ss:// share link of peer. Shadowsocks-2022 links
+// carry the method and the keys percent-encoded rather than in base64.
+func (Shadowsocks) ClientConfig(peer models.VpnPeer, server ServerConfig) ([]byte, error) {
+	if server.Shadowsocks.Port == 0 {
+		return nil, fmt.Errorf("server %s does not serve Shadowsocks", server.Endpoint)
+	}
+	host, err := endpointHost(server.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	link := "ss://" + ShadowsocksMethod + ":" + url.QueryEscape(server.Shadowsocks.Key+":"+peer.PublicKey) +
+		"@" + net.JoinHostPort(host, strconv.Itoa(server.Shadowsocks.Port)) + "#" + url.PathEscape(peer.Name)
+	return []byte(link), nil
+}
+
+// endpointHost returns the host of a host:port endpoint
+func endpointHost(endpoint string) (string, error) {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("endpoint %q: %w", endpoint, err)
+	}
+	return host, nil
+}
@@ -0,0 +1,105 @@
+package worker
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Status describes the state of a background worker
+type Status struct {
+	Name      string
+	Running   bool
+	StartedAt time.Time
+	StoppedAt time.Time
+	LastError string
+}
+
+// Group runs background workers that share a context and are stopped together on shutdown
+type Group struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	status map[string]*Status
+}
+
+// NewGroup returns a Group whose workers stop when parent is done or Stop is called
+func NewGroup(parent context.Context) *Group {
+	ctx, cancel := context.WithCancel(parent)
+	return &Group{
+		ctx:    ctx,
+		cancel: cancel,
+		status: map[string]*Status{},
+	}
+}
+
+// Go starts fn as a named worker. fn must return once ctx is done.
+func (g *Group) Go(name string, fn func(ctx context.Context) error) {
+	g.mu.Lock()
+	g.status[name] = &Status{Name: name, Running: true, StartedAt: time.Now()}
+	g.mu.Unlock()
+
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+
+		err := fn(g.ctx)
+
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		s := g.status[name]
+		s.Running = false
+		s.StoppedAt = time.Now()
+		if err != nil && err != context.Canceled {
+			s.LastError = err.Error()
+		}
+	}()
+}
+
+// Every runs fn immediately and then on every tick of interval until ctx is done
+func Every(ctx context.Context, interval time.Duration, fn func(ctx context.Context)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		fn(ctx)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Statuses returns a snapshot of every worker started in the group
+func (g *Group) Statuses() []Status {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	out := make([]Status, 0, len(g.status))
+	for _, s := range g.status {
+		out = append(out, *s)
+	}
+	return out
+}
+
+// Stop cancels every worker and waits for them to return or for ctx to be done
+func (g *Group) Stop(ctx context.Context) error {
+	g.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
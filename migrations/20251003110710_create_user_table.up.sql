@@ -0,0 +1,15 @@
+CREATE TABLE users (
+    id             serial PRIMARY KEY,
+    username       varchar(255) NOT NULL UNIQUE,
+    first_name     varchar(255) NOT NULL DEFAULT '',
+    last_name      varchar(255) NOT NULL DEFAULT '',
+    email          varchar(255) NOT NULL,
+    password       varchar(60)  NOT NULL,
+    is_verified    boolean      NOT NULL DEFAULT false,
+    is_admin       boolean      NOT NULL DEFAULT false,
+    access_level   integer      NOT NULL DEFAULT 1,
+    signup_ip      varchar(255) NOT NULL,
+    signup_country varchar(255) NOT NULL,
+    created_at     timestamp    NOT NULL,
+    updated_at     timestamp    NOT NULL
+);
@@ -0,0 +1,17 @@
+CREATE TABLE user_login_security (
+    id                        serial PRIMARY KEY,
+    user_id                   integer      NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    email_verification        boolean      NOT NULL DEFAULT false,
+    phone_verification        boolean      NOT NULL DEFAULT false,
+    multi_factor_auth         boolean      NOT NULL DEFAULT false,
+    verification_code         varchar(6),
+    code_expires_at           timestamp,
+    phone_number              varchar(255),
+    last_verification_sent_at timestamp,
+    failed_attempts           integer      NOT NULL DEFAULT 0,
+    locked_until              timestamp,
+    created_at                timestamp    NOT NULL,
+    updated_at                timestamp    NOT NULL
+);
+
+CREATE UNIQUE INDEX user_login_security_user_id_idx ON user_login_security (user_id);
@@ -0,0 +1,22 @@
+CREATE TABLE plans (
+    id            serial PRIMARY KEY,
+    name          varchar(255) NOT NULL,
+    price_cents   integer      NOT NULL DEFAULT 0,
+    currency      varchar(3)   NOT NULL DEFAULT 'USD',
+    duration_days integer      NOT NULL DEFAULT 30,
+    created_at    timestamp    NOT NULL,
+    updated_at    timestamp    NOT NULL
+);
+
+CREATE TABLE subscriptions (
+    id         serial PRIMARY KEY,
+    user_id    integer      NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    plan_id    integer      NOT NULL REFERENCES plans (id),
+    status     varchar(255) NOT NULL DEFAULT 'active',
+    starts_at  timestamp    NOT NULL,
+    expires_at timestamp    NOT NULL,
+    created_at timestamp    NOT NULL,
+    updated_at timestamp    NOT NULL
+);
+
+CREATE INDEX subscriptions_user_id_idx ON subscriptions (user_id);
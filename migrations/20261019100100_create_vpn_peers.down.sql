@@ -0,0 +1 @@
+DROP TABLE vpn_peers;
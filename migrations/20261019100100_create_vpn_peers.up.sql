@@ -0,0 +1,16 @@
+CREATE TABLE vpn_peers (
+    id              serial PRIMARY KEY,
+    user_id         integer      NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    subscription_id integer      NOT NULL REFERENCES subscriptions (id) ON DELETE CASCADE,
+    name            varchar(255) NOT NULL,
+    public_key      varchar(44)  NOT NULL,
+    private_key     varchar(44)  NOT NULL,
+    preshared_key   varchar(44)  NOT NULL,
+    address         varchar(255) NOT NULL,
+    revoked_at      timestamp,
+    created_at      timestamp    NOT NULL,
+    updated_at      timestamp    NOT NULL
+);
+
+CREATE INDEX vpn_peers_user_id_idx ON vpn_peers (user_id);
+CREATE UNIQUE INDEX vpn_peers_public_key_idx ON vpn_peers (public_key);
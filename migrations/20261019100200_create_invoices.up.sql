@@ -0,0 +1,16 @@
+CREATE TABLE invoices (
+    id              serial PRIMARY KEY,
+    user_id         integer      NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    subscription_id integer      REFERENCES subscriptions (id) ON DELETE SET NULL,
+    number          varchar(255) NOT NULL,
+    amount_cents    integer      NOT NULL DEFAULT 0,
+    currency        varchar(3)   NOT NULL DEFAULT 'USD',
+    status          varchar(255) NOT NULL DEFAULT 'open',
+    issued_at       timestamp    NOT NULL,
+    paid_at         timestamp,
+    created_at      timestamp    NOT NULL,
+    updated_at      timestamp    NOT NULL
+);
+
+CREATE INDEX invoices_user_id_idx ON invoices (user_id);
+CREATE UNIQUE INDEX invoices_number_idx ON invoices (number);
@@ -0,0 +1,16 @@
+CREATE TABLE api_tokens (
+    id           serial PRIMARY KEY,
+    user_id      integer      NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    name         varchar(255) NOT NULL,
+    prefix       varchar(12)  NOT NULL,
+    token_hash   varchar(64)  NOT NULL,
+    scopes       varchar(255) NOT NULL DEFAULT '',
+    last_used_at timestamp,
+    expires_at   timestamp,
+    revoked_at   timestamp,
+    created_at   timestamp    NOT NULL,
+    updated_at   timestamp    NOT NULL
+);
+
+CREATE UNIQUE INDEX api_tokens_token_hash_idx ON api_tokens (token_hash);
+CREATE INDEX api_tokens_user_id_idx ON api_tokens (user_id);
@@ -0,0 +1,18 @@
+CREATE TABLE outbox (
+    id              serial PRIMARY KEY,
+    recipient       varchar(255) NOT NULL,
+    subject         varchar(998) NOT NULL DEFAULT '',
+    payload         jsonb        NOT NULL,
+    status          varchar(16)  NOT NULL DEFAULT 'pending',
+    attempts        integer      NOT NULL DEFAULT 0,
+    max_attempts    integer      NOT NULL,
+    next_attempt_at timestamp    NOT NULL,
+    locked_until    timestamp,
+    last_error      text         NOT NULL DEFAULT '',
+    sent_at         timestamp,
+    created_at      timestamp    NOT NULL,
+    updated_at      timestamp    NOT NULL
+);
+
+CREATE INDEX outbox_status_next_attempt_at_idx ON outbox (status, next_attempt_at);
+CREATE INDEX outbox_recipient_sent_at_idx ON outbox (recipient, sent_at) WHERE status = 'sent';
@@ -0,0 +1,4 @@
+DROP TABLE notification_preferences;
+DROP TABLE notifications;
+
+ALTER TABLE outbox DROP COLUMN channel;
@@ -0,0 +1,31 @@
+ALTER TABLE outbox ADD COLUMN channel varchar(16) NOT NULL DEFAULT 'email';
+
+CREATE TABLE notifications (
+    id         serial PRIMARY KEY,
+    user_id    integer      NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    event      varchar(64)  NOT NULL,
+    title      varchar(255) NOT NULL,
+    body       text         NOT NULL DEFAULT '',
+    link       varchar(255) NOT NULL DEFAULT '',
+    in_app     boolean      NOT NULL DEFAULT true,
+    dedupe_key varchar(255),
+    read_at    timestamp,
+    created_at timestamp    NOT NULL,
+    updated_at timestamp    NOT NULL
+);
+
+CREATE INDEX notifications_user_id_created_at_idx ON notifications (user_id, created_at);
+CREATE UNIQUE INDEX notifications_user_id_dedupe_key_idx ON notifications (user_id, dedupe_key);
+
+CREATE TABLE notification_preferences (
+    id               serial PRIMARY KEY,
+    user_id          integer     NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    email            boolean     NOT NULL DEFAULT true,
+    telegram         boolean     NOT NULL DEFAULT false,
+    in_app           boolean     NOT NULL DEFAULT true,
+    telegram_chat_id varchar(64) NOT NULL DEFAULT '',
+    created_at       timestamp   NOT NULL,
+    updated_at       timestamp   NOT NULL
+);
+
+CREATE UNIQUE INDEX notification_preferences_user_id_idx ON notification_preferences (user_id);
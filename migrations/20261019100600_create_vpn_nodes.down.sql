@@ -0,0 +1,3 @@
+ALTER TABLE vpn_peers DROP COLUMN node_id;
+
+DROP TABLE vpn_nodes;
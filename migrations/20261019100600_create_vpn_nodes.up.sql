@@ -0,0 +1,20 @@
+CREATE TABLE vpn_nodes (
+    id         serial PRIMARY KEY,
+    name       varchar(64)  NOT NULL,
+    country    char(2)      NOT NULL,
+    endpoint   varchar(255) NOT NULL,
+    public_key varchar(44)  NOT NULL,
+    subnet     varchar(64)  NOT NULL,
+    capacity   integer      NOT NULL CHECK (capacity > 0),
+    state      varchar(16)  NOT NULL DEFAULT 'enabled',
+    created_at timestamp    NOT NULL,
+    updated_at timestamp    NOT NULL
+);
+
+CREATE UNIQUE INDEX vpn_nodes_name_idx ON vpn_nodes (name);
+CREATE INDEX vpn_nodes_country_idx ON vpn_nodes (country);
+
+-- peers without a node are served by the single server of WG_ENDPOINT
+ALTER TABLE vpn_peers ADD COLUMN node_id integer REFERENCES vpn_nodes (id);
+
+CREATE INDEX vpn_peers_node_id_idx ON vpn_peers (node_id);
@@ -0,0 +1,10 @@
+ALTER TABLE vpn_peers DROP COLUMN last_handshake_at;
+
+DROP INDEX vpn_nodes_agent_token_hash_idx;
+
+ALTER TABLE vpn_nodes
+    DROP COLUMN agent_error,
+    DROP COLUMN agent_peers,
+    DROP COLUMN agent_applied_at,
+    DROP COLUMN agent_seen_at,
+    DROP COLUMN agent_token_hash;
@@ -0,0 +1,11 @@
+-- the node agent authenticates with a per-node token, stored hashed like API tokens
+ALTER TABLE vpn_nodes
+    ADD COLUMN agent_token_hash varchar(64),
+    ADD COLUMN agent_seen_at    timestamp,
+    ADD COLUMN agent_applied_at timestamp,
+    ADD COLUMN agent_peers      integer NOT NULL DEFAULT 0,
+    ADD COLUMN agent_error      text    NOT NULL DEFAULT '';
+
+CREATE UNIQUE INDEX vpn_nodes_agent_token_hash_idx ON vpn_nodes (agent_token_hash);
+
+ALTER TABLE vpn_peers ADD COLUMN last_handshake_at timestamp;
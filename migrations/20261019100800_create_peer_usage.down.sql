@@ -0,0 +1,5 @@
+ALTER TABLE vpn_peers
+    DROP COLUMN tx_counter,
+    DROP COLUMN rx_counter;
+
+DROP TABLE peer_usage;
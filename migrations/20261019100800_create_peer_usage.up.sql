@@ -0,0 +1,16 @@
+-- traffic per peer, summed into hour, day and month buckets starting at bucket_start (UTC)
+CREATE TABLE peer_usage (
+    peer_id      integer     NOT NULL REFERENCES vpn_peers (id) ON DELETE CASCADE,
+    period       varchar(8)  NOT NULL,
+    bucket_start timestamp   NOT NULL,
+    rx_bytes     bigint      NOT NULL DEFAULT 0,
+    tx_bytes     bigint      NOT NULL DEFAULT 0,
+    PRIMARY KEY (peer_id, period, bucket_start)
+);
+
+CREATE INDEX peer_usage_period_bucket_start_idx ON peer_usage (period, bucket_start);
+
+-- the interface counters of the last agent report, to turn the next one into a delta
+ALTER TABLE vpn_peers
+    ADD COLUMN rx_counter bigint NOT NULL DEFAULT 0,
+    ADD COLUMN tx_counter bigint NOT NULL DEFAULT 0;
@@ -0,0 +1,7 @@
+DROP TABLE topups;
+DROP TABLE topup_packs;
+DROP TABLE user_quotas;
+
+ALTER TABLE plans
+    DROP COLUMN device_limit,
+    DROP COLUMN data_cap_bytes;
@@ -0,0 +1,40 @@
+-- 0 leaves the plan unlimited
+ALTER TABLE plans
+    ADD COLUMN data_cap_bytes bigint  NOT NULL DEFAULT 0,
+    ADD COLUMN device_limit   integer NOT NULL DEFAULT 0;
+
+-- admin overrides of the plan limits of a user, NULL keeping the plan's, and
+-- the block the quota enforcer puts on a user over the data cap
+CREATE TABLE user_quotas (
+    user_id        integer      PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    data_cap_bytes bigint,
+    device_limit   integer,
+    note           varchar(255) NOT NULL DEFAULT '',
+    blocked_until  timestamp,
+    created_at     timestamp    NOT NULL,
+    updated_at     timestamp    NOT NULL
+);
+
+CREATE TABLE topup_packs (
+    id          serial PRIMARY KEY,
+    name        varchar(255) NOT NULL,
+    data_bytes  bigint       NOT NULL,
+    price_cents integer      NOT NULL DEFAULT 0,
+    currency    varchar(3)   NOT NULL DEFAULT 'USD',
+    created_at  timestamp    NOT NULL,
+    updated_at  timestamp    NOT NULL
+);
+
+-- data bought on top of the cap, valid until the billing cycle it was bought in ends
+CREATE TABLE topups (
+    id              serial PRIMARY KEY,
+    user_id         integer   NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    subscription_id integer   NOT NULL REFERENCES subscriptions (id) ON DELETE CASCADE,
+    pack_id         integer   NOT NULL REFERENCES topup_packs (id),
+    data_bytes      bigint    NOT NULL,
+    starts_at       timestamp NOT NULL,
+    expires_at      timestamp NOT NULL,
+    created_at      timestamp NOT NULL
+);
+
+CREATE INDEX topups_user_id_expires_at_idx ON topups (user_id, expires_at);
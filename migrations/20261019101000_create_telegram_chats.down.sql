@@ -0,0 +1,2 @@
+DROP TABLE telegram_chats;
+DROP TABLE telegram_link_codes;
@@ -0,0 +1,16 @@
+CREATE TABLE telegram_link_codes (
+    user_id    integer     PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    code_hash  varchar(64) NOT NULL,
+    expires_at timestamp   NOT NULL,
+    created_at timestamp   NOT NULL
+);
+
+CREATE UNIQUE INDEX telegram_link_codes_code_hash_idx ON telegram_link_codes (code_hash);
+
+CREATE TABLE telegram_chats (
+    chat_id   bigint    PRIMARY KEY,
+    user_id   integer   NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    linked_at timestamp NOT NULL
+);
+
+CREATE INDEX telegram_chats_user_id_idx ON telegram_chats (user_id);
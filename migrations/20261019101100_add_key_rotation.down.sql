@@ -0,0 +1,7 @@
+DROP TABLE vpn_key_revocations;
+
+ALTER TABLE vpn_peers DROP COLUMN keys_rotated_at;
+
+ALTER TABLE plans
+    DROP COLUMN key_grace_hours,
+    DROP COLUMN key_rotation_days;
@@ -0,0 +1,28 @@
+-- 0 never rotates the keys of the plan's peers
+ALTER TABLE plans
+    ADD COLUMN key_rotation_days integer NOT NULL DEFAULT 0,
+    ADD COLUMN key_grace_hours   integer NOT NULL DEFAULT 72;
+
+ALTER TABLE vpn_peers ADD COLUMN keys_rotated_at timestamp;
+UPDATE vpn_peers SET keys_rotated_at = created_at;
+ALTER TABLE vpn_peers ALTER COLUMN keys_rotated_at SET NOT NULL;
+
+-- keys taken off a peer: served with their old address until serve_until, and
+-- confirmed once the agent of the node reports them gone
+CREATE TABLE vpn_key_revocations (
+    id            serial PRIMARY KEY,
+    peer_id       integer      NOT NULL REFERENCES vpn_peers (id) ON DELETE CASCADE,
+    node_id       integer      REFERENCES vpn_nodes (id),
+    public_key    varchar(44)  NOT NULL,
+    preshared_key varchar(44)  NOT NULL,
+    address       varchar(255) NOT NULL,
+    reason        varchar(16)  NOT NULL,
+    rx_counter    bigint       NOT NULL DEFAULT 0,
+    tx_counter    bigint       NOT NULL DEFAULT 0,
+    serve_until   timestamp    NOT NULL,
+    confirmed_at  timestamp,
+    created_at    timestamp    NOT NULL
+);
+
+CREATE INDEX vpn_key_revocations_peer_id_idx ON vpn_key_revocations (peer_id);
+CREATE INDEX vpn_key_revocations_node_id_idx ON vpn_key_revocations (node_id) WHERE confirmed_at IS NULL;
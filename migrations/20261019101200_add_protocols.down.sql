@@ -0,0 +1,12 @@
+ALTER TABLE vpn_nodes
+    DROP COLUMN shadowsocks_key,
+    DROP COLUMN shadowsocks_port,
+    DROP COLUMN reality_short_id,
+    DROP COLUMN reality_public_key,
+    DROP COLUMN reality_private_key,
+    DROP COLUMN reality_server_name,
+    DROP COLUMN vless_port;
+
+ALTER TABLE vpn_peers DROP COLUMN protocol;
+
+ALTER TABLE plans DROP COLUMN protocols;
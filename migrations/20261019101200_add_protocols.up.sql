@@ -0,0 +1,15 @@
+-- plans list the protocols their peers may use
+ALTER TABLE plans ADD COLUMN protocols text[] NOT NULL DEFAULT '{wireguard}';
+
+ALTER TABLE vpn_peers ADD COLUMN protocol varchar(16) NOT NULL DEFAULT 'wireguard';
+
+-- a port of 0 leaves the protocol off; the Reality private key is handed to
+-- the node agent only
+ALTER TABLE vpn_nodes
+    ADD COLUMN vless_port          integer      NOT NULL DEFAULT 0,
+    ADD COLUMN reality_server_name varchar(255) NOT NULL DEFAULT '',
+    ADD COLUMN reality_private_key varchar(44)  NOT NULL DEFAULT '',
+    ADD COLUMN reality_public_key  varchar(44)  NOT NULL DEFAULT '',
+    ADD COLUMN reality_short_id    varchar(16)  NOT NULL DEFAULT '',
+    ADD COLUMN shadowsocks_port    integer      NOT NULL DEFAULT 0,
+    ADD COLUMN shadowsocks_key     varchar(44)  NOT NULL DEFAULT '';
@@ -0,0 +1,3 @@
+DROP INDEX users_subscription_token_hash_idx;
+
+ALTER TABLE users DROP COLUMN subscription_token_hash;
@@ -0,0 +1,4 @@
+-- the subscription URL client apps import carries a per-user token, stored hashed like API tokens
+ALTER TABLE users ADD COLUMN subscription_token_hash varchar(64);
+
+CREATE UNIQUE INDEX users_subscription_token_hash_idx ON users (subscription_token_hash);
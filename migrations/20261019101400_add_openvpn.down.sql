@@ -0,0 +1,13 @@
+ALTER TABLE vpn_nodes
+    DROP COLUMN openvpn_private_key,
+    DROP COLUMN openvpn_certificate,
+    DROP COLUMN openvpn_port;
+
+-- the PEM encoded keys of OpenVPN peers do not fit the column
+DELETE FROM vpn_peers WHERE protocol = 'openvpn';
+
+ALTER TABLE vpn_peers
+    DROP COLUMN certificate,
+    ALTER COLUMN private_key TYPE varchar(44);
+
+DROP TABLE certificate_authorities;
@@ -0,0 +1,21 @@
+-- the CA of the OpenVPN peers; its key is encrypted with PKI_ENCRYPTION_KEY
+CREATE TABLE certificate_authorities (
+    id            integer   PRIMARY KEY DEFAULT 1 CHECK (id = 1),
+    certificate   text      NOT NULL,
+    encrypted_key text      NOT NULL,
+    crl           text      NOT NULL DEFAULT '',
+    crl_number    bigint    NOT NULL DEFAULT 0,
+    created_at    timestamp NOT NULL,
+    updated_at    timestamp NOT NULL
+);
+
+-- OpenVPN peers keep a PEM encoded key and the certificate issued for it
+ALTER TABLE vpn_peers
+    ALTER COLUMN private_key TYPE text,
+    ADD COLUMN certificate text NOT NULL DEFAULT '';
+
+-- a port of 0 leaves OpenVPN off; the key is handed to the node agent only
+ALTER TABLE vpn_nodes
+    ADD COLUMN openvpn_port        integer NOT NULL DEFAULT 0,
+    ADD COLUMN openvpn_certificate text    NOT NULL DEFAULT '',
+    ADD COLUMN openvpn_private_key text    NOT NULL DEFAULT '';
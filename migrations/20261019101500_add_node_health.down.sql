@@ -0,0 +1,6 @@
+ALTER TABLE vpn_nodes
+    DROP COLUMN health,
+    DROP COLUMN health_reason,
+    DROP COLUMN health_failures,
+    DROP COLUMN health_checked_at,
+    DROP COLUMN health_changed_at;
@@ -0,0 +1,8 @@
+-- the health of a node as last checked by the failover monitor; failures
+-- counts the checks in a row that found it unreachable
+ALTER TABLE vpn_nodes
+    ADD COLUMN health            varchar(16) NOT NULL DEFAULT 'healthy',
+    ADD COLUMN health_reason     text        NOT NULL DEFAULT '',
+    ADD COLUMN health_failures   integer     NOT NULL DEFAULT 0,
+    ADD COLUMN health_checked_at timestamp,
+    ADD COLUMN health_changed_at timestamp;
@@ -0,0 +1 @@
+DROP INDEX vpn_peers_node_address_idx;
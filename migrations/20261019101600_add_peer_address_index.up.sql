@@ -0,0 +1,4 @@
+-- a tunnel address routes to a single peer of a node; node_id is NULL on the
+-- default server
+CREATE UNIQUE INDEX vpn_peers_node_address_idx ON vpn_peers (COALESCE(node_id, 0), address)
+    WHERE revoked_at IS NULL AND address <> '';
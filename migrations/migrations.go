@@ -0,0 +1,10 @@
+// Package migrations embeds the SQL schema migrations so the binary can
+// apply them without any external tooling.
+package migrations
+
+import "embed"
+
+// FS holds every <version>_<name>.up.sql and .down.sql file in this directory
+//
+//go:embed *.sql
+var FS embed.FS